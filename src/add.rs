@@ -0,0 +1,106 @@
+use anyhow::Result;
+
+use crate::generate::{self, GeneratedHost};
+use crate::ssh;
+use crate::ssh_config::EntryType;
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    /// Name of the host, given to ssh
+    #[arg(short, long)]
+    name: String,
+
+    /// Host name or address to connect to (defaults to the name)
+    #[arg(long)]
+    hostname: Option<String>,
+
+    #[arg(short, long)]
+    user: Option<String>,
+
+    #[arg(short, long)]
+    port: Option<u16>,
+
+    /// Private key to authenticate with
+    #[arg(short, long, value_name = "FILE")]
+    identity: Option<String>,
+
+    /// File to add the host to, such as a file included by the configuration
+    /// (defaults to the last configuration file)
+    #[arg(short, long, value_name = "FILE")]
+    file: Option<String>,
+
+    /// Add the host even if another one already connects to the same address and port
+    #[arg(long, default_value_t = false)]
+    force: bool,
+}
+
+/// Appends a `Host` block to the configuration.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration cannot be parsed, if a host already has the
+/// name, if another host connects to the same address without `--force` or if the file
+/// cannot be written.
+pub fn run(config_paths: &[String], args: &Args) -> Result<()> {
+    let path = args
+        .file
+        .as_ref()
+        .or(config_paths.last())
+        .ok_or(anyhow::anyhow!("No configuration file to add the host to"))?;
+
+    let hostname = args.hostname.as_deref().unwrap_or(&args.name);
+    let port = args.port.map(|port| port.to_string());
+
+    let existing = ssh::load_hosts(config_paths)?;
+    if let Some(host) = existing.iter().find(|host| {
+        host.name == args.name || host.aliases.split(", ").any(|alias| alias == args.name)
+    }) {
+        anyhow::bail!(
+            "A host named {} already exists{}",
+            args.name,
+            defined_in(host)
+        );
+    }
+
+    let endpoint = format!(
+        "{}:{}",
+        hostname.to_lowercase(),
+        port.as_deref().unwrap_or("22")
+    );
+    if let Some(host) = existing.iter().find(|host| host.endpoint() == endpoint) {
+        if !args.force {
+            anyhow::bail!(
+                "{} already connects to {endpoint}{}, use --force to add {} anyway",
+                host.name,
+                defined_in(host),
+                args.name
+            );
+        }
+        eprintln!(
+            "Warning: {} also connects to {endpoint}{}",
+            host.name,
+            defined_in(host)
+        );
+    }
+
+    let mut host = GeneratedHost::new(&args.name);
+    host.push(EntryType::Hostname, hostname);
+    host.push(EntryType::User, args.user.as_deref().unwrap_or_default());
+    host.push(EntryType::Port, port.as_deref().unwrap_or_default());
+    host.push(
+        EntryType::IdentityFile,
+        args.identity.as_deref().unwrap_or_default(),
+    );
+
+    generate::append_to_config(path, std::slice::from_ref(&host))?;
+    println!("Added {} to {path}", args.name);
+
+    Ok(())
+}
+
+fn defined_in(host: &ssh::Host) -> String {
+    host.origin
+        .as_ref()
+        .map(|origin| format!(" ({}:{})", origin.path.display(), origin.line))
+        .unwrap_or_default()
+}
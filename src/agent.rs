@@ -0,0 +1,107 @@
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+use crate::state;
+
+/// Public keys loaded in the SSH agent, as `type base64` strings.
+///
+/// Returns `None` when no agent can be reached.
+#[must_use]
+pub fn loaded_keys() -> Option<Vec<String>> {
+    std::env::var_os("SSH_AUTH_SOCK")?;
+
+    let output = Command::new("ssh-add")
+        .arg("-L")
+        .stdin(Stdio::null())
+        .output()
+        .ok()?;
+
+    // 1 means the agent has no identities, 2 that it cannot be reached
+    match output.status.code() {
+        Some(0) => Some(
+            String::from_utf8_lossy(&output.stdout)
+                .lines()
+                .filter_map(key_of)
+                .collect(),
+        ),
+        Some(1) => Some(Vec::new()),
+        _ => {
+            log::debug!(stderr = String::from_utf8_lossy(&output.stderr).trim(); "SSH agent not reachable");
+            None
+        }
+    }
+}
+
+/// Lines of `ssh-add -l`, the fingerprints and comments of the loaded keys.
+#[must_use]
+pub fn describe_keys() -> Vec<String> {
+    match Command::new("ssh-add")
+        .arg("-l")
+        .stdin(Stdio::null())
+        .output()
+    {
+        Ok(output) => String::from_utf8_lossy(if output.stdout.is_empty() {
+            &output.stderr
+        } else {
+            &output.stdout
+        })
+        .lines()
+        .map(ToString::to_string)
+        .collect(),
+        Err(err) => vec![format!("Failed to run ssh-add: {err}")],
+    }
+}
+
+/// Public key of a private key file, read from the `.pub` file next to it.
+#[must_use]
+pub fn public_key_of(identity_file: &str) -> Option<String> {
+    let path = Path::new(identity_file);
+    let public_path = path.with_file_name(format!("{}.pub", path.file_name()?.to_str()?));
+
+    key_of(&std::fs::read_to_string(public_path).ok()?)
+}
+
+/// Private keys of the directory, the files with a `.pub` file next to them.
+#[must_use]
+pub fn key_files(dir: &Path) -> Vec<PathBuf> {
+    let Ok(entries) = std::fs::read_dir(dir) else {
+        return Vec::new();
+    };
+
+    let mut files = entries
+        .filter_map(|entry| entry.ok().map(|entry| entry.path()))
+        .filter(|path| path.extension().is_some_and(|extension| extension == "pub"))
+        .map(|path| path.with_extension(""))
+        .filter(|path| path.is_file())
+        .collect::<Vec<_>>();
+    files.sort();
+
+    files
+}
+
+/// Writes a public key loaded in the agent to a file, so that `ssh -i` can pick the key
+/// without having its private key file.
+///
+/// # Errors
+///
+/// Will return `Err` if the file cannot be written.
+pub fn write_public_key(key: &str) -> std::io::Result<PathBuf> {
+    let dir = state::state_dir().join("agent-keys");
+    std::fs::create_dir_all(&dir)?;
+
+    // The end of the key tells the keys apart, the start being the same for a key type
+    let name = key
+        .chars()
+        .filter(char::is_ascii_alphanumeric)
+        .collect::<String>();
+    let path = dir.join(format!("{}.pub", &name[name.len().saturating_sub(16)..]));
+    std::fs::write(&path, format!("{key}\n"))?;
+
+    Ok(path)
+}
+
+/// The `type base64` part of a public key line, without its comment.
+fn key_of(line: &str) -> Option<String> {
+    let mut fields = line.split_whitespace();
+    Some(format!("{} {}", fields.next()?, fields.next()?))
+}
@@ -0,0 +1,57 @@
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::PathBuf;
+
+use crate::settings;
+use crate::ssh;
+use crate::ssh_config::wildcard_match;
+
+/// Metadata given to hosts outside of the SSH configuration, read from
+/// `~/.config/sshs/annotations.toml` so that a team can share it.
+///
+/// ```toml
+/// [[hosts]]
+/// pattern = "web*.prod"
+/// owner = "platform"
+/// ```
+///
+/// The first entry matching a host gives each value, the comments of the host in the SSH
+/// configuration winning over the file.
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Annotations {
+    hosts: Vec<Entry>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Entry {
+    /// Name of the hosts, with `*` and `?` wildcards.
+    pattern: String,
+    #[serde(flatten)]
+    metadata: HashMap<String, String>,
+}
+
+#[must_use]
+pub fn path() -> PathBuf {
+    settings::config_dir().join("annotations.toml")
+}
+
+impl Annotations {
+    /// # Errors
+    ///
+    /// Will return `Err` if the file cannot be read or is not valid.
+    pub fn load() -> anyhow::Result<Annotations> {
+        settings::read_toml(&path())
+    }
+
+    /// Gives the host the metadata of the entries matching it.
+    pub fn apply(&self, host: &mut ssh::Host) {
+        for entry in &self.hosts {
+            if wildcard_match(&entry.pattern, &host.name) {
+                for (key, value) in &entry.metadata {
+                    host.annotate(key, value);
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,272 @@
+use serde::Serialize;
+
+const DAY: i64 = 86400;
+
+const WEEKDAYS: [&str; 7] = ["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"];
+
+/// A period during which a host should be left alone, from a `# sshs-maintenance:` comment.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Window {
+    /// The window as written in the comment.
+    pub text: String,
+    period: Period,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+enum Period {
+    /// Every week on the days, 0 being Sunday, between two times of the day in seconds.
+    /// An end before the start ends the window on the next day.
+    Weekly {
+        days: [bool; 7],
+        start: i64,
+        end: i64,
+    },
+    /// From a date to another, both included, in days since the Unix epoch.
+    Dates { first: i64, last: i64 },
+}
+
+impl Window {
+    /// Whether the window covers a time, given in seconds since the Unix epoch shifted to
+    /// the time zone of the host.
+    #[must_use]
+    pub fn contains(&self, local_time: i64) -> bool {
+        let day = local_time.div_euclid(DAY);
+        let time = local_time.rem_euclid(DAY);
+
+        match &self.period {
+            Period::Weekly { days, start, end } if start <= end => {
+                days[weekday(day)] && *start <= time && time < *end
+            }
+            Period::Weekly { days, start, end } => {
+                (days[weekday(day)] && time >= *start) || (days[weekday(day - 1)] && time < *end)
+            }
+            Period::Dates { first, last } => (*first..=*last).contains(&day),
+        }
+    }
+}
+
+impl std::fmt::Display for Window {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(&self.text)
+    }
+}
+
+/// Parses windows such as `Sun 02:00-04:00, Mon-Fri 23:00-01:00, 2026-12-20..2027-01-05`,
+/// skipping the invalid ones.
+///
+/// A window without days applies every day, a single date is a window of one day.
+#[must_use]
+pub fn parse_windows(value: &str) -> Vec<Window> {
+    let mut windows = Vec::new();
+    for text in value
+        .split(',')
+        .map(str::trim)
+        .filter(|text| !text.is_empty())
+    {
+        match parse_period(text) {
+            Some(period) => windows.push(Window {
+                text: text.to_string(),
+                period,
+            }),
+            None => {
+                log::warn!(windows = value, window = text; "Skipping invalid maintenance window");
+            }
+        }
+    }
+
+    windows
+}
+
+fn parse_period(text: &str) -> Option<Period> {
+    if let Some(first) = parse_date(text) {
+        return Some(Period::Dates { first, last: first });
+    }
+    if let Some((first, last)) = text.split_once("..") {
+        return Some(Period::Dates {
+            first: parse_date(first.trim())?,
+            last: parse_date(last.trim())?,
+        });
+    }
+
+    let (days, times) = match text.rsplit_once(char::is_whitespace) {
+        Some((days, times)) => (parse_days(days.trim())?, times),
+        None => ([true; 7], text),
+    };
+    let (start, end) = times.split_once('-')?;
+
+    Some(Period::Weekly {
+        days,
+        start: parse_time_of_day(start)?,
+        end: parse_time_of_day(end)?,
+    })
+}
+
+/// Parses `Sat`, `Mon-Fri` or `Fri-Mon`.
+fn parse_days(text: &str) -> Option<[bool; 7]> {
+    let day = |name: &str| {
+        WEEKDAYS
+            .iter()
+            .position(|weekday| weekday.eq_ignore_ascii_case(name))
+    };
+
+    let (first, last) = match text.split_once('-') {
+        Some((first, last)) => (day(first)?, day(last)?),
+        None => (day(text)?, day(text)?),
+    };
+
+    let mut days = [false; 7];
+    let mut current = first;
+    loop {
+        days[current] = true;
+        if current == last {
+            return Some(days);
+        }
+        current = (current + 1) % 7;
+    }
+}
+
+/// Parses `HH:MM` in seconds since midnight.
+fn parse_time_of_day(text: &str) -> Option<i64> {
+    let (hours, minutes) = text.split_once(':')?;
+    let hours = hours.parse::<i64>().ok().filter(|hours| *hours < 24)?;
+    let minutes = minutes
+        .parse::<i64>()
+        .ok()
+        .filter(|minutes| *minutes < 60)?;
+
+    Some(hours * 3600 + minutes * 60)
+}
+
+/// Parses `YYYY-MM-DD` in days since the Unix epoch.
+fn parse_date(text: &str) -> Option<i64> {
+    let mut fields = text.splitn(3, '-').map(|field| field.parse::<i64>().ok());
+    let (year, month, day) = (fields.next()??, fields.next()??, fields.next()??);
+    if !(1..=12).contains(&month) || !(1..=31).contains(&day) {
+        return None;
+    }
+
+    Some(days_from_civil(year, month, day))
+}
+
+/// Formats seconds since the Unix epoch, shifted to a time zone, as `Sun 14:05`.
+#[must_use]
+pub fn format_time_of_week(local_time: i64) -> String {
+    let time = local_time.rem_euclid(DAY);
+
+    format!(
+        "{} {:02}:{:02}",
+        WEEKDAYS[weekday(local_time.div_euclid(DAY))],
+        time / 3600,
+        time / 60 % 60
+    )
+}
+
+/// Day of the week of a number of days since the Unix epoch, 0 being Sunday.
+fn weekday(days: i64) -> usize {
+    // The epoch is a Thursday
+    usize::try_from((days + 4).rem_euclid(7)).unwrap_or_default()
+}
+
+/// Civil date `(year, month, day)` of a number of days since the Unix epoch, see
+/// <http://howardhinnant.github.io/date_algorithms.html>.
+#[must_use]
+pub fn civil_from_days(days: i64) -> (i64, i64, i64) {
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let day_of_era = z.rem_euclid(146_097);
+    let year_of_era =
+        (day_of_era - day_of_era / 1460 + day_of_era / 36524 - day_of_era / 146_096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let month_index = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * month_index + 2) / 5 + 1;
+    let month = if month_index < 10 {
+        month_index + 3
+    } else {
+        month_index - 9
+    };
+
+    (year_of_era + era * 400 + i64::from(month <= 2), month, day)
+}
+
+/// Days since the Unix epoch of a civil date, the inverse of [`civil_from_days`].
+fn days_from_civil(year: i64, month: i64, day: i64) -> i64 {
+    let year = if month <= 2 { year - 1 } else { year };
+    let era = year.div_euclid(400);
+    let year_of_era = year.rem_euclid(400);
+    let month_index = if month > 2 { month - 3 } else { month + 9 };
+    let day_of_year = (153 * month_index + 2) / 5 + day - 1;
+    let day_of_era = year_of_era * 365 + year_of_era / 4 - year_of_era / 100 + day_of_year;
+
+    era * 146_097 + day_of_era - 719_468
+}
+
+/// Offset from UTC in seconds of a time zone given as a fixed offset, such as `UTC`,
+/// `+02:00` or `UTC-5`.
+#[must_use]
+pub fn utc_offset(zone: &str) -> Option<i64> {
+    if zone == "UTC" || zone == "GMT" {
+        return Some(0);
+    }
+
+    parse_fixed_offset(zone)
+}
+
+/// Parses `+02:00`, `-0800` or `UTC+5` in seconds.
+fn parse_fixed_offset(zone: &str) -> Option<i64> {
+    let offset = zone
+        .strip_prefix("UTC")
+        .or_else(|| zone.strip_prefix("GMT"))
+        .unwrap_or(zone);
+    let (sign, offset) = match offset.split_at_checked(1)? {
+        ("+", offset) => (1, offset),
+        ("-", offset) => (-1, offset),
+        _ => return None,
+    };
+    if !offset.chars().all(|c| c.is_ascii_digit() || c == ':') {
+        return None;
+    }
+
+    let (hours, minutes) = match offset.split_once(':') {
+        Some((hours, minutes)) => (hours, minutes),
+        None if offset.len() == 4 => offset.split_at(2),
+        None => (offset, "0"),
+    };
+    let hours = hours.parse::<i64>().ok().filter(|hours| *hours <= 14)?;
+    let minutes = minutes
+        .parse::<i64>()
+        .ok()
+        .filter(|minutes| *minutes < 60)?;
+
+    Some(sign * (hours * 3600 + minutes * 60))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_windows_and_offsets() {
+        // Sunday 2024-06-16
+        let sunday = days_from_civil(2024, 6, 16) * DAY;
+        assert_eq!(format_time_of_week(sunday + 3 * 3600), "Sun 03:00");
+
+        let windows =
+            parse_windows("Sun 02:00-04:00, Fri-Mon 23:00-01:00, 2024-12-20..2025-01-05, bad");
+        assert_eq!(windows.len(), 3);
+        assert!(windows[0].contains(sunday + 3 * 3600));
+        assert!(!windows[0].contains(sunday + 5 * 3600));
+        assert!(windows[1].contains(sunday + 30 * 60));
+        assert!(windows[1].contains(sunday + DAY + 30 * 60));
+        assert!(!windows[1].contains(sunday + 3 * DAY + 30 * 60));
+        assert!(windows[2].contains(days_from_civil(2025, 1, 5) * DAY + 3600));
+        assert!(!windows[2].contains(days_from_civil(2025, 1, 6) * DAY));
+        assert!(parse_windows("Sun 22:00-24:30, Sat 24:00-02:00").is_empty());
+        assert_eq!(parse_time_of_day("23:59"), Some(DAY - 60));
+
+        assert_eq!(utc_offset("UTC+5:30"), Some(19800));
+        assert_eq!(utc_offset("-0800"), Some(-28800));
+        assert_eq!(utc_offset("GMT"), Some(0));
+        assert_eq!(utc_offset("Europe/Paris"), None);
+        assert_eq!(utc_offset("UTC+15"), None);
+    }
+}
@@ -0,0 +1,65 @@
+use anyhow::Result;
+use std::collections::HashSet;
+use std::io::Write;
+
+use crate::ssh;
+
+/// Output format, matching what the completion system of each shell expects.
+#[derive(clap::ValueEnum, Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Format {
+    /// One name per line, for bash `compgen -W`
+    Plain,
+    /// `name:description` lines, for zsh `_describe`
+    Zsh,
+    /// `name<TAB>description` lines, for fish `complete -a`
+    Fish,
+}
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    /// Output format
+    #[arg(short, long, value_enum, default_value_t = Format::Plain)]
+    format: Format,
+}
+
+/// Prints the names and aliases of the hosts so shells can complete them for `ssh`.
+///
+/// bash: `complete -W "$(sshs completion-hosts)" ssh`
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration cannot be parsed or stdout cannot be written.
+pub fn run(config_paths: &[String], args: &Args) -> Result<()> {
+    let hosts = ssh::load_hosts(config_paths)?;
+
+    let mut seen = HashSet::new();
+    let mut stdout = std::io::stdout().lock();
+
+    for host in &hosts {
+        let description = match &host.user {
+            Some(user) => format!("{user}@{}", host.destination),
+            None => host.destination.clone(),
+        };
+
+        let names = std::iter::once(host.name.as_str())
+            .chain(host.aliases.split(", "))
+            .filter(|name| {
+                !name.is_empty() && !name.starts_with('!') && !name.contains(['*', '?'])
+            });
+
+        for name in names {
+            if !seen.insert(name) {
+                continue;
+            }
+
+            match args.format {
+                Format::Plain => writeln!(stdout, "{name}")?,
+                // `:` separates the name from the description in zsh.
+                Format::Zsh => writeln!(stdout, "{}:{description}", name.replace(':', "\\:"))?,
+                Format::Fish => writeln!(stdout, "{name}\t{description}")?,
+            }
+        }
+    }
+
+    Ok(())
+}
@@ -0,0 +1,94 @@
+use anyhow::Result;
+use std::path::Path;
+
+use crate::ssh;
+
+/// Checks the hosts for mistakes `ssh` would only report when connecting.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration cannot be parsed or if a problem was found.
+pub fn run(config_paths: &[String]) -> Result<()> {
+    let hosts = ssh::load_hosts(config_paths)?;
+
+    let mut count = 0;
+    for host in &hosts {
+        for finding in check_host(host, &hosts) {
+            println!("{}: {finding}", host.name);
+            count += 1;
+        }
+    }
+
+    if count > 0 {
+        anyhow::bail!("Found {count} problems in {} hosts", hosts.len());
+    }
+
+    println!("No problem found in {} hosts", hosts.len());
+    Ok(())
+}
+
+/// Problems of the host, each one explaining how to fix it.
+#[must_use]
+pub fn check_host(host: &ssh::Host, hosts: &[ssh::Host]) -> Vec<String> {
+    let mut findings = Vec::new();
+
+    if let Some(identity_file) = &host.identity_file {
+        findings.extend(check_identity_file(Path::new(identity_file)));
+    }
+
+    for jump in host.proxy_jump.iter().flat_map(|jumps| jumps.split(',')) {
+        let Ok(destination) = jump.parse::<ssh::Destination>() else {
+            findings.push(format!("ProxyJump {jump} is not a [user@]host[:port]"));
+            continue;
+        };
+
+        let is_defined = hosts.iter().any(|other| {
+            other.name == destination.hostname
+                || other
+                    .aliases
+                    .split(", ")
+                    .any(|alias| alias == destination.hostname)
+        });
+        if !is_defined {
+            findings.push(format!(
+                "ProxyJump {} is not a host of the configuration, add a Host block for it or check its spelling",
+                destination.hostname
+            ));
+        }
+    }
+
+    findings
+}
+
+fn check_identity_file(path: &Path) -> Option<String> {
+    let metadata = match std::fs::metadata(path) {
+        Ok(metadata) => metadata,
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => {
+            return Some(format!(
+                "IdentityFile {} does not exist, create it with ssh-keygen or fix the path",
+                path.display()
+            ))
+        }
+        Err(err) => return Some(format!("IdentityFile {}: {err}", path.display())),
+    };
+
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+
+        // ssh refuses private keys other users can read
+        let mode = metadata.permissions().mode() & 0o777;
+        if mode & 0o077 != 0 {
+            return Some(format!(
+                "IdentityFile {} can be read by other users ({mode:o}), run chmod 600 {}",
+                path.display(),
+                path.display()
+            ));
+        }
+    }
+
+    #[cfg(not(unix))]
+    let _ = metadata;
+
+    None
+}
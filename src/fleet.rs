@@ -0,0 +1,102 @@
+use std::collections::{BTreeMap, HashMap};
+
+use crate::ssh;
+
+/// Hosts sharing a tag, like the machines of a horizontally scaled service, that can be
+/// connected to as one.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Fleet {
+    pub name: String,
+    /// Names of the hosts, in the order of their names.
+    pub members: Vec<String>,
+}
+
+/// Which member of a fleet to connect to.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Pick {
+    Random,
+    /// The one connected to the longest time ago, hosts never connected to coming first.
+    LeastRecentlyUsed,
+    /// The member at this position, starting at 1.
+    Index(usize),
+}
+
+/// Fleets of the hosts, one per tag given from sshs or `Tag`, in the order of their names.
+#[must_use]
+pub fn fleets<'a>(hosts: impl IntoIterator<Item = &'a ssh::Host>) -> Vec<Fleet> {
+    let mut members = BTreeMap::<&str, Vec<String>>::new();
+    for host in hosts {
+        for tag in host.tags.iter().chain(&host.tag) {
+            let fleet = members.entry(tag).or_default();
+            if !fleet.contains(&host.name) {
+                fleet.push(host.name.clone());
+            }
+        }
+    }
+
+    members
+        .into_iter()
+        .map(|(name, mut members)| {
+            members.sort();
+            Fleet {
+                name: name.to_string(),
+                members,
+            }
+        })
+        .collect()
+}
+
+impl Fleet {
+    /// The member to connect to, `last_connected` telling when each host was last connected
+    /// to.
+    #[must_use]
+    pub fn pick(&self, pick: Pick, last_connected: &HashMap<String, u64>) -> Option<&str> {
+        let member = match pick {
+            Pick::Random => {
+                let mut bytes = [0u8; 8];
+                getrandom::getrandom(&mut bytes).ok()?;
+                let index = u64::from_le_bytes(bytes) % u64::try_from(self.members.len()).ok()?;
+                self.members.get(usize::try_from(index).ok()?)
+            }
+            Pick::LeastRecentlyUsed => self
+                .members
+                .iter()
+                .min_by_key(|name| last_connected.get(*name).copied().unwrap_or_default()),
+            Pick::Index(index) => self.members.get(index.checked_sub(1)?),
+        };
+
+        member.map(String::as_str)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_pick_member() {
+        let hosts = ssh::parse_text("Host web2\n  # sshs-tags: web\nHost web1\n  # sshs-tags: web, prod\nHost db\n  Tag prod\n");
+
+        let fleets = fleets(&hosts);
+        assert_eq!(
+            fleets
+                .iter()
+                .map(|fleet| (fleet.name.as_str(), fleet.members.join(",")))
+                .collect::<Vec<_>>(),
+            [
+                ("prod", "db,web1".to_string()),
+                ("web", "web1,web2".to_string())
+            ]
+        );
+
+        let web = &fleets[1];
+        let last_connected = HashMap::from([("web1".to_string(), 1_700_000_000)]);
+        assert_eq!(
+            web.pick(Pick::LeastRecentlyUsed, &last_connected),
+            Some("web2")
+        );
+        assert_eq!(web.pick(Pick::Index(1), &last_connected), Some("web1"));
+        assert_eq!(web.pick(Pick::Index(3), &last_connected), None);
+        assert!(web.pick(Pick::Random, &last_connected).is_some());
+    }
+}
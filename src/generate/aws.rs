@@ -0,0 +1,172 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::process::{Command, Stdio};
+
+use super::{Env, GeneratedHost};
+use crate::ssh;
+use crate::ssh_config::EntryType;
+
+/// How to reach the instances.
+#[derive(Debug, Clone, Default)]
+pub struct Options {
+    pub region: Option<String>,
+    /// Profile of the AWS CLI, its default one otherwise.
+    pub profile: Option<String>,
+    /// Connect through Session Manager, the instances needing no public address.
+    pub ssm: bool,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Reservations {
+    #[serde(default)]
+    reservations: Vec<Reservation>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Reservation {
+    #[serde(default)]
+    instances: Vec<Instance>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Instance {
+    #[serde(rename = "InstanceId")]
+    id: String,
+    private_ip_address: Option<String>,
+    public_ip_address: Option<String>,
+    placement: Option<Placement>,
+    #[serde(default)]
+    tags: Vec<Tag>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Placement {
+    availability_zone: String,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Tag {
+    key: String,
+    value: String,
+}
+
+/// Imports the running EC2 instances of a region with the AWS CLI, named after their `Name`
+/// tag or their ID.
+///
+/// # Errors
+///
+/// Will return `Err` if `aws` cannot be run, fails or prints something else than instances.
+pub fn import(options: &Options, env: &Env) -> Result<Vec<GeneratedHost>> {
+    let mut command = Command::new("aws");
+    command.envs(env);
+    command.args([
+        "ec2",
+        "describe-instances",
+        "--output=json",
+        "--filters",
+        "Name=instance-state-name,Values=running",
+    ]);
+    if let Some(region) = &options.region {
+        command.arg(format!("--region={region}"));
+    }
+    if let Some(profile) = &options.profile {
+        command.arg(format!("--profile={profile}"));
+    }
+
+    let output = command
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run aws: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "aws failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    let reservations: Reservations = serde_json::from_slice(&output.stdout)?;
+    Ok(reservations
+        .reservations
+        .iter()
+        .flat_map(|reservation| &reservation.instances)
+        .map(|instance| instance_to_host(instance, options))
+        .collect())
+}
+
+fn instance_to_host(instance: &Instance, options: &Options) -> GeneratedHost {
+    let name = instance
+        .tags
+        .iter()
+        .find(|tag| tag.key == "Name" && !tag.value.is_empty())
+        .map_or(instance.id.as_str(), |tag| tag.value.as_str());
+    // The availability zone is the region followed by a letter
+    let region = options.region.clone().or_else(|| {
+        instance.placement.as_ref().map(|placement| {
+            placement
+                .availability_zone
+                .trim_end_matches(|c: char| c.is_ascii_lowercase())
+                .to_string()
+        })
+    });
+
+    let mut host = GeneratedHost::new(&name.replace(char::is_whitespace, "-"));
+    let address = if options.ssm {
+        Some(instance.id.as_str())
+    } else {
+        instance
+            .public_ip_address
+            .as_deref()
+            .or(instance.private_ip_address.as_deref())
+    };
+    host.push(EntryType::Hostname, address.unwrap_or(&instance.id));
+    if options.ssm {
+        host.push(
+            EntryType::ProxyCommand,
+            &ssh::ssm_proxy_command(&instance.id, region.as_deref(), options.profile.as_deref()),
+        );
+    }
+    host.push_metadata("instance-id", &instance.id);
+    host.push_metadata("region", region.as_deref().unwrap_or_default());
+
+    host
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_instance_to_host() {
+        let reservations: Reservations = serde_json::from_str(
+            r#"{"Reservations": [{"Instances": [
+                {"InstanceId": "i-0abc", "PrivateIpAddress": "10.0.1.5", "PublicIpAddress": "52.1.2.3",
+                 "Placement": {"AvailabilityZone": "eu-west-1b"}, "Tags": [{"Key": "Name", "Value": "web 1"}]},
+                {"InstanceId": "i-0def", "PrivateIpAddress": "10.0.1.6",
+                 "Placement": {"AvailabilityZone": "eu-west-1a"}}
+            ]}]}"#,
+        )
+        .unwrap();
+        let instances = &reservations.reservations[0].instances;
+
+        let options = Options::default();
+        assert_eq!(
+            instance_to_host(&instances[0], &options).to_string(),
+            "Host web-1\n  # sshs-instance-id: i-0abc\n  # sshs-region: eu-west-1\n  Hostname 52.1.2.3\n"
+        );
+
+        let options = Options {
+            profile: Some("ops".to_string()),
+            ssm: true,
+            ..Options::default()
+        };
+        assert_eq!(
+            instance_to_host(&instances[1], &options).to_string(),
+            "Host i-0def\n  # sshs-instance-id: i-0def\n  # sshs-region: eu-west-1\n  Hostname i-0def\n  ProxyCommand aws ssm start-session --target i-0def --document-name AWS-StartSSHSession --parameters portNumber=%p --region eu-west-1 --profile ops\n"
+        );
+    }
+}
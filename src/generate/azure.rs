@@ -0,0 +1,141 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::process::{Command, Stdio};
+
+use super::{Env, GeneratedHost};
+use crate::ssh_config::EntryType;
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct VirtualMachine {
+    name: String,
+    resource_group: String,
+    /// Addresses separated by commas.
+    #[serde(default)]
+    public_ips: Option<String>,
+    #[serde(default)]
+    private_ips: Option<String>,
+    #[serde(default)]
+    tags: Option<BTreeMap<String, String>>,
+    #[serde(default)]
+    os_profile: Option<OsProfile>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct OsProfile {
+    admin_username: Option<String>,
+}
+
+/// Imports the virtual machines of a subscription with the Azure CLI, which calls the Azure
+/// Resource Manager API with the credentials it is logged in with.
+///
+/// The resource group and the tags of each machine become its sshs tags, `key=value` for the
+/// tags with a value.
+///
+/// # Errors
+///
+/// Will return `Err` if `az` cannot be run, fails or prints something else than machines.
+pub fn import(
+    subscription: Option<&str>,
+    resource_group: Option<&str>,
+    private_ip: bool,
+    env: &Env,
+) -> Result<Vec<GeneratedHost>> {
+    let mut command = Command::new("az");
+    command.envs(env);
+    // --show-details adds the addresses of the machines
+    command.args(["vm", "list", "--show-details", "--output", "json"]);
+    if let Some(subscription) = subscription {
+        command.args(["--subscription", subscription]);
+    }
+    if let Some(resource_group) = resource_group {
+        command.args(["--resource-group", resource_group]);
+    }
+
+    let output = command
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run az: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "az failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    let machines: Vec<VirtualMachine> = serde_json::from_slice(&output.stdout)?;
+
+    Ok(machines
+        .iter()
+        .map(|machine| machine_to_host(machine, private_ip))
+        .collect())
+}
+
+fn machine_to_host(machine: &VirtualMachine, private_ip: bool) -> GeneratedHost {
+    let first = |addresses: &Option<String>| {
+        addresses
+            .iter()
+            .flat_map(|addresses| addresses.split(','))
+            .map(str::trim)
+            .find(|address| !address.is_empty())
+            .map(ToString::to_string)
+    };
+    let address = if private_ip {
+        first(&machine.private_ips)
+    } else {
+        first(&machine.public_ips).or_else(|| first(&machine.private_ips))
+    };
+
+    let mut tags = vec![machine.resource_group.clone()];
+    tags.extend(machine.tags.iter().flatten().map(|(key, value)| {
+        if value.is_empty() {
+            key.clone()
+        } else {
+            format!("{key}={value}")
+        }
+    }));
+
+    let mut host = GeneratedHost::new(&machine.name);
+    host.push_metadata("tags", &tags.join(", "));
+    host.push(
+        EntryType::Hostname,
+        address.as_deref().unwrap_or(&machine.name),
+    );
+    if let Some(user) = machine
+        .os_profile
+        .as_ref()
+        .and_then(|profile| profile.admin_username.as_deref())
+    {
+        host.push(EntryType::User, user);
+    }
+
+    host
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_machine_to_host() {
+        let machines: Vec<VirtualMachine> = serde_json::from_str(
+            r#"[{"name": "web-1", "resourceGroup": "shop-prod", "publicIps": "20.1.2.3",
+                 "privateIps": "10.0.0.4,10.0.1.4", "tags": {"env": "prod", "web": ""},
+                 "osProfile": {"adminUsername": "azureuser"}},
+                {"name": "db-1", "resourceGroup": "shop-prod", "publicIps": "", "privateIps": "10.0.0.5", "tags": null}]"#,
+        )
+        .unwrap();
+
+        assert_eq!(
+            machine_to_host(&machines[0], false).to_string(),
+            "Host web-1\n  # sshs-tags: shop-prod, env=prod, web\n  Hostname 20.1.2.3\n  User azureuser\n"
+        );
+        assert_eq!(machine_to_host(&machines[0], true).entries[0].1, "10.0.0.4");
+        assert_eq!(
+            machine_to_host(&machines[1], false).to_string(),
+            "Host db-1\n  # sshs-tags: shop-prod\n  Hostname 10.0.0.5\n"
+        );
+    }
+}
@@ -0,0 +1,152 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::process::{Command, Stdio};
+
+use super::{Env, GeneratedHost};
+use crate::ssh::Destination;
+use crate::ssh_config::EntryType;
+
+/// Tag of the generated hosts.
+const TAG: &str = "docker";
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Context {
+    name: String,
+    #[serde(default)]
+    docker_endpoint: String,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Container {
+    names: String,
+    /// Published ports, like `0.0.0.0:2222->22/tcp, :::2222->22/tcp`.
+    #[serde(default)]
+    ports: String,
+}
+
+/// Imports the Docker contexts reaching their daemon over SSH and, with `containers`, the
+/// running containers of the local daemon publishing port 22.
+///
+/// # Errors
+///
+/// Will return `Err` if `docker` cannot be run, fails or prints something else than contexts
+/// and containers.
+pub fn import(containers: bool, env: &Env) -> Result<Vec<GeneratedHost>> {
+    let mut hosts = parse_contexts(&docker(&["context", "ls", "--format", "json"], env)?)?;
+    if containers {
+        hosts.extend(parse_containers(&docker(
+            &["ps", "--format", "json"],
+            env,
+        )?)?);
+    }
+
+    Ok(hosts)
+}
+
+fn docker(args: &[&str], env: &Env) -> Result<String> {
+    let output = Command::new("docker")
+        .args(args)
+        .envs(env)
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run docker: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "docker failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout).to_string())
+}
+
+/// Reads the JSON objects `docker --format json` prints, one per line or in an array
+/// depending on its version.
+fn parse_lines<T: serde::de::DeserializeOwned>(content: &str) -> Result<Vec<T>> {
+    if content.trim_start().starts_with('[') {
+        return Ok(serde_json::from_str(content)?);
+    }
+
+    content
+        .lines()
+        .filter(|line| !line.trim().is_empty())
+        .map(|line| Ok(serde_json::from_str(line)?))
+        .collect()
+}
+
+fn parse_contexts(content: &str) -> Result<Vec<GeneratedHost>> {
+    let contexts: Vec<Context> = parse_lines(content)?;
+
+    Ok(contexts
+        .iter()
+        .filter_map(|context| {
+            let url = context.docker_endpoint.strip_prefix("ssh://")?;
+            // The path of the URL, if any, is not part of the destination
+            let url = url.split_once('/').map_or(url, |(url, _)| url);
+            let destination = url.parse::<Destination>().ok()?;
+
+            let mut host = destination.to_host_block(&context.name);
+            host.push_metadata("tags", TAG);
+            Some(host)
+        })
+        .collect())
+}
+
+fn parse_containers(content: &str) -> Result<Vec<GeneratedHost>> {
+    let containers: Vec<Container> = parse_lines(content)?;
+
+    Ok(containers
+        .iter()
+        .filter_map(|container| {
+            let (address, port) = container
+                .ports
+                .split(", ")
+                .find_map(|binding| binding.strip_suffix("->22/tcp")?.rsplit_once(':'))?;
+            let address = match address {
+                "" | "0.0.0.0" | "::" | "[::]" => "localhost",
+                address => address,
+            };
+
+            let name = container
+                .names
+                .split(',')
+                .next()
+                .unwrap_or(&container.names);
+            let mut host = GeneratedHost::new(name);
+            host.push_metadata("tags", TAG);
+            host.push(EntryType::Hostname, address);
+            host.push(EntryType::Port, port);
+            Some(host)
+        })
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_docker() {
+        let hosts = parse_contexts(
+            "{\"Name\":\"default\",\"DockerEndpoint\":\"unix:///var/run/docker.sock\"}\n\
+             {\"Name\":\"build\",\"DockerEndpoint\":\"ssh://ci@build.lan:2222\"}\n",
+        )
+        .unwrap();
+        assert_eq!(
+            hosts.iter().map(ToString::to_string).collect::<Vec<_>>(),
+            ["Host build\n  # sshs-tags: docker\n  Hostname build.lan\n  User ci\n  Port 2222\n"]
+        );
+
+        let hosts = parse_containers(
+            r#"[{"Names":"dev","Ports":"0.0.0.0:2201->22/tcp, :::2201->22/tcp"},
+                {"Names":"db","Ports":"5432/tcp"}]"#,
+        )
+        .unwrap();
+        assert_eq!(
+            hosts.iter().map(ToString::to_string).collect::<Vec<_>>(),
+            ["Host dev\n  # sshs-tags: docker\n  Hostname localhost\n  Port 2201\n"]
+        );
+    }
+}
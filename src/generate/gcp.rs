@@ -0,0 +1,210 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::process::{Command, Stdio};
+
+use super::{Env, GeneratedHost};
+use crate::ssh;
+use crate::ssh_config::EntryType;
+
+/// Key registered by `gcloud` for the OS Login profile of the account.
+const GCLOUD_KEY: &str = "~/.ssh/google_compute_engine";
+
+/// How to reach the instances.
+#[derive(Debug, Clone, Default)]
+pub struct Options {
+    pub project: Option<String>,
+    pub zone: Option<String>,
+    /// Tunnel through Identity-Aware Proxy, the instances needing no external address.
+    pub iap: bool,
+    /// Log in with the OS Login account of the gcloud user.
+    pub os_login: bool,
+}
+
+#[derive(Debug, Deserialize)]
+struct Instance {
+    name: String,
+    /// URL of the zone, ending with its name.
+    zone: String,
+    #[serde(default, rename = "networkInterfaces")]
+    network_interfaces: Vec<NetworkInterface>,
+    #[serde(default)]
+    metadata: Metadata,
+}
+
+#[derive(Debug, Deserialize)]
+struct NetworkInterface {
+    #[serde(rename = "networkIP")]
+    network_ip: Option<String>,
+    #[serde(default, rename = "accessConfigs")]
+    access_configs: Vec<AccessConfig>,
+}
+
+#[derive(Debug, Deserialize)]
+struct AccessConfig {
+    #[serde(rename = "natIP")]
+    nat_ip: Option<String>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct Metadata {
+    #[serde(default)]
+    items: Vec<MetadataItem>,
+}
+
+#[derive(Debug, Deserialize)]
+struct MetadataItem {
+    key: String,
+    #[serde(default)]
+    value: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct LoginProfile {
+    #[serde(default, rename = "posixAccounts")]
+    posix_accounts: Vec<PosixAccount>,
+}
+
+#[derive(Debug, Deserialize)]
+struct PosixAccount {
+    username: String,
+}
+
+/// Imports the Compute Engine instances of a project with `gcloud`, which calls the Compute
+/// API with the credentials it is logged in with.
+///
+/// # Errors
+///
+/// Will return `Err` if `gcloud` cannot be run, fails or prints something else than instances.
+pub fn import(options: &Options, env: &Env) -> Result<Vec<GeneratedHost>> {
+    let mut args = vec![
+        "compute".to_string(),
+        "instances".to_string(),
+        "list".to_string(),
+        "--format=json".to_string(),
+    ];
+    if let Some(project) = &options.project {
+        args.push(format!("--project={project}"));
+    }
+    if let Some(zone) = &options.zone {
+        args.push(format!("--zones={zone}"));
+    }
+    let instances: Vec<Instance> = serde_json::from_str(&gcloud(&args, env)?)?;
+
+    let user = if options.os_login {
+        let profile: LoginProfile = serde_json::from_str(&gcloud(
+            &[
+                "compute".to_string(),
+                "os-login".to_string(),
+                "describe-profile".to_string(),
+                "--format=json".to_string(),
+            ],
+            env,
+        )?)?;
+        let Some(account) = profile.posix_accounts.into_iter().next() else {
+            anyhow::bail!("The OS Login profile has no POSIX account, connect once with `gcloud compute ssh` to create it");
+        };
+        Some(account.username)
+    } else {
+        None
+    };
+
+    Ok(instances
+        .iter()
+        .map(|instance| instance_to_host(instance, options, user.as_deref()))
+        .collect())
+}
+
+fn gcloud(args: &[String], env: &Env) -> Result<String> {
+    let output = Command::new("gcloud")
+        .args(args)
+        .envs(env)
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run gcloud: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "gcloud failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout).to_string())
+}
+
+fn instance_to_host(instance: &Instance, options: &Options, user: Option<&str>) -> GeneratedHost {
+    let zone = instance.zone.rsplit('/').next().unwrap_or(&instance.zone);
+    let internal = instance
+        .network_interfaces
+        .iter()
+        .find_map(|interface| interface.network_ip.as_deref());
+    let external = instance
+        .network_interfaces
+        .iter()
+        .flat_map(|interface| &interface.access_configs)
+        .find_map(|config| config.nat_ip.as_deref());
+
+    let mut host = GeneratedHost::new(&instance.name);
+    let address = if options.iap {
+        internal
+    } else {
+        external.or(internal)
+    };
+    host.push(EntryType::Hostname, address.unwrap_or(&instance.name));
+
+    // OS Login can be disabled per instance, it is enabled for the project otherwise
+    let os_login_disabled = instance
+        .metadata
+        .items
+        .iter()
+        .any(|item| item.key == "enable-oslogin" && item.value.eq_ignore_ascii_case("false"));
+    if let Some(user) = user.filter(|_| !os_login_disabled) {
+        host.push(EntryType::User, user);
+        host.push(EntryType::IdentityFile, GCLOUD_KEY);
+    }
+
+    if options.iap {
+        host.push(
+            EntryType::ProxyCommand,
+            &ssh::iap_proxy_command(&instance.name, zone, options.project.as_deref()),
+        );
+    }
+    host.push_metadata("zone", zone);
+    host.push_metadata("project", options.project.as_deref().unwrap_or_default());
+
+    host
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_instance_to_host() {
+        let instances: Vec<Instance> = serde_json::from_str(
+            r#"[
+                {"name": "web-1", "zone": "https://www.googleapis.com/compute/v1/projects/shop/zones/europe-west1-b",
+                 "networkInterfaces": [{"networkIP": "10.132.0.2", "accessConfigs": [{"natIP": "34.76.1.2"}]}]},
+                {"name": "legacy", "zone": "projects/shop/zones/europe-west1-b",
+                 "networkInterfaces": [{"networkIP": "10.132.0.3"}],
+                 "metadata": {"items": [{"key": "enable-oslogin", "value": "FALSE"}]}}
+            ]"#,
+        )
+        .unwrap();
+
+        let options = Options::default();
+        assert_eq!(
+            instance_to_host(&instances[0], &options, Some("jane_example_com")).to_string(),
+            "Host web-1\n  # sshs-zone: europe-west1-b\n  Hostname 34.76.1.2\n  User jane_example_com\n  IdentityFile ~/.ssh/google_compute_engine\n"
+        );
+
+        let options = Options {
+            project: Some("shop".to_string()),
+            iap: true,
+            ..Options::default()
+        };
+        assert_eq!(
+            instance_to_host(&instances[1], &options, Some("jane_example_com")).to_string(),
+            "Host legacy\n  # sshs-zone: europe-west1-b\n  # sshs-project: shop\n  Hostname 10.132.0.3\n  ProxyCommand gcloud compute start-iap-tunnel legacy %p --listen-on-stdin --zone=europe-west1-b --project=shop --verbosity=warning\n"
+        );
+    }
+}
@@ -0,0 +1,333 @@
+use anyhow::Result;
+use itertools::Itertools;
+use std::collections::{HashMap, HashSet};
+use std::io::Read;
+use std::net::{IpAddr, ToSocketAddrs};
+use std::process::{Command, Stdio};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Mutex;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use super::GeneratedHost;
+use crate::known_hosts::{self, Entry};
+use crate::ssh_config::EntryType;
+
+/// Number of reverse DNS lookups running at the same time.
+const LOOKUP_JOBS: usize = 8;
+
+/// How long to wait for the name of an address.
+const LOOKUP_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// A host name to test hashed entries against, with the name to use if it matches.
+struct Candidate {
+    name: String,
+    known_as: String,
+}
+
+/// Imports the hosts of a `known_hosts` file.
+///
+/// Hashed entries can only be recovered by hashing the `candidates` host names and, when `resolve`
+/// is set, the addresses they resolve to. Hashed entries matching none of them are reported in
+/// `warnings`.
+///
+/// With `reverse`, the entries only known by their IP address are named after the name their
+/// address resolves back to, keeping the address as `HostKeyAlias` so that their host key still
+/// matches.
+///
+/// # Errors
+///
+/// Will return `Err` if the file cannot be read.
+pub fn import(
+    path: &str,
+    candidates: &[String],
+    resolve: bool,
+    reverse: bool,
+    warnings: &mut Vec<String>,
+) -> Result<Vec<GeneratedHost>> {
+    let path = shellexpand::tilde(path).to_string();
+    let entries = known_hosts::parse(&std::fs::read_to_string(&path)?);
+    let candidates = expand_candidates(candidates, resolve);
+
+    let mut known_as = Vec::new();
+    let mut seen = HashSet::new();
+    let mut unresolved = 0;
+
+    for entry in entries.iter().filter(|entry| entry.marker.is_none()) {
+        let names = if entry.is_hashed() {
+            let names = match_hashed(entry, &candidates);
+            if names.is_empty() {
+                warnings.push(format!(
+                    "{path}:{}: hashed {} entry matches none of the candidate hosts",
+                    entry.line, entry.key_type
+                ));
+                unresolved += 1;
+            }
+            names
+        } else {
+            entry
+                .hosts
+                .iter()
+                .filter(|host| !host.starts_with('!') && !host.contains(['*', '?']))
+                .cloned()
+                .collect()
+        };
+
+        for name in names {
+            if seen.insert(name.clone()) {
+                known_as.push(name);
+            }
+        }
+    }
+
+    if unresolved > 0 {
+        warnings.push(format!(
+            "{unresolved} hashed entries could not be identified, give the host names to try with --known-hosts-candidates"
+        ));
+    }
+
+    let names = if reverse {
+        let addresses = known_as
+            .iter()
+            .map(|name| known_hosts::split_host(name).0)
+            .filter(|hostname| hostname.parse::<IpAddr>().is_ok())
+            .unique()
+            .collect::<Vec<_>>();
+        let names = reverse_lookup(&addresses);
+        if names.len() < addresses.len() {
+            warnings.push(format!(
+                "{} of {} addresses have no name, they keep their address",
+                addresses.len() - names.len(),
+                addresses.len()
+            ));
+        }
+        names
+    } else {
+        HashMap::new()
+    };
+
+    Ok(known_hosts_to_hosts(&known_as, &names))
+}
+
+/// The hosts of the names of the entries, the addresses being named after the names they
+/// resolve back to in `names` when no other host has it.
+fn known_hosts_to_hosts(
+    known_as: &[String],
+    names: &HashMap<String, String>,
+) -> Vec<GeneratedHost> {
+    // A name the file already knows is left to its own host, ssh only reading the first block
+    let mut taken = known_as
+        .iter()
+        .map(|name| known_hosts::split_host(name).0.to_string())
+        .collect::<HashSet<_>>();
+
+    let mut hosts = Vec::new();
+    for name in known_as {
+        let address = known_hosts::split_host(name).0;
+        // Two addresses with the same name keep theirs, they might not be the same machine
+        let resolved = names
+            .get(address)
+            .filter(|resolved| taken.insert((*resolved).clone()))
+            .map(String::as_str);
+        hosts.push(known_host_to_host(name, resolved));
+    }
+
+    hosts
+}
+
+fn known_host_to_host(known_as: &str, resolved: Option<&str>) -> GeneratedHost {
+    let (hostname, port) = known_hosts::split_host(known_as);
+
+    let mut host = GeneratedHost::new(resolved.unwrap_or(hostname));
+    host.push(EntryType::Hostname, resolved.unwrap_or(hostname));
+    if let Some(port) = port {
+        host.push(EntryType::Port, port);
+    }
+    if resolved.is_some() {
+        host.push(EntryType::HostKeyAlias, known_as);
+    }
+
+    host
+}
+
+/// Names the addresses resolve back to, looked up a few at a time.
+fn reverse_lookup(addresses: &[&str]) -> HashMap<String, String> {
+    let next = AtomicUsize::new(0);
+    let names = Mutex::new(HashMap::new());
+
+    thread::scope(|scope| {
+        for _ in 0..LOOKUP_JOBS.min(addresses.len()) {
+            scope.spawn(|| {
+                while let Some(address) = addresses.get(next.fetch_add(1, Ordering::Relaxed)) {
+                    let name = lookup_name(address);
+                    log::debug!(address = address, name:? = name; "Reverse DNS lookup");
+                    if let (Some(name), Ok(mut names)) = (name, names.lock()) {
+                        names.insert((*address).to_string(), name);
+                    }
+                }
+            });
+        }
+    });
+
+    names.into_inner().unwrap_or_default()
+}
+
+/// Name of an address with `getent` on Linux, which also reads `/etc/hosts`, and `nslookup`
+/// elsewhere.
+fn lookup_name(address: &str) -> Option<String> {
+    let (program, args) = if cfg!(target_os = "linux") {
+        ("getent", ["hosts", address])
+    } else {
+        ("nslookup", [address, ""])
+    };
+    let output = output_within(
+        Command::new(program).args(args.iter().filter(|arg| !arg.is_empty())),
+        LOOKUP_TIMEOUT,
+    )?;
+
+    let name = if program == "getent" {
+        output.split_whitespace().nth(1)
+    } else {
+        output.lines().find_map(|line| {
+            // `1.0.0.10.in-addr.arpa name = web.example.com.` or `Name: web.example.com` on Windows
+            line.split_once("name = ")
+                .map(|(_, name)| name)
+                .or_else(|| line.trim().strip_prefix("Name:"))
+        })
+    }?;
+    let name = name.trim().trim_end_matches('.');
+
+    (!name.is_empty() && name != address).then(|| name.to_string())
+}
+
+/// Standard output of a command that succeeded before the timeout, the command being killed
+/// otherwise.
+fn output_within(command: &mut Command, timeout: Duration) -> Option<String> {
+    let mut child = command
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()
+        .ok()?;
+
+    let deadline = Instant::now() + timeout;
+    let status = loop {
+        if let Some(status) = child.try_wait().ok()? {
+            break status;
+        }
+        if Instant::now() >= deadline {
+            let _ = child.kill();
+            let _ = child.wait();
+            return None;
+        }
+        thread::sleep(Duration::from_millis(20));
+    };
+
+    let mut output = String::new();
+    child.stdout.take()?.read_to_string(&mut output).ok()?;
+
+    status.success().then_some(output)
+}
+
+fn match_hashed(entry: &Entry, candidates: &[Candidate]) -> Vec<String> {
+    candidates
+        .iter()
+        .filter(|candidate| {
+            entry
+                .hosts
+                .iter()
+                .any(|hashed| known_hosts::matches_hashed(hashed, &candidate.known_as))
+        })
+        .map(|candidate| candidate.name.clone())
+        .collect()
+}
+
+/// Adds the addresses of the candidates when `resolve` is set, since `ssh` also records host keys by IP address.
+fn expand_candidates(candidates: &[String], resolve: bool) -> Vec<Candidate> {
+    let mut expanded = Vec::new();
+
+    for candidate in candidates {
+        let (hostname, port) = known_hosts::split_host(candidate);
+        expanded.push(Candidate {
+            name: candidate.clone(),
+            known_as: candidate.clone(),
+        });
+
+        if !resolve {
+            continue;
+        }
+
+        let port_number = port.and_then(|port| port.parse().ok()).unwrap_or(22);
+        let Ok(addresses) = (hostname, port_number).to_socket_addrs() else {
+            log::debug!(host = hostname; "Failed to resolve candidate host");
+            continue;
+        };
+
+        for address in addresses {
+            expanded.push(Candidate {
+                name: candidate.clone(),
+                known_as: known_hosts::format_host(&address.ip().to_string(), port),
+            });
+        }
+    }
+
+    expanded
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_match_hashed() {
+        let candidates = expand_candidates(
+            &["example.org".to_string(), "example.com".to_string()],
+            false,
+        );
+        let entry = Entry {
+            line: 1,
+            marker: None,
+            hosts: vec![known_hosts::hash_host("example.com", b"salt")],
+            key_type: "ssh-ed25519".to_string(),
+            key: "AAAA".to_string(),
+        };
+
+        assert_eq!(match_hashed(&entry, &candidates), vec!["example.com"]);
+    }
+
+    #[test]
+    fn test_resolved_known_host() {
+        let host = known_host_to_host("[10.0.0.5]:2222", Some("web.example.com"));
+
+        assert_eq!(host.name, "web.example.com");
+        assert_eq!(
+            host.entries,
+            [
+                (EntryType::Hostname, "web.example.com".to_string()),
+                (EntryType::Port, "2222".to_string()),
+                (EntryType::HostKeyAlias, "[10.0.0.5]:2222".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_known_address_of_known_name() {
+        // web.example.com,10.0.0.5 ssh-ed25519 ...
+        let known_as = ["web.example.com".to_string(), "10.0.0.5".to_string()];
+        let names = HashMap::from([("10.0.0.5".to_string(), "web.example.com".to_string())]);
+
+        let hosts = known_hosts_to_hosts(&known_as, &names);
+
+        assert_eq!(
+            hosts
+                .iter()
+                .map(|host| host.name.as_str())
+                .collect::<Vec<_>>(),
+            ["web.example.com", "10.0.0.5"]
+        );
+        assert!(!hosts[1]
+            .entries
+            .iter()
+            .any(|(entry, _)| *entry == EntryType::HostKeyAlias));
+    }
+}
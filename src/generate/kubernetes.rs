@@ -0,0 +1,120 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::process::{Command, Stdio};
+
+use super::{Env, GeneratedHost};
+use crate::ssh_config::EntryType;
+
+/// Address types of a node, the first one found being its `HostName`.
+const ADDRESS_TYPES: &[&str] = &["ExternalIP", "InternalIP", "Hostname"];
+
+#[derive(Debug, Deserialize)]
+struct NodeList {
+    items: Vec<Node>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Node {
+    metadata: Metadata,
+    #[serde(default)]
+    status: Status,
+}
+
+#[derive(Debug, Deserialize)]
+struct Metadata {
+    name: String,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct Status {
+    #[serde(default)]
+    addresses: Vec<Address>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Address {
+    #[serde(rename = "type")]
+    kind: String,
+    address: String,
+}
+
+/// Imports the nodes of the current cluster of the kubeconfig with `kubectl`, optionally the
+/// ones matching a label selector.
+///
+/// # Errors
+///
+/// Will return `Err` if `kubectl` cannot be run, fails or prints something else than a node list.
+pub fn import(selector: Option<&str>, env: &Env) -> Result<Vec<GeneratedHost>> {
+    let mut command = Command::new("kubectl");
+    command.envs(env);
+    command.args(["get", "nodes", "--output", "json"]);
+    if let Some(selector) = selector {
+        command.args(["--selector", selector]);
+    }
+
+    let output = command
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run kubectl: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "kubectl failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    parse_nodes(&String::from_utf8_lossy(&output.stdout))
+}
+
+fn parse_nodes(content: &str) -> Result<Vec<GeneratedHost>> {
+    let nodes: NodeList = serde_json::from_str(content)?;
+
+    Ok(nodes.items.iter().map(node_to_host).collect())
+}
+
+fn node_to_host(node: &Node) -> GeneratedHost {
+    let address = ADDRESS_TYPES.iter().find_map(|kind| {
+        node.status
+            .addresses
+            .iter()
+            .find(|address| address.kind == *kind)
+    });
+
+    let mut host = GeneratedHost::new(&node.metadata.name);
+    host.push(
+        EntryType::Hostname,
+        address.map_or(&node.metadata.name, |address| &address.address),
+    );
+
+    host
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_nodes() {
+        let hosts = parse_nodes(
+            r#"{"items": [
+                {"metadata": {"name": "cp-1"}, "status": {"addresses": [
+                    {"type": "InternalIP", "address": "10.0.0.10"},
+                    {"type": "ExternalIP", "address": "203.0.113.10"}
+                ]}},
+                {"metadata": {"name": "worker-1"}, "status": {"addresses": [
+                    {"type": "Hostname", "address": "worker-1.lan"},
+                    {"type": "InternalIP", "address": "10.0.0.11"}
+                ]}}
+            ]}"#,
+        )
+        .unwrap();
+
+        assert_eq!(
+            hosts.iter().map(ToString::to_string).collect::<Vec<_>>(),
+            [
+                "Host cp-1\n  Hostname 203.0.113.10\n",
+                "Host worker-1\n  Hostname 10.0.0.11\n"
+            ]
+        );
+    }
+}
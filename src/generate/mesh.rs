@@ -0,0 +1,176 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::process::{Command, Stdio};
+
+use super::{Env, GeneratedHost};
+use crate::ssh_config::EntryType;
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct TailscaleStatus {
+    #[serde(default)]
+    peer: BTreeMap<String, TailscalePeer>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct TailscalePeer {
+    host_name: String,
+    /// `MagicDNS` name, ending with a dot.
+    #[serde(rename = "DNSName", default)]
+    dns_name: String,
+    #[serde(rename = "TailscaleIPs", default)]
+    tailscale_ips: Vec<String>,
+    #[serde(default)]
+    tags: Vec<String>,
+    /// Host keys of the peers running Tailscale SSH.
+    #[serde(rename = "sshHostKeys", default)]
+    ssh_host_keys: Vec<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct NetbirdStatus {
+    peers: NetbirdPeers,
+}
+
+#[derive(Debug, Deserialize)]
+struct NetbirdPeers {
+    #[serde(default)]
+    details: Vec<NetbirdPeer>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct NetbirdPeer {
+    fqdn: String,
+    netbird_ip: String,
+}
+
+/// Imports the peers of the tailnet from `tailscale status`, named after their `MagicDNS` name.
+///
+/// # Errors
+///
+/// Will return `Err` if `tailscale` cannot be run, fails or prints something else than a status.
+pub fn import_tailscale(ssh_only: bool, env: &Env) -> Result<Vec<GeneratedHost>> {
+    parse_tailscale(&status("tailscale", env)?, ssh_only)
+}
+
+/// Imports the peers of the network from `netbird status`, named after their domain
+/// name.
+///
+/// # Errors
+///
+/// Will return `Err` if `netbird` cannot be run, fails or prints something else than a status.
+pub fn import_netbird(env: &Env) -> Result<Vec<GeneratedHost>> {
+    parse_netbird(&status("netbird", env)?)
+}
+
+fn status(program: &str, env: &Env) -> Result<String> {
+    let output = Command::new(program)
+        .args(["status", "--json"])
+        .envs(env)
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run {program}: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "{program} failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout).to_string())
+}
+
+fn parse_tailscale(content: &str, ssh_only: bool) -> Result<Vec<GeneratedHost>> {
+    let status: TailscaleStatus = serde_json::from_str(content)?;
+
+    let mut peers = status
+        .peer
+        .values()
+        .filter(|peer| !ssh_only || !peer.ssh_host_keys.is_empty())
+        .collect::<Vec<_>>();
+    peers.sort_by(|a, b| a.dns_name.cmp(&b.dns_name));
+
+    Ok(peers
+        .into_iter()
+        .map(|peer| {
+            let dns_name = peer.dns_name.trim_end_matches('.');
+            let name = dns_name
+                .split('.')
+                .next()
+                .filter(|name| !name.is_empty())
+                .unwrap_or(&peer.host_name);
+
+            let mut host = GeneratedHost::new(name);
+            host.push_metadata(
+                "tags",
+                &peer
+                    .tags
+                    .iter()
+                    .map(|tag| tag.trim_start_matches("tag:"))
+                    .collect::<Vec<_>>()
+                    .join(", "),
+            );
+            host.push(
+                EntryType::Hostname,
+                if dns_name.is_empty() {
+                    peer.tailscale_ips.first().unwrap_or(&peer.host_name)
+                } else {
+                    dns_name
+                },
+            );
+            host
+        })
+        .collect())
+}
+
+fn parse_netbird(content: &str) -> Result<Vec<GeneratedHost>> {
+    let status: NetbirdStatus = serde_json::from_str(content)?;
+
+    Ok(status
+        .peers
+        .details
+        .iter()
+        .map(|peer| {
+            let fqdn = peer.fqdn.trim_end_matches('.');
+            let ip = peer.netbird_ip.split('/').next().unwrap_or_default();
+
+            let mut host = GeneratedHost::new(fqdn.split('.').next().unwrap_or(fqdn));
+            host.push(EntryType::Hostname, if fqdn.is_empty() { ip } else { fqdn });
+            host
+        })
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_peers() {
+        let tailscale = r#"{"Self": {"HostName": "laptop"}, "Peer": {
+            "nodekey:1": {"HostName": "nas", "DNSName": "nas.tail1234.ts.net.", "TailscaleIPs": ["100.64.0.2"],
+                          "Tags": ["tag:server"], "sshHostKeys": ["ssh-ed25519 AAAA"]},
+            "nodekey:2": {"HostName": "Pixel 8", "DNSName": "pixel-8.tail1234.ts.net.", "TailscaleIPs": ["100.64.0.3"]}
+        }}"#;
+
+        let hosts = parse_tailscale(tailscale, false).unwrap();
+        assert_eq!(
+            hosts[0].to_string(),
+            "Host nas\n  # sshs-tags: server\n  Hostname nas.tail1234.ts.net\n"
+        );
+        assert_eq!(hosts[1].name, "pixel-8");
+        assert_eq!(parse_tailscale(tailscale, true).unwrap().len(), 1);
+
+        let hosts = parse_netbird(
+            r#"{"peers": {"details": [{"fqdn": "builder.netbird.cloud", "netbirdIp": "100.85.1.2"}]}}"#,
+        )
+        .unwrap();
+        assert_eq!(
+            hosts[0].to_string(),
+            "Host builder\n  Hostname builder.netbird.cloud\n"
+        );
+    }
+}
@@ -0,0 +1,640 @@
+pub mod aws;
+pub mod azure;
+pub mod docker;
+pub mod gcp;
+pub mod known_hosts;
+pub mod kubernetes;
+pub mod mesh;
+pub mod putty;
+pub mod teleport;
+pub mod termius;
+pub mod vagrant;
+pub mod vps;
+
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::io::Write;
+
+use crate::ssh_config::EntryType;
+
+/// Environment variables set on the programs run by the generators, on top of the ones of sshs.
+pub type Env = BTreeMap<String, String>;
+
+/// A host block produced by one of the generators.
+#[derive(Debug, Clone, Default)]
+pub struct GeneratedHost {
+    pub name: String,
+    pub entries: Vec<(EntryType, String)>,
+    /// Written as `# sshs-KEY: VALUE` comments.
+    pub metadata: Vec<(String, String)>,
+    /// Generator the host comes from, like `tailscale`.
+    pub source: String,
+}
+
+impl GeneratedHost {
+    #[must_use]
+    pub fn new(name: &str) -> GeneratedHost {
+        GeneratedHost {
+            name: name.to_string(),
+            entries: Vec::new(),
+            metadata: Vec::new(),
+            source: String::new(),
+        }
+    }
+
+    pub fn push(&mut self, entry: EntryType, value: &str) {
+        if value.is_empty() {
+            return;
+        }
+
+        self.entries.push((entry, value.to_string()));
+    }
+
+    pub fn push_metadata(&mut self, key: &str, value: &str) {
+        if value.is_empty() {
+            return;
+        }
+
+        self.metadata.push((key.to_string(), value.to_string()));
+    }
+
+    fn record(&self) -> Record<'_> {
+        let mut options: Vec<(String, OptionValue)> = Vec::new();
+        for (entry, value) in &self.entries {
+            let keyword = entry.to_string();
+            match options.iter_mut().find(|(name, _)| *name == keyword) {
+                Some((_, OptionValue::Many(values))) => values.push(value),
+                Some((_, one)) => {
+                    if let OptionValue::One(first) = *one {
+                        *one = OptionValue::Many(vec![first, value]);
+                    }
+                }
+                None => options.push((keyword, OptionValue::One(value))),
+            }
+        }
+
+        Record {
+            name: &self.name,
+            source: &self.source,
+            tags: self
+                .metadata
+                .iter()
+                .filter(|(key, _)| key == "tags")
+                .flat_map(|(_, value)| value.split(", "))
+                .collect(),
+            options: Options(options),
+            metadata: self
+                .metadata
+                .iter()
+                .filter(|(key, _)| key != "tags")
+                .map(|(key, value)| (key.as_str(), value.as_str()))
+                .collect(),
+        }
+    }
+}
+
+/// A host as written with `--format json` or `--format yaml`.
+#[derive(Serialize)]
+struct Record<'a> {
+    name: &'a str,
+    source: &'a str,
+    tags: Vec<&'a str>,
+    options: Options<'a>,
+    metadata: BTreeMap<&'a str, &'a str>,
+}
+
+/// Options of a host in their order, the ones given several times listing their values.
+struct Options<'a>(Vec<(String, OptionValue<'a>)>);
+
+#[derive(Serialize)]
+#[serde(untagged)]
+enum OptionValue<'a> {
+    One(&'a str),
+    Many(Vec<&'a str>),
+}
+
+impl Serialize for Options<'_> {
+    fn serialize<S: serde::Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.collect_map(self.0.iter().map(|(keyword, value)| (keyword, value)))
+    }
+}
+
+impl fmt::Display for GeneratedHost {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.name.contains(char::is_whitespace) {
+            writeln!(f, "Host \"{}\"", self.name)?;
+        } else {
+            writeln!(f, "Host {}", self.name)?;
+        }
+
+        for (key, value) in &self.metadata {
+            writeln!(f, "  # sshs-{key}: {value}")?;
+        }
+        for (entry, value) in &self.entries {
+            writeln!(f, "  {entry} {value}")?;
+        }
+
+        Ok(())
+    }
+}
+
+/// How `sshs generate` writes the hosts.
+#[derive(clap::ValueEnum, Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum Format {
+    /// Host blocks of the SSH configuration
+    #[default]
+    Ssh,
+    /// A list of hosts with their source, tags and options
+    Json,
+    /// The list of `json` written as YAML
+    Yaml,
+}
+
+#[derive(clap::Args, Debug)]
+#[allow(clippy::struct_excessive_bools)]
+pub struct Args {
+    /// Import PuTTY saved sessions
+    #[arg(long, default_value_t = false)]
+    putty: bool,
+
+    /// Directory containing PuTTY session files (defaults to ~/.putty/sessions)
+    #[arg(long)]
+    putty_sessions: Option<String>,
+
+    /// Import hosts from a Termius export or a JSON/CSV file using the same fields
+    #[arg(long, value_name = "FILE")]
+    termius: Option<String>,
+
+    /// Import the hosts of a known hosts file (defaults to `~/.ssh/known_hosts`)
+    #[arg(
+        long,
+        value_name = "FILE",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "~/.ssh/known_hosts"
+    )]
+    known_hosts: Option<String>,
+
+    /// File listing host names, one per line, to identify hashed known hosts entries
+    #[arg(long, value_name = "FILE")]
+    known_hosts_candidates: Option<String>,
+
+    /// Also try the addresses the candidate host names resolve to
+    #[arg(long, default_value_t = false)]
+    resolve: bool,
+
+    /// Name the known hosts only recorded by their IP address after the name it resolves back to
+    #[arg(long, default_value_t = false)]
+    known_hosts_resolve: bool,
+
+    /// Import the nodes of the current Kubernetes cluster with kubectl
+    #[arg(long, default_value_t = false)]
+    kubernetes: bool,
+
+    /// Only import the nodes matching this label selector, like `node-role.kubernetes.io/worker`
+    #[arg(long, value_name = "SELECTOR", requires = "kubernetes")]
+    kubernetes_selector: Option<String>,
+
+    /// Import the Compute Engine instances of a Google Cloud project with gcloud
+    #[arg(long, default_value_t = false)]
+    gcp: bool,
+
+    /// Google Cloud project, the default one of gcloud otherwise
+    #[arg(long, requires = "gcp")]
+    project: Option<String>,
+
+    /// Only import the instances of this zone
+    #[arg(long, requires = "gcp")]
+    zone: Option<String>,
+
+    /// Connect to the instances through Identity-Aware Proxy
+    #[arg(long, default_value_t = false, requires = "gcp")]
+    iap: bool,
+
+    /// Log in with the OS Login account of the gcloud user
+    #[arg(long, default_value_t = false, requires = "gcp")]
+    os_login: bool,
+
+    /// Import the running EC2 instances of a region with the AWS CLI
+    #[arg(long, default_value_t = false)]
+    aws: bool,
+
+    /// AWS region, the default one of the AWS CLI otherwise
+    #[arg(long, requires = "aws")]
+    region: Option<String>,
+
+    /// Profile of the AWS CLI, its default one otherwise
+    #[arg(long, requires = "aws")]
+    aws_profile: Option<String>,
+
+    /// Connect to the instances through AWS Systems Manager Session Manager
+    #[arg(long, default_value_t = false, requires = "aws")]
+    ssm: bool,
+
+    /// Import the virtual machines of an Azure subscription with the Azure CLI
+    #[arg(long, default_value_t = false)]
+    azure: bool,
+
+    /// Azure subscription, the default one of the Azure CLI otherwise
+    #[arg(long, requires = "azure")]
+    subscription: Option<String>,
+
+    /// Only import the virtual machines of this resource group
+    #[arg(long, requires = "azure")]
+    resource_group: Option<String>,
+
+    /// Connect to the virtual machines with their private IP address even if they have a public one
+    #[arg(long, default_value_t = false, requires = "azure")]
+    private_ip: bool,
+
+    /// Import the Hetzner Cloud servers of the account of `HCLOUD_TOKEN`
+    #[arg(long, default_value_t = false)]
+    hetzner: bool,
+
+    /// Import the droplets of the `DigitalOcean` account of `DIGITALOCEAN_TOKEN`
+    #[arg(long, default_value_t = false)]
+    digitalocean: bool,
+
+    /// Import the Vultr instances of the account of `VULTR_API_KEY`
+    #[arg(long, default_value_t = false)]
+    vultr: bool,
+
+    /// Import the peers of the tailnet from `tailscale status`
+    #[arg(long, default_value_t = false)]
+    tailscale: bool,
+
+    /// Only import the peers running Tailscale SSH
+    #[arg(long, default_value_t = false, requires = "tailscale")]
+    tailscale_ssh_only: bool,
+
+    /// Import the peers of the network from `netbird status`
+    #[arg(long, default_value_t = false)]
+    netbird: bool,
+
+    /// Import the nodes of a Teleport cluster with tsh, connected to with `tsh ssh`
+    #[arg(long, default_value_t = false)]
+    teleport: bool,
+
+    /// Teleport cluster, the current one of tsh otherwise
+    #[arg(long, requires = "teleport")]
+    teleport_cluster: Option<String>,
+
+    /// Import the Docker contexts whose daemon is reached over SSH
+    #[arg(long, default_value_t = false)]
+    docker: bool,
+
+    /// Also import the running containers publishing port 22 on the local daemon
+    #[arg(long, default_value_t = false, requires = "docker")]
+    docker_containers: bool,
+
+    /// Import the running Vagrant machines of a project, or of all the projects without a
+    /// directory
+    #[arg(long, value_name = "DIR", num_args = 0..=1, require_equals = true)]
+    #[allow(clippy::option_option)]
+    vagrant: Option<Option<String>>,
+
+    /// Write the generated configuration to a file instead of stdout
+    #[arg(short, long)]
+    output: Option<String>,
+
+    /// Format of the hosts written
+    #[arg(long, value_enum, default_value_t = Format::Ssh)]
+    format: Format,
+}
+
+impl Args {
+    fn selects_source(&self) -> bool {
+        self.putty
+            || self.termius.is_some()
+            || self.known_hosts.is_some()
+            || self.kubernetes
+            || self.gcp
+            || self.aws
+            || self.azure
+            || self.hetzner
+            || self.digitalocean
+            || self.vultr
+            || self.tailscale
+            || self.netbird
+            || self.teleport
+            || self.docker
+            || self.vagrant.is_some()
+    }
+}
+
+/// # Errors
+///
+/// Will return `Err` if no source is selected, if a source cannot be read or if the output cannot be written.
+pub fn run(args: &Args) -> Result<()> {
+    let mut warnings = Vec::new();
+    let hosts = collect(args, &Env::new(), &mut warnings)?;
+    for warning in warnings {
+        eprintln!("{warning}");
+    }
+
+    let mut output: Box<dyn Write> = match &args.output {
+        Some(path) => Box::new(std::fs::File::create(shellexpand::tilde(path).to_string())?),
+        None => Box::new(std::io::stdout().lock()),
+    };
+
+    write_hosts(&mut output, &hosts, args.format)
+}
+
+fn write_hosts(output: &mut dyn Write, hosts: &[GeneratedHost], format: Format) -> Result<()> {
+    match format {
+        Format::Ssh => {
+            for (i, host) in hosts.iter().enumerate() {
+                if i > 0 {
+                    writeln!(output)?;
+                }
+
+                write!(output, "{host}")?;
+            }
+        }
+        Format::Json => {
+            let records = hosts.iter().map(GeneratedHost::record).collect::<Vec<_>>();
+            serde_json::to_writer_pretty(&mut *output, &records)?;
+            writeln!(output)?;
+        }
+        Format::Yaml => {
+            if hosts.is_empty() {
+                writeln!(output, "[]")?;
+            }
+            // Scalars and lists are written like in JSON, which YAML reads as well
+            for record in hosts.iter().map(GeneratedHost::record) {
+                writeln!(output, "- name: {}", serde_json::to_string(record.name)?)?;
+                writeln!(
+                    output,
+                    "  source: {}",
+                    serde_json::to_string(record.source)?
+                )?;
+                writeln!(output, "  tags: {}", serde_json::to_string(&record.tags)?)?;
+                if record.options.0.is_empty() {
+                    writeln!(output, "  options: {{}}")?;
+                } else {
+                    writeln!(output, "  options:")?;
+                }
+                for (keyword, value) in &record.options.0 {
+                    writeln!(output, "    {keyword}: {}", serde_json::to_string(value)?)?;
+                }
+                if record.metadata.is_empty() {
+                    writeln!(output, "  metadata: {{}}")?;
+                } else {
+                    writeln!(output, "  metadata:")?;
+                }
+                for (key, value) in &record.metadata {
+                    writeln!(
+                        output,
+                        "    {}: {}",
+                        serde_json::to_string(key)?,
+                        serde_json::to_string(value)?
+                    )?;
+                }
+            }
+        }
+    }
+
+    Ok(())
+}
+
+/// Reads the names tried against the hashed known hosts, one per line.
+fn read_candidates(path: &str) -> Result<Vec<String>> {
+    Ok(
+        std::fs::read_to_string(shellexpand::tilde(path).to_string())?
+            .lines()
+            .map(str::trim)
+            .filter(|line| !line.is_empty() && !line.starts_with('#'))
+            .map(ToString::to_string)
+            .collect(),
+    )
+}
+
+/// Imports the hosts of the sources selected by the arguments, the programs they run being given
+/// the variables of `env`. What the sources leave out is told in `warnings`.
+///
+/// # Errors
+///
+/// Will return `Err` if no source is selected or if a source cannot be read.
+pub fn collect(args: &Args, env: &Env, warnings: &mut Vec<String>) -> Result<Vec<GeneratedHost>> {
+    if !args.selects_source() {
+        anyhow::bail!(
+            "No source selected, use --putty, --termius, --known-hosts, --kubernetes, --gcp, --aws, --azure, --hetzner, --digitalocean, --vultr, --tailscale, --netbird, --teleport, --docker or --vagrant"
+        );
+    }
+
+    let mut hosts = Vec::new();
+
+    if args.putty {
+        hosts.extend(from_source(
+            "putty",
+            putty::import(args.putty_sessions.as_deref(), warnings)?,
+        ));
+    }
+
+    if let Some(path) = &args.termius {
+        hosts.extend(from_source("termius", termius::import(path)?));
+    }
+
+    if let Some(path) = &args.known_hosts {
+        let candidates = match &args.known_hosts_candidates {
+            Some(path) => read_candidates(path)?,
+            None => Vec::new(),
+        };
+
+        hosts.extend(from_source(
+            "known_hosts",
+            known_hosts::import(
+                path,
+                &candidates,
+                args.resolve,
+                args.known_hosts_resolve,
+                warnings,
+            )?,
+        ));
+    }
+
+    if args.kubernetes {
+        hosts.extend(from_source(
+            "kubernetes",
+            kubernetes::import(args.kubernetes_selector.as_deref(), env)?,
+        ));
+    }
+
+    if args.gcp {
+        hosts.extend(from_source(
+            "gcp",
+            gcp::import(
+                &gcp::Options {
+                    project: args.project.clone(),
+                    zone: args.zone.clone(),
+                    iap: args.iap,
+                    os_login: args.os_login,
+                },
+                env,
+            )?,
+        ));
+    }
+
+    if args.aws {
+        hosts.extend(from_source(
+            "aws",
+            aws::import(
+                &aws::Options {
+                    region: args.region.clone(),
+                    profile: args.aws_profile.clone(),
+                    ssm: args.ssm,
+                },
+                env,
+            )?,
+        ));
+    }
+
+    if args.azure {
+        hosts.extend(from_source(
+            "azure",
+            azure::import(
+                args.subscription.as_deref(),
+                args.resource_group.as_deref(),
+                args.private_ip,
+                env,
+            )?,
+        ));
+    }
+
+    for (enabled, provider) in [
+        (args.hetzner, vps::Provider::Hetzner),
+        (args.digitalocean, vps::Provider::DigitalOcean),
+        (args.vultr, vps::Provider::Vultr),
+    ] {
+        if enabled {
+            hosts.extend(from_source(provider.name(), vps::import(provider, env)?));
+        }
+    }
+
+    if args.tailscale {
+        hosts.extend(from_source(
+            "tailscale",
+            mesh::import_tailscale(args.tailscale_ssh_only, env)?,
+        ));
+    }
+
+    if args.netbird {
+        hosts.extend(from_source("netbird", mesh::import_netbird(env)?));
+    }
+
+    if args.teleport {
+        hosts.extend(from_source(
+            "teleport",
+            teleport::import(args.teleport_cluster.as_deref(), env)?,
+        ));
+    }
+
+    if args.docker {
+        hosts.extend(from_source(
+            "docker",
+            docker::import(args.docker_containers, env)?,
+        ));
+    }
+
+    if let Some(directory) = &args.vagrant {
+        hosts.extend(from_source(
+            "vagrant",
+            vagrant::import(directory.as_deref(), env, warnings)?,
+        ));
+    }
+
+    Ok(hosts)
+}
+
+/// Records the generator the hosts come from.
+fn from_source(source: &str, mut hosts: Vec<GeneratedHost>) -> Vec<GeneratedHost> {
+    for host in &mut hosts {
+        host.source = source.to_string();
+    }
+
+    hosts
+}
+
+/// Appends host blocks at the end of a configuration file, creating it if needed.
+///
+/// # Errors
+///
+/// Will return `Err` if the file cannot be read or written.
+pub fn append_to_config(path: &str, hosts: &[GeneratedHost]) -> Result<()> {
+    let path = shellexpand::tilde(path).to_string();
+
+    let existing = match std::fs::read_to_string(&path) {
+        Ok(content) => content,
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => String::new(),
+        Err(err) => return Err(err.into()),
+    };
+
+    if let Some(parent) = std::path::Path::new(&path).parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+
+    let mut file = std::fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)?;
+
+    if !existing.is_empty() {
+        if !existing.ends_with('\n') {
+            writeln!(file)?;
+        }
+        writeln!(file)?;
+    }
+
+    for (i, host) in hosts.iter().enumerate() {
+        if i > 0 {
+            writeln!(file)?;
+        }
+
+        write!(file, "{host}")?;
+    }
+
+    log::info!(path = path.as_str(), hosts = hosts.len(); "Appended hosts to configuration file");
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_write_formats() {
+        let mut host = GeneratedHost::new("nas");
+        host.source = "tailscale".to_string();
+        host.push_metadata("tags", "server, backup");
+        host.push(EntryType::Hostname, "nas.tail1234.ts.net");
+        host.push(EntryType::IdentityFile, "~/.ssh/a");
+        host.push(EntryType::IdentityFile, "~/.ssh/b");
+
+        let mut json = Vec::new();
+        write_hosts(&mut json, &[host.clone()], Format::Json).unwrap();
+        let json: serde_json::Value = serde_json::from_slice(&json).unwrap();
+        assert_eq!(
+            json,
+            serde_json::json!([{
+                "name": "nas",
+                "source": "tailscale",
+                "tags": ["server", "backup"],
+                "options": {
+                    "Hostname": "nas.tail1234.ts.net",
+                    "IdentityFile": ["~/.ssh/a", "~/.ssh/b"],
+                },
+                "metadata": {},
+            }])
+        );
+
+        let mut yaml = Vec::new();
+        write_hosts(&mut yaml, &[host], Format::Yaml).unwrap();
+        assert_eq!(
+            String::from_utf8(yaml).unwrap(),
+            "- name: \"nas\"\n  source: \"tailscale\"\n  tags: [\"server\",\"backup\"]\n  options:\n    Hostname: \"nas.tail1234.ts.net\"\n    IdentityFile: [\"~/.ssh/a\",\"~/.ssh/b\"]\n  metadata: {}\n"
+        );
+    }
+}
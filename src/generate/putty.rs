@@ -0,0 +1,249 @@
+use anyhow::Result;
+use std::collections::HashMap;
+use std::path::Path;
+
+use super::GeneratedHost;
+use crate::ssh_config::EntryType;
+
+const DEFAULT_SESSIONS_DIRECTORY: &str = "~/.putty/sessions";
+const REGISTRY_SESSIONS_KEY: &str = r"HKCU\Software\SimonTatham\PuTTY\Sessions";
+
+type Session = HashMap<String, String>;
+
+/// Imports the PuTTY saved sessions.
+///
+/// Sessions are read from the Windows registry on Windows and from the session files
+/// in `~/.putty/sessions` (or `sessions_directory`) everywhere else. The keys OpenSSH cannot
+/// read are left out, with a warning telling how to convert them.
+///
+/// # Errors
+///
+/// Will return `Err` if the sessions cannot be read.
+pub fn import(
+    sessions_directory: Option<&str>,
+    warnings: &mut Vec<String>,
+) -> Result<Vec<GeneratedHost>> {
+    let sessions = if cfg!(windows) && sessions_directory.is_none() {
+        read_registry_sessions()?
+    } else {
+        let directory =
+            shellexpand::tilde(sessions_directory.unwrap_or(DEFAULT_SESSIONS_DIRECTORY))
+                .to_string();
+        read_sessions_directory(Path::new(&directory))?
+    };
+
+    Ok(sessions
+        .iter()
+        .filter_map(|(name, session)| session_to_host(name, session, warnings))
+        .collect())
+}
+
+fn read_sessions_directory(directory: &Path) -> Result<Vec<(String, Session)>> {
+    let mut sessions = Vec::new();
+
+    for entry in std::fs::read_dir(directory)? {
+        let entry = entry?;
+        if !entry.file_type()?.is_file() {
+            continue;
+        }
+
+        let content = std::fs::read_to_string(entry.path())?;
+        let session = content
+            .lines()
+            .filter_map(|line| line.split_once('='))
+            .map(|(key, value)| (key.to_string(), value.to_string()))
+            .collect();
+
+        sessions.push((
+            decode_session_name(&entry.file_name().to_string_lossy()),
+            session,
+        ));
+    }
+
+    sessions.sort_by(|a, b| a.0.cmp(&b.0));
+    Ok(sessions)
+}
+
+fn read_registry_sessions() -> Result<Vec<(String, Session)>> {
+    let output = std::process::Command::new("reg")
+        .args(["query", REGISTRY_SESSIONS_KEY, "/s"])
+        .output()?;
+    if !output.status.success() {
+        anyhow::bail!("Failed to query the PuTTY sessions from the registry");
+    }
+
+    Ok(parse_registry_output(&String::from_utf8_lossy(
+        &output.stdout,
+    )))
+}
+
+/// Parses the output of `reg query <key> /s`.
+fn parse_registry_output(output: &str) -> Vec<(String, Session)> {
+    let mut sessions: Vec<(String, Session)> = Vec::new();
+
+    for line in output.lines() {
+        if line.starts_with("HKEY_") {
+            if let Some((_, name)) = line.rsplit_once('\\') {
+                sessions.push((decode_session_name(name), Session::new()));
+            }
+            continue;
+        }
+
+        let Some((_, session)) = sessions.last_mut() else {
+            continue;
+        };
+
+        let mut parts = line.trim().splitn(3, "    ");
+        let (Some(key), Some(kind), value) = (parts.next(), parts.next(), parts.next()) else {
+            continue;
+        };
+
+        let value = value.unwrap_or_default().trim();
+        let value = if kind == "REG_DWORD" {
+            u32::from_str_radix(value.trim_start_matches("0x"), 16)
+                .map(|v| v.to_string())
+                .unwrap_or_default()
+        } else {
+            value.to_string()
+        };
+
+        session.insert(key.to_string(), value);
+    }
+
+    sessions
+}
+
+/// PuTTY percent-encodes the characters that can't be used in file names or registry keys.
+fn decode_session_name(name: &str) -> String {
+    let mut bytes = Vec::new();
+
+    let mut chars = name.bytes();
+    while let Some(c) = chars.next() {
+        if c == b'%' {
+            let hex = [chars.next(), chars.next()];
+            if let [Some(a), Some(b)] = hex {
+                if let Ok(decoded) = u8::from_str_radix(&format!("{}{}", a as char, b as char), 16)
+                {
+                    bytes.push(decoded);
+                    continue;
+                }
+            }
+        }
+
+        bytes.push(c);
+    }
+
+    String::from_utf8_lossy(&bytes).to_string()
+}
+
+fn session_to_host(
+    name: &str,
+    session: &Session,
+    warnings: &mut Vec<String>,
+) -> Option<GeneratedHost> {
+    let get = |key: &str| session.get(key).map(String::as_str).unwrap_or_default();
+
+    if name == "Default Settings" || get("Protocol") != "ssh" {
+        return None;
+    }
+
+    let (user, hostname) = match get("HostName").split_once('@') {
+        Some((user, hostname)) => (user, hostname),
+        None => (get("UserName"), get("HostName")),
+    };
+    if hostname.is_empty() {
+        return None;
+    }
+
+    let mut host = GeneratedHost::new(name);
+    host.push(EntryType::Hostname, hostname);
+    host.push(EntryType::User, user);
+
+    let port = get("PortNumber");
+    if port != "22" {
+        host.push(EntryType::Port, port);
+    }
+
+    let key = get("PublicKeyFile");
+    if std::path::Path::new(key)
+        .extension()
+        .is_some_and(|extension| extension.eq_ignore_ascii_case("ppk"))
+    {
+        // OpenSSH cannot read the keys of PuTTY
+        let converted = std::path::Path::new(key).with_extension("");
+        warnings.push(format!(
+            "{name}: {key} is a PuTTY key, convert it with `puttygen \"{key}\" -O private-openssh -o \"{}\"` and add it as IdentityFile",
+            converted.display()
+        ));
+    } else {
+        host.push(EntryType::IdentityFile, key);
+    }
+
+    let proxy_host = get("ProxyHost");
+    let proxy_target = format!("{proxy_host}:{}", get("ProxyPort"));
+    match get("ProxyMethod") {
+        "1" => host.push(
+            EntryType::ProxyCommand,
+            &format!("nc -X 4 -x {proxy_target} %h %p"),
+        ),
+        "2" => host.push(
+            EntryType::ProxyCommand,
+            &format!("nc -X 5 -x {proxy_target} %h %p"),
+        ),
+        "3" => host.push(
+            EntryType::ProxyCommand,
+            &format!("nc -X connect -x {proxy_target} %h %p"),
+        ),
+        "5" => host.push(
+            EntryType::ProxyCommand,
+            &get("ProxyTelnetCommand")
+                .replace("%host", "%h")
+                .replace("%port", "%p"),
+        ),
+        "6" => {
+            let proxy_user = get("ProxyUsername");
+            if proxy_user.is_empty() {
+                host.push(EntryType::ProxyJump, &proxy_target);
+            } else {
+                host.push(
+                    EntryType::ProxyJump,
+                    &format!("{proxy_user}@{proxy_target}"),
+                );
+            }
+        }
+        _ => {}
+    }
+
+    Some(host)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_session_to_host() {
+        let session = Session::from([
+            ("Protocol".to_string(), "ssh".to_string()),
+            ("HostName".to_string(), "root@example.com".to_string()),
+            ("PortNumber".to_string(), "2222".to_string()),
+            ("ProxyMethod".to_string(), "2".to_string()),
+            ("ProxyHost".to_string(), "proxy.example.com".to_string()),
+            ("ProxyPort".to_string(), "1080".to_string()),
+            (
+                "PublicKeyFile".to_string(),
+                "C:\\Keys\\server.PPK".to_string(),
+            ),
+        ]);
+
+        let mut warnings = Vec::new();
+        let host =
+            session_to_host(&decode_session_name("My%20Server"), &session, &mut warnings).unwrap();
+
+        assert_eq!(
+            host.to_string(),
+            "Host \"My Server\"\n  Hostname example.com\n  User root\n  Port 2222\n  ProxyCommand nc -X 5 -x proxy.example.com:1080 %h %p\n"
+        );
+        assert_eq!(warnings.len(), 1);
+    }
+}
@@ -0,0 +1,80 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::process::{Command, Stdio};
+
+use super::{Env, GeneratedHost};
+use crate::ssh_config::EntryType;
+
+#[derive(Debug, Deserialize)]
+struct Node {
+    spec: NodeSpec,
+}
+
+#[derive(Debug, Deserialize)]
+struct NodeSpec {
+    hostname: String,
+}
+
+/// Imports the nodes of a Teleport cluster with `tsh ls`, the current cluster of `tsh`
+/// without one. sshs connects to them with `tsh ssh`.
+///
+/// # Errors
+///
+/// Will return `Err` if `tsh` cannot be run, fails or prints something else than nodes.
+pub fn import(cluster: Option<&str>, env: &Env) -> Result<Vec<GeneratedHost>> {
+    let mut command = Command::new("tsh");
+    command.envs(env);
+    command.args(["ls", "--format=json"]);
+    if let Some(cluster) = cluster {
+        command.arg(format!("--cluster={cluster}"));
+    }
+
+    let output = command
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run tsh: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "tsh failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    let nodes: Vec<Node> = serde_json::from_slice(&output.stdout)?;
+    Ok(nodes
+        .iter()
+        .map(|node| node_to_host(node, cluster))
+        .collect())
+}
+
+fn node_to_host(node: &Node, cluster: Option<&str>) -> GeneratedHost {
+    let mut host = GeneratedHost::new(&node.spec.hostname);
+    host.push(EntryType::Hostname, &node.spec.hostname);
+    host.push_metadata("teleport", cluster.unwrap_or("yes"));
+
+    host
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_node_to_host() {
+        let nodes: Vec<Node> = serde_json::from_str(
+            r#"[{"kind": "node", "version": "v2",
+                 "metadata": {"name": "5c9d2f6e", "labels": {"env": "prod"}},
+                 "spec": {"addr": "", "hostname": "web-1"}}]"#,
+        )
+        .unwrap();
+
+        assert_eq!(
+            node_to_host(&nodes[0], None).to_string(),
+            "Host web-1\n  # sshs-teleport: yes\n  Hostname web-1\n"
+        );
+        assert_eq!(
+            node_to_host(&nodes[0], Some("prod")).to_string(),
+            "Host web-1\n  # sshs-teleport: prod\n  Hostname web-1\n"
+        );
+    }
+}
@@ -0,0 +1,185 @@
+use anyhow::Result;
+use serde_json::{Map, Value};
+use std::path::Path;
+
+use super::GeneratedHost;
+use crate::ssh_config::EntryType;
+
+const NAME_KEYS: &[&str] = &["label", "alias", "name"];
+const HOSTNAME_KEYS: &[&str] = &["address", "hostname", "host", "ip"];
+const PORT_KEYS: &[&str] = &["port"];
+const USER_KEYS: &[&str] = &["username", "user"];
+const IDENTITY_FILE_KEYS: &[&str] = &["identity_file", "identityfile", "key"];
+
+/// Imports hosts from a Termius export or from any JSON or CSV file using a similar schema.
+///
+/// JSON files can either contain an array of hosts or an object with a `hosts` array.
+/// CSV files must have a header row naming the columns.
+///
+/// # Errors
+///
+/// Will return `Err` if the file cannot be read or parsed.
+pub fn import(path: &str) -> Result<Vec<GeneratedHost>> {
+    let path = shellexpand::tilde(path).to_string();
+    let content = std::fs::read_to_string(&path)?;
+
+    let records = if Path::new(&path)
+        .extension()
+        .is_some_and(|ext| ext.eq_ignore_ascii_case("csv"))
+    {
+        parse_csv(&content)
+    } else {
+        parse_json(&content)?
+    };
+
+    Ok(records.iter().filter_map(record_to_host).collect())
+}
+
+fn parse_json(content: &str) -> Result<Vec<Map<String, Value>>> {
+    let hosts = match serde_json::from_str(content)? {
+        Value::Array(hosts) => hosts,
+        Value::Object(mut root) => match root.remove("hosts") {
+            Some(Value::Array(hosts)) => hosts,
+            _ => anyhow::bail!("Expected a `hosts` array at the root of the JSON file"),
+        },
+        _ => anyhow::bail!("Expected an array of hosts or an object with a `hosts` array"),
+    };
+
+    Ok(hosts
+        .into_iter()
+        .filter_map(|host| match host {
+            Value::Object(host) => Some(host),
+            _ => None,
+        })
+        .collect())
+}
+
+fn parse_csv(content: &str) -> Vec<Map<String, Value>> {
+    let mut lines = content.lines().filter(|line| !line.trim().is_empty());
+    let Some(header) = lines.next() else {
+        return Vec::new();
+    };
+    let columns = split_csv_line(header);
+
+    lines
+        .map(|line| {
+            columns
+                .iter()
+                .zip(split_csv_line(line))
+                .map(|(column, value)| (column.to_lowercase(), Value::String(value)))
+                .collect()
+        })
+        .collect()
+}
+
+fn split_csv_line(line: &str) -> Vec<String> {
+    let mut fields = Vec::new();
+    let mut field = String::new();
+    let mut in_quotes = false;
+
+    let mut chars = line.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '"' if in_quotes && chars.peek() == Some(&'"') => {
+                field.push('"');
+                chars.next();
+            }
+            '"' => in_quotes = !in_quotes,
+            ',' if !in_quotes => fields.push(std::mem::take(&mut field).trim().to_string()),
+            _ => field.push(c),
+        }
+    }
+    fields.push(field.trim().to_string());
+
+    fields
+}
+
+/// Looks for the first non-empty value of the keys, in their order, then inside the nested
+/// `ssh_config` and `identity` objects used by Termius.
+fn find(record: &Map<String, Value>, keys: &[&str]) -> Option<String> {
+    let get = |wanted: &str| {
+        record
+            .iter()
+            .find(|(key, _)| key.eq_ignore_ascii_case(wanted))
+            .map(|(_, value)| value)
+    };
+
+    keys.iter()
+        .find_map(|&key| match get(key)? {
+            Value::String(s) if !s.is_empty() => Some(s.clone()),
+            Value::Number(n) => Some(n.to_string()),
+            _ => None,
+        })
+        .or_else(|| {
+            ["ssh_config", "identity"]
+                .iter()
+                .find_map(|&nested| match get(nested)? {
+                    Value::Object(nested) => find(nested, keys),
+                    _ => None,
+                })
+        })
+}
+
+fn record_to_host(record: &Map<String, Value>) -> Option<GeneratedHost> {
+    let hostname = find(record, HOSTNAME_KEYS)?;
+    let name = find(record, NAME_KEYS).unwrap_or_else(|| hostname.clone());
+
+    let mut host = GeneratedHost::new(&name);
+    host.push(EntryType::Hostname, &hostname);
+    host.push(
+        EntryType::User,
+        &find(record, USER_KEYS).unwrap_or_default(),
+    );
+    host.push(
+        EntryType::Port,
+        &find(record, PORT_KEYS).unwrap_or_default(),
+    );
+    host.push(
+        EntryType::IdentityFile,
+        &find(record, IDENTITY_FILE_KEYS).unwrap_or_default(),
+    );
+
+    Some(host)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_import_formats() {
+        let json = r#"{"hosts": [{"label": "web", "address": "10.0.0.1", "ssh_config": {"port": 2222, "identity": {"username": "bob"}}}]}"#;
+        let hosts = parse_json(json)
+            .unwrap()
+            .iter()
+            .filter_map(record_to_host)
+            .collect::<Vec<_>>();
+        assert_eq!(
+            hosts[0].to_string(),
+            "Host web\n  Hostname 10.0.0.1\n  User bob\n  Port 2222\n"
+        );
+
+        let csv = "Name,Hostname,User\n\"db, primary\",10.0.0.2,alice\n";
+        let hosts = parse_csv(csv)
+            .iter()
+            .filter_map(record_to_host)
+            .collect::<Vec<_>>();
+        assert_eq!(
+            hosts[0].to_string(),
+            "Host \"db, primary\"\n  Hostname 10.0.0.2\n  User alice\n"
+        );
+
+        // The keys are looked for in their order, not in the one of the file
+        let json =
+            r#"[{"host": "web", "hostname": "web.internal", "user": "root", "username": "bob"}]"#;
+        let hosts = parse_json(json)
+            .unwrap()
+            .iter()
+            .filter_map(record_to_host)
+            .collect::<Vec<_>>();
+        assert_eq!(
+            hosts[0].to_string(),
+            "Host web.internal\n  Hostname web.internal\n  User bob\n"
+        );
+    }
+}
@@ -0,0 +1,142 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::collections::{BTreeMap, BTreeSet};
+use std::path::Path;
+use std::process::{Command, Stdio};
+use std::str::FromStr;
+
+use super::{Env, GeneratedHost};
+use crate::ssh_config::EntryType;
+
+/// Index of the machines Vagrant created, whatever their project.
+const MACHINE_INDEX: &str = "~/.vagrant.d/data/machine-index/index";
+
+#[derive(Debug, Deserialize)]
+struct MachineIndex {
+    #[serde(default)]
+    machines: BTreeMap<String, IndexedMachine>,
+}
+
+#[derive(Debug, Deserialize)]
+struct IndexedMachine {
+    state: String,
+    vagrantfile_path: String,
+}
+
+/// Imports the running machines of a Vagrant project with `vagrant ssh-config`, or of every
+/// project of the machine index without a directory.
+///
+/// The machines are named after the directory of their project, followed by their name for
+/// the projects defining several machines. The projects of the index that cannot be read are
+/// left out with a warning.
+///
+/// # Errors
+///
+/// Will return `Err` if the machine index cannot be read, or if `vagrant` cannot be run or
+/// fails for the directory given.
+pub fn import(
+    directory: Option<&str>,
+    env: &Env,
+    warnings: &mut Vec<String>,
+) -> Result<Vec<GeneratedHost>> {
+    if let Some(directory) = directory {
+        let directory = shellexpand::tilde(directory).to_string();
+        return Ok(parse_ssh_config(&ssh_config(&directory, env)?, &directory));
+    }
+
+    let path = shellexpand::tilde(MACHINE_INDEX).to_string();
+    let content = std::fs::read_to_string(&path).map_err(|err| {
+        anyhow::anyhow!(
+            "Failed to read {path}: {err}, give the directory of a project with --vagrant=DIR"
+        )
+    })?;
+    let index: MachineIndex = serde_json::from_str(&content)?;
+    let directories = index
+        .machines
+        .values()
+        .filter(|machine| machine.state == "running")
+        .map(|machine| machine.vagrantfile_path.as_str())
+        .collect::<BTreeSet<_>>();
+
+    let mut hosts = Vec::new();
+    for directory in directories {
+        // A project that cannot be read anymore should not prevent importing the others
+        match ssh_config(directory, env) {
+            Ok(config) => hosts.extend(parse_ssh_config(&config, directory)),
+            Err(err) => warnings.push(format!("{directory}: {err}")),
+        }
+    }
+
+    Ok(hosts)
+}
+
+fn ssh_config(directory: &str, env: &Env) -> Result<String> {
+    let output = Command::new("vagrant")
+        .arg("ssh-config")
+        .envs(env)
+        .current_dir(directory)
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run vagrant: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "vagrant ssh-config failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout).to_string())
+}
+
+fn parse_ssh_config(content: &str, directory: &str) -> Vec<GeneratedHost> {
+    let project = Path::new(directory)
+        .file_name()
+        .map_or("vagrant".to_string(), |name| {
+            name.to_string_lossy().to_string()
+        });
+
+    let mut hosts: Vec<GeneratedHost> = Vec::new();
+    for line in content.lines() {
+        let Some((keyword, value)) = line.trim().split_once(char::is_whitespace) else {
+            continue;
+        };
+        let value = value.trim();
+
+        if keyword.eq_ignore_ascii_case("host") {
+            hosts.push(GeneratedHost::new(value));
+        } else if let (Some(host), Ok(entry)) = (hosts.last_mut(), EntryType::from_str(keyword)) {
+            host.push(entry, value);
+        }
+    }
+
+    let single = hosts.len() == 1;
+    for host in &mut hosts {
+        host.name = if single {
+            project.clone()
+        } else {
+            format!("{project}-{}", host.name)
+        };
+    }
+
+    hosts
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_ssh_config() {
+        let config = "Host default\n  HostName 127.0.0.1\n  User vagrant\n  Port 2222\n  IdentityFile \"/home/me/my app/.vagrant/machines/default/virtualbox/private_key\"\n  LogLevel FATAL\n\n";
+
+        assert_eq!(
+            parse_ssh_config(config, "/home/me/my app")[0].to_string(),
+            "Host \"my app\"\n  Hostname 127.0.0.1\n  User vagrant\n  Port 2222\n  IdentityFile \"/home/me/my app/.vagrant/machines/default/virtualbox/private_key\"\n  LogLevel FATAL\n"
+        );
+
+        let config = "Host web\n  HostName 127.0.0.1\n  Port 2222\nHost db\n  HostName 127.0.0.1\n  Port 2200\n";
+        let hosts = parse_ssh_config(config, "/srv/shop");
+        assert_eq!(hosts[0].name, "shop-web");
+        assert_eq!(hosts[1].name, "shop-db");
+    }
+}
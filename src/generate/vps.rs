@@ -0,0 +1,370 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+use super::{Env, GeneratedHost};
+use crate::ssh_config::EntryType;
+
+/// Hosting providers whose servers can be listed with an API token.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Provider {
+    Hetzner,
+    DigitalOcean,
+    Vultr,
+}
+
+impl Provider {
+    #[must_use]
+    pub fn name(self) -> &'static str {
+        match self {
+            Provider::Hetzner => "hetzner",
+            Provider::DigitalOcean => "digitalocean",
+            Provider::Vultr => "vultr",
+        }
+    }
+
+    /// Environment variable of the token, the one read by the CLI of the provider.
+    fn token_variable(self) -> &'static str {
+        match self {
+            Provider::Hetzner => "HCLOUD_TOKEN",
+            Provider::DigitalOcean => "DIGITALOCEAN_TOKEN",
+            Provider::Vultr => "VULTR_API_KEY",
+        }
+    }
+
+    fn first_page(self) -> &'static str {
+        match self {
+            Provider::Hetzner => "https://api.hetzner.cloud/v1/servers?per_page=50",
+            Provider::DigitalOcean => "https://api.digitalocean.com/v2/droplets?per_page=200",
+            Provider::Vultr => "https://api.vultr.com/v2/instances?per_page=100",
+        }
+    }
+}
+
+/// A server of any of the providers, with the address it is reached at.
+struct Server {
+    name: String,
+    address: Option<String>,
+    labels: Vec<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct HetznerPage {
+    servers: Vec<HetznerServer>,
+    meta: HetznerMeta,
+}
+
+#[derive(Debug, Deserialize)]
+struct HetznerServer {
+    name: String,
+    public_net: HetznerPublicNet,
+    #[serde(default)]
+    private_net: Vec<HetznerAddress>,
+    #[serde(default)]
+    labels: BTreeMap<String, String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct HetznerPublicNet {
+    ipv4: Option<HetznerAddress>,
+}
+
+#[derive(Debug, Deserialize)]
+struct HetznerAddress {
+    ip: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct HetznerMeta {
+    pagination: HetznerPagination,
+}
+
+#[derive(Debug, Deserialize)]
+struct HetznerPagination {
+    next_page: Option<u64>,
+}
+
+#[derive(Debug, Deserialize)]
+struct DigitalOceanPage {
+    droplets: Vec<Droplet>,
+    #[serde(default)]
+    links: DigitalOceanLinks,
+}
+
+#[derive(Debug, Deserialize)]
+struct Droplet {
+    name: String,
+    networks: DropletNetworks,
+    #[serde(default)]
+    tags: Vec<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct DropletNetworks {
+    #[serde(default)]
+    v4: Vec<DropletAddress>,
+}
+
+#[derive(Debug, Deserialize)]
+struct DropletAddress {
+    ip_address: String,
+    #[serde(rename = "type")]
+    kind: String,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct DigitalOceanLinks {
+    #[serde(default)]
+    pages: DigitalOceanPages,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct DigitalOceanPages {
+    next: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct VultrPage {
+    instances: Vec<VultrInstance>,
+    meta: VultrMeta,
+}
+
+#[derive(Debug, Deserialize)]
+struct VultrInstance {
+    #[serde(default)]
+    label: String,
+    #[serde(default)]
+    hostname: String,
+    main_ip: String,
+    #[serde(default)]
+    tags: Vec<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct VultrMeta {
+    links: VultrLinks,
+}
+
+#[derive(Debug, Deserialize)]
+struct VultrLinks {
+    /// Cursor of the next page, empty on the last one.
+    next: String,
+}
+
+/// Imports the servers of an account of the provider, the token being read from its usual
+/// environment variable, in `env` first. The labels or tags of the servers become their sshs tags.
+///
+/// # Errors
+///
+/// Will return `Err` if the token is not set, or if the API cannot be reached or answers with
+/// something else than servers.
+pub fn import(provider: Provider, env: &Env) -> Result<Vec<GeneratedHost>> {
+    let variable = provider.token_variable();
+    let Some(token) = env
+        .get(variable)
+        .cloned()
+        .or_else(|| std::env::var(variable).ok())
+        .filter(|token| !token.is_empty())
+    else {
+        anyhow::bail!("Set {variable} to the API token of the account to import");
+    };
+
+    let mut servers = Vec::new();
+    let mut next = Some(provider.first_page().to_string());
+    while let Some(url) = next {
+        let page = fetch(&url, &token, env)?;
+        next = parse_page(provider, &page, &mut servers)?;
+    }
+
+    Ok(servers.iter().map(server_to_host).collect())
+}
+
+/// Reads a page of servers, returning the URL of the next page.
+fn parse_page(provider: Provider, page: &str, servers: &mut Vec<Server>) -> Result<Option<String>> {
+    let first_page = provider.first_page();
+
+    Ok(match provider {
+        Provider::Hetzner => {
+            let page: HetznerPage = serde_json::from_str(page)?;
+            servers.extend(page.servers.into_iter().map(|server| {
+                Server {
+                    name: server.name,
+                    address: server
+                        .public_net
+                        .ipv4
+                        .or(server.private_net.into_iter().next())
+                        .map(|address| address.ip),
+                    labels: server
+                        .labels
+                        .into_iter()
+                        .map(|(key, value)| {
+                            if value.is_empty() {
+                                key
+                            } else {
+                                format!("{key}={value}")
+                            }
+                        })
+                        .collect(),
+                }
+            }));
+            page.meta
+                .pagination
+                .next_page
+                .map(|next_page| format!("{first_page}&page={next_page}"))
+        }
+        Provider::DigitalOcean => {
+            let page: DigitalOceanPage = serde_json::from_str(page)?;
+            servers.extend(page.droplets.into_iter().map(|droplet| {
+                let address = |kind: &str| {
+                    droplet
+                        .networks
+                        .v4
+                        .iter()
+                        .find(|address| address.kind == kind)
+                        .map(|address| address.ip_address.clone())
+                };
+                Server {
+                    address: address("public").or_else(|| address("private")),
+                    name: droplet.name,
+                    labels: droplet.tags,
+                }
+            }));
+            page.links.pages.next
+        }
+        Provider::Vultr => {
+            let page: VultrPage = serde_json::from_str(page)?;
+            servers.extend(page.instances.into_iter().map(|instance| Server {
+                name: if instance.label.is_empty() {
+                    instance.hostname
+                } else {
+                    instance.label
+                },
+                // Instances still being deployed have no address yet
+                address: Some(instance.main_ip).filter(|ip| ip != "0.0.0.0"),
+                labels: instance.tags,
+            }));
+            Some(page.meta.links.next)
+                .filter(|cursor| !cursor.is_empty())
+                .map(|cursor| format!("{first_page}&cursor={}", encode_query_value(&cursor)))
+        }
+    })
+}
+
+/// Percent-encodes a value of the query string of a URL, the cursors of Vultr being base64.
+fn encode_query_value(value: &str) -> String {
+    value
+        .bytes()
+        .map(|byte| {
+            if byte.is_ascii_alphanumeric() || matches!(byte, b'-' | b'_' | b'.' | b'~') {
+                (byte as char).to_string()
+            } else {
+                format!("%{byte:02X}")
+            }
+        })
+        .collect()
+}
+
+/// Calls the API with `curl`, the token being given on its standard input so that it does not
+/// show in the list of processes.
+fn fetch(url: &str, token: &str, env: &Env) -> Result<String> {
+    log::debug!(url = url; "Fetching servers");
+    let mut child = Command::new("curl")
+        .args(["--fail", "--silent", "--show-error", "--header", "@-"])
+        .arg(url)
+        .envs(env)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .map_err(|err| anyhow::anyhow!("Failed to run curl: {err}"))?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        writeln!(stdin, "Authorization: Bearer {token}")?;
+    }
+    let output = child.wait_with_output()?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to fetch {url}: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout).to_string())
+}
+
+fn server_to_host(server: &Server) -> GeneratedHost {
+    let mut host = GeneratedHost::new(&server.name);
+    host.push_metadata("tags", &server.labels.join(", "));
+    host.push(
+        EntryType::Hostname,
+        server.address.as_deref().unwrap_or(&server.name),
+    );
+
+    host
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_pages() {
+        let mut servers = Vec::new();
+        let next = parse_page(
+            Provider::Hetzner,
+            r#"{"servers": [{"name": "nas", "public_net": {"ipv4": {"ip": "49.12.0.1"}},
+                "labels": {"env": "home", "backup": ""}}],
+                "meta": {"pagination": {"next_page": 2}}}"#,
+            &mut servers,
+        )
+        .unwrap();
+        assert_eq!(
+            next.as_deref(),
+            Some("https://api.hetzner.cloud/v1/servers?per_page=50&page=2")
+        );
+
+        let next = parse_page(
+            Provider::DigitalOcean,
+            r#"{"droplets": [{"name": "vpn", "tags": ["edge"], "networks": {"v4": [
+                {"ip_address": "10.110.0.2", "type": "private"},
+                {"ip_address": "164.90.0.1", "type": "public"}]}}], "links": {}}"#,
+            &mut servers,
+        )
+        .unwrap();
+        assert_eq!(next, None);
+
+        let next = parse_page(
+            Provider::Vultr,
+            r#"{"instances": [], "meta": {"links": {"next": "bmV4dF9fMQ=="}}}"#,
+            &mut servers,
+        )
+        .unwrap();
+        assert_eq!(
+            next.as_deref(),
+            Some("https://api.vultr.com/v2/instances?per_page=100&cursor=bmV4dF9fMQ%3D%3D")
+        );
+
+        let next = parse_page(
+            Provider::Vultr,
+            r#"{"instances": [{"label": "", "hostname": "mail", "main_ip": "0.0.0.0", "tags": []}],
+                "meta": {"links": {"next": ""}}}"#,
+            &mut servers,
+        )
+        .unwrap();
+        assert_eq!(next, None);
+
+        assert_eq!(
+            servers
+                .iter()
+                .map(|server| server_to_host(server).to_string())
+                .collect::<Vec<_>>(),
+            [
+                "Host nas\n  # sshs-tags: backup, env=home\n  Hostname 49.12.0.1\n",
+                "Host vpn\n  # sshs-tags: edge\n  Hostname 164.90.0.1\n",
+                "Host mail\n  Hostname mail\n",
+            ]
+        );
+    }
+}
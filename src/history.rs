@@ -0,0 +1,203 @@
+use anyhow::Result;
+use itertools::Itertools;
+use serde::{Deserialize, Serialize};
+use std::io::{BufRead, BufReader, Write};
+use std::path::PathBuf;
+use std::time::Duration;
+
+use crate::clock;
+use crate::scheduler::parse_duration;
+use crate::ssh;
+use crate::state;
+
+/// A connection made from sshs, stored one JSON object per line in the history file.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Record {
+    /// Seconds since the Unix epoch.
+    pub timestamp: u64,
+    /// Local account that connected.
+    pub local_user: String,
+    pub host: String,
+    pub user: Option<String>,
+    pub hostname: String,
+    pub port: Option<String>,
+    /// Ticket or change reference given with `--ticket` or `SSHS_TICKET`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ticket: Option<String>,
+}
+
+impl Record {
+    #[must_use]
+    pub fn new(host: &ssh::Host, ticket: Option<&str>) -> Record {
+        Record {
+            timestamp: state::now(),
+            local_user: ssh::local_user(),
+            host: host.name.clone(),
+            user: host.user.clone(),
+            hostname: host.destination.clone(),
+            port: host.port.clone(),
+            ticket: ticket.map(ToString::to_string),
+        }
+    }
+}
+
+fn path() -> PathBuf {
+    state::state_dir().join("history.jsonl")
+}
+
+/// Appends the record to the history file.
+///
+/// # Errors
+///
+/// Will return `Err` if the history file cannot be written.
+pub fn append(record: &Record) -> Result<()> {
+    let path = path();
+    if let Some(parent) = path.parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+
+    let mut file = std::fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)?;
+    writeln!(file, "{}", serde_json::to_string(record)?)?;
+
+    Ok(())
+}
+
+/// Reads the history file, skipping the lines that cannot be parsed.
+///
+/// # Errors
+///
+/// Will return `Err` if the history file exists but cannot be read.
+pub fn load() -> Result<Vec<Record>> {
+    let file = match std::fs::File::open(path()) {
+        Ok(file) => file,
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(err) => return Err(err.into()),
+    };
+
+    let mut records = Vec::new();
+    for line in BufReader::new(file).lines() {
+        match serde_json::from_str(&line?) {
+            Ok(record) => records.push(record),
+            Err(err) => log::warn!(error:% = err; "Skipping invalid history line"),
+        }
+    }
+
+    Ok(records)
+}
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    #[command(subcommand)]
+    command: HistoryCommand,
+}
+
+#[derive(clap::Subcommand, Debug)]
+enum HistoryCommand {
+    /// Export the connections made from sshs for auditing
+    Export(ExportArgs),
+}
+
+#[derive(clap::ValueEnum, Clone, Copy, Debug, PartialEq, Eq)]
+enum Format {
+    Csv,
+    Json,
+}
+
+#[derive(clap::Args, Debug)]
+struct ExportArgs {
+    /// Output format
+    #[arg(short, long, value_enum, default_value_t = Format::Csv)]
+    format: Format,
+
+    /// Only export the connections made within this duration (e.g. 30d, 12h)
+    #[arg(long, value_name = "DURATION", value_parser = parse_duration)]
+    since: Option<Duration>,
+}
+
+/// # Errors
+///
+/// Will return `Err` if the history cannot be read or stdout cannot be written.
+pub fn run(args: &Args) -> Result<()> {
+    match &args.command {
+        HistoryCommand::Export(export_args) => export(export_args),
+    }
+}
+
+fn export(args: &ExportArgs) -> Result<()> {
+    let since = args
+        .since
+        .map_or(0, |since| state::now().saturating_sub(since.as_secs()));
+    let records = load()?
+        .into_iter()
+        .filter(|record| record.timestamp >= since)
+        .collect::<Vec<_>>();
+
+    let mut stdout = std::io::stdout().lock();
+    match args.format {
+        Format::Json => {
+            serde_json::to_writer_pretty(&mut stdout, &records)?;
+            writeln!(stdout)?;
+        }
+        Format::Csv => {
+            writeln!(stdout, "time,local_user,host,user,hostname,port,ticket")?;
+            for record in &records {
+                let fields = [
+                    format_timestamp(record.timestamp),
+                    record.local_user.clone(),
+                    record.host.clone(),
+                    record.user.clone().unwrap_or_default(),
+                    record.hostname.clone(),
+                    record.port.clone().unwrap_or_default(),
+                    record.ticket.clone().unwrap_or_default(),
+                ];
+                writeln!(
+                    stdout,
+                    "{}",
+                    fields.iter().map(|field| csv_field(field)).join(",")
+                )?;
+            }
+        }
+    }
+
+    Ok(())
+}
+
+fn csv_field(value: &str) -> String {
+    if value.contains([',', '"', '\n', '\r']) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+/// Formats seconds since the Unix epoch as an RFC 3339 UTC date.
+fn format_timestamp(timestamp: u64) -> String {
+    let days = i64::try_from(timestamp / 86400).unwrap_or_default();
+    let seconds = timestamp % 86400;
+    let (year, month, day) = clock::civil_from_days(days);
+
+    format!(
+        "{year:04}-{month:02}-{day:02}T{:02}:{:02}:{:02}Z",
+        seconds / 3600,
+        seconds / 60 % 60,
+        seconds % 60
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_export_fields() {
+        assert_eq!(format_timestamp(0), "1970-01-01T00:00:00Z");
+        assert_eq!(format_timestamp(951_782_400), "2000-02-29T00:00:00Z");
+        assert_eq!(format_timestamp(1_718_454_645), "2024-06-15T12:30:45Z");
+
+        assert_eq!(csv_field("web1"), "web1");
+        assert_eq!(csv_field("CHG-1, \"urgent\""), "\"CHG-1, \"\"urgent\"\"\"");
+    }
+}
@@ -0,0 +1,254 @@
+use anyhow::anyhow;
+use serde::Deserialize;
+use std::process::Command;
+use std::time::Duration;
+
+use crate::secrets;
+use crate::settings::Settings;
+use crate::ssh;
+use crate::ssh_config::wildcard_match;
+use crate::state;
+
+/// A command run before connecting to the hosts or after disconnecting from them, with the
+/// `SSHS_*` variables of [`Session`] in its environment.
+///
+/// ```toml
+/// [[hooks]]
+/// when = "before"
+/// hosts = ["*.corp"]
+/// command = "vault ssh -role ops -mode ca %r@%h"
+///
+/// [[hooks]]
+/// when = "after"
+/// command = "sh -c 'curl -fsS -d \"$SSHS_HOST $SSHS_EXIT_STATUS\" https://hooks.example.com/ssh'"
+/// ```
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Hook {
+    #[serde(default)]
+    pub when: When,
+    /// Names of the hosts the hook runs for with `*` and `?` wildcards, all of them when
+    /// empty.
+    #[serde(default)]
+    pub hosts: Vec<String>,
+    /// Command run with the terminal released, `%h`, `%n`, `%p` and `%r` being replaced like
+    /// in the SSH configuration and `{{secret "REFERENCE"}}` with the secret.
+    pub command: String,
+}
+
+#[derive(Debug, Clone, Copy, Default, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum When {
+    /// Before connecting, a failing hook cancelling the connection.
+    #[default]
+    Before,
+    /// Once the connection is closed.
+    After,
+}
+
+impl When {
+    fn name(self) -> &'static str {
+        match self {
+            When::Before => "before",
+            When::After => "after",
+        }
+    }
+}
+
+impl Hook {
+    #[must_use]
+    pub fn applies_to(&self, host: &ssh::Host) -> bool {
+        self.hosts.is_empty()
+            || self
+                .hosts
+                .iter()
+                .any(|pattern| wildcard_match(pattern, &host.name))
+    }
+}
+
+/// The connection the hooks run around.
+pub struct Session<'a> {
+    pub host: &'a ssh::Host,
+    /// Command connecting to the host, quoted for a shell.
+    pub command: &'a str,
+    pub ticket: Option<&'a str>,
+    /// Exit code of the command, `None` when it was killed, and how long it ran, once it did.
+    pub outcome: Option<(Option<i32>, Duration)>,
+}
+
+impl Session<'_> {
+    /// Variables given to the hooks.
+    fn environment(&self, when: When) -> Vec<(&'static str, String)> {
+        let mut env = vec![
+            ("SSHS_HOOK", when.name().to_string()),
+            ("SSHS_HOST", self.host.name.clone()),
+            ("SSHS_DESTINATION", self.host.destination.clone()),
+            (
+                "SSHS_USER",
+                self.host.user.clone().unwrap_or_else(ssh::local_user),
+            ),
+            (
+                "SSHS_PORT",
+                self.host.port.clone().unwrap_or_else(|| "22".to_string()),
+            ),
+            ("SSHS_COMMAND", self.command.to_string()),
+        ];
+        if let Some(ticket) = self.ticket {
+            env.push(("SSHS_TICKET", ticket.to_string()));
+        }
+        if let Some((code, duration)) = self.outcome {
+            env.push(("SSHS_EXIT_STATUS", code.unwrap_or(-1).to_string()));
+            env.push(("SSHS_DURATION", duration.as_secs().to_string()));
+        }
+
+        env
+    }
+}
+
+/// Whether any of the hooks runs for the host at that moment.
+#[must_use]
+pub fn any(hooks: &[Hook], when: When, host: &ssh::Host) -> bool {
+    hooks
+        .iter()
+        .any(|hook| hook.when == when && hook.applies_to(host))
+}
+
+/// Runs the hooks of the host for that moment in their order, stopping at the first one
+/// failing.
+///
+/// # Errors
+///
+/// Will return `Err` if a hook cannot be parsed or run, or exits with a failure.
+pub fn run(hooks: &[Hook], when: When, session: &Session) -> anyhow::Result<()> {
+    let env = session.environment(when);
+    let mut secrets = None;
+
+    for hook in hooks
+        .iter()
+        .filter(|hook| hook.when == when && hook.applies_to(session.host))
+    {
+        let command = session.host.expand_tokens(&hook.command);
+        let secrets = secrets.get_or_insert_with(secrets::Registry::discover);
+        // Split first so that the values of the host stay within their argument
+        let args = session
+            .host
+            .expand_command(&hook.command)
+            .filter(|args| !args.is_empty())
+            .ok_or(anyhow!("Failed to parse hook command: {command}"))?
+            .iter()
+            .map(|arg| session.host.render_argument(arg, secrets))
+            .collect::<anyhow::Result<Vec<_>>>()?;
+        log::info!(host = session.host.name.as_str(), when = when.name(), command = command.as_str(); "Running hook");
+
+        let status = Command::new(&args[0])
+            .args(&args[1..])
+            .envs(env.iter().map(|(name, value)| (*name, value)))
+            .status()
+            .map_err(|err| anyhow!("Failed to run {command}: {err}"))?;
+        log::info!(status:% = status; "Hook exited");
+        if !status.success() {
+            anyhow::bail!("{command} failed ({status})");
+        }
+    }
+
+    Ok(())
+}
+
+#[derive(clap::Args, Debug)]
+pub struct AfterArgs {
+    /// Name of the host the session was opened on
+    host: String,
+
+    /// Command of the session
+    #[arg(long)]
+    command: String,
+
+    /// Ticket the session was opened for
+    #[arg(long)]
+    ticket: Option<String>,
+
+    /// When the session started, in seconds since the Unix epoch
+    #[arg(long)]
+    started: u64,
+
+    /// Exit status of the session
+    #[arg(long)]
+    status: i32,
+}
+
+/// Command of this sshs running the hooks once a session opened in a multiplexer ends, the
+/// pane giving it `--started` and `--status`.
+///
+/// # Errors
+///
+/// Will return `Err` if the path of this executable cannot be found.
+pub fn after_command(config_paths: &[String], session: &Session) -> anyhow::Result<Vec<String>> {
+    let mut command = vec![
+        std::env::current_exe()?.display().to_string(),
+        "after-hooks".to_string(),
+        session.host.name.clone(),
+        "--command".to_string(),
+        session.command.to_string(),
+    ];
+    if let Some(ticket) = session.ticket {
+        command.extend(["--ticket".to_string(), ticket.to_string()]);
+    }
+    for path in config_paths {
+        command.extend(["--config".to_string(), path.clone()]);
+    }
+
+    Ok(command)
+}
+
+/// Runs the hooks of a session opened in a multiplexer once it ends, from its pane.
+///
+/// # Errors
+///
+/// Will return `Err` if the host or the settings cannot be read, or if a hook fails.
+pub fn run_after(config_paths: &[String], args: &AfterArgs) -> anyhow::Result<()> {
+    let hosts = ssh::load_hosts(config_paths)?;
+    let Some(host) = hosts.iter().find(|host| host.name == args.host) else {
+        anyhow::bail!("No host named {}, not running its hooks", args.host);
+    };
+
+    let session = Session {
+        host,
+        command: &args.command,
+        ticket: args.ticket.as_deref(),
+        outcome: Some((
+            Some(args.status),
+            Duration::from_secs(state::now().saturating_sub(args.started)),
+        )),
+    };
+    run(&Settings::load()?.hooks, When::After, &session)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_hooks_of_host() {
+        let hosts = ssh::parse_text("Host db.corp\n  User admin\n  Port 2222\n");
+
+        let hooks = toml::from_str::<Settings>(
+            "[[hooks]]\nhosts = [\"*.corp\"]\ncommand = \"true\"\n[[hooks]]\nwhen = \"after\"\nhosts = [\"web*\"]\ncommand = \"false\"\n",
+        )
+        .unwrap()
+        .hooks;
+        assert!(any(&hooks, When::Before, &hosts[0]));
+        assert!(!any(&hooks, When::After, &hosts[0]));
+
+        let session = Session {
+            host: &hosts[0],
+            command: "ssh db.corp",
+            ticket: Some("CHG-1"),
+            outcome: None,
+        };
+        let env = session.environment(When::Before);
+        assert!(env.contains(&("SSHS_USER", "admin".to_string())));
+        assert!(env.contains(&("SSHS_PORT", "2222".to_string())));
+        assert!(env.contains(&("SSHS_TICKET", "CHG-1".to_string())));
+        assert!(!env.iter().any(|(name, _)| *name == "SSHS_EXIT_STATUS"));
+    }
+}
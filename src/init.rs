@@ -0,0 +1,199 @@
+use anyhow::Result;
+use std::path::{Path, PathBuf};
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    /// Move the content of the existing configuration file to config.d/migrated.conf
+    #[arg(long, default_value_t = false)]
+    migrate: bool,
+
+    /// Print the files without writing them
+    #[arg(long, default_value_t = false)]
+    dry_run: bool,
+}
+
+/// Directory of the included files, next to the configuration file.
+const INCLUDE_DIR: &str = "config.d";
+
+const EXAMPLE_ZONES: [(&str, &str); 2] = [
+    (
+        "work.conf.example",
+        "# Hosts of a zone, rename this file to work.conf to use it.
+#
+# Host web-1 web-2
+#     # sshs-tags: prod
+#     # sshs-owner: platform
+#     User deploy
+#
+# Host web-1
+#     HostName 10.0.1.11
+#
+# Host web-2
+#     HostName 10.0.1.12
+#
+# Host db
+#     HostName 10.0.2.20
+#     ProxyJump web-1
+",
+    ),
+    (
+        "personal.conf.example",
+        "# Hosts of a zone, rename this file to personal.conf to use it.
+#
+# Host homelab
+#     # sshs-note: Raspberry Pi under the desk
+#     HostName 192.168.1.50
+#     User pi
+#     IdentityFile ~/.ssh/id_ed25519
+",
+    ),
+];
+
+/// Writes a configuration file including the files of `config.d`, one per zone, team or
+/// project, with example zones and defaults for all the hosts.
+///
+/// # Errors
+///
+/// Will return `Err` if the configuration file already includes `config.d`, if it is not
+/// empty without `--migrate` or if the files cannot be written.
+pub fn run(config_paths: &[String], args: &Args) -> Result<()> {
+    let raw_path = config_paths
+        .last()
+        .ok_or(anyhow::anyhow!("No configuration file to initialize"))?;
+    let path = PathBuf::from(shellexpand::tilde(raw_path).to_string());
+    let dir = path.parent().unwrap_or(Path::new("."));
+
+    let existing = match std::fs::read_to_string(&path) {
+        Ok(content) => content,
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => String::new(),
+        Err(err) => return Err(err.into()),
+    };
+
+    // ssh resolves relative includes from ~/.ssh whatever the file, the directory is kept
+    // as given so that it is right for other configuration files too
+    let raw_dir = Path::new(raw_path)
+        .parent()
+        .map_or(PathBuf::from(INCLUDE_DIR), |parent| {
+            parent.join(INCLUDE_DIR)
+        });
+    let files = scaffold(&existing, &raw_dir.display().to_string(), args.migrate)?;
+
+    if !args.dry_run && !existing.is_empty() {
+        let migrated = dir.join(INCLUDE_DIR).join("migrated.conf");
+        if migrated.exists() {
+            anyhow::bail!("{} already exists", migrated.display());
+        }
+
+        let backup = path.with_file_name(format!(
+            "{}.sshs-backup",
+            path.file_name().unwrap_or_default().to_string_lossy()
+        ));
+        std::fs::write(&backup, &existing)?;
+        println!("Saved the previous configuration to {}", backup.display());
+    }
+
+    for (name, content) in &files {
+        let file_path = if *name == "config" {
+            path.clone()
+        } else {
+            dir.join(INCLUDE_DIR).join(name)
+        };
+
+        if args.dry_run {
+            println!("--- {}", file_path.display());
+            print!("{content}");
+            println!();
+            continue;
+        }
+
+        if file_path.exists() && *name != "config" {
+            println!("Kept {}, it already exists", file_path.display());
+            continue;
+        }
+        if let Some(parent) = file_path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        std::fs::write(&file_path, content)?;
+        log::info!(path:? = file_path; "Wrote configuration file");
+        println!("Wrote {}", file_path.display());
+    }
+
+    Ok(())
+}
+
+/// The files to write, by name in the directory of the included files or `config` for the
+/// configuration file itself.
+fn scaffold(
+    existing: &str,
+    include_dir: &str,
+    migrate: bool,
+) -> Result<Vec<(&'static str, String)>> {
+    if existing.lines().any(|line| {
+        let mut words = line.split_whitespace();
+        words
+            .next()
+            .is_some_and(|keyword| keyword.eq_ignore_ascii_case("include"))
+            && words.any(|pattern| pattern.contains(INCLUDE_DIR))
+    }) {
+        anyhow::bail!("The configuration already includes {INCLUDE_DIR}");
+    }
+    if !existing.trim().is_empty() && !migrate {
+        anyhow::bail!(
+            "The configuration file is not empty, use --migrate to move its hosts to {INCLUDE_DIR}/migrated.conf"
+        );
+    }
+
+    let mut files = vec![("config", main_config(include_dir))];
+    if !existing.trim().is_empty() {
+        files.push(("migrated.conf", existing.to_string()));
+    }
+    files.extend(
+        EXAMPLE_ZONES
+            .iter()
+            .map(|(name, content)| (*name, (*content).to_string())),
+    );
+
+    Ok(files)
+}
+
+fn main_config(include_dir: &str) -> String {
+    format!(
+        "# Written by sshs init.
+#
+# The hosts are in the files of {INCLUDE_DIR}, one per zone, team or project: sshs groups
+# them by file in its tree view (--tree). ssh uses the first value it finds for each
+# option, so the defaults below only apply to the hosts that don't set them.
+
+Include {include_dir}/*.conf
+
+Host *
+    ServerAliveInterval 60
+    ServerAliveCountMax 3
+    AddKeysToAgent yes
+"
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_scaffold() {
+        let files = scaffold("", "~/.ssh/config.d", false).unwrap();
+        assert_eq!(files[0].0, "config");
+        assert!(files[0].1.contains("\nInclude ~/.ssh/config.d/*.conf\n"));
+        assert!(files.iter().all(|(name, _)| *name != "migrated.conf"));
+
+        let existing = "Host web\n    HostName 10.0.0.1\n";
+        assert!(scaffold(existing, "~/.ssh/config.d", false).is_err());
+
+        let files = scaffold(existing, "~/.ssh/config.d", true).unwrap();
+        assert!(files
+            .iter()
+            .any(|(name, content)| *name == "migrated.conf" && content == existing));
+
+        let initialized = main_config("~/.ssh/config.d");
+        assert!(scaffold(&initialized, "~/.ssh/config.d", true).is_err());
+    }
+}
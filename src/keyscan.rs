@@ -0,0 +1,249 @@
+use anyhow::Result;
+use itertools::Itertools;
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+use crate::known_hosts;
+use crate::scheduler::{RateLimitArgs, Scheduler};
+use crate::ssh;
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    /// Wildcard pattern selecting the hosts by name or alias (can be repeated)
+    #[arg(short, long, required = true)]
+    search: Vec<String>,
+
+    /// Only print the entries that would be added or removed
+    #[arg(long, default_value_t = false)]
+    dry_run: bool,
+
+    /// Remove the known keys of the types the host no longer offers, once one of its known
+    /// keys is confirmed, like `UpdateHostKeys` does
+    #[arg(long, default_value_t = false)]
+    rotate: bool,
+
+    #[command(flatten)]
+    rate_limit: RateLimitArgs,
+}
+
+/// Adds the keys of the selected hosts to their known hosts file, trusting them on first use.
+///
+/// Entries are hashed when `HashKnownHosts` is enabled for the host, like `ssh` does.
+/// Keys conflicting with an already known key are never written. Known keys of types the
+/// host stopped offering are reported and only removed with `--rotate`.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration cannot be parsed, if no host matches or if
+/// the keys of at least one host could not be added.
+pub fn run(config_paths: &[String], args: &Args) -> Result<()> {
+    let hosts = ssh::select_hosts(config_paths, &args.search)?;
+    let scheduler = Scheduler::new(&args.rate_limit);
+
+    let mut failures = 0;
+    for host in &hosts {
+        scheduler.wait_turn(&host.rate_limit_key());
+        if let Err(err) = scan_host(host, args) {
+            log::error!(host = host.name.as_str(), error:? = err; "Failed to scan host keys");
+            eprintln!("{}: {err}", host.name);
+            failures += 1;
+        }
+    }
+
+    if failures > 0 {
+        anyhow::bail!(
+            "Failed to add the keys of {failures} of {} hosts",
+            hosts.len()
+        );
+    }
+
+    Ok(())
+}
+
+fn scan_host(host: &ssh::Host, args: &Args) -> Result<()> {
+    let options = host.effective_options()?;
+    let hostname = options.get("hostname").unwrap_or(&host.name);
+    let port = options.get("port").map_or("22", String::as_str);
+    let hash = options
+        .get("hashknownhosts")
+        .is_some_and(|value| value == "yes");
+    let path = options
+        .get("userknownhostsfile")
+        .and_then(|files| files.split_whitespace().next())
+        .unwrap_or("~/.ssh/known_hosts");
+    let path = shellexpand::tilde(path).to_string();
+    let update_host_keys = options.get("updatehostkeys").map_or("no", String::as_str);
+
+    let known_as = known_hosts::format_host(hostname, Some(port));
+
+    let output = Command::new("ssh-keyscan")
+        .args(["-p", port, hostname])
+        .stderr(Stdio::null())
+        .output()?;
+    let scanned = known_hosts::parse(&String::from_utf8_lossy(&output.stdout));
+    if scanned.is_empty() {
+        anyhow::bail!("No key received from {known_as}");
+    }
+
+    let existing = match std::fs::read_to_string(&path) {
+        Ok(content) => known_hosts::parse(&content),
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => Vec::new(),
+        Err(err) => return Err(err.into()),
+    };
+
+    let mut lines = Vec::new();
+    for key in &scanned {
+        let known_keys = existing
+            .iter()
+            .filter(|entry| {
+                entry.marker.is_none() && entry.key_type == key.key_type && entry.is_for(&known_as)
+            })
+            .collect::<Vec<_>>();
+
+        if known_keys.iter().any(|entry| entry.key == key.key) {
+            continue;
+        }
+
+        if let Some(entry) = known_keys.first() {
+            anyhow::bail!(
+                "The {} key of {known_as} differs from the one at {path}:{}, it may have been tampered with",
+                key.key_type,
+                entry.line
+            );
+        }
+
+        let host_field = if hash {
+            known_hosts::hash_host_with_random_salt(&known_as)?
+        } else {
+            known_as.clone()
+        };
+        lines.push(format!("{host_field} {} {}", key.key_type, key.key));
+    }
+
+    // Keys of the types the host does not offer anymore, as `UpdateHostKeys` would remove them
+    let retired = existing
+        .iter()
+        .filter(|entry| {
+            entry.marker.is_none()
+                && entry.is_for(&known_as)
+                && !scanned.iter().any(|key| key.key_type == entry.key_type)
+        })
+        .collect::<Vec<_>>();
+    if !retired.is_empty() {
+        println!(
+            "{}: {} known keys are no longer offered (UpdateHostKeys {update_host_keys}){}",
+            host.name,
+            retired.len(),
+            if args.rotate {
+                ""
+            } else {
+                ", use --rotate to remove them"
+            }
+        );
+
+        if args.rotate {
+            let confirmed = existing.iter().any(|entry| {
+                entry.is_for(&known_as) && scanned.iter().any(|key| key.key == entry.key)
+            });
+            retire_keys(&host.name, &path, &retired, confirmed, args.dry_run)?;
+        }
+    }
+
+    if lines.is_empty() {
+        println!("{}: all offered keys already known", host.name);
+        return Ok(());
+    }
+
+    if args.dry_run {
+        for line in &lines {
+            println!("{}: would add {line}", host.name);
+        }
+        return Ok(());
+    }
+
+    append_lines(&path, &lines)?;
+    println!(
+        "{}: added {} keys to {path}{}",
+        host.name,
+        lines.len(),
+        if hash { " (hashed)" } else { "" }
+    );
+
+    Ok(())
+}
+
+/// Removes the entries of the retired keys, refusing to when no known key of the host was
+/// seen again since nothing proves the host changed its keys itself.
+fn retire_keys(
+    name: &str,
+    path: &str,
+    retired: &[&known_hosts::Entry],
+    confirmed: bool,
+    dry_run: bool,
+) -> Result<()> {
+    if !confirmed {
+        anyhow::bail!("None of the known keys is offered anymore, refusing to rotate them");
+    }
+
+    let mut removed_lines = Vec::new();
+    for entry in retired {
+        // Lines shared with other hosts are left to `ssh-keygen -R`
+        if entry.hosts.len() > 1 {
+            println!(
+                "{name}: {path}:{} is shared with other hosts, skipping it",
+                entry.line
+            );
+            continue;
+        }
+
+        if dry_run {
+            println!(
+                "{name}: would remove {path}:{} ({})",
+                entry.line, entry.key_type
+            );
+        }
+        removed_lines.push(entry.line);
+    }
+
+    if dry_run || removed_lines.is_empty() {
+        return Ok(());
+    }
+
+    let content = std::fs::read_to_string(path)?;
+    let mut kept = content
+        .lines()
+        .enumerate()
+        .filter(|(i, _)| !removed_lines.contains(&(i + 1)))
+        .map(|(_, line)| line)
+        .join("\n");
+    kept.push('\n');
+    std::fs::write(path, kept)?;
+
+    println!("{name}: removed {} keys from {path}", removed_lines.len());
+
+    Ok(())
+}
+
+fn append_lines(path: &str, lines: &[String]) -> Result<()> {
+    let missing_newline = std::fs::read(path)
+        .ok()
+        .is_some_and(|content| !content.is_empty() && !content.ends_with(b"\n"));
+
+    if let Some(parent) = std::path::Path::new(path).parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+
+    let mut file = std::fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(path)?;
+
+    if missing_newline {
+        writeln!(file)?;
+    }
+    for line in lines {
+        writeln!(file, "{line}")?;
+    }
+
+    Ok(())
+}
@@ -0,0 +1,158 @@
+use base64::{engine::general_purpose::STANDARD, Engine};
+
+/// Prefix of the host names hashed by `HashKnownHosts`.
+const HASH_MAGIC: &str = "|1|";
+
+/// A line of a `known_hosts` file.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Entry {
+    /// Line number, starting at 1.
+    pub line: usize,
+    /// `@cert-authority` or `@revoked`.
+    pub marker: Option<String>,
+    /// Host names or patterns, either plain or hashed.
+    pub hosts: Vec<String>,
+    pub key_type: String,
+    pub key: String,
+}
+
+impl Entry {
+    #[must_use]
+    pub fn is_hashed(&self) -> bool {
+        self.hosts.iter().any(|host| host.starts_with(HASH_MAGIC))
+    }
+
+    /// Whether the entry is for the host, formatted by [`format_host`].
+    #[must_use]
+    pub fn is_for(&self, host: &str) -> bool {
+        self.hosts.iter().any(|known| {
+            if known.starts_with(HASH_MAGIC) {
+                matches_hashed(known, host)
+            } else {
+                known == host
+            }
+        })
+    }
+}
+
+/// Parses the content of a `known_hosts` file, ignoring comments and malformed lines.
+#[must_use]
+pub fn parse(content: &str) -> Vec<Entry> {
+    content
+        .lines()
+        .enumerate()
+        .filter_map(|(i, line)| {
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') {
+                return None;
+            }
+
+            let mut fields = line.split_whitespace();
+            let mut hosts = fields.next()?;
+
+            let marker = if hosts.starts_with('@') {
+                let marker = hosts.to_string();
+                hosts = fields.next()?;
+                Some(marker)
+            } else {
+                None
+            };
+
+            Some(Entry {
+                line: i + 1,
+                marker,
+                hosts: hosts.split(',').map(ToString::to_string).collect(),
+                key_type: fields.next()?.to_string(),
+                key: fields.next()?.to_string(),
+            })
+        })
+        .collect()
+}
+
+/// Formats a host the way `ssh` writes it in `known_hosts`, `[host]:port` for non-default ports.
+#[must_use]
+pub fn format_host(host: &str, port: Option<&str>) -> String {
+    match port {
+        Some(port) if port != "22" => format!("[{host}]:{port}"),
+        _ => host.to_string(),
+    }
+}
+
+/// Splits `[host]:port` into its host and port.
+#[must_use]
+pub fn split_host(host: &str) -> (&str, Option<&str>) {
+    host.strip_prefix('[')
+        .and_then(|host| host.split_once("]:"))
+        .map_or((host, None), |(host, port)| (host, Some(port)))
+}
+
+/// Hashes a host name with the given salt, as done by `ssh` when `HashKnownHosts` is enabled.
+#[must_use]
+pub fn hash_host(host: &str, salt: &[u8]) -> String {
+    let hash = hmac_sha1::hmac_sha1(salt, host.as_bytes());
+
+    format!(
+        "{HASH_MAGIC}{}|{}",
+        STANDARD.encode(salt),
+        STANDARD.encode(hash)
+    )
+}
+
+/// Hashes a host name with a new random salt.
+///
+/// # Errors
+///
+/// Will return `Err` if the system cannot provide random bytes.
+pub fn hash_host_with_random_salt(host: &str) -> anyhow::Result<String> {
+    // Same salt length as `ssh`.
+    let mut salt = [0u8; 20];
+    getrandom::getrandom(&mut salt)
+        .map_err(|err| anyhow::anyhow!("Failed to generate a salt: {err}"))?;
+
+    Ok(hash_host(host, &salt))
+}
+
+/// Whether the hashed host name of a `known_hosts` entry is the given host.
+#[must_use]
+pub fn matches_hashed(hashed: &str, host: &str) -> bool {
+    let Some((salt, _)) = hashed
+        .strip_prefix(HASH_MAGIC)
+        .and_then(|hashed| hashed.split_once('|'))
+    else {
+        return false;
+    };
+
+    let Ok(salt) = STANDARD.decode(salt) else {
+        return false;
+    };
+
+    hash_host(host, &salt) == hashed
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_hashed_hosts() {
+        // `example.com` hashed with a fixed salt, as `ssh-keygen -H` would write it.
+        let hashed = "|1|oaVTb/EO0T2AX84pVkIjr6/6uXM=|wVBWOWJM1FD9bLr4SvNWGz/F9q8=";
+        let salt = STANDARD.decode("oaVTb/EO0T2AX84pVkIjr6/6uXM=").unwrap();
+
+        assert_eq!(hash_host("example.com", &salt), hashed);
+        assert!(matches_hashed(hashed, "example.com"));
+        assert!(!matches_hashed(hashed, "example.org"));
+
+        let entries = parse(&format!(
+            "# comment\n{hashed} ssh-ed25519 AAAA\n@revoked [git.example.com]:2222,10.0.0.1 ssh-rsa BBBB\n"
+        ));
+        assert_eq!(entries.len(), 2);
+        assert!(entries[0].is_hashed());
+        assert_eq!(entries[1].line, 3);
+        assert_eq!(entries[1].marker.as_deref(), Some("@revoked"));
+        assert_eq!(
+            split_host(&entries[1].hosts[0]),
+            ("git.example.com", Some("2222"))
+        );
+    }
+}
@@ -0,0 +1,152 @@
+use anyhow::anyhow;
+use serde::Deserialize;
+use std::process::{Command, Stdio};
+
+use crate::generate::GeneratedHost;
+use crate::ssh;
+use crate::ssh_config::EntryType;
+
+/// Which pods are listed next to the hosts with `--kubernetes`.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Options {
+    /// Namespaces of the pods, all of them when empty.
+    pub namespaces: Vec<String>,
+    /// Context of kubectl, its current one otherwise.
+    pub context: Option<String>,
+}
+
+impl Options {
+    /// Name of the source of the pods, shown like the path of a configuration file.
+    #[must_use]
+    pub fn source_name(&self) -> String {
+        let context = self
+            .context
+            .as_ref()
+            .map(|context| format!(" {context}"))
+            .unwrap_or_default();
+        if self.namespaces.is_empty() {
+            format!("kubernetes{context}")
+        } else {
+            format!("kubernetes{context} ({})", self.namespaces.join(", "))
+        }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct PodList {
+    #[serde(default)]
+    items: Vec<Pod>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Pod {
+    metadata: Metadata,
+    #[serde(default)]
+    status: PodStatus,
+}
+
+#[derive(Debug, Deserialize)]
+struct Metadata {
+    name: String,
+    namespace: String,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct PodStatus {
+    #[serde(rename = "podIP")]
+    pod_ip: Option<String>,
+}
+
+/// Lists the running pods of the namespaces as hosts named `NAMESPACE/POD`, reached with
+/// `kubectl exec`.
+///
+/// # Errors
+///
+/// Will return `Err` if `kubectl` cannot be run, fails or prints something else than pods.
+pub fn pods(options: &Options) -> anyhow::Result<Vec<ssh::Host>> {
+    let mut blocks = Vec::new();
+    if options.namespaces.is_empty() {
+        blocks.extend(list(options, None)?);
+    }
+    for namespace in &options.namespaces {
+        blocks.extend(list(options, Some(namespace))?);
+    }
+    log::debug!(pods = blocks.len(); "Listed pods");
+
+    ssh::parse_generated(&options.source_name(), &blocks)
+}
+
+fn list(options: &Options, namespace: Option<&str>) -> anyhow::Result<Vec<GeneratedHost>> {
+    let mut command = Command::new("kubectl");
+    command.args([
+        "get",
+        "pods",
+        "--output=json",
+        "--field-selector=status.phase=Running",
+    ]);
+    match namespace {
+        Some(namespace) => command.arg(format!("--namespace={namespace}")),
+        None => command.arg("--all-namespaces"),
+    };
+    if let Some(context) = &options.context {
+        command.arg(format!("--context={context}"));
+    }
+
+    let output = command
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow!("Failed to run kubectl: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "kubectl failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    let pods: PodList = serde_json::from_slice(&output.stdout)?;
+    Ok(pods
+        .items
+        .iter()
+        .map(|pod| pod_to_host(pod, options.context.as_deref()))
+        .collect())
+}
+
+fn pod_to_host(pod: &Pod, context: Option<&str>) -> GeneratedHost {
+    let mut host = GeneratedHost::new(&format!("{}/{}", pod.metadata.namespace, pod.metadata.name));
+    host.push(EntryType::Hostname, &pod.metadata.name);
+    host.push_metadata("protocol", "kubernetes");
+    host.push_metadata("namespace", &pod.metadata.namespace);
+    if let Some(context) = context {
+        host.push_metadata("context", context);
+    }
+    if let Some(ip) = &pod.status.pod_ip {
+        host.push_metadata("note", &format!("pod IP {ip}"));
+    }
+
+    host
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_pods_to_hosts() {
+        let pods: PodList = serde_json::from_str(
+            r#"{"apiVersion": "v1", "kind": "List", "items": [
+                {"metadata": {"name": "api-7d9f", "namespace": "shop"},
+                 "status": {"phase": "Running", "podIP": "10.1.2.3"}}
+            ]}"#,
+        )
+        .unwrap();
+        let blocks = vec![pod_to_host(&pods.items[0], Some("prod"))];
+        let hosts = ssh::parse_generated("kubernetes", &blocks).unwrap();
+
+        assert_eq!(hosts[0].name, "shop/api-7d9f");
+        assert_eq!(hosts[0].destination, "api-7d9f");
+        assert_eq!(hosts[0].protocol, ssh::Protocol::Kubernetes);
+        assert_eq!(hosts[0].namespace.as_deref(), Some("shop"));
+        assert_eq!(hosts[0].context.as_deref(), Some("prod"));
+        assert_eq!(hosts[0].probe_address(), None);
+    }
+}
@@ -0,0 +1,76 @@
+use anyhow::{anyhow, Result};
+use log::{kv, LevelFilter, Log, Metadata, Record};
+use std::fmt::Write as _;
+use std::fs::{File, OpenOptions};
+use std::io::Write as _;
+use std::sync::Mutex;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// Writes the log records to a file, one `key=value` line per record.
+struct FileLogger {
+    file: Mutex<File>,
+}
+
+struct KeyValues<'a>(&'a mut String);
+
+impl<'kvs> kv::VisitSource<'kvs> for KeyValues<'_> {
+    fn visit_pair(&mut self, key: kv::Key<'kvs>, value: kv::Value<'kvs>) -> Result<(), kv::Error> {
+        let _ = write!(self.0, " {key}={value:?}");
+        Ok(())
+    }
+}
+
+impl Log for FileLogger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        metadata.level() <= log::max_level()
+    }
+
+    fn log(&self, record: &Record) {
+        if !self.enabled(record.metadata()) {
+            return;
+        }
+
+        let timestamp = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs_f64())
+            .unwrap_or_default();
+
+        let mut line = format!(
+            "ts={timestamp:.3} level={} target={} msg={:?}",
+            record.level(),
+            record.target(),
+            record.args().to_string(),
+        );
+        let _ = record.key_values().visit(&mut KeyValues(&mut line));
+
+        if let Ok(mut file) = self.file.lock() {
+            let _ = writeln!(file, "{line}");
+        }
+    }
+
+    fn flush(&self) {
+        if let Ok(mut file) = self.file.lock() {
+            let _ = file.flush();
+        }
+    }
+}
+
+/// Sends every log record to the given file.
+///
+/// # Errors
+///
+/// Will return `Err` if the file cannot be opened or if a logger is already set.
+pub fn init(path: &str) -> Result<()> {
+    let path = shellexpand::tilde(path).to_string();
+    let file = OpenOptions::new().create(true).append(true).open(&path)?;
+
+    log::set_boxed_logger(Box::new(FileLogger {
+        file: Mutex::new(file),
+    }))
+    .map_err(|e| anyhow!("Failed to setup the logger: {e}"))?;
+    log::set_max_level(LevelFilter::Trace);
+
+    log::info!(version = env!("CARGO_PKG_VERSION"), path = path.as_str(); "Debug logging enabled");
+
+    Ok(())
+}
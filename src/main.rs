@@ -1,19 +1,51 @@
+pub mod add;
+pub mod agent;
+pub mod annotations;
+pub mod clock;
+pub mod completion;
+pub mod doctor;
+pub mod fleet;
+pub mod generate;
+pub mod history;
+pub mod hooks;
+pub mod init;
+pub mod keyscan;
+pub mod known_hosts;
+pub mod kubernetes;
+pub mod logger;
+pub mod manage;
+pub mod network;
+pub mod probe;
+pub mod run;
+pub mod scheduler;
 pub mod searchable;
+pub mod secrets;
+pub mod settings;
 pub mod ssh;
 pub mod ssh_config;
+pub mod state;
+pub mod sync;
+pub mod tree;
 pub mod ui;
+pub mod update;
+pub mod vault;
 
 use anyhow::Result;
-use clap::Parser;
-use ui::{App, AppConfig};
+use clap::{Parser, Subcommand};
+use ui::{App, AppConfig, PrintMode, SortOrder};
 
 #[derive(Parser, Debug)]
-#[command(version, about, long_about = None)]
+#[allow(clippy::struct_excessive_bools)]
+#[command(version, about, long_about = None, args_override_self = true)]
 struct Args {
+    #[command(subcommand)]
+    command: Option<Command>,
+
     /// Path to the SSH configuration file
     #[arg(
         short,
         long,
+        global = true,
         num_args = 1..,
         default_values_t = [
             "/etc/ssh/ssh_config".to_string(),
@@ -26,34 +58,302 @@ struct Args {
     #[arg(long, default_value_t = false)]
     show_proxy_command: bool,
 
+    /// Shows the private key each host authenticates with
+    #[arg(long, default_value_t = false)]
+    show_identity_file: bool,
+
+    /// Shows the local command run on connect, such hosts are marked either way
+    #[arg(long, default_value_t = false)]
+    show_local_command: bool,
+
+    /// Group hosts by the configuration file they come from
+    #[arg(long, default_value_t = false)]
+    tree: bool,
+
+    /// Show each alias of a `Host` line as its own host, to pick the exact name given to ssh
+    #[arg(long, default_value_t = false)]
+    expand_aliases: bool,
+
+    /// Check in the background whether hosts are reachable
+    #[arg(long, default_value_t = false)]
+    ping: bool,
+
     /// Host search filter
     #[arg(short, long)]
     search: Option<String>,
 
-    /// Sort hosts by hostname
-    #[arg(long, default_value_t = true)]
+    /// Do not restore nor remember the last search and selected host
+    #[arg(long, default_value_t = false)]
+    no_restore: bool,
+
+    /// Deprecated, `--sort=false` standing for `--sort-by config`
+    #[arg(
+        long,
+        default_value_t = true,
+        hide = true,
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true",
+        action = clap::ArgAction::Set
+    )]
     sort: bool,
 
+    /// Order of the hosts, can be changed in the list with ctrl+s
+    #[arg(long, value_enum, default_value_t = SortOrder::Name)]
+    sort_by: SortOrder,
+
     /// Handlebars template of the command to execute
     #[arg(short, long, default_value = "ssh \"{{{name}}}\"")]
     template: String,
 
+    /// Reload the configuration when one of its files changes
+    #[arg(long, default_value_t = false)]
+    watch: bool,
+
+    /// Authenticate with this key only, whatever the configuration says
+    #[arg(short, long, value_name = "FILE")]
+    identity: Option<String>,
+
     /// Exit after ending the SSH session
     #[arg(short, long, default_value_t = false)]
     exit: bool,
+
+    /// Disable agent forwarding toward the hosts with `Tag untrusted` instead of only warning
+    #[arg(long, default_value_t = false)]
+    strip_untrusted_agent: bool,
+
+    /// Open the sessions in new tmux windows and keep sshs running
+    #[arg(long, default_value_t = false, conflicts_with_all = ["zellij", "print"])]
+    tmux: bool,
+
+    /// Open the sessions in new zellij panes and keep sshs running
+    #[arg(long, default_value_t = false, conflicts_with = "print")]
+    zellij: bool,
+
+    /// Open the sessions in new Windows Terminal tabs, or panes, and keep sshs running
+    #[arg(
+        long,
+        value_enum,
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "tab",
+        conflicts_with_all = ["tmux", "zellij", "print"]
+    )]
+    windows_terminal: Option<ssh::TerminalLayout>,
+
+    /// Print the selected host to stdout instead of connecting to it
+    #[arg(
+        long,
+        value_enum,
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "name"
+    )]
+    print: Option<PrintMode>,
+
+    /// Share the connections to each host so the next ones are instant, keeping them open for
+    /// this long after the last session (10m by default) and closing them when sshs exits
+    #[arg(
+        long,
+        value_name = "DURATION",
+        value_parser = scheduler::parse_duration,
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "10m"
+    )]
+    control_persist: Option<std::time::Duration>,
+
+    /// Show the command before connecting, to confirm it with Enter
+    #[arg(long, default_value_t = false)]
+    confirm: bool,
+
+    /// Print the command that would connect to the selected host and exit instead of running it
+    #[arg(long, default_value_t = false, conflicts_with = "print")]
+    dry_run: bool,
+
+    /// Leave the mouse to the terminal, to select text, instead of clicking and scrolling the
+    /// list with it
+    #[arg(long, default_value_t = false)]
+    no_mouse: bool,
+
+    /// Move with j/k/gg/G/ctrl+d/ctrl+u, search after / and jump between the matches with n/N
+    #[arg(long, default_value_t = false)]
+    vim: bool,
+
+    /// Share the connection to the jump host of the hosts behind a single one, so that it is
+    /// authenticated to once, keeping it open as long as --control-persist does
+    #[arg(long, default_value_t = false)]
+    share_jump_hosts: bool,
+
+    /// Connect to the hosts with an EC2 instance ID through AWS Systems Manager Session
+    /// Manager, unless a jump host is given for the connection
+    #[arg(long, default_value_t = false)]
+    ssm: bool,
+
+    /// List the running pods of these namespaces of Kubernetes, all of them when none is given,
+    /// after the hosts to open a shell in them with kubectl exec
+    #[arg(long, value_name = "NAMESPACE", num_args = 0.., value_delimiter = ',')]
+    kubernetes: Option<Vec<String>>,
+
+    /// Context of kubectl the pods are listed from, its current one otherwise
+    #[arg(long, value_name = "CONTEXT", requires = "kubernetes")]
+    kube_context: Option<String>,
+
+    /// Ring the terminal bell when a session ends while sshs is in a tmux pane in the
+    /// background
+    #[arg(long, default_value_t = false)]
+    bell: bool,
+
+    /// Ticket or change reference recorded in the connection history
+    #[arg(long, env = "SSHS_TICKET")]
+    ticket: Option<String>,
+
+    /// How long to wait for each configuration file when reloading the hosts after a change,
+    /// the slower ones being added once loaded. The hosts are listed as they are read at startup
+    #[arg(long, value_name = "DURATION", value_parser = scheduler::parse_duration, default_value = "2s")]
+    source_timeout: std::time::Duration,
+
+    /// Write debug logs to a file
+    #[arg(
+        long,
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "sshs-debug.log"
+    )]
+    debug: Option<String>,
+}
+
+#[derive(Subcommand, Debug)]
+enum Command {
+    /// Generate SSH configuration from other sources
+    Generate(Box<generate::Args>),
+
+    /// Set up a configuration including a file per zone from config.d
+    Init(init::Args),
+
+    /// Write the hosts of the generators of the settings to a file of the SSH configuration
+    Sync(sync::Args),
+
+    /// Add a host to the SSH configuration
+    Add(add::Args),
+
+    /// Remove a host from the SSH configuration, with its block when it was its only pattern
+    Remove(manage::RemoveArgs),
+
+    /// Rename a host in the SSH configuration
+    Rename(manage::RenameArgs),
+
+    /// Run a command on all the matching hosts
+    Run(run::Args),
+
+    /// Add the host keys of the matching hosts to the known hosts file
+    Keyscan(keyscan::Args),
+
+    /// Check the identity files and jump hosts of the hosts
+    Doctor,
+
+    /// Print the hosts for the shell completion of ssh
+    CompletionHosts(completion::Args),
+
+    /// Inspect the history of the connections made from sshs
+    History(history::Args),
+
+    /// Inspect the secret providers
+    Secret(secrets::Args),
+
+    /// Replace this executable with the latest release
+    SelfUpdate(update::Args),
+
+    /// Run the hooks after a session opened in a multiplexer, from its pane
+    #[command(hide = true)]
+    AfterHooks(hooks::AfterArgs),
 }
 
 fn main() -> Result<()> {
-    let args = Args::parse();
+    // An invalid settings file is reported once the hosts are shown
+    let defaults = settings::Settings::load()
+        .map(|settings| settings.args)
+        .unwrap_or_default();
+    // Given first, the command line overriding their options, though not turning their flags off
+    let mut command_line = std::env::args_os();
+    let args = Args::parse_from(
+        command_line
+            .next()
+            .into_iter()
+            .chain(defaults.into_iter().map(Into::into))
+            .chain(command_line),
+    );
+
+    if let Some(path) = &args.debug {
+        logger::init(path)?;
+    }
+
+    if let Some(command) = &args.command {
+        return match command {
+            Command::Generate(generate_args) => generate::run(generate_args),
+            Command::Doctor => doctor::run(&args.config),
+            Command::Init(init_args) => init::run(&args.config, init_args),
+            Command::Sync(sync_args) => sync::run(sync_args),
+            Command::Add(add_args) => add::run(&args.config, add_args),
+            Command::Remove(remove_args) => manage::remove(&args.config, remove_args),
+            Command::Rename(rename_args) => manage::rename(&args.config, rename_args),
+            Command::Run(run_args) => run::run(&args.config, run_args),
+            Command::Keyscan(keyscan_args) => keyscan::run(&args.config, keyscan_args),
+            Command::CompletionHosts(completion_args) => {
+                completion::run(&args.config, completion_args)
+            }
+            Command::History(history_args) => history::run(history_args),
+            Command::Secret(secret_args) => secrets::run(secret_args),
+            Command::SelfUpdate(update_args) => update::run(update_args),
+            Command::AfterHooks(after_args) => hooks::run_after(&args.config, after_args),
+        };
+    }
 
     let mut app = App::new(&AppConfig {
         config_paths: args.config,
         search_filter: args.search,
-        sort_by_name: args.sort,
+        sort_order: if args.sort {
+            args.sort_by
+        } else {
+            SortOrder::Config
+        },
         show_proxy_command: args.show_proxy_command,
+        show_identity_file: args.show_identity_file,
+        show_local_command: args.show_local_command,
+        tree_view: args.tree,
+        expand_aliases: args.expand_aliases,
+        ping: args.ping,
+        remember_state: !args.no_restore,
         command_template: args.template,
         exit_after_ssh: args.exit,
-    })?;
+        print: args.print,
+        source_timeout: args.source_timeout,
+        strip_untrusted_agent: args.strip_untrusted_agent,
+        multiplexer: if args.tmux {
+            Some(ssh::Multiplexer::Tmux)
+        } else if args.zellij {
+            Some(ssh::Multiplexer::Zellij)
+        } else {
+            args.windows_terminal.map(ssh::Multiplexer::WindowsTerminal)
+        },
+        ticket: args.ticket,
+        control_persist: args.control_persist,
+        share_jump_hosts: args.share_jump_hosts,
+        ssm: args.ssm,
+        kubernetes: args.kubernetes.map(|namespaces| kubernetes::Options {
+            namespaces,
+            context: args.kube_context,
+        }),
+        watch: args.watch,
+        mouse: !args.no_mouse,
+        vim: args.vim,
+        confirm: args.confirm,
+        dry_run: args.dry_run,
+        bell: args.bell,
+        identity: args
+            .identity
+            .map(|path| shellexpand::tilde(&path).to_string().into()),
+    });
     app.start()?;
 
     Ok(())
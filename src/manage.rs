@@ -0,0 +1,608 @@
+use anyhow::Result;
+use std::collections::BTreeMap;
+use std::ops::Range;
+use std::path::{Path, PathBuf};
+
+use crate::ssh;
+use crate::ssh_config::Origin;
+
+#[derive(clap::Args, Debug)]
+pub struct RemoveArgs {
+    /// Name or alias of the host to remove
+    name: String,
+
+    /// Print the changes as a diff without writing them
+    #[arg(long, default_value_t = false)]
+    dry_run: bool,
+}
+
+#[derive(clap::Args, Debug)]
+pub struct RenameArgs {
+    /// Name or alias of the host to rename
+    name: String,
+
+    /// New name of the host
+    new_name: String,
+
+    /// Print the changes as a diff without writing them
+    #[arg(long, default_value_t = false)]
+    dry_run: bool,
+}
+
+/// Lines of a configuration file replaced by others.
+struct Change {
+    /// Line numbers, starting at 0.
+    lines: Range<usize>,
+    replacement: Vec<String>,
+}
+
+/// Removes the host from the `Host` lines defining it, in the configuration files or the files
+/// they include. A block is removed along with its last pattern, the other hosts of a `Host` line
+/// keeping theirs.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration cannot be parsed, if no host has the name or
+/// if a file cannot be written.
+pub fn remove(config_paths: &[String], args: &RemoveArgs) -> Result<()> {
+    let mut changes = BTreeMap::<PathBuf, Vec<Change>>::new();
+    for origin in host_blocks(config_paths, &args.name)? {
+        let lines = read_lines(&origin.path)?;
+        let line = origin.line - 1;
+        // Hosts added by `# sshs-expand:` come from a block defining others
+        let Some(removed) = remove_pattern(&lines[line], &args.name) else {
+            anyhow::bail!(
+                "{}:{} does not name {} literally, remove it by hand",
+                origin.path.display(),
+                origin.line,
+                args.name
+            );
+        };
+
+        let change = if has_patterns(&removed) {
+            Change {
+                lines: line..line + 1,
+                replacement: vec![removed],
+            }
+        } else {
+            Change {
+                lines: block_range(&lines, line),
+                replacement: Vec::new(),
+            }
+        };
+        changes.entry(origin.path).or_default().push(change);
+    }
+
+    apply(&changes, args.dry_run)
+}
+
+/// Renames the host in the `Host` lines defining it, keeping the rest of the lines as written.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration cannot be parsed, if no host has the name,
+/// if a host already has the new name or if a file cannot be written.
+pub fn rename(config_paths: &[String], args: &RenameArgs) -> Result<()> {
+    if has_name(&ssh::load_hosts(config_paths)?, &args.new_name) {
+        anyhow::bail!("A host named {} already exists", args.new_name);
+    }
+
+    let mut changes = BTreeMap::<PathBuf, Vec<Change>>::new();
+    for origin in host_blocks(config_paths, &args.name)? {
+        let lines = read_lines(&origin.path)?;
+        let line = origin.line - 1;
+        let Some(renamed) = rename_pattern(&lines[line], &args.name, &args.new_name) else {
+            anyhow::bail!(
+                "{}:{} does not name {} literally, rename it by hand",
+                origin.path.display(),
+                origin.line,
+                args.name
+            );
+        };
+
+        changes.entry(origin.path).or_default().push(Change {
+            lines: line..line + 1,
+            replacement: vec![renamed],
+        });
+    }
+
+    apply(&changes, args.dry_run)
+}
+
+fn has_name(hosts: &[ssh::Host], name: &str) -> bool {
+    hosts
+        .iter()
+        .any(|host| host.name == name || host.aliases.split(", ").any(|alias| alias == name))
+}
+
+/// Where the blocks defining the host start.
+fn host_blocks(config_paths: &[String], name: &str) -> Result<Vec<Origin>> {
+    let mut origins = Vec::new();
+    for host in ssh::load_hosts(config_paths)? {
+        if !has_name(std::slice::from_ref(&host), name) {
+            continue;
+        }
+
+        match host.origin {
+            Some(origin) if origin.line > 0 => {
+                if !origins.contains(&origin) {
+                    origins.push(origin);
+                }
+            }
+            _ => anyhow::bail!("Cannot locate the block defining {name}"),
+        }
+    }
+
+    if origins.is_empty() {
+        anyhow::bail!("No host named {name}");
+    }
+
+    Ok(origins)
+}
+
+fn read_lines(path: &PathBuf) -> Result<Vec<String>> {
+    Ok(std::fs::read_to_string(path)?
+        .lines()
+        .map(ToString::to_string)
+        .collect())
+}
+
+/// Prints the changes as a diff and writes them unless it is a dry run.
+fn apply(changes: &BTreeMap<PathBuf, Vec<Change>>, dry_run: bool) -> Result<()> {
+    for (path, changes) in changes {
+        let content = std::fs::read_to_string(path)?;
+        let mut lines = content.lines().map(ToString::to_string).collect::<Vec<_>>();
+
+        println!("--- {}", path.display());
+        println!("+++ {}", path.display());
+
+        let mut changes = changes.iter().collect::<Vec<_>>();
+        changes.sort_by_key(|change| change.lines.start);
+        for change in &changes {
+            println!(
+                "@@ -{},{} +{},{} @@",
+                change.lines.start + 1,
+                change.lines.len(),
+                change.lines.start + 1,
+                change.replacement.len()
+            );
+            for line in &lines[change.lines.clone()] {
+                println!("-{line}");
+            }
+            for line in &change.replacement {
+                println!("+{line}");
+            }
+        }
+
+        if dry_run {
+            continue;
+        }
+
+        // From the end so the line numbers of the other changes stay valid
+        for change in changes.iter().rev() {
+            lines.splice(change.lines.clone(), change.replacement.iter().cloned());
+        }
+
+        write_lines(path, &lines, content.ends_with('\n'))?;
+        log::info!(path:? = path, changes = changes.len(); "Updated configuration file");
+    }
+
+    Ok(())
+}
+
+fn write_lines(path: &PathBuf, lines: &[String], ends_with_newline: bool) -> Result<()> {
+    let mut updated = lines.join("\n");
+    if !updated.is_empty() && ends_with_newline {
+        updated.push('\n');
+    }
+    std::fs::write(path, updated)?;
+
+    Ok(())
+}
+
+/// Sets the value of the `# sshs-KEY:` comment of the block of the host starting at the
+/// origin, an empty value removing the comment.
+///
+/// # Errors
+///
+/// Will return `Err` if the `Host` line of the block does not name the host, so that the
+/// other hosts of a pattern are left alone, or if the file cannot be read or written.
+pub fn set_metadata(origin: &Origin, name: &str, key: &str, value: &str) -> Result<()> {
+    if edit_block(origin, name, |lines, start| {
+        set_metadata_line(lines, start, key, value)
+    })? {
+        log::info!(path:? = origin.path, line = origin.line, key = key; "Updated host metadata");
+    }
+
+    Ok(())
+}
+
+/// Sets the entry such as `ProxyJump` of the block of the host starting at the origin,
+/// replacing its value if the block already has it.
+///
+/// # Errors
+///
+/// Will return `Err` if the `Host` line of the block does not name the host, so that the
+/// other hosts of a pattern are left alone, or if the file cannot be read or written.
+pub fn set_entry(origin: &Origin, name: &str, keyword: &str, value: &str) -> Result<()> {
+    if edit_block(origin, name, |lines, start| {
+        set_entry_line(lines, start, keyword, value)
+    })? {
+        log::info!(path:? = origin.path, line = origin.line, keyword = keyword; "Updated host entry");
+    }
+
+    Ok(())
+}
+
+/// Appends a copy of the block of the host starting at the origin to another file, under a
+/// new name and connecting to another `HostName`.
+///
+/// # Errors
+///
+/// Will return `Err` if the `Host` line of the block does not name the host, if a file cannot
+/// be read or if the destination cannot be written.
+pub fn clone_block(
+    origin: &Origin,
+    name: &str,
+    new_name: &str,
+    hostname: &str,
+    destination: &Path,
+) -> Result<()> {
+    let (_, lines) = read_block_file(origin, name)?;
+    let copy = cloned_block(&lines, origin.line - 1, new_name, hostname);
+
+    let mut content = match std::fs::read_to_string(destination) {
+        Ok(content) => content,
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => String::new(),
+        Err(err) => return Err(err.into()),
+    };
+    if !content.is_empty() {
+        if !content.ends_with('\n') {
+            content.push('\n');
+        }
+        content.push('\n');
+    }
+    content.push_str(&copy.join("\n"));
+    content.push('\n');
+
+    if let Some(parent) = destination.parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+    std::fs::write(destination, content)?;
+    log::info!(host = name, new_name = new_name, path:? = destination; "Cloned host block");
+
+    Ok(())
+}
+
+/// The block starting at the given line renamed and with the host name replaced, without the
+/// blank lines separating it from the next one.
+fn cloned_block(lines: &[String], start: usize, new_name: &str, hostname: &str) -> Vec<String> {
+    let block = block_range(lines, start);
+    let mut copy = lines[block].to_vec();
+    while copy.len() > 1 && copy.last().is_some_and(|line| line.trim().is_empty()) {
+        copy.pop();
+    }
+
+    let indent = &copy[0][..copy[0].len() - copy[0].trim_start().len()];
+    copy[0] = format!("{indent}Host {new_name}");
+    set_entry_line(&mut copy, 0, "HostName", hostname);
+
+    copy
+}
+
+/// Edits the lines of the file of the block starting at the origin, writing them if `edit`
+/// returns that they changed.
+fn edit_block(
+    origin: &Origin,
+    name: &str,
+    edit: impl FnOnce(&mut Vec<String>, usize) -> bool,
+) -> Result<bool> {
+    let (content, mut lines) = read_block_file(origin, name)?;
+
+    let changed = edit(&mut lines, origin.line - 1);
+    if changed {
+        write_lines(&origin.path, &lines, content.ends_with('\n'))?;
+    }
+
+    Ok(changed)
+}
+
+/// Reads the file of the block starting at the origin, checking that the block names the host.
+fn read_block_file(origin: &Origin, name: &str) -> Result<(String, Vec<String>)> {
+    let content = std::fs::read_to_string(&origin.path)?;
+    let lines = content.lines().map(ToString::to_string).collect::<Vec<_>>();
+    if origin.line == 0 || origin.line > lines.len() {
+        anyhow::bail!(
+            "Cannot locate the block at {}:{}",
+            origin.path.display(),
+            origin.line
+        );
+    }
+    if rename_pattern(&lines[origin.line - 1], name, name).is_none() {
+        anyhow::bail!(
+            "{}:{} does not name {name} literally",
+            origin.path.display(),
+            origin.line
+        );
+    }
+
+    Ok((content, lines))
+}
+
+/// Updates, adds or removes the metadata comment in the block starting at the given line,
+/// returns whether the lines changed.
+fn set_metadata_line(lines: &mut Vec<String>, start: usize, key: &str, value: &str) -> bool {
+    let block = block_range(lines, start);
+    let prefix = format!("sshs-{key}:");
+    let existing = block.clone().skip(1).find(|i| {
+        lines[*i]
+            .trim_start()
+            .strip_prefix('#')
+            .is_some_and(|comment| comment.trim_start().starts_with(&prefix))
+    });
+
+    let line = format!("{}# {prefix} {value}", block_indent(lines, &block));
+
+    match existing {
+        Some(i) if value.is_empty() => {
+            lines.remove(i);
+        }
+        Some(i) if lines[i] != line => lines[i] = line,
+        None if !value.is_empty() => lines.insert(start + 1, line),
+        _ => return false,
+    }
+
+    true
+}
+
+/// Updates or adds the entry in the block starting at the given line, returns whether the
+/// lines changed.
+fn set_entry_line(lines: &mut Vec<String>, start: usize, keyword: &str, value: &str) -> bool {
+    let block = block_range(lines, start);
+    let existing = block.clone().skip(1).find(|i| {
+        words(&lines[*i])
+            .first()
+            .is_some_and(|word| lines[*i][word.clone()].eq_ignore_ascii_case(keyword))
+    });
+    let line = format!("{}{keyword} {value}", block_indent(lines, &block));
+
+    match existing {
+        Some(i) if lines[i] == line => return false,
+        Some(i) => lines[i] = line,
+        None => {
+            // After the last entry, before the blank lines separating the blocks
+            let end = block
+                .clone()
+                .rev()
+                .find(|i| !lines[*i].trim().is_empty())
+                .map_or(start + 1, |i| i + 1);
+            lines.insert(end, line);
+        }
+    }
+
+    true
+}
+
+/// Indentation of the entries of the block.
+fn block_indent(lines: &[String], block: &Range<usize>) -> String {
+    lines[block.clone()]
+        .iter()
+        .skip(1)
+        .find(|line| !line.trim().is_empty())
+        .map_or("  ", |line| &line[..line.len() - line.trim_start().len()])
+        .to_string()
+}
+
+/// Lines of the block starting at the given line, up to the next `Host` or `Match` block.
+///
+/// The comments right above the next block are left to it.
+fn block_range(lines: &[String], start: usize) -> Range<usize> {
+    let mut end = start + 1;
+    while end < lines.len() && !starts_block(&lines[end]) {
+        end += 1;
+    }
+
+    if end < lines.len() {
+        while end > start + 1 && lines[end - 1].trim_start().starts_with('#') {
+            end -= 1;
+        }
+    }
+
+    start..end
+}
+
+fn starts_block(line: &str) -> bool {
+    let keyword = line
+        .trim_start()
+        .split(|c: char| c.is_whitespace() || c == '=')
+        .next()
+        .unwrap_or_default();
+
+    keyword.eq_ignore_ascii_case("host") || keyword.eq_ignore_ascii_case("match")
+}
+
+/// Replaces the pattern of a `Host` line, returns `None` if no pattern is the name.
+fn rename_pattern(line: &str, name: &str, new_name: &str) -> Option<String> {
+    let range = words(line)
+        .into_iter()
+        .skip(1)
+        .find(|range| line[range.clone()].trim_matches('"') == name)?;
+
+    let new_name = if new_name.contains(char::is_whitespace) {
+        format!("\"{new_name}\"")
+    } else {
+        new_name.to_string()
+    };
+
+    let mut renamed = line.to_string();
+    renamed.replace_range(range, &new_name);
+    Some(renamed)
+}
+
+/// Removes the pattern of a `Host` line with the spaces before it, returns `None` if no pattern
+/// is the name.
+fn remove_pattern(line: &str, name: &str) -> Option<String> {
+    let words = words(line);
+    let index = words
+        .iter()
+        .skip(1)
+        .position(|range| line[range.clone()].trim_matches('"') == name)?
+        + 1;
+
+    let mut removed = line.to_string();
+    removed.replace_range(words[index - 1].end..words[index].end, "");
+    Some(removed)
+}
+
+/// Whether a `Host` line still has a pattern matching hosts, negated ones only excluding them.
+fn has_patterns(line: &str) -> bool {
+    words(line)
+        .into_iter()
+        .skip(1)
+        .any(|range| !line[range].trim_start_matches('"').starts_with('!'))
+}
+
+/// Byte ranges of the words of a line, quotes included, up to a comment.
+fn words(line: &str) -> Vec<Range<usize>> {
+    let mut words = Vec::new();
+    let mut start = None;
+    let mut in_quotes = false;
+
+    for (i, c) in line.char_indices() {
+        // The keyword can be followed by an equal sign instead of spaces
+        let is_equal_sign = c == '=' && (words.is_empty() || (words.len() == 1 && start.is_none()));
+        if !in_quotes && (c.is_whitespace() || is_equal_sign) {
+            if let Some(start) = start.take() {
+                words.push(start..i);
+            }
+            continue;
+        }
+
+        if c == '#' && start.is_none() && !in_quotes {
+            return words;
+        }
+        if c == '"' {
+            in_quotes = !in_quotes;
+        }
+        start.get_or_insert(i);
+    }
+
+    if let Some(start) = start {
+        words.push(start..line.len());
+    }
+
+    words
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_edit_blocks() {
+        let lines = "Host a\n  User me\n\n# The b server\nHost b\n  User you\n"
+            .lines()
+            .map(ToString::to_string)
+            .collect::<Vec<_>>();
+
+        assert_eq!(block_range(&lines, 0), 0..3);
+        assert_eq!(block_range(&lines, 4), 4..6);
+
+        assert_eq!(
+            rename_pattern("Host web web-1 # old", "web", "new web").as_deref(),
+            Some("Host \"new web\" web-1 # old")
+        );
+        assert_eq!(
+            rename_pattern("  Host = \"web\" web-1", "web-1", "web-2").as_deref(),
+            Some("  Host = \"web\" web-2")
+        );
+        assert_eq!(rename_pattern("Host web # other", "other", "x"), None);
+    }
+
+    #[test]
+    fn test_remove_pattern() {
+        let removed = remove_pattern("Host web web-1 # old", "web").unwrap();
+        assert_eq!(removed, "Host web-1 # old");
+        assert!(has_patterns(&removed));
+
+        assert_eq!(
+            remove_pattern("  Host = \"web\" web-1", "web-1").as_deref(),
+            Some("  Host = \"web\"")
+        );
+
+        let removed = remove_pattern("Host web !web-1", "web").unwrap();
+        assert_eq!(removed, "Host !web-1");
+        assert!(!has_patterns(&removed));
+        assert!(!has_patterns(&remove_pattern("Host web", "web").unwrap()));
+
+        assert_eq!(remove_pattern("Host web # other", "other"), None);
+    }
+
+    #[test]
+    fn test_set_metadata_line() {
+        let mut lines = vec![
+            "Host a".to_string(),
+            "    User me".to_string(),
+            "Host b".to_string(),
+        ];
+
+        assert!(set_metadata_line(&mut lines, 0, "tags", "web"));
+        assert_eq!(lines[1], "    # sshs-tags: web");
+        assert!(set_metadata_line(&mut lines, 0, "tags", "web, db"));
+        assert_eq!(lines[1], "    # sshs-tags: web, db");
+        assert!(!set_metadata_line(&mut lines, 0, "tags", "web, db"));
+
+        assert!(set_metadata_line(&mut lines, 3, "tags", "db"));
+        assert_eq!(lines[4], "  # sshs-tags: db");
+
+        assert!(set_metadata_line(&mut lines, 0, "tags", ""));
+        assert_eq!(lines.len(), 4);
+        assert_eq!(lines[1], "    User me");
+    }
+
+    #[test]
+    fn test_set_entry_line() {
+        let mut lines = vec![
+            "Host a".to_string(),
+            "    User me".to_string(),
+            String::new(),
+            "Host b".to_string(),
+        ];
+
+        assert!(set_entry_line(&mut lines, 0, "ProxyJump", "bastion"));
+        assert_eq!(lines[2], "    ProxyJump bastion");
+        assert_eq!(lines[3], "");
+
+        lines[2] = "    proxyjump=old".to_string();
+        assert!(set_entry_line(&mut lines, 0, "ProxyJump", "a,b"));
+        assert_eq!(lines[2], "    ProxyJump a,b");
+        assert!(!set_entry_line(&mut lines, 0, "ProxyJump", "a,b"));
+
+        assert!(set_entry_line(&mut lines, 4, "ProxyJump", "a"));
+        assert_eq!(lines[5], "  ProxyJump a");
+    }
+
+    #[test]
+    fn test_cloned_block() {
+        let lines = "Host api api.prod
+  # sshs-tags: prod
+  HostName 10.0.0.1
+  User deploy
+
+Host other
+"
+        .lines()
+        .map(ToString::to_string)
+        .collect::<Vec<_>>();
+
+        assert_eq!(
+            cloned_block(&lines, 0, "api-staging", "10.1.0.1"),
+            [
+                "Host api-staging",
+                "  # sshs-tags: prod",
+                "  HostName 10.1.0.1",
+                "  User deploy"
+            ]
+        );
+    }
+}
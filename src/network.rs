@@ -0,0 +1,282 @@
+use serde::Deserialize;
+use std::net::Ipv4Addr;
+use std::process::{Command, Stdio};
+
+use crate::ssh;
+use crate::ssh_config::wildcard_match;
+
+/// Connection defaults applying while on a network, the first network of the settings
+/// matching the current one being used.
+///
+/// ```toml
+/// [[networks]]
+/// name = "office"
+/// ssid = ["Corp"]
+/// gateway = ["10.0.0.1"]
+/// hosts = ["*.corp"]
+/// direct = true
+///
+/// [[networks]]
+/// name = "off-site"
+/// hosts = ["*.corp"]
+/// jump = "bastion.example.com"
+/// ```
+#[derive(Debug, Clone, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Network {
+    pub name: String,
+    /// Names of the Wi-Fi networks, one of them being joined.
+    pub ssid: Vec<String>,
+    /// Addresses of the default gateway, one of them being in use.
+    pub gateway: Vec<String>,
+    /// Names of the network interfaces with `*` and `?` wildcards, one of them being up,
+    /// like `tun*` or `wg*` for a VPN.
+    pub interfaces: Vec<String>,
+    /// Names of the hosts the defaults apply to with `*` and `?` wildcards, all of them
+    /// when empty.
+    pub hosts: Vec<String>,
+    /// Connect directly, ignoring the `ProxyJump` and `ProxyCommand` of the hosts.
+    pub direct: bool,
+    /// Connect through this jump host.
+    pub jump: Option<String>,
+    /// Other arguments given to `ssh`.
+    pub args: Vec<String>,
+}
+
+impl Network {
+    /// Whether the network is the current one, a network without any condition always
+    /// matching.
+    #[must_use]
+    pub fn matches(&self, context: &Context) -> bool {
+        (self.ssid.is_empty()
+            || context
+                .ssid
+                .as_ref()
+                .is_some_and(|ssid| self.ssid.contains(ssid)))
+            && (self.gateway.is_empty()
+                || context
+                    .gateway
+                    .as_ref()
+                    .is_some_and(|gateway| self.gateway.contains(gateway)))
+            && (self.interfaces.is_empty()
+                || self.interfaces.iter().any(|pattern| {
+                    context
+                        .interfaces
+                        .iter()
+                        .any(|interface| wildcard_match(pattern, interface))
+                }))
+    }
+
+    #[must_use]
+    pub fn applies_to(&self, host: &ssh::Host) -> bool {
+        self.hosts.is_empty()
+            || self
+                .hosts
+                .iter()
+                .any(|pattern| wildcard_match(&pattern.to_lowercase(), &host.name.to_lowercase()))
+    }
+
+    /// Arguments of `ssh` applying the defaults.
+    #[must_use]
+    pub fn arguments(&self) -> Vec<String> {
+        let mut args = Vec::new();
+        if self.direct {
+            args.extend([
+                "-o".to_string(),
+                "ProxyJump=none".to_string(),
+                "-o".to_string(),
+                "ProxyCommand=none".to_string(),
+            ]);
+        }
+        if let Some(jump) = &self.jump {
+            args.extend(["-J".to_string(), jump.clone()]);
+        }
+        args.extend(self.args.iter().cloned());
+
+        args
+    }
+}
+
+/// What is known of the network the machine is on.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Context {
+    pub ssid: Option<String>,
+    pub gateway: Option<String>,
+    pub interfaces: Vec<String>,
+}
+
+impl Context {
+    /// Looks at the Wi-Fi network, the default gateway and the interfaces that are up, the ones
+    /// that cannot be found being left empty.
+    #[must_use]
+    pub fn detect() -> Context {
+        let context = if cfg!(target_os = "linux") {
+            Context {
+                ssid: run("iwgetid", &["-r"])
+                    .filter(|ssid| !ssid.is_empty())
+                    .or_else(|| {
+                        run("nmcli", &["-t", "-f", "active,ssid", "dev", "wifi"])
+                            .and_then(|output| active_nmcli_ssid(&output))
+                    }),
+                gateway: std::fs::read_to_string("/proc/net/route")
+                    .ok()
+                    .and_then(|routes| proc_route_gateway(&routes)),
+                interfaces: std::fs::read_dir("/sys/class/net")
+                    .map(|entries| {
+                        entries
+                            .filter_map(Result::ok)
+                            .filter(|entry| {
+                                std::fs::read_to_string(entry.path().join("operstate"))
+                                    .is_ok_and(|state| is_up(&state))
+                            })
+                            .filter_map(|entry| entry.file_name().into_string().ok())
+                            .collect()
+                    })
+                    .unwrap_or_default(),
+            }
+        } else if cfg!(target_os = "macos") {
+            Context {
+                ssid: run("networksetup", &["-getairportnetwork", "en0"])
+                    .and_then(|output| field(&output, "Current Wi-Fi Network")),
+                gateway: run("route", &["-n", "get", "default"])
+                    .and_then(|output| field(&output, "gateway")),
+                interfaces: run("ifconfig", &["-l", "-u"])
+                    .map(|output| output.split_whitespace().map(String::from).collect())
+                    .unwrap_or_default(),
+            }
+        } else if cfg!(windows) {
+            Context {
+                ssid: run("netsh", &["wlan", "show", "interfaces"])
+                    .and_then(|output| field(&output, "SSID")),
+                gateway: run("ipconfig", &[]).and_then(|output| field(&output, "Default Gateway")),
+                interfaces: Vec::new(),
+            }
+        } else {
+            Context::default()
+        };
+
+        log::debug!(context:? = context; "Detected network");
+        context
+    }
+}
+
+/// Output of a command, `None` when it cannot be run or fails.
+fn run(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program)
+        .args(args)
+        .stdin(Stdio::null())
+        .stderr(Stdio::null())
+        .output()
+        .ok()
+        .filter(|output| output.status.success())?;
+
+    Some(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+/// Whether the `operstate` of an interface of `/sys/class/net` is up, the tunnels of VPNs such as
+/// `WireGuard` not reporting their state.
+fn is_up(operstate: &str) -> bool {
+    matches!(operstate.trim(), "up" | "unknown")
+}
+
+/// Value of the first `key: value` line of the output with this key, the dots aligning the
+/// values of `ipconfig` being ignored.
+fn field(output: &str, key: &str) -> Option<String> {
+    output.lines().find_map(|line| {
+        let (name, value) = line.split_once(':')?;
+        let value = value.trim();
+        (name.trim().trim_end_matches(['.', ' ']) == key && !value.is_empty())
+            .then(|| value.to_string())
+    })
+}
+
+fn active_nmcli_ssid(output: &str) -> Option<String> {
+    output
+        .lines()
+        .find_map(|line| line.strip_prefix("yes:"))
+        .filter(|ssid| !ssid.is_empty())
+        .map(String::from)
+}
+
+/// Gateway of the default route of `/proc/net/route`, whose addresses are little-endian hex.
+fn proc_route_gateway(routes: &str) -> Option<String> {
+    routes.lines().skip(1).find_map(|line| {
+        let columns = line.split_whitespace().collect::<Vec<_>>();
+        if columns.get(1) != Some(&"00000000") {
+            return None;
+        }
+        let gateway = u32::from_str_radix(columns.get(2)?, 16).ok()?;
+
+        Some(Ipv4Addr::from(gateway.to_le_bytes()).to_string())
+    })
+}
+
+/// First network of the list matching the context.
+#[must_use]
+pub fn current<'a>(networks: &'a [Network], context: &Context) -> Option<&'a Network> {
+    networks.iter().find(|network| network.matches(context))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_detection_parsers() {
+        let routes = "Iface\tDestination\tGateway \tFlags\nwlan0\t0000A8C0\t00000000\t0001\nwlan0\t00000000\t0100A8C0\t0003\n";
+        assert_eq!(proc_route_gateway(routes).as_deref(), Some("192.168.0.1"));
+
+        assert_eq!(
+            field(
+                "   Default Gateway . . . . . . . . . : 10.0.0.1",
+                "Default Gateway"
+            )
+            .as_deref(),
+            Some("10.0.0.1")
+        );
+        assert_eq!(
+            field("    BSSID : aa:bb\n    SSID : Corp", "SSID").as_deref(),
+            Some("Corp")
+        );
+        assert_eq!(
+            active_nmcli_ssid("no:Guest\nyes:Corp\n").as_deref(),
+            Some("Corp")
+        );
+
+        assert!(is_up("up\n"));
+        assert!(is_up("unknown\n"));
+        assert!(!is_up("down\n"));
+        assert!(!is_up("lowerlayerdown\n"));
+    }
+
+    #[test]
+    fn test_current_network() {
+        let settings: crate::settings::Settings = toml::from_str(
+            "[[networks]]\nname = \"vpn\"\ninterfaces = [\"wg*\"]\n\n[[networks]]\nname = \"office\"\nssid = [\"Corp\"]\ngateway = [\"10.0.0.1\"]\ndirect = true\n\n[[networks]]\nname = \"off-site\"\njump = \"bastion\"",
+        )
+        .unwrap();
+        let networks = settings.networks;
+
+        let office = Context {
+            ssid: Some("Corp".to_string()),
+            gateway: Some("10.0.0.1".to_string()),
+            interfaces: vec!["lo".to_string(), "wlan0".to_string()],
+        };
+        assert_eq!(current(&networks, &office).unwrap().name, "office");
+
+        let guest = Context {
+            ssid: Some("Corp".to_string()),
+            gateway: Some("192.168.1.1".to_string()),
+            ..office.clone()
+        };
+        let off_site = current(&networks, &guest).unwrap();
+        assert_eq!(off_site.name, "off-site");
+        assert_eq!(off_site.arguments(), ["-J", "bastion"]);
+
+        let vpn = Context {
+            interfaces: vec!["wg0".to_string()],
+            ..guest
+        };
+        assert_eq!(current(&networks, &vpn).unwrap().name, "vpn");
+    }
+}
@@ -0,0 +1,163 @@
+use std::collections::{HashMap, HashSet};
+use std::net::{TcpStream, ToSocketAddrs};
+use std::sync::mpsc::{self, Receiver, Sender};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+/// Number of probes running at the same time.
+const WORKERS: usize = 8;
+
+/// Reachability of a host, as seen by the last probe.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Status {
+    Unknown,
+    Up,
+    Down,
+}
+
+/// Checks in the background whether hosts accept TCP connections.
+///
+/// Results are cached for `interval` so an address is never dialed more than once per interval.
+pub struct Prober {
+    interval: Duration,
+    statuses: HashMap<String, (Status, Instant)>,
+    pending: HashSet<String>,
+    queue: Sender<String>,
+    results: Receiver<(String, Status)>,
+    /// Probes collected by [`Prober::update`] since the last [`Prober::take_finished`].
+    finished: Vec<(String, Status)>,
+}
+
+impl Prober {
+    #[must_use]
+    pub fn new(timeout: Duration, interval: Duration) -> Prober {
+        let (queue, queue_receiver) = mpsc::channel::<String>();
+        let (results_sender, results) = mpsc::channel();
+        let queue_receiver = Arc::new(Mutex::new(queue_receiver));
+
+        for _ in 0..WORKERS {
+            let queue_receiver = Arc::clone(&queue_receiver);
+            let results_sender = results_sender.clone();
+
+            thread::spawn(move || loop {
+                let Ok(address) = queue_receiver.lock().map(|receiver| receiver.recv()) else {
+                    return;
+                };
+                let Ok(address) = address else {
+                    return;
+                };
+
+                let status = dial(&address, timeout);
+                log::debug!(address = address.as_str(), status:? = status; "Probed host");
+
+                if results_sender.send((address, status)).is_err() {
+                    return;
+                }
+            });
+        }
+
+        Prober {
+            interval,
+            statuses: HashMap::new(),
+            pending: HashSet::new(),
+            queue,
+            results,
+            finished: Vec::new(),
+        }
+    }
+
+    /// Queues a probe of the address unless it is already queued or its status is still fresh.
+    pub fn probe(&mut self, address: &str) {
+        if self.pending.contains(address) {
+            return;
+        }
+
+        if let Some((_, checked_at)) = self.statuses.get(address) {
+            if checked_at.elapsed() < self.interval {
+                return;
+            }
+        }
+
+        if self.queue.send(address.to_string()).is_ok() {
+            self.pending.insert(address.to_string());
+        }
+    }
+
+    /// Collects the finished probes, returns whether a status changed.
+    pub fn update(&mut self) -> bool {
+        let mut changed = false;
+
+        while let Ok((address, status)) = self.results.try_recv() {
+            self.pending.remove(&address);
+
+            let previous = self
+                .statuses
+                .insert(address.clone(), (status, Instant::now()));
+            changed |= previous.is_none_or(|(previous, _)| previous != status);
+            self.finished.push((address, status));
+        }
+
+        changed
+    }
+
+    /// Returns the addresses probed since the last call with their status.
+    pub fn take_finished(&mut self) -> Vec<(String, Status)> {
+        std::mem::take(&mut self.finished)
+    }
+
+    #[must_use]
+    pub fn status(&self, address: &str) -> Status {
+        self.statuses
+            .get(address)
+            .map_or(Status::Unknown, |(status, _)| *status)
+    }
+}
+
+/// Whether the address accepts TCP connections, dialed right away.
+#[must_use]
+pub fn is_reachable(address: &str, timeout: Duration) -> bool {
+    dial(address, timeout) == Status::Up
+}
+
+fn dial(address: &str, timeout: Duration) -> Status {
+    let Ok(addresses) = address.to_socket_addrs() else {
+        return Status::Down;
+    };
+
+    for address in addresses {
+        if TcpStream::connect_timeout(&address, timeout).is_ok() {
+            return Status::Up;
+        }
+    }
+
+    Status::Down
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::TcpListener;
+
+    #[test]
+    fn test_probe() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let up = listener.local_addr().unwrap().to_string();
+
+        let mut prober = Prober::new(Duration::from_secs(1), Duration::from_secs(60));
+        assert_eq!(prober.status(&up), Status::Unknown);
+
+        prober.probe(&up);
+        prober.probe(&up);
+        assert_eq!(prober.pending.len(), 1);
+
+        let deadline = Instant::now() + Duration::from_secs(5);
+        while !prober.update() && Instant::now() < deadline {
+            thread::sleep(Duration::from_millis(10));
+        }
+        assert_eq!(prober.status(&up), Status::Up);
+
+        prober.probe(&up);
+        assert!(prober.pending.is_empty());
+    }
+}
@@ -0,0 +1,195 @@
+use anyhow::Result;
+use std::collections::VecDeque;
+use std::io::{BufRead, BufReader, Read};
+use std::process::{Command, Stdio};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use crate::scheduler::{RateLimitArgs, Scheduler};
+use crate::ssh;
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    /// Wildcard pattern selecting the hosts by name or alias (can be repeated)
+    #[arg(short, long, required = true)]
+    search: Vec<String>,
+
+    /// Number of hosts to run the command on at the same time
+    #[arg(short, long, default_value_t = 10)]
+    jobs: usize,
+
+    #[command(flatten)]
+    rate_limit: RateLimitArgs,
+
+    /// Command to execute on the hosts
+    #[arg(last = true, required = true)]
+    command: Vec<String>,
+}
+
+struct Outcome {
+    host: String,
+    code: Option<i32>,
+    error: Option<String>,
+    duration: Duration,
+}
+
+/// Runs the command on every selected host and prints a summary.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration cannot be parsed, if no host matches or if
+/// the command failed on at least one host.
+pub fn run(config_paths: &[String], args: &Args) -> Result<()> {
+    let hosts = ssh::select_hosts(config_paths, &args.search)?
+        .into_iter()
+        .collect::<VecDeque<_>>();
+
+    let width = hosts
+        .iter()
+        .map(|host| host.name.len())
+        .max()
+        .unwrap_or_default();
+    let queue = Arc::new(Mutex::new(hosts));
+    let outcomes = Arc::new(Mutex::new(Vec::new()));
+    let scheduler = Arc::new(Scheduler::new(&args.rate_limit));
+
+    let workers = (0..args.jobs.max(1))
+        .map(|_| {
+            let queue = Arc::clone(&queue);
+            let outcomes = Arc::clone(&outcomes);
+            let scheduler = Arc::clone(&scheduler);
+            let command = args.command.clone();
+
+            thread::spawn(move || loop {
+                let Some(host) = queue.lock().ok().and_then(|mut queue| queue.pop_front()) else {
+                    break;
+                };
+
+                scheduler.wait_turn(&host.rate_limit_key());
+                let outcome = run_on_host(&host, &command, width);
+                if let Ok(mut outcomes) = outcomes.lock() {
+                    outcomes.push(outcome);
+                }
+            })
+        })
+        .collect::<Vec<_>>();
+
+    for worker in workers {
+        let _ = worker.join();
+    }
+
+    let mut outcomes = std::mem::take(
+        &mut *outcomes
+            .lock()
+            .map_err(|_| anyhow::anyhow!("Worker panicked"))?,
+    );
+    outcomes.sort_by(|a, b| a.host.cmp(&b.host));
+
+    print_summary(&outcomes, width);
+
+    let failures = outcomes.iter().filter(|o| o.code != Some(0)).count();
+    if failures > 0 {
+        anyhow::bail!("Command failed on {failures} of {} hosts", outcomes.len());
+    }
+
+    Ok(())
+}
+
+fn run_on_host(host: &ssh::Host, command: &[String], width: usize) -> Outcome {
+    let start = Instant::now();
+    let name = host.name.as_str();
+    log::info!(host = name, command:? = command; "Running command on host");
+
+    let child = Command::new("ssh")
+        .args(host.config_arguments())
+        .args(["-o", "BatchMode=yes", "-o", "RequestTTY=no"])
+        // A RemoteCommand from the configuration would conflict with the command.
+        .args(["-o", "RemoteCommand=none", name, "--"])
+        .args(command)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn();
+
+    let mut child = match child {
+        Ok(child) => child,
+        Err(err) => {
+            return Outcome {
+                host: name.to_string(),
+                code: None,
+                error: Some(err.to_string()),
+                duration: start.elapsed(),
+            }
+        }
+    };
+
+    let prefix = format!("{name:width$} |");
+    let stdout = child
+        .stdout
+        .take()
+        .map(|out| stream_lines(out, prefix.clone(), false));
+    let stderr = child
+        .stderr
+        .take()
+        .map(|err| stream_lines(err, prefix, true));
+
+    for stream in [stdout, stderr].into_iter().flatten() {
+        let _ = stream.join();
+    }
+
+    let (code, error) = match child.wait() {
+        Ok(status) => (status.code(), None),
+        Err(err) => (None, Some(err.to_string())),
+    };
+    log::info!(host = name, code:? = code; "Command finished on host");
+
+    Outcome {
+        host: name.to_string(),
+        code,
+        error,
+        duration: start.elapsed(),
+    }
+}
+
+fn stream_lines<R>(reader: R, prefix: String, is_stderr: bool) -> thread::JoinHandle<()>
+where
+    R: Read + Send + 'static,
+{
+    thread::spawn(move || {
+        for line in BufReader::new(reader).lines().map_while(Result::ok) {
+            if is_stderr {
+                eprintln!("{prefix} {line}");
+            } else {
+                println!("{prefix} {line}");
+            }
+        }
+    })
+}
+
+fn print_summary(outcomes: &[Outcome], width: usize) {
+    println!();
+    println!("{:width$}   STATUS   TIME", "HOST");
+
+    for outcome in outcomes {
+        let status = match (&outcome.error, outcome.code) {
+            (Some(error), _) => format!("error: {error}"),
+            (None, Some(0)) => "ok".to_string(),
+            (None, Some(code)) => format!("exit {code}"),
+            (None, None) => "killed".to_string(),
+        };
+
+        println!(
+            "{:width$}   {status:8} {:.1}s",
+            outcome.host,
+            outcome.duration.as_secs_f64()
+        );
+    }
+
+    let succeeded = outcomes.iter().filter(|o| o.code == Some(0)).count();
+    println!();
+    println!(
+        "{succeeded} succeeded, {} failed",
+        outcomes.len() - succeeded
+    );
+}
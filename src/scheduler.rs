@@ -0,0 +1,138 @@
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::thread;
+use std::time::{Duration, Instant};
+
+/// Options of the [`Scheduler`] shared by the commands connecting to many hosts.
+#[derive(clap::Args, Debug, Clone)]
+pub struct RateLimitArgs {
+    /// Minimum delay between two connections to the same destination (e.g. 500ms, 2s)
+    #[arg(long, value_name = "DURATION", value_parser = parse_duration, default_value = "1s")]
+    pub min_interval: Duration,
+
+    /// Maximum random delay added before each connection (e.g. 250ms)
+    #[arg(long, value_name = "DURATION", value_parser = parse_duration, default_value = "250ms")]
+    pub jitter: Duration,
+}
+
+/// Spaces out the connections made to each destination, so that batch operations going
+/// through the same server do not look like a brute force attempt to it.
+#[derive(Debug)]
+pub struct Scheduler {
+    min_interval: Duration,
+    jitter: Duration,
+    /// When the next connection to each destination is allowed.
+    next_slots: Mutex<HashMap<String, Instant>>,
+}
+
+impl Scheduler {
+    #[must_use]
+    pub fn new(args: &RateLimitArgs) -> Scheduler {
+        Scheduler {
+            min_interval: args.min_interval,
+            jitter: args.jitter,
+            next_slots: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Blocks until a connection to the destination is allowed and reserves it.
+    pub fn wait_turn(&self, destination: &str) {
+        let now = Instant::now();
+        let start = {
+            let Ok(mut next_slots) = self.next_slots.lock() else {
+                return;
+            };
+
+            let start = next_slots
+                .get(destination)
+                .map_or(now, |slot| (*slot).max(now))
+                + random_delay(self.jitter);
+            next_slots.insert(destination.to_string(), start + self.min_interval);
+
+            start
+        };
+
+        let delay = start.saturating_duration_since(now);
+        if !delay.is_zero() {
+            log::debug!(destination = destination, delay:? = delay; "Waiting before connecting");
+            thread::sleep(delay);
+        }
+    }
+}
+
+fn random_delay(max: Duration) -> Duration {
+    if max.is_zero() {
+        return Duration::ZERO;
+    }
+
+    let mut bytes = [0u8; 8];
+    if getrandom::getrandom(&mut bytes).is_err() {
+        return Duration::ZERO;
+    }
+
+    let max_nanos = u64::try_from(max.as_nanos()).unwrap_or(u64::MAX);
+    Duration::from_nanos(u64::from_le_bytes(bytes) % max_nanos)
+}
+
+/// Parses durations like `500ms`, `2s`, `1m` or `30d`, a number alone being seconds.
+///
+/// # Errors
+///
+/// Will return `Err` if the value is not a number followed by an optional unit.
+pub fn parse_duration(value: &str) -> Result<Duration, String> {
+    let value = value.trim();
+    let split = value
+        .find(|c: char| !c.is_ascii_digit() && c != '.')
+        .unwrap_or(value.len());
+    let (number, unit) = value.split_at(split);
+
+    let number = number
+        .parse::<f64>()
+        .map_err(|_| format!("invalid duration `{value}`"))?;
+    let seconds = match unit.trim() {
+        "ms" => number / 1000.0,
+        "" | "s" => number,
+        "m" => number * 60.0,
+        "h" => number * 3600.0,
+        "d" => number * 86400.0,
+        unit => {
+            return Err(format!(
+                "unknown duration unit `{unit}`, use ms, s, m, h or d"
+            ))
+        }
+    };
+
+    Duration::try_from_secs_f64(seconds).map_err(|err| err.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_duration() {
+        assert_eq!(parse_duration("500ms"), Ok(Duration::from_millis(500)));
+        assert_eq!(parse_duration("2"), Ok(Duration::from_secs(2)));
+        assert_eq!(parse_duration("1.5s"), Ok(Duration::from_millis(1500)));
+        assert_eq!(parse_duration("1m"), Ok(Duration::from_secs(60)));
+        assert!(parse_duration("fast").is_err());
+        assert_eq!(parse_duration("30d"), Ok(Duration::from_secs(30 * 86400)));
+        assert!(parse_duration("1w").is_err());
+    }
+
+    #[test]
+    fn test_wait_turn() {
+        let scheduler = Scheduler::new(&RateLimitArgs {
+            min_interval: Duration::from_millis(50),
+            jitter: Duration::ZERO,
+        });
+
+        let start = Instant::now();
+        scheduler.wait_turn("a:22");
+        scheduler.wait_turn("b:22");
+        assert!(start.elapsed() < Duration::from_millis(50));
+
+        scheduler.wait_turn("a:22");
+        assert!(start.elapsed() >= Duration::from_millis(50));
+    }
+}
@@ -1,19 +1,17 @@
 type SearchableFn<T> = dyn FnMut(&&T, &str) -> bool;
+type NarrowsFn = dyn Fn(&str, &str) -> bool;
 
-pub struct Searchable<T>
-where
-    T: Clone,
-{
+pub struct Searchable<T> {
     vec: Vec<T>,
 
     filter: Box<SearchableFn<T>>,
-    filtered: Vec<T>,
+    /// Indexes in `vec` of the items matching `search_value`.
+    filtered: Vec<usize>,
+    search_value: String,
+    narrows: Option<Box<NarrowsFn>>,
 }
 
-impl<T> Searchable<T>
-where
-    T: Clone,
-{
+impl<T> Searchable<T> {
     #[must_use]
     pub fn new<P>(vec: Vec<T>, search_value: &str, predicate: P) -> Self
     where
@@ -24,23 +22,51 @@ where
 
             filter: Box::new(predicate),
             filtered: Vec::new(),
+            search_value: String::new(),
+            narrows: None,
         };
         searchable.search(search_value);
         searchable
     }
 
+    /// Lets a search extending the previous one only filter the items that matched it,
+    /// when `narrows(previous, value)` tells that no other item can match.
+    ///
+    /// Typing keeps extending the search, this keeps it fast with many items.
+    #[must_use]
+    pub fn with_narrowing<N>(mut self, narrows: N) -> Self
+    where
+        N: Fn(&str, &str) -> bool + 'static,
+    {
+        self.narrows = Some(Box::new(narrows));
+        self
+    }
+
     pub fn search(&mut self, value: &str) {
         if value.is_empty() {
-            self.filtered = self.vec.clone();
+            self.filtered = (0..self.vec.len()).collect();
+            self.search_value.clear();
             return;
         }
 
-        self.filtered = self
-            .vec
-            .iter()
-            .filter(|host| (self.filter)(host, value))
-            .cloned()
+        let previous = self.search_value.as_str();
+        let narrowing = !previous.is_empty()
+            && value.starts_with(previous)
+            && self
+                .narrows
+                .as_ref()
+                .is_some_and(|narrows| narrows(previous, value));
+        let candidates = if narrowing {
+            std::mem::take(&mut self.filtered)
+        } else {
+            (0..self.vec.len()).collect()
+        };
+
+        self.filtered = candidates
+            .into_iter()
+            .filter(|index| (self.filter)(&&self.vec[*index], value))
             .collect();
+        self.search_value = value.to_string();
     }
 
     #[allow(clippy::must_use_candidate)]
@@ -53,34 +79,92 @@ where
         self.filtered.is_empty()
     }
 
-    pub fn non_filtered_iter(&self) -> std::slice::Iter<T> {
+    pub fn non_filtered_iter(&self) -> std::slice::Iter<'_, T> {
         self.vec.iter()
     }
 
-    pub fn iter(&self) -> std::slice::Iter<T> {
-        self.filtered.iter()
+    #[must_use]
+    pub fn iter(&self) -> Iter<'_, T> {
+        Iter {
+            vec: &self.vec,
+            indexes: self.filtered.iter(),
+        }
     }
 }
 
-impl<'a, T> IntoIterator for &'a Searchable<T>
-where
-    T: Clone,
-{
+/// Iterator over the items matching the search.
+pub struct Iter<'a, T> {
+    vec: &'a [T],
+    indexes: std::slice::Iter<'a, usize>,
+}
+
+impl<'a, T> Iterator for Iter<'a, T> {
     type Item = &'a T;
-    type IntoIter = std::slice::Iter<'a, T>;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        self.indexes.next().map(|index| &self.vec[*index])
+    }
+
+    fn size_hint(&self) -> (usize, Option<usize>) {
+        self.indexes.size_hint()
+    }
+}
+
+impl<'a, T> IntoIterator for &'a Searchable<T> {
+    type Item = &'a T;
+    type IntoIter = Iter<'a, T>;
 
     fn into_iter(self) -> Self::IntoIter {
-        self.filtered.iter()
+        self.iter()
     }
 }
 
-impl<T> std::ops::Index<usize> for Searchable<T>
-where
-    T: Clone,
-{
+impl<T> std::ops::Index<usize> for Searchable<T> {
     type Output = T;
 
     fn index(&self, index: usize) -> &Self::Output {
-        &self.filtered[index]
+        &self.vec[self.filtered[index]]
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::Cell;
+    use std::rc::Rc;
+
+    #[test]
+    fn test_narrowing_search() {
+        let calls = Rc::new(Cell::new(0));
+        let counter = Rc::clone(&calls);
+        let mut searchable = Searchable::new(
+            vec!["web-1", "web-2", "db-1"],
+            "",
+            move |item: &&&str, value: &str| {
+                counter.set(counter.get() + 1);
+                item.contains(value)
+            },
+        )
+        .with_narrowing(|_, _| true);
+
+        searchable.search("web");
+        assert_eq!(
+            searchable.iter().copied().collect::<Vec<_>>(),
+            ["web-1", "web-2"]
+        );
+        assert_eq!(calls.get(), 3);
+
+        searchable.search("web-2");
+        assert_eq!(searchable.iter().copied().collect::<Vec<_>>(), ["web-2"]);
+        assert_eq!(calls.get(), 5);
+
+        // Not an extension of the previous search, every item is filtered again
+        searchable.search("-1");
+        assert_eq!(
+            searchable.iter().copied().collect::<Vec<_>>(),
+            ["web-1", "db-1"]
+        );
+        assert_eq!(calls.get(), 8);
+        assert_eq!(searchable[1], "db-1");
     }
 }
@@ -0,0 +1,322 @@
+use anyhow::{anyhow, Result};
+use std::path::PathBuf;
+use std::process::{Command, Stdio};
+
+/// Prefix of the executables providing secrets, `sshs-secret-pass` provides the `pass:` references.
+const PROVIDER_PREFIX: &str = "sshs-secret-";
+
+/// A store credentials are read from.
+///
+/// Every credential integration implements this trait so that sshs only deals with
+/// references like `pass:servers/db` and never with the store itself.
+pub trait Secrets: Send + Sync {
+    /// Name of the provider, the scheme of the references it resolves.
+    fn name(&self) -> &str;
+
+    /// Returns the secret the reference points to.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the secret cannot be read from the store.
+    fn get(&self, reference: &str) -> Result<String>;
+}
+
+/// Provider backed by an `sshs-secret-NAME` executable.
+///
+/// The executable is run as `sshs-secret-NAME get REFERENCE` with the whole reference,
+/// scheme included. It prints the secret on stdout and exits with 0, or explains the
+/// failure on stderr and exits with another status. A single trailing newline is dropped.
+#[derive(Debug, Clone)]
+pub struct ExecProvider {
+    name: String,
+    program: PathBuf,
+}
+
+impl ExecProvider {
+    #[must_use]
+    pub fn new(name: &str, program: PathBuf) -> ExecProvider {
+        ExecProvider {
+            name: name.to_string(),
+            program,
+        }
+    }
+}
+
+impl Secrets for ExecProvider {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn get(&self, reference: &str) -> Result<String> {
+        log::debug!(provider = self.name.as_str(), program:? = self.program; "Reading secret");
+        let mut command = Command::new(&self.program);
+        command.args(["get", reference]);
+
+        read_secret(command, reference)
+    }
+}
+
+/// Fields of a Bitwarden item `bw get` can print, `password` being read when the reference
+/// does not end with one.
+const BITWARDEN_FIELDS: [&str; 5] = ["username", "password", "totp", "notes", "uri"];
+
+/// Password managers read through their own command line, unless an `sshs-secret-NAME`
+/// executable has the same name.
+///
+/// - `pass:servers/db` runs `pass show servers/db`, the first line being the secret.
+/// - `op://vault/item/field` runs `op read op://vault/item/field`.
+/// - `bw:item` and `bw:item/username` run `bw get password item` and `bw get username item`,
+///   the vault being unlocked beforehand with `BW_SESSION` set.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Manager {
+    Pass,
+    OnePassword,
+    Bitwarden,
+}
+
+impl Manager {
+    pub const ALL: [Manager; 3] = [Manager::Pass, Manager::OnePassword, Manager::Bitwarden];
+
+    /// The program and its arguments printing the secret.
+    fn command(self, reference: &str) -> Vec<String> {
+        let path = reference
+            .split_once(':')
+            .map_or(reference, |(_, path)| path);
+
+        let args = match self {
+            Manager::Pass => vec!["pass", "show", path],
+            Manager::OnePassword => vec!["op", "read", reference],
+            Manager::Bitwarden => {
+                let (item, field) = match path.rsplit_once('/') {
+                    Some((item, field)) if BITWARDEN_FIELDS.contains(&field) => (item, field),
+                    _ => (path, "password"),
+                };
+                vec!["bw", "get", field, item]
+            }
+        };
+
+        args.into_iter().map(ToString::to_string).collect()
+    }
+}
+
+impl Secrets for Manager {
+    fn name(&self) -> &str {
+        match self {
+            Manager::Pass => "pass",
+            Manager::OnePassword => "op",
+            Manager::Bitwarden => "bw",
+        }
+    }
+
+    fn get(&self, reference: &str) -> Result<String> {
+        let args = self.command(reference);
+        log::debug!(provider = self.name(), program = args[0].as_str(); "Reading secret");
+        let mut command = Command::new(&args[0]);
+        command.args(&args[1..]);
+
+        let secret = read_secret(command, reference)?;
+        Ok(match self {
+            Manager::Pass => secret.lines().next().unwrap_or_default().to_string(),
+            Manager::OnePassword | Manager::Bitwarden => secret,
+        })
+    }
+}
+
+/// Runs the command printing a secret, a single trailing newline being dropped.
+fn read_secret(mut command: Command, reference: &str) -> Result<String> {
+    let program = command.get_program().to_string_lossy().to_string();
+    let output = command
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow!("Failed to run {program}: {err}"))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "{program} failed to get `{reference}`: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    let mut secret = String::from_utf8(output.stdout)?;
+    if secret.ends_with('\n') {
+        secret.pop();
+        if secret.ends_with('\r') {
+            secret.pop();
+        }
+    }
+
+    Ok(secret)
+}
+
+/// The secret providers available, looked up by the scheme of the references.
+#[derive(Default)]
+pub struct Registry {
+    providers: Vec<Box<dyn Secrets>>,
+}
+
+impl Registry {
+    /// Registers the `sshs-secret-*` executables found on the `PATH`, then the password
+    /// managers of [`Manager`] none of them replaces.
+    ///
+    /// When several directories provide the same name, the first one wins like it would in a shell.
+    #[must_use]
+    pub fn discover() -> Registry {
+        let mut registry = Registry::default();
+
+        for directory in std::env::var_os("PATH")
+            .iter()
+            .flat_map(std::env::split_paths)
+        {
+            let Ok(entries) = std::fs::read_dir(&directory) else {
+                continue;
+            };
+
+            for entry in entries.flatten() {
+                let program = entry.path();
+                let Some(name) = program
+                    .file_stem()
+                    .and_then(|stem| stem.to_str())
+                    .and_then(|stem| stem.strip_prefix(PROVIDER_PREFIX))
+                else {
+                    continue;
+                };
+
+                if name.is_empty() || !program.is_file() || registry.provider(name).is_some() {
+                    continue;
+                }
+
+                log::debug!(name = name, program:? = program; "Found secret provider");
+                let name = name.to_string();
+                registry.register(Box::new(ExecProvider::new(&name, program)));
+            }
+        }
+
+        for manager in Manager::ALL {
+            if registry.provider(manager.name()).is_none() {
+                registry.register(Box::new(manager));
+            }
+        }
+
+        registry
+    }
+
+    /// Adds a provider, replacing the one with the same name.
+    pub fn register(&mut self, provider: Box<dyn Secrets>) {
+        self.providers
+            .retain(|existing| existing.name() != provider.name());
+        self.providers.push(provider);
+    }
+
+    pub fn providers(&self) -> impl Iterator<Item = &dyn Secrets> {
+        self.providers.iter().map(AsRef::as_ref)
+    }
+
+    #[must_use]
+    pub fn provider(&self, name: &str) -> Option<&dyn Secrets> {
+        self.providers().find(|provider| provider.name() == name)
+    }
+
+    /// Resolves a `PROVIDER:PATH` reference with the provider named by its scheme.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the reference has no scheme, if no provider has its name or if
+    /// the provider fails.
+    pub fn get(&self, reference: &str) -> Result<String> {
+        let Some((scheme, _)) = reference.split_once(':') else {
+            anyhow::bail!("Secret reference `{reference}` should look like PROVIDER:PATH");
+        };
+
+        let Some(provider) = self.provider(scheme) else {
+            anyhow::bail!("No secret provider named `{scheme}`, install {PROVIDER_PREFIX}{scheme} in your PATH");
+        };
+
+        provider.get(reference)
+    }
+}
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    #[command(subcommand)]
+    command: SecretCommand,
+}
+
+#[derive(clap::Subcommand, Debug)]
+enum SecretCommand {
+    /// List the secret providers found in the PATH
+    List,
+
+    /// Print the secret a PROVIDER:PATH reference points to, to check a provider works
+    Get { reference: String },
+}
+
+/// # Errors
+///
+/// Will return `Err` if the secret cannot be read.
+pub fn run(args: &Args) -> Result<()> {
+    let registry = Registry::discover();
+
+    match &args.command {
+        SecretCommand::List => {
+            for provider in registry.providers() {
+                println!("{}", provider.name());
+            }
+        }
+        SecretCommand::Get { reference } => println!("{}", registry.get(reference)?),
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    struct Static {
+        name: String,
+    }
+
+    impl Secrets for Static {
+        fn name(&self) -> &str {
+            &self.name
+        }
+
+        fn get(&self, reference: &str) -> Result<String> {
+            Ok(format!("secret of {reference}"))
+        }
+    }
+
+    #[test]
+    fn test_registry_get() {
+        let mut registry = Registry::default();
+        registry.register(Box::new(Static {
+            name: "static".to_string(),
+        }));
+
+        assert_eq!(
+            registry.get("static:servers/db").unwrap(),
+            "secret of static:servers/db"
+        );
+        assert!(registry.get("vault:servers/db").is_err());
+        assert!(registry.get("servers/db").is_err());
+    }
+
+    #[test]
+    fn test_manager_commands() {
+        assert_eq!(
+            Manager::Pass.command("pass:servers/db"),
+            ["pass", "show", "servers/db"]
+        );
+        assert_eq!(
+            Manager::OnePassword.command("op://vault/item/field"),
+            ["op", "read", "op://vault/item/field"]
+        );
+        assert_eq!(
+            Manager::Bitwarden.command("bw:github/username"),
+            ["bw", "get", "username", "github"]
+        );
+        assert_eq!(
+            Manager::Bitwarden.command("bw:servers/db"),
+            ["bw", "get", "password", "servers/db"]
+        );
+    }
+}
@@ -0,0 +1,397 @@
+use serde::{de::DeserializeOwned, Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+use crate::hooks::Hook;
+use crate::network::Network;
+use crate::ssh;
+use crate::sync::SyncSettings;
+use crate::vault;
+
+/// Preferences of sshs, read from `~/.config/sshs/config.toml`.
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Settings {
+    /// Arguments of sshs given before the ones of the command line, like `["--tree", "--ping"]`.
+    /// The command line overrides their options, but cannot turn off the flags they turn on.
+    pub args: Vec<String>,
+    /// Colors of the interface.
+    pub theme: Theme,
+    /// Columns of the list after the name of the hosts, in their order.
+    pub columns: Option<Vec<Column>>,
+    /// Keys doing what a key of sshs does, like `"alt+t" = "ctrl+t"`.
+    pub keys: BTreeMap<String, String>,
+    /// Commands that can be run on the selected host from the actions menu.
+    pub actions: Vec<Action>,
+    /// Commands run before connecting to the hosts and after disconnecting from them.
+    pub hooks: Vec<Hook>,
+    /// Workarounds applied when connecting to the hosts tagged with the name of the profile.
+    pub profiles: BTreeMap<String, Profile>,
+    /// Forwardings enabled when sshs starts, they can be toggled for the session.
+    pub session: SessionOptions,
+    /// Defaults of the connections depending on the network the machine is on.
+    pub networks: Vec<Network>,
+    /// Generators whose hosts are kept up to date by `sshs sync`.
+    pub sync: Option<SyncSettings>,
+    /// Roles of Vault signing the keys of the hosts before connecting.
+    pub vault: Vec<vault::Signer>,
+    /// Command templates of the hosts reached with another protocol than SSH.
+    pub protocols: Protocols,
+}
+
+#[derive(Debug, Clone, Copy, Default, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum Theme {
+    #[default]
+    Blue,
+    Slate,
+    Emerald,
+    Teal,
+    Violet,
+    Rose,
+    Amber,
+}
+
+/// A column of the list of hosts, the name always coming first.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Column {
+    Aliases,
+    User,
+    #[serde(alias = "target")]
+    Destination,
+    Port,
+    #[serde(alias = "key")]
+    IdentityFile,
+    #[serde(alias = "proxy")]
+    ProxyCommand,
+    #[serde(alias = "jump")]
+    ProxyJump,
+    LocalCommand,
+    Tags,
+    LastConnected,
+}
+
+impl Column {
+    pub const ALL: [Column; 10] = [
+        Column::Aliases,
+        Column::User,
+        Column::Destination,
+        Column::Port,
+        Column::IdentityFile,
+        Column::ProxyCommand,
+        Column::ProxyJump,
+        Column::LocalCommand,
+        Column::Tags,
+        Column::LastConnected,
+    ];
+
+    #[must_use]
+    pub fn title(self) -> &'static str {
+        match self {
+            Column::Aliases => "Aliases",
+            Column::User => "User",
+            Column::Destination => "Destination",
+            Column::Port => "Port",
+            Column::IdentityFile => "IdentityFile",
+            Column::ProxyCommand => "Proxy",
+            Column::ProxyJump => "Jump",
+            Column::LocalCommand => "Local command",
+            Column::Tags => "Tags",
+            Column::LastConnected => "Last connected",
+        }
+    }
+}
+
+/// A command listed in the actions menu.
+///
+/// ```toml
+/// [[actions]]
+/// name = "ping"
+/// key = "p"
+/// command = "ping -c 4 %h"
+/// ```
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Action {
+    pub name: String,
+    /// Key running the action once the menu is open.
+    pub key: char,
+    /// Command run with the terminal released, `%h`, `%n`, `%p` and `%r` being replaced
+    /// like in the SSH configuration.
+    pub command: String,
+}
+
+/// Workarounds for hosts that need special handling.
+///
+/// ```toml
+/// [profiles.legacy]
+/// no_agent = true
+/// force_password = true
+/// no_multiplexing = true
+/// env = { LC_ALL = "C" }
+/// args = ["-o", "KexAlgorithms=+diffie-hellman-group1-sha1"]
+/// ```
+#[derive(Debug, Clone, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Profile {
+    /// Never forward the agent, even if the host or the command template asks for it.
+    pub no_agent: bool,
+    /// Log in with a password instead of a key.
+    pub force_password: bool,
+    /// Open a connection of its own instead of sharing one with `--control-persist`.
+    pub no_multiplexing: bool,
+    /// Environment variables sent to the host with `SetEnv`.
+    pub env: BTreeMap<String, String>,
+    /// Other arguments given to `ssh`.
+    pub args: Vec<String>,
+}
+
+impl Profile {
+    /// Arguments of `ssh` applying the workarounds.
+    #[must_use]
+    pub fn arguments(&self) -> Vec<String> {
+        let mut args = Vec::new();
+        if self.no_agent {
+            args.push(ssh::NO_AGENT_FORWARDING.to_string());
+        }
+        if self.force_password {
+            args.extend([
+                "-o".to_string(),
+                "PreferredAuthentications=password,keyboard-interactive".to_string(),
+                "-o".to_string(),
+                "PubkeyAuthentication=no".to_string(),
+            ]);
+        }
+        if self.no_multiplexing {
+            args.extend([
+                "-o".to_string(),
+                "ControlMaster=no".to_string(),
+                "-o".to_string(),
+                "ControlPath=none".to_string(),
+            ]);
+        }
+        if !self.env.is_empty() {
+            let env = self
+                .env
+                .iter()
+                .map(|(name, value)| format!("{name}={}", quote_env_value(value)))
+                .collect::<Vec<_>>();
+            args.extend(["-o".to_string(), format!("SetEnv={}", env.join(" "))]);
+        }
+        args.extend(self.args.iter().cloned());
+
+        args
+    }
+}
+
+/// Quotes a value of `SetEnv` the way `ssh` splits its variables, when it has to be.
+fn quote_env_value(value: &str) -> String {
+    if !value.is_empty()
+        && !value
+            .chars()
+            .any(|c| c.is_whitespace() || matches!(c, '"' | '\'' | '\\' | '=' | '#'))
+    {
+        return value.to_string();
+    }
+
+    format!("\"{}\"", value.replace('\\', "\\\\").replace('"', "\\\""))
+}
+
+/// Forwardings and compression of the connections made from sshs.
+///
+/// ```toml
+/// [session]
+/// x11 = "trusted"
+/// agent = true
+/// compression = true
+/// ```
+#[derive(Debug, Clone, Copy, Default, Deserialize, PartialEq, Eq)]
+#[serde(default, deny_unknown_fields)]
+pub struct SessionOptions {
+    pub x11: X11Forwarding,
+    /// Forward the agent, with `-A`.
+    pub agent: bool,
+    /// Compress the connection, with `-C`.
+    pub compression: bool,
+}
+
+#[derive(Debug, Clone, Copy, Default, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum X11Forwarding {
+    #[default]
+    Off,
+    /// `-X`, the X11 security extension restricting what the remote clients can do.
+    Untrusted,
+    /// `-Y`, the remote clients having full access to the display.
+    Trusted,
+}
+
+impl X11Forwarding {
+    #[must_use]
+    pub fn next(self) -> Self {
+        match self {
+            X11Forwarding::Off => X11Forwarding::Untrusted,
+            X11Forwarding::Untrusted => X11Forwarding::Trusted,
+            X11Forwarding::Trusted => X11Forwarding::Off,
+        }
+    }
+}
+
+impl SessionOptions {
+    /// Arguments of `ssh` enabling the options.
+    #[must_use]
+    pub fn arguments(&self) -> Vec<&'static str> {
+        let mut args = Vec::new();
+        match self.x11 {
+            X11Forwarding::Off => {}
+            X11Forwarding::Untrusted => args.push("-X"),
+            X11Forwarding::Trusted => args.push("-Y"),
+        }
+        if self.agent {
+            args.push("-A");
+        }
+        if self.compression {
+            args.push("-C");
+        }
+
+        args
+    }
+}
+
+/// Command templates of the hosts with a `# sshs-protocol:` comment, the one of `--template`
+/// being used for SSH.
+///
+/// ```toml
+/// [protocols]
+/// telnet = "telnet -l {{{user}}} {{{destination}}}"
+/// console = "ipmitool -I lanplus -H {{{destination}}} -U {{{user}}} -P {{secret \"pass:bmc\"}} sol activate"
+/// ```
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Protocols {
+    pub telnet: String,
+    /// IPMI Serial over LAN, `ipmitool` reading the password from `IPMI_PASSWORD` by default.
+    pub console: String,
+    /// Shell in a pod, bash when it has one.
+    pub kubernetes: String,
+    /// Remote desktop, with `mstsc` on Windows and `xfreerdp` elsewhere.
+    pub rdp: String,
+}
+
+impl Default for Protocols {
+    fn default() -> Self {
+        Protocols {
+            telnet: "telnet {{{destination}}} {{#if port}}{{{port}}}{{/if}}".to_string(),
+            console: "ipmitool -I lanplus -H {{{destination}}} {{#if user}}-U {{{user}}}{{/if}} -E sol activate".to_string(),
+            rdp: if cfg!(windows) {
+                "mstsc /v:{{{destination}}}{{#if port}}:{{{port}}}{{/if}}".to_string()
+            } else {
+                "xfreerdp /v:{{{destination}}}{{#if port}}:{{{port}}}{{/if}} {{#if user}}/u:{{{user}}}{{/if}} /dynamic-resolution".to_string()
+            },
+            kubernetes: "kubectl exec -it {{#if context}}--context {{{context}}}{{/if}} {{#if namespace}}-n {{{namespace}}}{{/if}} {{{destination}}} -- sh -c \"command -v bash >/dev/null && exec bash || exec sh\"".to_string(),
+        }
+    }
+}
+
+impl Protocols {
+    /// The template of the protocol, `None` for SSH.
+    #[must_use]
+    pub fn template(&self, protocol: ssh::Protocol) -> Option<&str> {
+        match protocol {
+            ssh::Protocol::Ssh => None,
+            ssh::Protocol::Telnet => Some(&self.telnet),
+            ssh::Protocol::Console => Some(&self.console),
+            ssh::Protocol::Kubernetes => Some(&self.kubernetes),
+            ssh::Protocol::Rdp => Some(&self.rdp),
+        }
+    }
+}
+
+/// Directory of the files configuring sshs, following the XDG base directory specification.
+#[must_use]
+pub fn config_dir() -> PathBuf {
+    let config_home = std::env::var("XDG_CONFIG_HOME")
+        .ok()
+        .filter(|dir| !dir.is_empty())
+        .unwrap_or_else(|| shellexpand::tilde("~/.config").to_string());
+
+    PathBuf::from(config_home).join("sshs")
+}
+
+#[must_use]
+pub fn path() -> PathBuf {
+    config_dir().join("config.toml")
+}
+
+/// Reads a TOML file, the defaults applying when it does not exist.
+///
+/// # Errors
+///
+/// Will return `Err` if the file cannot be read or is not valid.
+pub fn read_toml<T: DeserializeOwned + Default>(path: &Path) -> anyhow::Result<T> {
+    let content = match std::fs::read_to_string(path) {
+        Ok(content) => content,
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(T::default()),
+        Err(err) => return Err(err.into()),
+    };
+
+    toml::from_str(&content).map_err(|err| anyhow::anyhow!("Invalid {}: {err}", path.display()))
+}
+
+impl Settings {
+    /// Reads the settings, the defaults applying when the file does not exist.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the file cannot be read or is not valid.
+    pub fn load() -> anyhow::Result<Settings> {
+        read_toml(&path())
+    }
+
+    /// Profiles applying to the host, the ones named after its tags or its `Tag`.
+    pub fn profiles_for<'a>(
+        &'a self,
+        host: &'a ssh::Host,
+    ) -> impl Iterator<Item = (&'a String, &'a Profile)> {
+        self.profiles.iter().filter(|(name, _)| {
+            host.tags.contains(name) || host.tag.as_ref().is_some_and(|tag| tag == *name)
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_profile_arguments() {
+        let profile: Profile = toml::from_str(
+            "no_agent = true\nno_multiplexing = true\nenv = { LC_ALL = \"C\", LANG = \"C\", GREETING = 'say \"hi\"', OPTS = \"a=b\" }\nargs = [\"-4\"]",
+        )
+        .unwrap();
+
+        assert_eq!(
+            profile.arguments(),
+            [
+                "-a",
+                "-o",
+                "ControlMaster=no",
+                "-o",
+                "ControlPath=none",
+                "-o",
+                "SetEnv=GREETING=\"say \\\"hi\\\"\" LANG=C LC_ALL=C OPTS=\"a=b\"",
+                "-4"
+            ]
+        );
+    }
+
+    #[test]
+    fn test_session_arguments() {
+        let settings: Settings =
+            toml::from_str("[session]\nx11 = \"trusted\"\ncompression = true").unwrap();
+
+        assert_eq!(settings.session.arguments(), ["-Y", "-C"]);
+        assert_eq!(settings.session.x11.next(), X11Forwarding::Off);
+    }
+}
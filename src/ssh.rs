@@ -1,25 +1,385 @@
 use anyhow::anyhow;
-use handlebars::Handlebars;
+use handlebars::{
+    Context, Handlebars, Helper, HelperResult, Output, RenderContext, RenderErrorReason,
+};
 use itertools::Itertools;
-use serde::Serialize;
-use std::collections::VecDeque;
-use std::process::Command;
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::path::{Path, PathBuf};
+use std::process::{Command, ExitStatus};
+use std::time::Duration;
 
+use crate::clock;
+use crate::generate::GeneratedHost;
+use crate::secrets;
 use crate::ssh_config::{self, parser_error::ParseError, HostVecExt};
+use crate::state;
 
 #[derive(Debug, Serialize, Clone)]
 pub struct Host {
     pub name: String,
     pub aliases: String,
+    /// Name of the host whose `Host` line also lists this one, for the rows made by
+    /// [`expand_aliases`].
+    pub alias_of: Option<String>,
     pub user: Option<String>,
     pub destination: String,
     pub port: Option<String>,
+    /// Ports tried in order when the port is unreachable, from a `# sshs-ports:` comment.
+    pub fallback_ports: Vec<u16>,
+    pub identity_file: Option<String>,
+    pub forward_agent: Option<String>,
+    pub tag: Option<String>,
+    /// Tags given from sshs, read from a `# sshs-tags:` comment.
+    pub tags: Vec<String>,
     pub proxy_command: Option<String>,
+    /// The `ProxyCommand` before its tokens are expanded, the same for all the hosts behind
+    /// one proxy.
+    #[serde(skip)]
+    pub proxy_command_pattern: Option<String>,
+    pub proxy_jump: Option<String>,
+    pub local_command: Option<String>,
+    pub permit_local_command: bool,
+    pub remote_command: Option<String>,
+    pub request_tty: Option<String>,
+    pub log_level: Option<String>,
+    /// Team or person owning the host, from a `# sshs-owner:` or `# sshs-team:` comment.
+    pub owner: Option<String>,
+    /// What the host is for, from a `# sshs-note:` comment.
+    pub note: Option<String>,
+    /// Time zone of the host, from a `# sshs-timezone:` comment.
+    pub timezone: Option<String>,
+    /// EC2 instance of the host, from a `# sshs-instance-id:` comment, reachable through
+    /// Session Manager.
+    pub instance_id: Option<String>,
+    /// AWS region of the instance, from a `# sshs-region:` comment.
+    pub region: Option<String>,
+    /// Compute Engine zone of the instance named like the host, from a `# sshs-zone:` comment.
+    pub zone: Option<String>,
+    /// Google Cloud project of the instance, from a `# sshs-project:` comment.
+    pub project: Option<String>,
+    /// Connect through an Identity-Aware Proxy tunnel to the instance, from a `# sshs-iap: yes`
+    /// comment.
+    pub iap: bool,
+    /// Teleport cluster of the node, from a `# sshs-teleport:` comment or a `ProxyCommand`
+    /// running `tsh proxy ssh`, connected to with `tsh ssh`. Empty for the current cluster.
+    pub teleport: Option<String>,
+    /// How to reach the host when it is not through SSH, from a `# sshs-protocol:` comment.
+    pub protocol: Protocol,
+    /// Kubernetes namespace of the pod, from a `# sshs-namespace:` comment.
+    pub namespace: Option<String>,
+    /// kubectl context of the cluster of the pod, from a `# sshs-context:` comment.
+    pub context: Option<String>,
+    /// When the host should be left alone, from a `# sshs-maintenance:` comment.
+    pub maintenance: Vec<clock::Window>,
+    pub origin: Option<ssh_config::Origin>,
+    /// The configuration file given to sshs the host was read from.
+    pub config_path: String,
 }
 
+/// Direction of a file copy made with [`Host::scp_command`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Transfer {
+    Push,
+    Pull,
+}
+
+/// What the host is reached with, each protocol having its own command template.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Protocol {
+    #[default]
+    Ssh,
+    /// Network gear without SSH.
+    Telnet,
+    /// The serial console of a BMC, through IPMI Serial over LAN.
+    Console,
+    /// A shell in a pod, through `kubectl exec`.
+    Kubernetes,
+    /// The desktop of a Windows host, through `xfreerdp` or `mstsc`.
+    Rdp,
+}
+
+impl Protocol {
+    /// Reads the value of a `# sshs-protocol:` comment, `ipmi` and `serial` standing for
+    /// the console and `k8s` for Kubernetes.
+    #[must_use]
+    pub fn parse(value: &str) -> Option<Protocol> {
+        match value.to_ascii_lowercase().as_str() {
+            "ssh" => Some(Protocol::Ssh),
+            "telnet" => Some(Protocol::Telnet),
+            "console" | "ipmi" | "serial" => Some(Protocol::Console),
+            "kubernetes" | "k8s" => Some(Protocol::Kubernetes),
+            "rdp" => Some(Protocol::Rdp),
+            _ => None,
+        }
+    }
+
+    #[must_use]
+    pub fn name(self) -> &'static str {
+        match self {
+            Protocol::Ssh => "ssh",
+            Protocol::Telnet => "telnet",
+            Protocol::Console => "console",
+            Protocol::Kubernetes => "kubernetes",
+            Protocol::Rdp => "rdp",
+        }
+    }
+
+    /// Port of the protocol when the host has none, pods having none.
+    #[must_use]
+    pub fn default_port(self) -> &'static str {
+        match self {
+            Protocol::Ssh => "22",
+            Protocol::Telnet => "23",
+            Protocol::Console => "623",
+            Protocol::Kubernetes => "",
+            Protocol::Rdp => "3389",
+        }
+    }
+}
+
+/// Terminal multiplexer the sessions can be opened in, instead of taking over the terminal of sshs.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Multiplexer {
+    Tmux,
+    Zellij,
+    /// Windows Terminal, through `wt.exe` which also works from WSL.
+    WindowsTerminal(TerminalLayout),
+}
+
+/// Where Windows Terminal opens the sessions.
+#[derive(clap::ValueEnum, Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TerminalLayout {
+    /// A new tab
+    Tab,
+    /// A pane next to sshs
+    Pane,
+}
+
+impl Multiplexer {
+    /// Command opening a tmux window, a zellij pane or a Windows Terminal tab or pane called
+    /// `name` that runs `command`.
+    #[must_use]
+    pub fn open_command(self, name: &str, command: &[String]) -> Vec<String> {
+        let open: &[&str] = match self {
+            Multiplexer::Tmux => &["tmux", "new-window", "-n", name, "--"],
+            Multiplexer::Zellij => &["zellij", "run", "--name", name, "--close-on-exit", "--"],
+            Multiplexer::WindowsTerminal(TerminalLayout::Tab) => {
+                &["wt.exe", "-w", "0", "new-tab", "--title", name, "--"]
+            }
+            Multiplexer::WindowsTerminal(TerminalLayout::Pane) => {
+                &["wt.exe", "-w", "0", "split-pane", "--title", name, "--"]
+            }
+        };
+
+        // wt.exe reads `;` as the start of another of its commands
+        let command = command.iter().map(|arg| match self {
+            Multiplexer::WindowsTerminal(_) => arg.replace(';', "\\;"),
+            Multiplexer::Tmux | Multiplexer::Zellij => arg.clone(),
+        });
+
+        open.iter()
+            .map(ToString::to_string)
+            .chain(command)
+            .collect()
+    }
+
+    /// Runs `after` in the pane once `command` exits, given `--started` and `--status` of the
+    /// session. Windows Terminal runs `command` alone, without a shell to wrap it in.
+    fn then_run(self, command: Vec<String>, after: &[String]) -> anyhow::Result<Vec<String>> {
+        if after.is_empty() {
+            return Ok(command);
+        }
+        if let Multiplexer::WindowsTerminal(_) = self {
+            log::warn!(after:? = after; "Not running the hooks after a session in Windows Terminal");
+            return Ok(command);
+        }
+
+        let after = shlex::try_join(after.iter().map(String::as_str))?;
+        let script = format!(
+            "start=$(date +%s); \"$@\"; status=$?; {after} --started \"$start\" --status \"$status\"; exit \"$status\""
+        );
+
+        Ok(
+            ["sh".to_string(), "-c".to_string(), script, "sh".to_string()]
+                .into_iter()
+                .chain(command)
+                .collect(),
+        )
+    }
+}
+
+/// Whether sshs runs in a tmux pane that is not shown, its window or session being in the
+/// background.
+#[must_use]
+pub fn in_background_tmux_pane() -> bool {
+    let Ok(pane) = std::env::var("TMUX_PANE") else {
+        return false;
+    };
+
+    match Command::new("tmux")
+        .args([
+            "display-message",
+            "-p",
+            "-t",
+            &pane,
+            "#{session_attached} #{window_active} #{pane_active}",
+        ])
+        .output()
+    {
+        Ok(output) if output.status.success() => String::from_utf8_lossy(&output.stdout)
+            .split_whitespace()
+            .any(|flag| flag == "0"),
+        Ok(_) | Err(_) => false,
+    }
+}
+
+/// An ad-hoc `[user@]host[:port]` destination that is not in the configuration.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Destination {
+    pub user: Option<String>,
+    pub hostname: String,
+    pub port: Option<String>,
+}
+
+impl std::str::FromStr for Destination {
+    type Err = anyhow::Error;
+
+    fn from_str(value: &str) -> Result<Self, Self::Err> {
+        let value = value.trim();
+        let value = value.strip_prefix("ssh://").unwrap_or(value);
+
+        let (user, address) = match value.rsplit_once('@') {
+            Some((user, address)) => (Some(user.to_string()), address),
+            None => (None, value),
+        };
+
+        let (hostname, port) = if let Some(address) = address.strip_prefix('[') {
+            // [IPv6]:port
+            let (hostname, rest) = address
+                .split_once(']')
+                .ok_or(anyhow!("Missing closing bracket in {value:?}"))?;
+            (hostname, rest.strip_prefix(':'))
+        } else if address.matches(':').count() == 1 {
+            let (hostname, port) = address.split_once(':').unwrap_or_default();
+            (hostname, Some(port))
+        } else {
+            (address, None)
+        };
+
+        if hostname.is_empty() || user.as_deref() == Some("") {
+            anyhow::bail!("Expected [user@]host[:port], got {value:?}");
+        }
+        if let Some(port) = port {
+            port.parse::<u16>()
+                .map_err(|_| anyhow!("Invalid port {port:?}"))?;
+        }
+
+        Ok(Destination {
+            user,
+            hostname: hostname.to_string(),
+            port: port.map(ToString::to_string),
+        })
+    }
+}
+
+impl Destination {
+    /// Builds the `ssh` command connecting to the destination.
+    #[must_use]
+    pub fn ssh_command(&self) -> Vec<String> {
+        let mut command = vec!["ssh".to_string()];
+        if let Some(port) = &self.port {
+            command.extend(["-p".to_string(), port.clone()]);
+        }
+        command.push(match &self.user {
+            Some(user) => format!("{user}@{}", self.hostname),
+            None => self.hostname.clone(),
+        });
+
+        command
+    }
+
+    /// Builds the `Host` block to save the destination under the given name.
+    #[must_use]
+    pub fn to_host_block(&self, name: &str) -> GeneratedHost {
+        let mut host = GeneratedHost::new(name);
+        host.push(ssh_config::EntryType::Hostname, &self.hostname);
+        if let Some(user) = &self.user {
+            host.push(ssh_config::EntryType::User, user);
+        }
+        if let Some(port) = &self.port {
+            host.push(ssh_config::EntryType::Port, port);
+        }
+
+        host
+    }
+}
+
+/// Options opening an interactive shell even if the host sets a `RemoteCommand` or disables the TTY.
+pub const INTERACTIVE_ARGUMENTS: [&str; 4] = ["-o", "RequestTTY=force", "-o", "RemoteCommand=none"];
+
+/// Option disabling agent forwarding, it also drops the `-A` of the command template.
+pub const NO_AGENT_FORWARDING: &str = "-a";
+
+/// `Tag` of the hosts the agent should not be forwarded to.
+pub const UNTRUSTED_TAG: &str = "untrusted";
+
+/// Values of `LogLevel` below `INFO`, at which `ssh` does not show the banner of the server.
+const QUIET_LOG_LEVELS: [&str; 3] = ["QUIET", "FATAL", "ERROR"];
+
+/// Configuration files read by `ssh` without having to be given with `-F`.
+const DEFAULT_CONFIG_PATHS: [&str; 2] = ["/etc/ssh/ssh_config", "~/.ssh/config"];
+
+/// Maximum number of ports a `# sshs-ports:` comment can list, each one being tried in turn.
+const MAX_FALLBACK_PORTS: usize = 32;
+
+/// Handlebars helper of the templates reading a secret, `{{secret "pass:servers/db"}}`.
+pub const SECRET_HELPER: &str = "secret";
+
+/// Fields of the host the templates can use, all the serialized ones but the maintenance
+/// windows.
+pub const TEMPLATE_FIELDS: [&str; 33] = [
+    "name",
+    "aliases",
+    "alias_of",
+    "user",
+    "destination",
+    "port",
+    "fallback_ports",
+    "identity_file",
+    "forward_agent",
+    "tag",
+    "tags",
+    "proxy_command",
+    "proxy_jump",
+    "local_command",
+    "permit_local_command",
+    "remote_command",
+    "request_tty",
+    "log_level",
+    "owner",
+    "note",
+    "timezone",
+    "instance_id",
+    "region",
+    "zone",
+    "project",
+    "iap",
+    "teleport",
+    "protocol",
+    "namespace",
+    "context",
+    "origin.path",
+    "origin.line",
+    "config_path",
+];
+
 impl Host {
     /// Uses the provided Handlebars template to run a command.
     ///
+    /// `extra_args` are given to the program right after its name.
+    ///
     /// # Errors
     ///
     /// Will return `Err` if the command cannot be executed.
@@ -27,25 +387,952 @@ impl Host {
     /// # Panics
     ///
     /// Will panic if the regex cannot be compiled.
-    pub fn run_command_template(&self, pattern: &str) -> anyhow::Result<()> {
-        let handlebars = Handlebars::new();
-        let rendered_command = handlebars.render_template(pattern, &self)?;
+    pub fn run_command_template(
+        &self,
+        pattern: &str,
+        extra_args: &[&str],
+    ) -> anyhow::Result<ExitStatus> {
+        // Shown and logged with the secrets hidden, the log file being attached to bug reports
+        let command_line = self.command_line(pattern, extra_args)?;
+        println!("Running command: {command_line}");
+
+        let secrets = secrets::Registry::discover();
+        let mut args = self.command_template_args(pattern, extra_args, Some(&secrets))?;
+        let command = args.pop_front().ok_or(anyhow!("Failed to get command"))?;
+        log::info!(command = command_line.as_str(); "Spawning command");
+
+        let status = Command::new(command).args(args).spawn()?.wait()?;
+        log::info!(status:% = status; "Command exited");
+
+        Ok(status)
+    }
+
+    /// The command [`Host::run_command_template`] runs, quoted for a shell, with the secrets
+    /// hidden.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the template cannot be rendered or split into arguments.
+    pub fn command_line(&self, pattern: &str, extra_args: &[&str]) -> anyhow::Result<String> {
+        let args = self.command_template_args(pattern, extra_args, None)?;
+        Ok(shlex::try_join(args.iter().map(String::as_str))?)
+    }
+
+    /// Opens the command in a new window of the multiplexer sshs runs in, named after the host.
+    ///
+    /// Returns once the window is opened, the session going on next to sshs. The window runs
+    /// the `after` command once the session ends, see [`crate::hooks::after_command`].
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the command cannot be rendered or the multiplexer fails to open it.
+    pub fn open_in_multiplexer(
+        &self,
+        multiplexer: Multiplexer,
+        pattern: &str,
+        extra_args: &[&str],
+        after: &[String],
+    ) -> anyhow::Result<()> {
+        let secrets = secrets::Registry::discover();
+        let args = Vec::from(self.command_template_args(pattern, extra_args, Some(&secrets))?);
+        let command = multiplexer.open_command(&self.name, &multiplexer.then_run(args, after)?);
+        log::info!(multiplexer:? = multiplexer, command = self.command_line(pattern, extra_args)?.as_str(); "Opening command in multiplexer");
+
+        let output = Command::new(&command[0]).args(&command[1..]).output()?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "{} failed: {}",
+                command[0],
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+
+        Ok(())
+    }
+
+    /// Whether the connection is made by `ssh` and takes its arguments, like `-vvv`, which
+    /// `tsh` and the programs of the other protocols do not.
+    #[must_use]
+    pub fn takes_ssh_arguments(&self) -> bool {
+        self.protocol == Protocol::Ssh && self.teleport.is_none()
+    }
+
+    /// Renders the template and splits it into the program and its arguments, the extra
+    /// arguments coming right after the program.
+    ///
+    /// The secrets are read from `secrets`, or hidden without them.
+    fn command_template_args(
+        &self,
+        pattern: &str,
+        extra_args: &[&str],
+        secrets: Option<&secrets::Registry>,
+    ) -> anyhow::Result<VecDeque<String>> {
+        // The arguments of sshs are the ones of ssh, telnet and ipmitool would not take them
+        let extra_args = if self.protocol == Protocol::Ssh {
+            extra_args
+        } else {
+            if !extra_args.is_empty() {
+                log::debug!(host = self.name.as_str(), protocol = self.protocol.name(), extra_args:? = extra_args; "Ignoring ssh arguments");
+            }
+            &[]
+        };
+        if let Some(cluster) = self
+            .teleport
+            .as_ref()
+            .filter(|_| self.protocol == Protocol::Ssh)
+        {
+            return Ok(self.tsh_args(cluster, extra_args));
+        }
 
-        println!("Running command: {rendered_command}");
+        let rendered_command = match secrets {
+            Some(secrets) => self.render_template(pattern, Some(secrets))?,
+            None => self.render_command_template(pattern)?,
+        };
 
         let mut args = shlex::split(&rendered_command)
             .ok_or(anyhow!("Failed to parse command: {rendered_command}"))?
             .into_iter()
             .collect::<VecDeque<String>>();
         let command = args.pop_front().ok_or(anyhow!("Failed to get command"))?;
+        // ssh keeps the last of `-A` and `-a`, the template would win over the extra arguments
+        if extra_args.contains(&NO_AGENT_FORWARDING) {
+            args.retain(|arg| arg != "-A");
+        }
+        for arg in extra_args.iter().rev() {
+            args.push_front((*arg).to_string());
+        }
+        args.push_front(command);
 
-        let status = Command::new(command).args(args).spawn()?.wait()?;
-        if !status.success() {
-            std::process::exit(status.code().unwrap_or(1));
+        Ok(args)
+    }
+
+    /// `tsh ssh` connecting to the Teleport node, with the extra arguments it understands:
+    /// `-A`, `-l`, `-p` and `-L`.
+    fn tsh_args(&self, cluster: &str, extra_args: &[&str]) -> VecDeque<String> {
+        let mut args = VecDeque::from(["tsh".to_string(), "ssh".to_string()]);
+        if !cluster.is_empty() {
+            args.push_back(format!("--cluster={cluster}"));
         }
 
-        Ok(())
+        let mut user = self.user.clone();
+        let mut port = self.port.clone();
+        let mut extra_args = extra_args.iter();
+        while let Some(arg) = extra_args.next() {
+            match *arg {
+                "-A" => args.push_back("-A".to_string()),
+                "-l" => user = extra_args.next().map(ToString::to_string),
+                "-p" => port = extra_args.next().map(ToString::to_string),
+                "-L" => {
+                    if let Some(forward) = extra_args.next() {
+                        args.extend(["-L".to_string(), (*forward).to_string()]);
+                    }
+                }
+                _ => {
+                    log::debug!(host = self.name.as_str(), arg = arg; "Ignoring argument tsh does not take");
+                }
+            }
+        }
+
+        if let Some(port) = port {
+            args.extend(["-p".to_string(), port]);
+        }
+        args.push_back(match user {
+            Some(user) => format!("{user}@{}", self.destination),
+            None => self.destination.clone(),
+        });
+
+        args
+    }
+
+    /// Renders the Handlebars template of the command without running it, the secrets being
+    /// hidden.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the template cannot be rendered.
+    pub fn render_command_template(&self, pattern: &str) -> anyhow::Result<String> {
+        let rendered_command = self.render_template(pattern, None)?;
+        log::debug!(host = self.name.as_str(), template = pattern, command = rendered_command.as_str(); "Rendered command template");
+
+        Ok(rendered_command)
     }
+
+    /// Renders a Handlebars template with the fields of the host.
+    ///
+    /// `{{secret "REFERENCE"}}` is replaced with the secret read from `secrets` quoted for a
+    /// shell, or with `<secret REFERENCE>` without them so that the command can be shown.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the template cannot be rendered or a secret cannot be read.
+    pub fn render_template(
+        &self,
+        pattern: &str,
+        secrets: Option<&secrets::Registry>,
+    ) -> anyhow::Result<String> {
+        self.render(pattern, secrets, true)
+    }
+
+    /// Renders the Handlebars template of a single argument of a command with the fields of
+    /// the host, the secrets being written as they are.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the template cannot be rendered or a secret cannot be read.
+    pub fn render_argument(
+        &self,
+        pattern: &str,
+        secrets: &secrets::Registry,
+    ) -> anyhow::Result<String> {
+        self.render(pattern, Some(secrets), false)
+    }
+
+    fn render(
+        &self,
+        pattern: &str,
+        secrets: Option<&secrets::Registry>,
+        quote_secrets: bool,
+    ) -> anyhow::Result<String> {
+        let mut handlebars = Handlebars::new();
+        handlebars.register_helper(
+            SECRET_HELPER,
+            Box::new(
+                move |h: &Helper,
+                      _: &Handlebars,
+                      _: &Context,
+                      _: &mut RenderContext,
+                      out: &mut dyn Output|
+                      -> HelperResult {
+                    let reference = h
+                        .param(0)
+                        .and_then(|param| param.value().as_str())
+                        .ok_or(RenderErrorReason::ParamNotFoundForIndex(SECRET_HELPER, 0))?;
+                    let secret = match secrets {
+                        Some(secrets) => secrets
+                            .get(reference)
+                            .map_err(|err| RenderErrorReason::Other(err.to_string()))?,
+                        None => format!("<secret {reference}>"),
+                    };
+                    if quote_secrets {
+                        let quoted = shlex::try_quote(&secret)
+                            .map_err(|err| RenderErrorReason::Other(err.to_string()))?;
+                        out.write(&quoted)?;
+                    } else {
+                        out.write(&secret)?;
+                    }
+
+                    Ok(())
+                },
+            ),
+        );
+
+        Ok(handlebars.render_template(pattern, &self)?)
+    }
+
+    /// Whether `ssh` will run the `LocalCommand` on this machine after connecting.
+    #[must_use]
+    pub fn runs_local_command(&self) -> bool {
+        self.permit_local_command && self.local_command.is_some()
+    }
+
+    /// Replaces the `%h`, `%n`, `%p` and `%r` tokens with the values of the host.
+    #[must_use]
+    pub fn expand_tokens(&self, value: &str) -> String {
+        let local_user = local_user();
+        expand_tokens(
+            value,
+            &[
+                ('h', &self.destination),
+                ('n', &self.name),
+                ('p', self.port.as_deref().unwrap_or("22")),
+                ('r', self.user.as_deref().unwrap_or(&local_user)),
+            ],
+        )
+    }
+
+    /// Splits a command like a shell would, then replaces the `%h`, `%n`, `%p` and `%r` tokens
+    /// in each argument so that a value with spaces or quotes stays within its argument.
+    /// `None` if the command cannot be split.
+    #[must_use]
+    pub fn expand_command(&self, command: &str) -> Option<Vec<String>> {
+        Some(
+            shlex::split(command)?
+                .iter()
+                .map(|arg| self.expand_tokens(arg))
+                .collect(),
+        )
+    }
+
+    /// What to show in the aliases column, the host the row is an alias of for expanded aliases.
+    #[must_use]
+    pub fn aliases_label(&self) -> String {
+        match &self.alias_of {
+            Some(name) => format!("alias of {name}"),
+            None => self.aliases.clone(),
+        }
+    }
+
+    /// Sets metadata given outside of the configuration, unless the configuration sets it.
+    pub fn annotate(&mut self, key: &str, value: &str) {
+        match key {
+            "owner" | "team" => {
+                self.owner.get_or_insert_with(|| value.to_string());
+            }
+            "note" => {
+                self.note.get_or_insert_with(|| value.to_string());
+            }
+            "instance-id" => {
+                self.instance_id.get_or_insert_with(|| value.to_string());
+            }
+            "region" => {
+                self.region.get_or_insert_with(|| value.to_string());
+            }
+            "zone" => {
+                self.zone.get_or_insert_with(|| value.to_string());
+            }
+            "project" => {
+                self.project.get_or_insert_with(|| value.to_string());
+            }
+            "iap" => self.iap |= value.eq_ignore_ascii_case("yes"),
+            "teleport" => {
+                self.teleport.get_or_insert_with(|| teleport_cluster(value));
+            }
+            "namespace" => {
+                self.namespace.get_or_insert_with(|| value.to_string());
+            }
+            "context" => {
+                self.context.get_or_insert_with(|| value.to_string());
+            }
+            "protocol" => {
+                if self.protocol == Protocol::Ssh {
+                    self.protocol = parse_protocol(&self.name, value);
+                }
+            }
+            _ => log::debug!(host = self.name.as_str(), key = key; "Ignoring unknown annotation"),
+        }
+    }
+
+    /// Arguments of `ssh` connecting to the EC2 instance of the host through Session Manager,
+    /// `None` without instance ID.
+    #[must_use]
+    pub fn ssm_arguments(&self) -> Option<Vec<String>> {
+        let instance_id = self.instance_id.as_deref()?;
+
+        Some(vec![
+            "-o".to_string(),
+            format!(
+                "ProxyCommand={}",
+                ssm_proxy_command(instance_id, self.region.as_deref(), None)
+            ),
+        ])
+    }
+
+    /// Arguments of `ssh` connecting to the Compute Engine instance of the host through an
+    /// Identity-Aware Proxy tunnel, `None` unless the host asks for it and has a zone.
+    #[must_use]
+    pub fn iap_arguments(&self) -> Option<Vec<String>> {
+        let zone = self.zone.as_deref().filter(|_| self.iap)?;
+
+        Some(vec![
+            "-o".to_string(),
+            format!(
+                "ProxyCommand={}",
+                iap_proxy_command(&self.name, zone, self.project.as_deref())
+            ),
+        ])
+    }
+
+    /// Current time in the time zone of the host, in seconds since the Unix epoch shifted by
+    /// its offset. `None` without time zone or when it is unknown.
+    #[must_use]
+    pub fn local_time(&self) -> Option<i64> {
+        let now = i64::try_from(state::now()).ok()?;
+        let offset = clock::utc_offset(self.timezone.as_deref()?)?;
+
+        Some(now + offset)
+    }
+
+    /// The maintenance window the host is in, in its time zone or UTC without one.
+    #[must_use]
+    pub fn current_maintenance(&self) -> Option<&clock::Window> {
+        if self.maintenance.is_empty() {
+            return None;
+        }
+
+        let now = self
+            .local_time()
+            .or_else(|| i64::try_from(state::now()).ok())?;
+        self.maintenance.iter().find(|window| window.contains(now))
+    }
+
+    /// Whether the `LogLevel` of the host is too low for `ssh` to show the banner of the server.
+    #[must_use]
+    pub fn hides_banner(&self) -> bool {
+        self.log_level.as_deref().is_some_and(|level| {
+            QUIET_LOG_LEVELS
+                .iter()
+                .any(|quiet| level.eq_ignore_ascii_case(quiet))
+        })
+    }
+
+    /// Where the debug output of a connection to the host started now is written.
+    #[must_use]
+    pub fn debug_log_path(&self) -> PathBuf {
+        state::state_dir()
+            .join("debug")
+            .join(format!("{}-{}.log", self.name, state::now()))
+    }
+
+    /// Whether the host is tagged as untrusted with `Tag untrusted`.
+    #[must_use]
+    pub fn is_untrusted(&self) -> bool {
+        self.tag
+            .as_deref()
+            .is_some_and(|tag| tag.eq_ignore_ascii_case(UNTRUSTED_TAG))
+    }
+
+    /// Whether connecting with the command template forwards the agent, with `ForwardAgent` or `-A`.
+    #[must_use]
+    pub fn forwards_agent(&self, pattern: &str) -> bool {
+        self.forward_agent
+            .as_deref()
+            .is_some_and(|value| !value.eq_ignore_ascii_case("no"))
+            || self
+                .command_template_args(pattern, &[], None)
+                .is_ok_and(|args| args.iter().any(|arg| arg == "-A"))
+    }
+
+    /// Where the connections to the host end up, hosts sharing it are duplicates of each other.
+    #[must_use]
+    pub fn endpoint(&self) -> String {
+        let address = format!(
+            "{}:{}",
+            self.destination.to_lowercase(),
+            self.port.as_deref().unwrap_or(self.protocol.default_port())
+        );
+
+        match &self.proxy_command {
+            Some(proxy_command) => format!("{address} via {proxy_command}"),
+            None => address,
+        }
+    }
+
+    /// The server connections to the host go to, the proxy for hosts behind a `ProxyCommand`.
+    #[must_use]
+    pub fn rate_limit_key(&self) -> String {
+        match &self.proxy_command_pattern {
+            Some(proxy_command) => proxy_command.clone(),
+            None => format!(
+                "{}:{}",
+                self.destination,
+                self.port.as_deref().unwrap_or("22")
+            ),
+        }
+    }
+
+    /// Address to dial to check whether the host is reachable.
+    ///
+    /// Hosts behind a `ProxyCommand` cannot be reached directly and have none, neither do
+    /// consoles, IPMI going over UDP, and pods.
+    #[must_use]
+    pub fn probe_address(&self) -> Option<String> {
+        if matches!(self.protocol, Protocol::Console | Protocol::Kubernetes) {
+            return None;
+        }
+
+        self.probe_address_on(self.port.as_deref().unwrap_or(self.protocol.default_port()))
+    }
+
+    /// Same as [`Host::probe_address`] on another port.
+    #[must_use]
+    pub fn probe_address_on(&self, port: &str) -> Option<String> {
+        if self.proxy_command.is_some() {
+            return None;
+        }
+
+        Some(if self.destination.contains(':') {
+            format!("[{}]:{port}", self.destination)
+        } else {
+            format!("{}:{port}", self.destination)
+        })
+    }
+
+    /// The port followed by the fallback ports, without repetition.
+    #[must_use]
+    pub fn ports(&self) -> Vec<u16> {
+        let port = self
+            .port
+            .as_deref()
+            .and_then(|port| port.parse().ok())
+            .unwrap_or(22);
+
+        std::iter::once(port)
+            .chain(self.fallback_ports.iter().copied())
+            .unique()
+            .collect()
+    }
+
+    /// Arguments making `ssh`, `scp` or `sftp` read the configuration file the host comes from.
+    #[must_use]
+    pub fn config_arguments(&self) -> Vec<String> {
+        if DEFAULT_CONFIG_PATHS.contains(&self.config_path.as_str()) {
+            return Vec::new();
+        }
+
+        vec![
+            "-F".to_string(),
+            shellexpand::tilde(&self.config_path).to_string(),
+        ]
+    }
+
+    /// Asks `ssh -G` for the options that apply to the host once the whole configuration is evaluated.
+    ///
+    /// Option names are lowercased, only the first value of repeated options is kept.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if `ssh` cannot be executed or fails.
+    pub fn effective_options(&self) -> anyhow::Result<HashMap<String, String>> {
+        let output = Command::new("ssh")
+            .args(self.config_arguments())
+            .args(["-G", &self.name])
+            .output()?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "ssh -G {} failed: {}",
+                self.name,
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+
+        let mut options = HashMap::new();
+        for line in String::from_utf8_lossy(&output.stdout).lines() {
+            if let Some((key, value)) = line.split_once(' ') {
+                options
+                    .entry(key.to_lowercase())
+                    .or_insert_with(|| value.to_string());
+            }
+        }
+
+        Ok(options)
+    }
+
+    /// Connection to the host shared with `--control-persist` by a session given these
+    /// arguments.
+    #[must_use]
+    pub fn shared_connection(&self, arguments: &[&str]) -> SharedConnection {
+        let mut config_arguments = self.config_arguments();
+        config_arguments.extend(arguments.iter().map(ToString::to_string));
+
+        SharedConnection {
+            destination: self.name.clone(),
+            arguments: config_arguments,
+            jump: false,
+        }
+    }
+
+    /// Options reaching the host through a shared connection to its jump host, so that the
+    /// hosts behind the same bastion authenticate to it once. `None` unless the host goes
+    /// through a single jump host.
+    #[must_use]
+    pub fn shared_jump(&self, persist: Duration) -> Option<(SharedConnection, Vec<String>)> {
+        let jump = self.proxy_jump.as_deref()?.trim();
+        if jump.is_empty() || jump.eq_ignore_ascii_case("none") || jump.contains(',') {
+            return None;
+        }
+
+        // `ssh` only reads a port after the host name from a URI
+        let destination = if !jump.starts_with("ssh://")
+            && (jump.matches(':').count() == 1 || jump.contains("]:"))
+        {
+            format!("ssh://{jump}")
+        } else {
+            jump.to_string()
+        };
+        let connection = SharedConnection {
+            destination,
+            arguments: self.config_arguments(),
+            jump: true,
+        };
+
+        // The tokens of the control path are for the jump host, not expanded for this one
+        let mut command = vec!["ssh".to_string()];
+        command.extend(connection.arguments.iter().cloned());
+        command.extend(control_arguments(persist));
+        let mut command = command
+            .iter()
+            .map(|arg| arg.replace('%', "%%"))
+            .collect::<Vec<_>>();
+        command.extend([
+            "-W".to_string(),
+            "[%h]:%p".to_string(),
+            connection.destination.clone(),
+        ]);
+        let proxy_command = shlex::try_join(command.iter().map(String::as_str)).ok()?;
+
+        Some((
+            connection,
+            vec!["-o".to_string(), format!("ProxyCommand={proxy_command}")],
+        ))
+    }
+
+    /// Builds the `scp` command copying `local` to `remote` on the host or the other way around.
+    #[must_use]
+    pub fn scp_command(&self, transfer: Transfer, local: &str, remote: &str) -> Vec<String> {
+        let remote = format!("{}:{remote}", self.name);
+
+        let mut command = vec!["scp".to_string(), "-r".to_string()];
+        command.extend(self.config_arguments());
+        match transfer {
+            Transfer::Push => command.extend([local.to_string(), remote]),
+            Transfer::Pull => command.extend([remote, local.to_string()]),
+        }
+
+        command
+    }
+}
+
+/// Builds the `scp` command copying `source` on the first host to `destination` on the
+/// second one, the data going through this machine so the hosts need not reach each other.
+///
+/// # Errors
+///
+/// Will return `Err` if the hosts come from different configuration files, `scp` reading
+/// only one of them.
+pub fn scp_between_command(
+    from: &Host,
+    source: &str,
+    to: &Host,
+    destination: &str,
+) -> anyhow::Result<Vec<String>> {
+    if from.config_arguments() != to.config_arguments() {
+        anyhow::bail!(
+            "{} and {} come from different configuration files, scp reads only one of them",
+            from.name,
+            to.name
+        );
+    }
+
+    let mut command = vec!["scp".to_string(), "-3".to_string(), "-r".to_string()];
+    command.extend(from.config_arguments());
+    command.extend([
+        format!("{}:{source}", from.name),
+        format!("{}:{destination}", to.name),
+    ]);
+
+    Ok(command)
+}
+
+/// A connection shared through a control socket, to a host or to the jump host of hosts.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SharedConnection {
+    /// Name of the host, or destination of the jump host.
+    pub destination: String,
+    /// Arguments of `ssh` before the destination, like `-p` or `-J`, the control socket being
+    /// named after the connection they make.
+    pub arguments: Vec<String>,
+    /// Whether the hosts behind the jump host share it.
+    pub jump: bool,
+}
+
+impl SharedConnection {
+    /// Sends a control command such as `exit` to the shared connection.
+    #[must_use]
+    pub fn control_command(&self, operation: &str) -> Vec<String> {
+        let mut command = vec!["ssh".to_string()];
+        command.extend(self.arguments.iter().cloned());
+        command.extend([
+            "-o".to_string(),
+            format!("ControlPath={}", control_dir().join("%C").display()),
+            "-O".to_string(),
+            operation.to_string(),
+            self.destination.clone(),
+        ]);
+
+        command
+    }
+
+    /// Sends a control command quietly, returns whether it succeeded.
+    #[must_use]
+    pub fn control(&self, operation: &str) -> bool {
+        let command = self.control_command(operation);
+        Command::new(&command[0])
+            .args(&command[1..])
+            .stdin(std::process::Stdio::null())
+            .stdout(std::process::Stdio::null())
+            .stderr(std::process::Stdio::null())
+            .status()
+            .is_ok_and(|status| status.success())
+    }
+}
+
+/// How long the shared connections stay open after their last session by default.
+pub const DEFAULT_CONTROL_PERSIST: Duration = Duration::from_secs(600);
+
+/// Directory of the control sockets of the connections shared with `--control-persist`.
+#[must_use]
+pub fn control_dir() -> PathBuf {
+    state::state_dir().join("control")
+}
+
+/// Options sharing the connections to a host through a control socket, the first connection
+/// staying open for `persist` after the last session ends.
+#[must_use]
+pub fn control_arguments(persist: Duration) -> Vec<String> {
+    vec![
+        "-o".to_string(),
+        "ControlMaster=auto".to_string(),
+        "-o".to_string(),
+        format!("ControlPath={}", control_dir().join("%C").display()),
+        "-o".to_string(),
+        format!("ControlPersist={}s", persist.as_secs().max(1)),
+    ]
+}
+
+/// Options making `ssh` authenticate with the key of the identity file only.
+#[must_use]
+pub fn identity_arguments(path: &Path) -> Vec<String> {
+    vec![
+        "-i".to_string(),
+        path.display().to_string(),
+        "-o".to_string(),
+        "IdentitiesOnly=yes".to_string(),
+    ]
+}
+
+/// `ProxyCommand` reaching an EC2 instance through a Session Manager session forwarding the
+/// port `ssh` connects to.
+#[must_use]
+pub fn ssm_proxy_command(instance_id: &str, region: Option<&str>, profile: Option<&str>) -> String {
+    let region = region
+        .map(|region| format!(" --region {region}"))
+        .unwrap_or_default();
+    let profile = profile
+        .map(|profile| format!(" --profile {profile}"))
+        .unwrap_or_default();
+
+    format!("aws ssm start-session --target {instance_id} --document-name AWS-StartSSHSession --parameters portNumber=%p{region}{profile}")
+}
+
+/// Protocol of a `# sshs-protocol:` comment, SSH when it is unknown.
+fn parse_protocol(host: &str, value: &str) -> Protocol {
+    Protocol::parse(value).unwrap_or_else(|| {
+        log::warn!(host = host, protocol = value; "Unknown protocol, using ssh");
+        Protocol::Ssh
+    })
+}
+
+/// Cluster of a `# sshs-teleport:` comment, `yes` standing for the current one.
+fn teleport_cluster(value: &str) -> String {
+    if value.eq_ignore_ascii_case("yes") {
+        String::new()
+    } else {
+        value.to_string()
+    }
+}
+
+/// Teleport cluster of the block, from its comment or its `ProxyCommand`.
+fn host_teleport_cluster(host: &ssh_config::Host) -> Option<String> {
+    host.get_metadata("teleport")
+        .map(teleport_cluster)
+        .or_else(|| tsh_proxy_cluster(&host.get(&ssh_config::EntryType::ProxyCommand)?))
+}
+
+/// Cluster of a `ProxyCommand` running `tsh proxy ssh`, like the ones `tsh config` writes.
+fn tsh_proxy_cluster(command: &str) -> Option<String> {
+    let args = shlex::split(command)?;
+    let program = Path::new(args.first()?).file_stem()?;
+    if program != "tsh" || args.get(1..3) != Some(&["proxy".to_string(), "ssh".to_string()]) {
+        return None;
+    }
+
+    Some(
+        args.iter()
+            .find_map(|arg| arg.strip_prefix("--cluster="))
+            .unwrap_or_default()
+            .to_string(),
+    )
+}
+
+/// `ProxyCommand` reaching a Compute Engine instance through an Identity-Aware Proxy tunnel to
+/// the port `ssh` connects to.
+#[must_use]
+pub fn iap_proxy_command(instance: &str, zone: &str, project: Option<&str>) -> String {
+    let project = project
+        .map(|project| format!(" --project={project}"))
+        .unwrap_or_default();
+
+    format!("gcloud compute start-iap-tunnel {instance} %p --listen-on-stdin --zone={zone}{project} --verbosity=warning")
+}
+
+/// Options making `ssh` write its most verbose output to the file instead of the terminal,
+/// whatever the `LogLevel` of the host.
+#[must_use]
+pub fn debug_arguments(path: &Path) -> Vec<String> {
+    vec![
+        "-vvv".to_string(),
+        "-E".to_string(),
+        path.display().to_string(),
+    ]
+}
+
+/// Runs a command attached to the terminal and waits for it to exit.
+///
+/// # Errors
+///
+/// Will return `Err` if the command cannot be executed.
+pub fn run_command(command: &[String]) -> anyhow::Result<std::process::ExitStatus> {
+    let (program, args) = command
+        .split_first()
+        .ok_or(anyhow!("Failed to get command"))?;
+
+    println!(
+        "Running command: {}",
+        shlex::try_join(command.iter().map(String::as_str))?
+    );
+    log::info!(program = program.as_str(), args:? = args; "Spawning command");
+
+    let status = Command::new(program).args(args).spawn()?.wait()?;
+    log::info!(status:% = status; "Command exited");
+
+    Ok(status)
+}
+
+/// A configuration block applying to a host, as listed by [`explain_host`].
+#[derive(Debug, Clone)]
+pub struct ContributingBlock {
+    /// `None` for the entries set outside of any host block.
+    pub patterns: Option<Vec<String>>,
+    pub origin: Option<ssh_config::Origin>,
+    /// The entries of the block and whether each one is the value used by `ssh`.
+    pub entries: Vec<(ssh_config::EntryType, String, bool)>,
+}
+
+/// Lists the blocks of the configuration files applying to the host, in the order `ssh`
+/// reads them. Since the first obtained value of an option is the one used, an entry only
+/// wins if no earlier block already set it.
+///
+/// Configuration files are read from the last one to the first one, so that `~/.ssh/config`
+/// takes precedence over `/etc/ssh/ssh_config` like it does with `ssh`.
+///
+/// # Errors
+///
+/// Will return `Err` if one of the SSH configuration files cannot be parsed.
+pub fn explain_host(
+    config_paths: &[String],
+    name: &str,
+) -> Result<Vec<ContributingBlock>, ParseConfigError> {
+    let mut blocks = Vec::new();
+    let mut seen = HashSet::new();
+
+    for raw_path in config_paths.iter().rev() {
+        let normalized_path = shellexpand::tilde(&raw_path).to_string();
+        let path = match std::fs::canonicalize(normalized_path) {
+            Ok(path) => path,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => continue,
+            Err(err) => return Err(err.into()),
+        };
+
+        // Unparseable lines are listed in the problems panel already
+        let (global_host, hosts) = ssh_config::Parser::new()
+            .with_error_recovery()
+            .parse_file_blocks(&path)?;
+
+        let global_block = (!global_host.is_empty()).then_some((None, global_host));
+        let host_blocks = hosts
+            .into_iter()
+            .filter(|host| host.matches(name))
+            .map(|host| (Some(host.get_patterns().clone()), host));
+
+        for (patterns, host) in global_block.into_iter().chain(host_blocks) {
+            let entries = host
+                .get_entries()
+                .iter()
+                .sorted_by_key(|(entry, _)| entry.to_string())
+                .map(|(entry, value)| (entry.clone(), value.clone(), seen.insert(entry.clone())))
+                .collect();
+
+            blocks.push(ContributingBlock {
+                patterns,
+                origin: host.get_origin().cloned().or_else(|| {
+                    Some(ssh_config::Origin {
+                        path: path.clone(),
+                        line: 0,
+                    })
+                }),
+                entries,
+            });
+        }
+    }
+
+    Ok(blocks)
+}
+
+/// Checks that the program used by the command template can be executed.
+///
+/// Returns a warning to display when the program can't be found or, for `ssh`, when it
+/// doesn't look like OpenSSH.
+#[must_use]
+pub fn check_command_program(template: &str) -> Option<String> {
+    let program = shlex::split(template)?.into_iter().next()?;
+
+    if find_in_path(&program).is_none() {
+        log::warn!(program = program.as_str(); "Command program not found");
+        return Some(format!(
+            "`{program}` was not found in your PATH, connecting to a host will fail"
+        ));
+    }
+
+    if program != "ssh" {
+        return None;
+    }
+
+    let warning = match Command::new(&program).arg("-V").output() {
+        Ok(output) => {
+            let version = String::from_utf8_lossy(&output.stderr).trim().to_string();
+            log::debug!(version = version.as_str(); "Found ssh binary");
+
+            if version.contains("OpenSSH") {
+                None
+            } else {
+                Some(format!(
+                    "`ssh -V` didn't report an OpenSSH version ({version}), some options might not be supported"
+                ))
+            }
+        }
+        Err(err) => Some(format!("Failed to run `ssh -V`: {err}")),
+    };
+
+    if let Some(warning) = &warning {
+        log::warn!(warning = warning.as_str(); "Incompatible ssh binary");
+    }
+
+    warning
+}
+
+fn find_in_path(program: &str) -> Option<PathBuf> {
+    let path = Path::new(program);
+    if path.components().count() > 1 {
+        return path.is_file().then(|| path.to_path_buf());
+    }
+
+    let extensions: &[&str] = if cfg!(windows) {
+        &["exe", "cmd", "bat"]
+    } else {
+        &[]
+    };
+
+    std::env::split_paths(&std::env::var_os("PATH")?).find_map(|directory| {
+        let candidate = directory.join(program);
+        if candidate.is_file() {
+            return Some(candidate);
+        }
+
+        extensions
+            .iter()
+            .map(|extension| candidate.with_extension(extension))
+            .find(|candidate| candidate.is_file())
+    })
 }
 
 #[derive(Debug)]
@@ -54,6 +1341,15 @@ pub enum ParseConfigError {
     SshConfig(ParseError),
 }
 
+impl std::fmt::Display for ParseConfigError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            ParseConfigError::Io(e) => write!(f, "{e}"),
+            ParseConfigError::SshConfig(e) => write!(f, "{e}"),
+        }
+    }
+}
+
 impl From<std::io::Error> for ParseConfigError {
     fn from(e: std::io::Error) -> Self {
         ParseConfigError::Io(e)
@@ -66,34 +1362,624 @@ impl From<ParseError> for ParseConfigError {
     }
 }
 
+/// Parses a configuration file, skipping the lines that cannot be parsed.
+///
+/// Returns the hosts and the errors of the skipped lines.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration file cannot be read.
+pub fn parse_config(raw_path: &String) -> Result<(Vec<Host>, Vec<ParseError>), ParseConfigError> {
+    parse_config_with_progress(raw_path, None)
+}
+
+/// Parses a configuration file like [`parse_config`], giving the hosts read so far to
+/// `on_hosts` before reading each included file.
+///
 /// # Errors
 ///
-/// Will return `Err` if the SSH configuration file cannot be parsed.
-pub fn parse_config(raw_path: &String) -> Result<Vec<Host>, ParseConfigError> {
+/// Will return `Err` if the SSH configuration file cannot be read.
+pub fn parse_config_with_progress(
+    raw_path: &String,
+    on_hosts: Option<&dyn Fn(Vec<Host>)>,
+) -> Result<(Vec<Host>, Vec<ParseError>), ParseConfigError> {
     let normalized_path = shellexpand::tilde(&raw_path).to_string();
     let path = std::fs::canonicalize(normalized_path)?;
+    log::debug!(path:? = path; "Parsing configuration file");
+
+    let mut parser = ssh_config::Parser::new().with_error_recovery();
+    if let Some(on_hosts) = on_hosts {
+        parser = parser.with_progress(move |blocks| on_hosts(to_hosts(raw_path, blocks)));
+    }
+    let hosts = to_hosts(raw_path, parser.parse_file(path)?);
+    let problems = parser.take_problems();
+    log::debug!(path = raw_path.as_str(), hosts = hosts.len(), problems = problems.len(); "Parsed configuration file");
+
+    Ok((hosts, problems))
+}
+
+/// Builds the hosts of blocks made by sshs, as if they were read from a configuration file
+/// named after their source.
+///
+/// # Errors
+///
+/// Will return `Err` if the blocks cannot be parsed.
+pub fn parse_generated(source: &str, blocks: &[GeneratedHost]) -> anyhow::Result<Vec<Host>> {
+    let text = blocks.iter().join("\n");
+    let blocks = ssh_config::Parser::new().parse(&mut text.as_bytes())?;
 
-    let hosts = ssh_config::Parser::new()
-        .parse_file(path)?
+    Ok(to_hosts(source, blocks))
+}
+
+/// Builds the hosts of a configuration given as text, as if it was read from a file named
+/// `test`.
+#[cfg(test)]
+pub(crate) fn parse_text(text: &str) -> Vec<Host> {
+    let blocks = ssh_config::Parser::new()
+        .parse(&mut text.as_bytes())
+        .unwrap();
+
+    to_hosts("test", blocks)
+}
+
+/// Builds the hosts of the blocks of the configuration file, the pattern blocks applying
+/// to them.
+fn to_hosts(raw_path: &str, mut blocks: Vec<ssh_config::Host>) -> Vec<Host> {
+    blocks
+        .expand_names()
         .apply_patterns()
         .apply_name_to_empty_hostname()
-        .merge_same_hosts()
         .iter()
-        .map(|host| Host {
-            name: host
+        .map(|host| {
+            let name = host
                 .get_patterns()
                 .first()
                 .unwrap_or(&String::new())
-                .clone(),
-            aliases: host.get_patterns().iter().skip(1).join(", "),
-            user: host.get(&ssh_config::EntryType::User),
-            destination: host
-                .get(&ssh_config::EntryType::Hostname)
-                .unwrap_or_default(),
-            port: host.get(&ssh_config::EntryType::Port),
-            proxy_command: host.get(&ssh_config::EntryType::ProxyCommand),
+                .clone();
+            let user = host.get(&ssh_config::EntryType::User);
+            let port = host.get(&ssh_config::EntryType::Port);
+            let destination = expand_tokens(
+                &host
+                    .get(&ssh_config::EntryType::Hostname)
+                    .unwrap_or_default(),
+                &[('h', &name)],
+            );
+
+            // Values of the tokens as `ssh` would expand them, see the TOKENS section of ssh_config(5)
+            let local_user = local_user();
+            let home = std::env::var("HOME").unwrap_or_default();
+            let tokens = [
+                ('h', destination.as_str()),
+                ('n', name.as_str()),
+                ('p', port.as_deref().unwrap_or("22")),
+                ('r', user.as_deref().unwrap_or(&local_user)),
+                ('u', local_user.as_str()),
+                ('d', home.as_str()),
+            ];
+            let proxy_tokens = &tokens[..4];
+
+            Host {
+                aliases: host.get_patterns().iter().skip(1).join(", "),
+                alias_of: None,
+                identity_file: host.get(&ssh_config::EntryType::IdentityFile).map(|path| {
+                    shellexpand::tilde(&expand_tokens(&expand_env(&path), &tokens)).to_string()
+                }),
+                forward_agent: host.get(&ssh_config::EntryType::ForwardAgent),
+                tag: host.get(&ssh_config::EntryType::Tag),
+                proxy_command: host
+                    .get(&ssh_config::EntryType::ProxyCommand)
+                    .map(|command| expand_tokens(&command, proxy_tokens)),
+                proxy_command_pattern: host.get(&ssh_config::EntryType::ProxyCommand),
+                proxy_jump: host
+                    .get(&ssh_config::EntryType::ProxyJump)
+                    .filter(|jump| !jump.eq_ignore_ascii_case("none"))
+                    .map(|jump| expand_tokens(&jump, proxy_tokens)),
+                local_command: host
+                    .get(&ssh_config::EntryType::LocalCommand)
+                    .map(|command| expand_tokens(&command, &tokens)),
+                permit_local_command: host
+                    .get(&ssh_config::EntryType::PermitLocalCommand)
+                    .is_some_and(|value| value.eq_ignore_ascii_case("yes")),
+                remote_command: host
+                    .get(&ssh_config::EntryType::RemoteCommand)
+                    .map(|command| expand_tokens(&command, &tokens)),
+                request_tty: host.get(&ssh_config::EntryType::RequestTTY),
+                log_level: host.get(&ssh_config::EntryType::LogLevel),
+                tags: host
+                    .get_metadata("tags")
+                    .map(parse_tags)
+                    .unwrap_or_default(),
+                owner: host
+                    .get_metadata("owner")
+                    .or_else(|| host.get_metadata("team"))
+                    .map(ToString::to_string),
+                note: host.get_metadata("note").map(ToString::to_string),
+                timezone: host.get_metadata("timezone").map(ToString::to_string),
+                instance_id: host.get_metadata("instance-id").map(ToString::to_string),
+                region: host.get_metadata("region").map(ToString::to_string),
+                zone: host.get_metadata("zone").map(ToString::to_string),
+                project: host.get_metadata("project").map(ToString::to_string),
+                iap: host
+                    .get_metadata("iap")
+                    .is_some_and(|value| value.eq_ignore_ascii_case("yes")),
+                teleport: host_teleport_cluster(host),
+                protocol: host
+                    .get_metadata("protocol")
+                    .map(|value| parse_protocol(&name, value))
+                    .unwrap_or_default(),
+                namespace: host.get_metadata("namespace").map(ToString::to_string),
+                context: host.get_metadata("context").map(ToString::to_string),
+                maintenance: host
+                    .get_metadata("maintenance")
+                    .map(clock::parse_windows)
+                    .unwrap_or_default(),
+                fallback_ports: host
+                    .get_metadata("ports")
+                    .map(parse_ports)
+                    .unwrap_or_default(),
+                origin: host.get_origin().cloned(),
+                config_path: raw_path.to_string(),
+                name,
+                user,
+                destination,
+                port,
+            }
         })
-        .collect();
+        .collect()
+}
+
+/// Parses a comma-separated list of tags, skipping the empty ones.
+fn parse_tags(value: &str) -> Vec<String> {
+    value
+        .split(',')
+        .map(str::trim)
+        .filter(|tag| !tag.is_empty())
+        .map(ToString::to_string)
+        .collect()
+}
+
+/// Parses a list of ports and port ranges such as `22,2222,8022-8024`, skipping the invalid ones
+/// and the ones past [`MAX_FALLBACK_PORTS`].
+fn parse_ports(value: &str) -> Vec<u16> {
+    let mut ports = Vec::new();
+    for item in value
+        .split(',')
+        .map(str::trim)
+        .filter(|item| !item.is_empty())
+    {
+        let range = match item.split_once('-') {
+            Some((start, end)) => start
+                .trim()
+                .parse()
+                .and_then(|start: u16| end.trim().parse().map(|end: u16| start..=end)),
+            None => item.parse().map(|port| port..=port),
+        };
+
+        match range {
+            Ok(range) if ports.len() + range.len() > MAX_FALLBACK_PORTS => {
+                log::warn!(ports = value, item = item, max = MAX_FALLBACK_PORTS; "Skipping ports past the maximum");
+            }
+            Ok(range) => ports.extend(range),
+            Err(err) => {
+                log::warn!(ports = value, item = item, error:% = err; "Skipping invalid port");
+            }
+        }
+    }
+
+    ports
+}
+
+/// Adds a host for each alias of the hosts, right after the host, so the exact name given to
+/// `ssh` can be picked.
+#[must_use]
+pub fn expand_aliases(hosts: &[Host]) -> Vec<Host> {
+    let mut expanded = Vec::with_capacity(hosts.len());
+    for host in hosts {
+        expanded.push(host.clone());
+
+        let names = std::iter::once(host.name.as_str())
+            .chain(host.aliases.split(", ").filter(|alias| !alias.is_empty()))
+            .collect::<Vec<_>>();
+        for alias in &names[1..] {
+            let mut alias_host = host.clone();
+            alias_host.name = (*alias).to_string();
+            alias_host.aliases = names.iter().filter(|name| *name != alias).join(", ");
+            alias_host.alias_of = Some(host.name.clone());
+            // Without HostName, ssh connects to the name it is given
+            if host.destination == host.name {
+                alias_host.destination = (*alias).to_string();
+            }
+            expanded.push(alias_host);
+        }
+    }
+
+    expanded
+}
+
+/// Groups the hosts by [`Host::endpoint`], keeping the endpoints defined by several hosts.
+#[must_use]
+pub fn find_duplicates(hosts: &[Host]) -> HashMap<String, Vec<Host>> {
+    let mut endpoints = HashMap::<String, Vec<Host>>::new();
+    for host in hosts {
+        endpoints
+            .entry(host.endpoint())
+            .or_default()
+            .push(host.clone());
+    }
+
+    endpoints.retain(|_, hosts| hosts.len() > 1);
+    endpoints
+}
+
+/// Name of the user running sshs, used by `ssh` when the host has no `User`.
+#[must_use]
+pub fn local_user() -> String {
+    std::env::var("USER")
+        .or_else(|_| std::env::var("USERNAME"))
+        .unwrap_or_default()
+}
+
+/// Replaces the `%x` tokens with their value, leaving the unknown ones as written.
+fn expand_tokens(value: &str, tokens: &[(char, &str)]) -> String {
+    let mut expanded = String::with_capacity(value.len());
+    let mut chars = value.chars();
+
+    while let Some(c) = chars.next() {
+        if c != '%' {
+            expanded.push(c);
+            continue;
+        }
+
+        let Some(token) = chars.next() else {
+            expanded.push('%');
+            break;
+        };
+
+        if token == '%' {
+            expanded.push('%');
+        } else if let Some((_, value)) = tokens.iter().find(|(name, _)| *name == token) {
+            expanded.push_str(value);
+        } else {
+            expanded.push('%');
+            expanded.push(token);
+        }
+    }
+
+    expanded
+}
+
+/// Replaces the `${NAME}` environment variables, leaving the unset ones as written.
+fn expand_env(value: &str) -> String {
+    let mut expanded = String::with_capacity(value.len());
+    let mut rest = value;
+
+    while let Some(start) = rest.find("${") {
+        let Some(length) = rest[start + 2..].find('}') else {
+            break;
+        };
+
+        let name = &rest[start + 2..start + 2 + length];
+        expanded.push_str(&rest[..start]);
+        match std::env::var(name) {
+            Ok(value) => expanded.push_str(&value),
+            Err(_) => expanded.push_str(&rest[start..start + 3 + length]),
+        }
+        rest = &rest[start + 3 + length..];
+    }
+
+    expanded.push_str(rest);
+    expanded
+}
+
+/// Loads the hosts whose name or one of the aliases matches one of the wildcard patterns.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration cannot be parsed or if no host matches.
+pub fn select_hosts(config_paths: &[String], patterns: &[String]) -> anyhow::Result<Vec<Host>> {
+    let hosts = load_hosts(config_paths)?
+        .into_iter()
+        .filter(|host| {
+            patterns.iter().any(|pattern| {
+                std::iter::once(host.name.as_str())
+                    .chain(host.aliases.split(", "))
+                    .any(|name| {
+                        ssh_config::wildcard_match(&pattern.to_lowercase(), &name.to_lowercase())
+                    })
+            })
+        })
+        .collect::<Vec<_>>();
+
+    if hosts.is_empty() {
+        anyhow::bail!("No host matches {}", patterns.join(", "));
+    }
 
     Ok(hosts)
 }
+
+/// Parses all the SSH configuration files, ignoring a missing system-wide one.
+///
+/// The lines that cannot be parsed are skipped and reported on stderr.
+///
+/// # Errors
+///
+/// Will return `Err` if one of the SSH configuration files cannot be read.
+pub fn load_hosts(config_paths: &[String]) -> anyhow::Result<Vec<Host>> {
+    let (hosts, problems) = load_hosts_with_problems(config_paths)?;
+
+    for problem in &problems {
+        eprintln!("Warning: {problem}");
+    }
+
+    Ok(hosts)
+}
+
+/// Parses all the SSH configuration files, ignoring a missing system-wide one.
+///
+/// Returns the hosts and the errors of the lines that could not be parsed.
+///
+/// # Errors
+///
+/// Will return `Err` if one of the SSH configuration files cannot be read.
+pub fn load_hosts_with_problems(
+    config_paths: &[String],
+) -> anyhow::Result<(Vec<Host>, Vec<ParseError>)> {
+    let mut hosts = Vec::new();
+    let mut problems = Vec::new();
+
+    for path in config_paths {
+        let (parsed_hosts, parsed_problems) = load_source(path)?;
+        hosts.extend(parsed_hosts);
+        problems.extend(parsed_problems);
+    }
+
+    Ok((hosts, problems))
+}
+
+/// Parses one of the SSH configuration files, a missing system-wide one having no hosts.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration file cannot be read.
+pub fn load_source(path: &String) -> anyhow::Result<(Vec<Host>, Vec<ParseError>)> {
+    load_source_with_progress(path, None)
+}
+
+/// Parses one of the SSH configuration files like [`load_source`], giving the hosts read so
+/// far to `on_hosts` before reading each included file.
+///
+/// # Errors
+///
+/// Will return `Err` if the SSH configuration file cannot be read.
+pub fn load_source_with_progress(
+    path: &String,
+    on_hosts: Option<&dyn Fn(Vec<Host>)>,
+) -> anyhow::Result<(Vec<Host>, Vec<ParseError>)> {
+    match parse_config_with_progress(path, on_hosts) {
+        Ok(parsed) => Ok(parsed),
+        Err(err) => {
+            if path == "/etc/ssh/ssh_config" {
+                if let ParseConfigError::Io(io_err) = &err {
+                    // Ignore missing system-wide SSH configuration file
+                    if io_err.kind() == std::io::ErrorKind::NotFound {
+                        log::debug!(path = path.as_str(); "Skipping missing system-wide configuration file");
+                        return Ok((Vec::new(), Vec::new()));
+                    }
+                }
+            }
+
+            log::error!(path = path.as_str(), error:? = err; "Failed to parse SSH configuration file");
+            anyhow::bail!("Failed to parse SSH configuration file {path}: {err}");
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_destination() {
+        let destination = |user: Option<&str>, hostname: &str, port: Option<&str>| Destination {
+            user: user.map(ToString::to_string),
+            hostname: hostname.to_string(),
+            port: port.map(ToString::to_string),
+        };
+
+        assert_eq!(
+            "example.com".parse::<Destination>().unwrap(),
+            destination(None, "example.com", None)
+        );
+        assert_eq!(
+            "root@10.0.0.1:2222".parse::<Destination>().unwrap(),
+            destination(Some("root"), "10.0.0.1", Some("2222"))
+        );
+        assert_eq!(
+            "ssh://admin@[::1]:22".parse::<Destination>().unwrap(),
+            destination(Some("admin"), "::1", Some("22"))
+        );
+        assert_eq!(
+            "fe80::1".parse::<Destination>().unwrap(),
+            destination(None, "fe80::1", None)
+        );
+        assert!("@host".parse::<Destination>().is_err());
+        assert!("host:ssh".parse::<Destination>().is_err());
+    }
+
+    #[test]
+    fn test_expand_config_values() {
+        let tokens = [('h', "10.0.0.1"), ('p', "22"), ('r', "root")];
+
+        assert_eq!(
+            expand_tokens("ssh -W %h:%p -l %r bastion", &tokens),
+            "ssh -W 10.0.0.1:22 -l root bastion"
+        );
+        assert_eq!(expand_tokens("100%% %C %", &tokens), "100% %C %");
+
+        std::env::set_var("SSHS_TEST_KEYS", "/keys");
+        assert_eq!(
+            expand_env("${SSHS_TEST_KEYS}/id_${SSHS_TEST_UNSET}"),
+            "/keys/id_${SSHS_TEST_UNSET}"
+        );
+        assert_eq!(expand_env("$HOME/${unclosed"), "$HOME/${unclosed");
+    }
+
+    #[test]
+    fn test_template_fields() {
+        let host = &parse_text("Host web\n")[0];
+        let serde_json::Value::Object(fields) = serde_json::to_value(host).unwrap() else {
+            panic!("A host serializes to an object");
+        };
+
+        let listed = TEMPLATE_FIELDS
+            .iter()
+            .filter_map(|field| field.split('.').next())
+            .chain(["maintenance"])
+            .collect::<std::collections::BTreeSet<_>>();
+        assert_eq!(
+            listed,
+            fields
+                .keys()
+                .map(String::as_str)
+                .collect::<std::collections::BTreeSet<_>>()
+        );
+    }
+
+    #[test]
+    fn test_rate_limit_key() {
+        let hosts = parse_text(
+            "Host web\nHost db\nHost direct\n  HostName 10.0.0.1\nHost * !direct\n  ProxyCommand ssh -W %h:%p bastion\n",
+        );
+
+        assert_eq!(
+            hosts[0].proxy_command.as_deref(),
+            Some("ssh -W web:22 bastion")
+        );
+        // Hosts behind the same proxy wait for each other
+        assert_eq!(hosts[0].rate_limit_key(), "ssh -W %h:%p bastion");
+        assert_eq!(hosts[1].rate_limit_key(), hosts[0].rate_limit_key());
+        assert_eq!(hosts[2].rate_limit_key(), "10.0.0.1:22");
+    }
+
+    #[test]
+    fn test_expand_aliases() {
+        let hosts = parse_text(
+            "Host web1 web1.internal\n  User me\nHost db db.internal\n  HostName 10.0.0.3\n",
+        );
+
+        let expanded = expand_aliases(&hosts)
+            .into_iter()
+            .map(|host| (host.name, host.destination, host.aliases, host.alias_of))
+            .collect::<Vec<_>>();
+        let row = |name: &str, destination: &str, aliases: &str, alias_of: Option<&str>| {
+            (
+                name.to_string(),
+                destination.to_string(),
+                aliases.to_string(),
+                alias_of.map(ToString::to_string),
+            )
+        };
+        assert_eq!(
+            expanded,
+            vec![
+                row("web1", "web1", "web1.internal", None),
+                row("web1.internal", "web1.internal", "web1", Some("web1")),
+                row("db", "10.0.0.3", "db.internal", None),
+                row("db.internal", "10.0.0.3", "db", Some("db")),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_run_after_session() {
+        let command = vec!["ssh".to_string(), "web".to_string()];
+        let after = ["/bin/sshs".to_string(), "after-hooks".to_string()];
+
+        let wrapped = Multiplexer::Tmux.then_run(command.clone(), &after).unwrap();
+        assert_eq!(wrapped[..2], ["sh", "-c"]);
+        assert!(wrapped[2].contains("\"$@\"; status=$?; /bin/sshs after-hooks --started"));
+        assert_eq!(wrapped[3..], ["sh", "ssh", "web"]);
+
+        assert_eq!(
+            Multiplexer::Tmux.then_run(command.clone(), &[]).unwrap(),
+            command
+        );
+    }
+
+    #[test]
+    fn test_expand_command() {
+        let mut host = parse_text("Host web\n  Port 2222\n").remove(0);
+        host.user = Some("it's me".to_string());
+
+        assert_eq!(
+            host.expand_command("sh -c 'echo %r@%n' -p %p").unwrap(),
+            ["sh", "-c", "echo it's me@web", "-p", "2222"]
+        );
+        assert_eq!(host.expand_command("echo 'unclosed"), None);
+    }
+
+    #[test]
+    fn test_teleport_command() {
+        let hosts = parse_text("Host web\n  # sshs-teleport: yes\n  User root\nHost db\n  ProxyCommand tsh proxy ssh --cluster=lab %r@%h:%p\n");
+
+        assert_eq!(
+            hosts[0]
+                .command_line("ssh {{{name}}}", &["-A", "-o", "ForwardX11=yes"])
+                .unwrap(),
+            "tsh ssh -A root@web"
+        );
+        assert_eq!(
+            hosts[1]
+                .command_line("ssh {{{name}}}", &["-l", "admin", "-p", "2222"])
+                .unwrap(),
+            "tsh ssh '--cluster=lab' -p 2222 admin@db"
+        );
+    }
+
+    #[test]
+    fn test_protocols() {
+        let hosts = parse_text("Host switch\n  # sshs-protocol: telnet\n  Hostname 10.0.0.2\nHost bmc\n  # sshs-protocol: IPMI\nHost desktop\n  # sshs-protocol: rdp\nHost web\n  # sshs-protocol: vnc\n");
+
+        assert_eq!(hosts[0].protocol, Protocol::Telnet);
+        assert_eq!(hosts[0].probe_address().as_deref(), Some("10.0.0.2:23"));
+        assert_eq!(hosts[1].protocol, Protocol::Console);
+        assert_eq!(hosts[1].probe_address(), None);
+        assert_eq!(hosts[2].protocol, Protocol::Rdp);
+        assert_eq!(hosts[2].probe_address().as_deref(), Some("desktop:3389"));
+        assert_eq!(hosts[3].protocol, Protocol::Ssh);
+    }
+
+    #[test]
+    fn test_shared_jump() {
+        let hosts =
+            parse_text("Host app\n  ProxyJump admin@bastion:2222\nHost chain\n  ProxyJump a,b\n");
+
+        let (connection, args) = hosts[0].shared_jump(Duration::from_secs(60)).unwrap();
+        assert_eq!(connection.destination, "ssh://admin@bastion:2222");
+        assert!(connection.jump);
+        assert_eq!(args[0], "-o");
+        assert!(args[1].starts_with("ProxyCommand=ssh -F "));
+        assert!(args[1].contains("/%%C"));
+        assert!(args[1].ends_with(" -W '[%h]:%p' ssh://admin@bastion:2222"));
+        assert!(hosts[1].shared_jump(Duration::from_secs(60)).is_none());
+
+        let command = hosts[0]
+            .shared_connection(&["-p", "2222", "-J", "none"])
+            .control_command("exit");
+        assert_eq!(
+            command[..7],
+            ["ssh", "-F", "test", "-p", "2222", "-J", "none"]
+        );
+        assert_eq!(command[command.len() - 3..], ["-O", "exit", "app"]);
+    }
+
+    #[test]
+    fn test_parse_ports() {
+        assert_eq!(
+            parse_ports("22, 2222,8022-8024"),
+            vec![22, 2222, 8022, 8023, 8024]
+        );
+        assert_eq!(parse_ports("443,ssh,,2-x"), vec![443]);
+        assert_eq!(parse_ports("1-65535, 2222"), vec![2222]);
+    }
+}
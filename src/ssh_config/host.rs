@@ -1,14 +1,29 @@
 use regex::Regex;
+use serde::Serialize;
 use std::collections::HashMap;
+use std::path::PathBuf;
 
 use super::EntryType;
 
+/// Maximum number of names a `# sshs-expand:` comment can add.
+const MAX_EXPANDED_NAMES: usize = 4096;
+
 pub(crate) type Entry = (EntryType, String);
 
+/// Location of a host block in the configuration files.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Origin {
+    pub path: PathBuf,
+    pub line: usize,
+}
+
 #[derive(Debug, Clone)]
 pub struct Host {
     patterns: Vec<String>,
     entries: HashMap<EntryType, String>,
+    /// Values of the `# sshs-KEY: VALUE` comments of the block, by key.
+    metadata: HashMap<String, String>,
+    origin: Option<Origin>,
 }
 
 impl Host {
@@ -17,13 +32,35 @@ impl Host {
         Host {
             patterns,
             entries: HashMap::new(),
+            metadata: HashMap::new(),
+            origin: None,
         }
     }
 
+    #[must_use]
+    pub fn with_origin(mut self, origin: Option<Origin>) -> Host {
+        self.origin = origin;
+        self
+    }
+
+    #[allow(clippy::must_use_candidate)]
+    pub fn get_origin(&self) -> Option<&Origin> {
+        self.origin.as_ref()
+    }
+
     pub fn update(&mut self, entry: Entry) {
         self.entries.insert(entry.0, entry.1);
     }
 
+    pub(crate) fn set_metadata(&mut self, key: &str, value: &str) {
+        self.metadata.insert(key.to_string(), value.to_string());
+    }
+
+    #[allow(clippy::must_use_candidate)]
+    pub fn get_metadata(&self, key: &str) -> Option<&str> {
+        self.metadata.get(key).map(String::as_str)
+    }
+
     pub(crate) fn extend_patterns(&mut self, host: &Host) {
         self.patterns.extend(host.patterns.clone());
     }
@@ -32,10 +69,13 @@ impl Host {
         self.entries.extend(host.entries.clone());
     }
 
-    pub(crate) fn extend_if_not_contained(&mut self, host: &Host) {
-        for (key, value) in &host.entries {
-            if !self.entries.contains_key(key) {
-                self.entries.insert(key.clone(), value.clone());
+    /// Takes the entries of the options set before the first block, which ssh reads first and
+    /// keeps over the entries of the host. The metadata of the host still wins.
+    pub(crate) fn extend_from_global(&mut self, host: &Host) {
+        self.entries.extend(host.entries.clone());
+        for (key, value) in &host.metadata {
+            if !self.metadata.contains_key(key) {
+                self.metadata.insert(key.clone(), value.clone());
             }
         }
     }
@@ -79,6 +119,35 @@ impl Host {
             .collect()
     }
 
+    /// Whether the block applies to the given host name, following the `ssh_config` rules:
+    /// at least one pattern must match and none of the negated patterns may match.
+    #[allow(clippy::must_use_candidate)]
+    pub fn matches(&self, name: &str) -> bool {
+        let name = name.to_lowercase();
+        let mut is_matching = false;
+
+        for pattern in &self.patterns {
+            let (pattern, is_negated) = match pattern.strip_prefix('!') {
+                Some(pattern) => (pattern, true),
+                None => (pattern.as_str(), false),
+            };
+
+            if wildcard_match(&pattern.to_lowercase(), &name) {
+                if is_negated {
+                    return false;
+                }
+                is_matching = true;
+            }
+        }
+
+        is_matching
+    }
+
+    #[allow(clippy::must_use_candidate)]
+    pub fn get_entries(&self) -> &HashMap<EntryType, String> {
+        &self.entries
+    }
+
     #[allow(clippy::must_use_candidate)]
     pub fn get(&self, entry: &EntryType) -> Option<String> {
         self.entries.get(entry).cloned()
@@ -90,8 +159,81 @@ impl Host {
     }
 }
 
+/// Matches `*` (any sequence) and `?` (any character) wildcards.
+#[must_use]
+pub fn wildcard_match(pattern: &str, value: &str) -> bool {
+    let pattern = pattern.chars().collect::<Vec<_>>();
+    let value = value.chars().collect::<Vec<_>>();
+
+    let (mut p, mut v) = (0, 0);
+    let mut backtrack: Option<(usize, usize)> = None;
+
+    while v < value.len() {
+        if p < pattern.len() && (pattern[p] == '?' || pattern[p] == value[v]) {
+            p += 1;
+            v += 1;
+        } else if p < pattern.len() && pattern[p] == '*' {
+            backtrack = Some((p, v));
+            p += 1;
+        } else if let Some((star, matched)) = backtrack {
+            p = star + 1;
+            v = matched + 1;
+            backtrack = Some((star, matched + 1));
+        } else {
+            return false;
+        }
+    }
+
+    pattern[p..].iter().all(|c| *c == '*')
+}
+
+/// Expands the `{01..20}` and `[01-20]` ranges of a name, the numbers being zero-padded
+/// like the start of their range.
+///
+/// Returns `None` if a range is invalid or gives too many names.
+#[must_use]
+pub fn expand_ranges(name: &str) -> Option<Vec<String>> {
+    let Some(open) = name.find(['{', '[']) else {
+        return Some(vec![name.to_string()]);
+    };
+    let (close, separator) = if name[open..].starts_with('{') {
+        ('}', "..")
+    } else {
+        (']', "-")
+    };
+    let close = open + name[open..].find(close)?;
+    let (start, end) = name[open + 1..close].split_once(separator)?;
+    let width = if start.starts_with('0') {
+        start.len()
+    } else {
+        0
+    };
+    let (start, end) = (start.parse::<u32>().ok()?, end.parse::<u32>().ok()?);
+
+    let prefix = &name[..open];
+    let suffixes = expand_ranges(&name[close + 1..])?;
+    let mut names = Vec::new();
+    for number in start..=end {
+        for suffix in &suffixes {
+            if names.len() == MAX_EXPANDED_NAMES {
+                return None;
+            }
+            names.push(format!("{prefix}{number:0width$}{suffix}"));
+        }
+    }
+
+    (!names.is_empty()).then_some(names)
+}
+
 #[allow(clippy::module_name_repetitions)]
 pub trait HostVecExt {
+    /// Adds a host after each block for the names listed by its `# sshs-expand:` comment,
+    /// such as `web{01..20}.prod`.
+    ///
+    /// The names get the entries of the blocks whose patterns they match once
+    /// [`HostVecExt::apply_patterns`] is called, like in ssh.
+    fn expand_names(&mut self) -> &mut Self;
+
     /// Apply the name entry to the hostname entry if the hostname entry is empty.
     fn apply_name_to_empty_hostname(&mut self) -> &mut Self;
 
@@ -106,6 +248,45 @@ pub trait HostVecExt {
 }
 
 impl HostVecExt for Vec<Host> {
+    fn expand_names(&mut self) -> &mut Self {
+        let mut names = self
+            .iter()
+            .filter(|host| host.matching_pattern_regexes().is_empty())
+            .filter_map(|host| host.patterns.first().cloned())
+            .collect::<std::collections::HashSet<_>>();
+
+        let mut hosts = Vec::with_capacity(self.len());
+        for host in self.drain(..) {
+            let expanded = host
+                .get_metadata("expand")
+                .map(|value| {
+                    value
+                        .split(|c: char| c == ',' || c.is_whitespace())
+                        .filter(|name| !name.is_empty())
+                        .flat_map(|name| {
+                            expand_ranges(name).unwrap_or_else(|| {
+                                log::warn!(name = name; "Skipping invalid expansion");
+                                Vec::new()
+                            })
+                        })
+                        .collect::<Vec<_>>()
+                })
+                .unwrap_or_default();
+            let origin = host.origin.clone();
+            hosts.push(host);
+
+            for name in expanded {
+                // Hosts defined on their own keep their block
+                if names.insert(name.clone()) {
+                    hosts.push(Host::new(vec![name]).with_origin(origin.clone()));
+                }
+            }
+        }
+
+        *self = hosts;
+        self
+    }
+
     fn apply_name_to_empty_hostname(&mut self) -> &mut Self {
         for host in self.iter_mut() {
             if host.get(&EntryType::Hostname).is_none() {
@@ -160,41 +341,60 @@ impl HostVecExt for Vec<Host> {
     /// You might want to call [`HostVecExt::merge_same_hosts`] after this.
     fn apply_patterns(&mut self) -> &mut Self {
         let hosts = self.spread();
-        let mut pattern_indexes = Vec::new();
-
-        for i in 0..hosts.len() {
-            let matching_pattern_regexes = hosts[i].matching_pattern_regexes();
-            if matching_pattern_regexes.is_empty() {
+        let regexes = hosts
+            .iter()
+            .map(Host::matching_pattern_regexes)
+            .collect::<Vec<_>>();
+        let pattern_indexes = (0..hosts.len())
+            .filter(|i| !regexes[*i].is_empty())
+            .collect::<Vec<_>>();
+
+        for j in 0..hosts.len() {
+            if !regexes[j].is_empty() {
                 continue;
             }
 
-            pattern_indexes.push(i);
-
-            for j in 0..hosts.len() {
-                if i == j {
-                    continue;
-                }
+            let blocks = pattern_indexes
+                .iter()
+                .copied()
+                .filter(|i| hosts[*i].matches(&hosts[j].patterns[0]))
+                .collect::<Vec<_>>();
+            if blocks.is_empty() {
+                continue;
+            }
 
-                if !hosts[j].matching_pattern_regexes().is_empty() {
-                    continue;
+            // ssh keeps the first value of each entry in the order of the blocks, so a
+            // `Host *` above the host wins over its own entries
+            let mut entries = HashMap::new();
+            let ordered = blocks
+                .iter()
+                .copied()
+                .filter(|i| *i < j)
+                .chain(std::iter::once(j))
+                .chain(blocks.iter().copied().filter(|i| *i > j));
+            for i in ordered {
+                for (key, value) in &hosts[i].entries {
+                    entries.entry(key.clone()).or_insert_with(|| value.clone());
                 }
+            }
 
-                for (regex, is_negated) in &matching_pattern_regexes {
-                    if regex.is_match(&hosts[j].patterns[0]) == *is_negated {
-                        continue;
-                    }
-
-                    let host = hosts[i].clone();
-                    hosts[j].extend_if_not_contained(&host);
-                    break;
+            let mut metadata = hosts[j].metadata.clone();
+            for i in &blocks {
+                for (key, value) in &hosts[*i].metadata {
+                    metadata.entry(key.clone()).or_insert_with(|| value.clone());
                 }
             }
-        }
 
-        for i in pattern_indexes.into_iter().rev() {
-            hosts.remove(i);
+            hosts[j].entries = entries;
+            hosts[j].metadata = metadata;
         }
 
+        let mut index = 0;
+        hosts.retain(|_| {
+            index += 1;
+            regexes[index - 1].is_empty()
+        });
+
         hosts
     }
 }
@@ -203,6 +403,44 @@ impl HostVecExt for Vec<Host> {
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_expand_names() {
+        assert_eq!(
+            expand_ranges("web{08..10}.prod"),
+            Some(vec![
+                "web08.prod".to_string(),
+                "web09.prod".to_string(),
+                "web10.prod".to_string()
+            ])
+        );
+        assert_eq!(expand_ranges("db[1-2]-[a-b]"), None);
+        assert_eq!(
+            expand_ranges("db[1-2]x{1..1}").unwrap(),
+            vec!["db1x1", "db2x1"]
+        );
+        assert_eq!(expand_ranges("web{3..1}"), None);
+        assert_eq!(expand_ranges("web{1..99999}"), None);
+
+        let mut pattern = Host::new(vec!["web*".to_string()]);
+        pattern.set_metadata("expand", "web1, web[2-3]");
+        pattern.update((EntryType::User, "deploy".to_string()));
+        let mut hosts = vec![Host::new(vec!["web2".to_string()]), pattern];
+
+        let hosts = hosts.expand_names().apply_patterns();
+
+        assert_eq!(
+            hosts
+                .iter()
+                .map(|host| (host.patterns[0].as_str(), host.get(&EntryType::User)))
+                .collect::<Vec<_>>(),
+            vec![
+                ("web2", Some("deploy".to_string())),
+                ("web1", Some("deploy".to_string())),
+                ("web3", Some("deploy".to_string())),
+            ]
+        );
+    }
+
     #[test]
     fn test_apply_patterns() {
         let mut hosts = Vec::new();
@@ -211,7 +449,7 @@ mod tests {
         host.update((EntryType::Hostname, "example.com".to_string()));
         hosts.push(host);
 
-        let mut host = Host::new(vec!["!example.com".to_string()]);
+        let mut host = Host::new(vec!["*".to_string(), "!example.com".to_string()]);
         host.update((EntryType::User, "hello".to_string()));
         hosts.push(host);
 
@@ -238,4 +476,70 @@ mod tests {
         assert_eq!(hosts[1].entries[&EntryType::User], "hello");
         assert_eq!(hosts[1].entries[&EntryType::Port], "22");
     }
+
+    #[test]
+    fn test_apply_patterns_in_order() {
+        let block = |pattern: &str, port: Option<&str>| {
+            let mut host = Host::new(vec![pattern.to_string()]);
+            if let Some(port) = port {
+                host.update((EntryType::Port, port.to_string()));
+            }
+            host
+        };
+
+        let mut hosts = vec![
+            block("db", Some("5432")),
+            block("web-*", Some("2200")),
+            block("web-1", Some("22")),
+            block("web-2", None),
+            block("*", Some("2222")),
+        ];
+        let hosts = hosts.apply_patterns();
+
+        // The first value wins like in ssh, a pattern above the host overriding its own port
+        let ports = hosts
+            .iter()
+            .map(|host| host.entries[&EntryType::Port].as_str())
+            .collect::<Vec<_>>();
+        assert_eq!(ports, ["5432", "2200", "2200"]);
+    }
+
+    #[test]
+    fn test_apply_negated_patterns() {
+        let mut all_but_bastion = Host::new(vec!["*".to_string(), "!bastion".to_string()]);
+        all_but_bastion.update((EntryType::ProxyJump, "bastion".to_string()));
+        let mut not_web = Host::new(vec!["!web".to_string()]);
+        not_web.update((EntryType::User, "admin".to_string()));
+        let mut hosts = vec![
+            Host::new(vec!["bastion".to_string()]),
+            Host::new(vec!["web".to_string()]),
+            all_but_bastion,
+            not_web,
+        ];
+
+        let hosts = hosts.apply_patterns();
+
+        // Like in ssh, a negated pattern only excludes and never matches on its own
+        assert_eq!(hosts.len(), 2);
+        assert_eq!(hosts[0].get(&EntryType::ProxyJump), None);
+        assert_eq!(hosts[0].get(&EntryType::User), None);
+        assert_eq!(
+            hosts[1].get(&EntryType::ProxyJump),
+            Some("bastion".to_string())
+        );
+        assert_eq!(hosts[1].get(&EntryType::User), None);
+    }
+
+    #[test]
+    fn test_matches() {
+        let host = Host::new(vec![
+            "*.example.com".to_string(),
+            "!db?.example.com".to_string(),
+        ]);
+
+        assert!(host.matches("web.example.com"));
+        assert!(host.matches("WEB.example.com"));
+        assert!(!host.matches("db1.example.com"));
+        assert!(!host.matches("example.com"));
+    }
 }
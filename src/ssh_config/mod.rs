@@ -3,7 +3,9 @@ mod host_entry;
 pub mod parser;
 pub mod parser_error;
 
+pub use host::wildcard_match;
 pub use host::Host;
 pub use host::HostVecExt;
+pub use host::Origin;
 pub use host_entry::EntryType;
 pub use parser::Parser;
@@ -1,4 +1,5 @@
 use glob::glob;
+use std::cell::{Cell, RefCell};
 use std::fs::File;
 use std::io::BufRead;
 use std::io::BufReader;
@@ -10,27 +11,60 @@ use super::parser_error::InvalidIncludeError;
 use super::parser_error::InvalidIncludeErrorDetails;
 use super::parser_error::ParseError;
 use super::parser_error::UnknownEntryError;
-use super::{EntryType, Host};
+use super::{EntryType, Host, Origin};
 
-#[derive(Debug)]
-pub struct Parser {
+type ProgressFn<'a> = dyn Fn(Vec<Host>) + 'a;
+
+pub struct Parser<'a> {
     ignore_unknown_entries: bool,
+    recover_errors: bool,
+    problems: RefCell<Vec<ParseError>>,
+    on_progress: Option<Box<ProgressFn<'a>>>,
+    /// How many Include directives deep the file being parsed is.
+    depth: Cell<usize>,
 }
 
-impl Default for Parser {
+impl Default for Parser<'_> {
     fn default() -> Self {
         Self::new()
     }
 }
 
-impl Parser {
+impl<'a> Parser<'a> {
     #[must_use]
-    pub fn new() -> Parser {
+    pub fn new() -> Self {
         Parser {
             ignore_unknown_entries: true,
+            recover_errors: false,
+            problems: RefCell::new(Vec::new()),
+            on_progress: None,
+            depth: Cell::new(0),
         }
     }
 
+    /// Calls `on_progress` with the hosts of the file read so far before reading each of the
+    /// files it includes, so that the hosts can be shown while slow includes are read.
+    #[must_use]
+    pub fn with_progress<F>(mut self, on_progress: F) -> Self
+    where
+        F: Fn(Vec<Host>) + 'a,
+    {
+        self.on_progress = Some(Box::new(on_progress));
+        self
+    }
+
+    /// Skips the lines that cannot be parsed instead of failing, see [`Parser::take_problems`].
+    #[must_use]
+    pub fn with_error_recovery(mut self) -> Self {
+        self.recover_errors = true;
+        self
+    }
+
+    /// Returns the errors of the lines skipped since the last call.
+    pub fn take_problems(&self) -> Vec<ParseError> {
+        self.problems.take()
+    }
+
     /// # Errors
     ///
     /// Will return `Err` if the SSH configuration cannot be parsed.
@@ -38,131 +72,221 @@ impl Parser {
     where
         P: AsRef<Path>,
     {
+        let path = path.as_ref();
         let mut reader = BufReader::new(File::open(path)?);
-        self.parse(&mut reader)
+        let (global_host, hosts) = self.parse_raw(&mut reader, Some(path))?;
+
+        Ok(apply_global_host(&global_host, hosts))
     }
 
+    /// Parses the file without applying the global entries to the hosts.
+    ///
+    /// Returns the entries set outside of any host block and the host blocks in the order
+    /// they appear in, Include directives being expanded in place.
+    ///
     /// # Errors
     ///
     /// Will return `Err` if the SSH configuration cannot be parsed.
-    pub fn parse(&self, reader: &mut impl BufRead) -> Result<Vec<Host>, ParseError> {
-        let (global_host, mut hosts) = self.parse_raw(reader)?;
+    pub fn parse_file_blocks<P>(&self, path: P) -> Result<(Host, Vec<Host>), ParseError>
+    where
+        P: AsRef<Path>,
+    {
+        let path = path.as_ref();
+        let mut reader = BufReader::new(File::open(path)?);
+        self.parse_raw(&mut reader, Some(path))
+    }
 
-        if !global_host.is_empty() {
-            for host in &mut hosts {
-                host.extend_if_not_contained(&global_host);
-            }
-        }
+    /// # Errors
+    ///
+    /// Will return `Err` if the SSH configuration cannot be parsed.
+    pub fn parse(&self, reader: &mut impl BufRead) -> Result<Vec<Host>, ParseError> {
+        let (global_host, hosts) = self.parse_raw(reader, None)?;
 
-        Ok(hosts)
+        Ok(apply_global_host(&global_host, hosts))
     }
 
-    fn parse_raw(&self, reader: &mut impl BufRead) -> Result<(Host, Vec<Host>), ParseError> {
-        let mut global_host = Host::new(Vec::new());
-        let mut is_in_host_block = false;
-        let mut hosts = Vec::new();
+    fn parse_raw(
+        &self,
+        reader: &mut impl BufRead,
+        path: Option<&Path>,
+    ) -> Result<(Host, Vec<Host>), ParseError> {
+        let mut blocks = Blocks {
+            global_host: Host::new(Vec::new()),
+            hosts: Vec::new(),
+            is_in_host_block: false,
+        };
 
         let mut line = String::new();
+        let mut line_number = 0;
         while reader.read_line(&mut line)? > 0 {
-            line = line.trim().to_string();
-            if line.is_empty() || line.starts_with('#') {
-                line.clear();
-                continue;
+            line_number += 1;
+            if let Some((key, value)) = parse_metadata(line.trim()) {
+                if blocks.is_in_host_block {
+                    log::trace!(key = key, value = value; "Host metadata");
+                    blocks.hosts.last_mut().unwrap().set_metadata(key, value);
+                }
             }
 
-            let entry = parse_line(&line)?;
+            let text = strip_comment(line.trim()).trim_end().to_string();
             line.clear();
 
-            match entry.0 {
-                EntryType::Unknown(_) => {
-                    if !self.ignore_unknown_entries {
-                        return Err(UnknownEntryError {
-                            line,
-                            entry: entry.0.to_string(),
-                        }
-                        .into());
-                    }
-                }
-                EntryType::Host => {
-                    let patterns = parse_patterns(&entry.1);
-                    hosts.push(Host::new(patterns));
-                    is_in_host_block = true;
+            if text.is_empty() {
+                continue;
+            }
 
-                    continue;
+            if let Err(error) = self.parse_raw_line(&text, path, line_number, &mut blocks) {
+                let error = error.located(path.map(Path::to_path_buf), line_number);
+                if !self.recover_errors {
+                    return Err(error);
                 }
-                EntryType::Include => {
-                    let mut include_path = shellexpand::tilde(&entry.1).to_string();
 
-                    if !include_path.starts_with('/') {
-                        let ssh_config_directory = shellexpand::tilde("~/.ssh").to_string();
-                        include_path = format!("{ssh_config_directory}/{include_path}");
-                    }
+                log::warn!(error:% = error; "Skipping configuration line");
+                self.problems.borrow_mut().push(error);
+            }
+        }
+
+        Ok((blocks.global_host, blocks.hosts))
+    }
 
-                    let paths = match glob(&include_path) {
-                        Ok(paths) => paths,
-                        Err(e) => {
-                            return Err(InvalidIncludeError {
-                                line,
-                                details: InvalidIncludeErrorDetails::Pattern(e),
-                            }
-                            .into())
-                        }
-                    };
-
-                    for path in paths {
-                        let path = match path {
-                            Ok(path) => path,
-                            Err(e) => {
-                                return Err(InvalidIncludeError {
-                                    line,
-                                    details: InvalidIncludeErrorDetails::Glob(e),
-                                }
-                                .into())
-                            }
-                        };
-
-                        let mut file = BufReader::new(File::open(path)?);
-                        let (included_global_host, included_hosts) = self.parse_raw(&mut file)?;
-
-                        if is_in_host_block {
-                            // Can't include hosts inside a host block
-                            if !included_hosts.is_empty() {
-                                return Err(InvalidIncludeError {
-                                    line,
-                                    details: InvalidIncludeErrorDetails::HostsInsideHostBlock,
-                                }
-                                .into());
-                            }
-
-                            hosts
-                                .last_mut()
-                                .unwrap()
-                                .extend_entries(&included_global_host);
-                        } else {
-                            if !included_global_host.is_empty() {
-                                global_host.extend_entries(&included_global_host);
-                            }
-
-                            hosts.extend(included_hosts);
-                        }
+    fn parse_raw_line(
+        &self,
+        line: &str,
+        path: Option<&Path>,
+        line_number: usize,
+        blocks: &mut Blocks,
+    ) -> Result<(), ParseError> {
+        let entry = parse_line(line)?;
+
+        match entry.0 {
+            EntryType::Unknown(_) => {
+                log::debug!(entry:% = entry.0, ignored = self.ignore_unknown_entries; "Unknown entry");
+                if !self.ignore_unknown_entries {
+                    return Err(UnknownEntryError {
+                        line: line.to_string(),
+                        entry: entry.0.to_string(),
                     }
+                    .into());
+                }
+            }
+            EntryType::Host => {
+                let patterns = parse_patterns(&entry.1);
+                log::trace!(patterns:? = patterns; "Host block");
+                blocks
+                    .hosts
+                    .push(Host::new(patterns).with_origin(path.map(|path| Origin {
+                        path: path.to_path_buf(),
+                        line: line_number,
+                    })));
+                blocks.is_in_host_block = true;
+
+                return Ok(());
+            }
+            EntryType::Include => {
+                self.include(line, &entry.1, blocks)?;
+                return Ok(());
+            }
+            _ => {}
+        }
+
+        if blocks.is_in_host_block {
+            blocks.hosts.last_mut().unwrap().update(entry);
+        } else {
+            blocks.global_host.update(entry);
+        }
 
-                    continue;
+        Ok(())
+    }
+
+    fn include(&self, line: &str, pattern: &str, blocks: &mut Blocks) -> Result<(), ParseError> {
+        let mut include_path = shellexpand::tilde(pattern).to_string();
+
+        if !include_path.starts_with('/') {
+            let ssh_config_directory = shellexpand::tilde("~/.ssh").to_string();
+            include_path = format!("{ssh_config_directory}/{include_path}");
+        }
+
+        let paths = match glob(&include_path) {
+            Ok(paths) => paths,
+            Err(e) => {
+                return Err(InvalidIncludeError {
+                    line: line.to_string(),
+                    details: InvalidIncludeErrorDetails::Pattern(e),
                 }
-                _ => {}
+                .into())
             }
+        };
+
+        for path in paths {
+            let path = match path {
+                Ok(path) => path,
+                Err(e) => {
+                    return Err(InvalidIncludeError {
+                        line: line.to_string(),
+                        details: InvalidIncludeErrorDetails::Glob(e),
+                    }
+                    .into())
+                }
+            };
+
+            log::debug!(pattern = include_path.as_str(), path:? = path, in_host_block = blocks.is_in_host_block; "Including file");
+            // Included files can be slow to read, such as network mounts
+            if let Some(on_progress) = self.on_progress.as_ref().filter(|_| self.depth.get() == 0) {
+                on_progress(apply_global_host(&blocks.global_host, blocks.hosts.clone()));
+            }
+            let mut file = BufReader::new(File::open(&path).map_err(|e| InvalidIncludeError {
+                line: line.to_string(),
+                details: InvalidIncludeErrorDetails::Io(e),
+            })?);
+            self.depth.set(self.depth.get() + 1);
+            let parsed = self.parse_raw(&mut file, Some(&path));
+            self.depth.set(self.depth.get() - 1);
+            let (included_global_host, included_hosts) = parsed?;
+
+            if blocks.is_in_host_block {
+                // Can't include hosts inside a host block
+                if !included_hosts.is_empty() {
+                    return Err(InvalidIncludeError {
+                        line: line.to_string(),
+                        details: InvalidIncludeErrorDetails::HostsInsideHostBlock,
+                    }
+                    .into());
+                }
 
-            if is_in_host_block {
-                hosts.last_mut().unwrap().update(entry);
+                blocks
+                    .hosts
+                    .last_mut()
+                    .unwrap()
+                    .extend_entries(&included_global_host);
             } else {
-                global_host.update(entry);
+                if !included_global_host.is_empty() {
+                    blocks.global_host.extend_entries(&included_global_host);
+                }
+
+                blocks.hosts.extend(included_hosts);
             }
         }
 
-        Ok((global_host, hosts))
+        Ok(())
     }
 }
 
+/// The blocks read so far by [`Parser::parse_raw`].
+struct Blocks {
+    global_host: Host,
+    hosts: Vec<Host>,
+    is_in_host_block: bool,
+}
+
+fn apply_global_host(global_host: &Host, mut hosts: Vec<Host>) -> Vec<Host> {
+    if !global_host.is_empty() {
+        for host in &mut hosts {
+            host.extend_from_global(global_host);
+        }
+    }
+
+    hosts
+}
+
 fn parse_line(line: &str) -> Result<Entry, ParseError> {
     let (mut key, mut value) = line
         .trim()
@@ -178,10 +302,60 @@ fn parse_line(line: &str) -> Result<Entry, ParseError> {
         value = value.trim_start_matches('=').trim_start();
     }
 
-    Ok((
-        EntryType::from_str(key).unwrap_or(EntryType::Unknown(key.to_string())),
-        value.to_string(),
-    ))
+    let entry = EntryType::from_str(key).unwrap_or(EntryType::Unknown(key.to_string()));
+
+    // Commands are given to the shell as written, keep their quotes
+    let value = match entry {
+        EntryType::Host
+        | EntryType::Match
+        | EntryType::ProxyCommand
+        | EntryType::LocalCommand
+        | EntryType::RemoteCommand
+        | EntryType::KnownHostsCommand => value,
+        _ => unquote(value),
+    };
+
+    Ok((entry, value.to_string()))
+}
+
+/// Removes the quotes around a value made of a single quoted string.
+fn unquote(value: &str) -> &str {
+    value
+        .strip_prefix('"')
+        .and_then(|value| value.strip_suffix('"'))
+        .filter(|value| !value.contains('"'))
+        .unwrap_or(value)
+}
+
+/// Reads a `# sshs-KEY: VALUE` or `# sshs:KEY=VALUE` comment, giving metadata to the block
+/// it is in.
+fn parse_metadata(line: &str) -> Option<(&str, &str)> {
+    let comment = line.strip_prefix('#')?.trim_start();
+    let (key, value) = match comment.strip_prefix("sshs-") {
+        Some(metadata) => metadata.split_once(':')?,
+        None => comment.strip_prefix("sshs:")?.split_once('=')?,
+    };
+
+    Some((key.trim(), value.trim()))
+}
+
+/// Removes a trailing comment, starting with a `#` at the beginning of a word outside of quotes.
+fn strip_comment(line: &str) -> &str {
+    let mut in_double_quotes = false;
+    let mut previous = None;
+
+    for (i, c) in line.char_indices() {
+        match c {
+            '"' => in_double_quotes = !in_double_quotes,
+            '#' if !in_double_quotes && previous.is_none_or(char::is_whitespace) => {
+                return &line[..i];
+            }
+            _ => {}
+        }
+        previous = Some(c);
+    }
+
+    line
 }
 
 fn parse_patterns(entry_value: &str) -> Vec<String> {
@@ -218,3 +392,77 @@ fn parse_patterns(entry_value: &str) -> Vec<String> {
 
     patterns
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_comments_and_quotes() {
+        let config = "# comment\n\
+            Host Desktop  # my desktop\n\
+            \x20 HostName \"desktop.local\" # trailing\n\
+            \x20 User me#myself\n\
+            \x20 # sshs-ports: 22, 2222\n\
+            \x20 #sshs:note=my desktop\n\
+            Host \"My server\" \"#not-a-comment\"\n\
+            \x20 ProxyCommand ssh -W \"%h:%p\" bastion\n";
+
+        let hosts = Parser::new().parse(&mut config.as_bytes()).unwrap();
+
+        assert_eq!(hosts[0].get_patterns(), &vec!["Desktop".to_string()]);
+        assert_eq!(
+            hosts[0].get(&EntryType::Hostname),
+            Some("desktop.local".to_string())
+        );
+        assert_eq!(
+            hosts[0].get(&EntryType::User),
+            Some("me#myself".to_string())
+        );
+        assert_eq!(hosts[0].get_metadata("ports"), Some("22, 2222"));
+        assert_eq!(hosts[0].get_metadata("note"), Some("my desktop"));
+        assert_eq!(hosts[1].get_metadata("ports"), None);
+        assert_eq!(
+            hosts[1].get_patterns(),
+            &vec!["My server".to_string(), "#not-a-comment".to_string()]
+        );
+        assert_eq!(
+            hosts[1].get(&EntryType::ProxyCommand),
+            Some("ssh -W \"%h:%p\" bastion".to_string())
+        );
+    }
+
+    #[test]
+    fn test_error_recovery() {
+        let config = "Host a\n  User\nHost b\n  Include /nonexistent/[\n  HostName b.local\n";
+
+        let parser = Parser::new().with_error_recovery();
+        let hosts = parser.parse(&mut config.as_bytes()).unwrap();
+
+        assert_eq!(hosts.len(), 2);
+        assert_eq!(
+            hosts[1].get(&EntryType::Hostname),
+            Some("b.local".to_string())
+        );
+        assert_eq!(
+            parser
+                .take_problems()
+                .iter()
+                .map(|problem| match problem {
+                    ParseError::Located { line_number, .. } => *line_number,
+                    _ => 0,
+                })
+                .collect::<Vec<_>>(),
+            vec![2, 4]
+        );
+    }
+
+    #[test]
+    fn test_error_location() {
+        let config = "Host a\n  HostName a.local\n  User\n";
+
+        let err = Parser::new().parse(&mut config.as_bytes()).unwrap_err();
+
+        assert_eq!(err.to_string(), "line 3: unparseable line `User`");
+    }
+}
@@ -1,3 +1,6 @@
+use std::fmt;
+use std::path::PathBuf;
+
 #[derive(Debug)]
 pub struct UnknownEntryError {
     pub line: String,
@@ -24,8 +27,60 @@ pub enum ParseError {
     UnparseableLine(String),
     UnknownEntry(UnknownEntryError),
     InvalidInclude(InvalidIncludeError),
+    /// An error on a given line of a configuration file.
+    Located {
+        path: Option<PathBuf>,
+        line_number: usize,
+        error: Box<ParseError>,
+    },
+}
+
+impl ParseError {
+    /// Attaches the location of the line the error comes from, unless it already has one.
+    #[must_use]
+    pub fn located(self, path: Option<PathBuf>, line_number: usize) -> ParseError {
+        match self {
+            ParseError::Located { .. } => self,
+            error => ParseError::Located {
+                path,
+                line_number,
+                error: Box::new(error),
+            },
+        }
+    }
 }
 
+impl fmt::Display for ParseError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ParseError::Io(e) => write!(f, "{e}"),
+            ParseError::UnparseableLine(line) => write!(f, "unparseable line `{line}`"),
+            ParseError::UnknownEntry(e) => write!(f, "unknown entry `{}` in `{}`", e.entry, e.line),
+            ParseError::InvalidInclude(e) => {
+                write!(f, "invalid Include `{}`: ", e.line)?;
+                match &e.details {
+                    InvalidIncludeErrorDetails::Pattern(e) => write!(f, "{e}"),
+                    InvalidIncludeErrorDetails::Glob(e) => write!(f, "{e}"),
+                    InvalidIncludeErrorDetails::Io(e) => write!(f, "{e}"),
+                    InvalidIncludeErrorDetails::HostsInsideHostBlock => {
+                        write!(f, "included files cannot define hosts inside a Host block")
+                    }
+                }
+            }
+            ParseError::Located {
+                path,
+                line_number,
+                error,
+            } => match path {
+                Some(path) => write!(f, "{}:{line_number}: {error}", path.display()),
+                None => write!(f, "line {line_number}: {error}"),
+            },
+        }
+    }
+}
+
+impl std::error::Error for ParseError {}
+
 impl From<std::io::Error> for ParseError {
     fn from(e: std::io::Error) -> Self {
         ParseError::Io(e)
@@ -0,0 +1,98 @@
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use crate::settings::Column;
+
+/// What sshs remembers between runs.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct State {
+    /// Last search filter.
+    pub search: String,
+    /// Name of the last selected host.
+    pub selected_host: Option<String>,
+    /// When sshs last connected to each host, in seconds since the Unix epoch.
+    pub last_connected: HashMap<String, u64>,
+    /// Port that last accepted connections, for the hosts with fallback ports.
+    pub ports: HashMap<String, u16>,
+    /// Result of the last probe of each host.
+    pub liveness: HashMap<String, Liveness>,
+    /// Tags of the hosts whose configuration file could not be written.
+    pub tags: HashMap<String, Vec<String>>,
+    /// Whether the detail pane is shown next to the list.
+    pub detail_pane: bool,
+    /// Whether the status bar was hidden.
+    pub hide_status_bar: bool,
+    /// Columns of the list picked in sshs, instead of the ones of the settings.
+    pub columns: Option<Vec<Column>>,
+}
+
+/// Whether a host accepted connections when it was last probed.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Liveness {
+    pub reachable: bool,
+    /// When the host was probed, in seconds since the Unix epoch.
+    pub at: u64,
+}
+
+/// Directory of the files sshs writes between runs, following the XDG base directory specification.
+#[must_use]
+pub fn state_dir() -> PathBuf {
+    let state_home = std::env::var("XDG_STATE_HOME")
+        .ok()
+        .filter(|dir| !dir.is_empty())
+        .unwrap_or_else(|| shellexpand::tilde("~/.local/state").to_string());
+
+    PathBuf::from(state_home).join("sshs")
+}
+
+fn path() -> PathBuf {
+    state_dir().join("state.json")
+}
+
+/// Seconds since the Unix epoch.
+#[must_use]
+pub fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or_default()
+}
+
+impl State {
+    /// Reads the state file, a missing or invalid file gives the default state.
+    #[must_use]
+    pub fn load() -> State {
+        let path = path();
+
+        let state = std::fs::read_to_string(&path)
+            .ok()
+            .and_then(|content| serde_json::from_str(&content).ok())
+            .unwrap_or_default();
+        log::debug!(path:? = path, state:? = state; "Loaded state");
+
+        state
+    }
+
+    pub fn record_connection(&mut self, host: &str) {
+        self.last_connected.insert(host.to_string(), now());
+    }
+
+    /// # Errors
+    ///
+    /// Will return `Err` if the state file cannot be written.
+    pub fn save(&self) -> Result<()> {
+        let path = path();
+
+        if let Some(parent) = path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        std::fs::write(&path, serde_json::to_string_pretty(self)?)?;
+        log::debug!(path:? = path; "Saved state");
+
+        Ok(())
+    }
+}
@@ -0,0 +1,330 @@
+use anyhow::Result;
+use clap::Parser;
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::fmt::Write;
+use std::path::PathBuf;
+use std::time::Duration;
+
+use crate::generate::{self, GeneratedHost};
+use crate::scheduler::parse_duration;
+use crate::settings::Settings;
+use crate::ssh_config::wildcard_match;
+use crate::state;
+
+/// Generators run by `sshs sync`, whose hosts are written to a file of their own.
+///
+/// ```toml
+/// [sync]
+/// sources = ["--tailscale", "--known-hosts"]
+/// output = "~/.ssh/config.d/sync.conf"
+/// interval = "1h"
+///
+/// [[sync.sources]]
+/// args = "--hetzner"
+/// env = { HCLOUD_TOKEN = "..." }
+/// exclude = ["test-*"]
+/// ```
+#[derive(Debug, Clone, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct SyncSettings {
+    pub sources: Vec<SyncSource>,
+    /// File the hosts are written to, to include from the SSH configuration.
+    pub output: String,
+    /// How often `sshs sync --daemon` syncs.
+    pub interval: String,
+}
+
+impl Default for SyncSettings {
+    fn default() -> Self {
+        SyncSettings {
+            sources: Vec::new(),
+            output: "~/.ssh/config.d/sync.conf".to_string(),
+            interval: "1h".to_string(),
+        }
+    }
+}
+
+/// A generator run by `sshs sync`, given as its arguments or as a table.
+#[derive(Debug, Clone, Default, Deserialize)]
+#[serde(from = "SourceEntry")]
+pub struct SyncSource {
+    /// Arguments of `sshs generate` selecting the source.
+    pub args: String,
+    /// Environment variables given to the programs the source runs, for its credentials or
+    /// profile.
+    pub env: generate::Env,
+    /// Only the hosts whose name matches one of these patterns are kept when set.
+    pub hosts: Vec<String>,
+    /// Hosts whose name matches one of these patterns are left out.
+    pub exclude: Vec<String>,
+}
+
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum SourceEntry {
+    Args(String),
+    Table {
+        args: String,
+        #[serde(default)]
+        env: generate::Env,
+        #[serde(default)]
+        hosts: Vec<String>,
+        #[serde(default)]
+        exclude: Vec<String>,
+    },
+}
+
+impl From<String> for SyncSource {
+    fn from(args: String) -> Self {
+        SyncSource {
+            args,
+            ..SyncSource::default()
+        }
+    }
+}
+
+impl From<SourceEntry> for SyncSource {
+    fn from(entry: SourceEntry) -> Self {
+        match entry {
+            SourceEntry::Args(args) => args.into(),
+            SourceEntry::Table {
+                args,
+                env,
+                hosts,
+                exclude,
+            } => SyncSource {
+                args,
+                env,
+                hosts,
+                exclude,
+            },
+        }
+    }
+}
+
+impl SyncSource {
+    fn keeps(&self, name: &str) -> bool {
+        let matches = |pattern: &String| wildcard_match(pattern, name);
+        (self.hosts.is_empty() || self.hosts.iter().any(matches))
+            && !self.exclude.iter().any(matches)
+    }
+
+    /// Runs the generator, the programs it runs being given its variables.
+    fn collect(&self, warnings: &mut Vec<String>) -> Result<Vec<GeneratedHost>> {
+        let args = shlex::split(&self.args)
+            .ok_or_else(|| anyhow::anyhow!("Invalid source {:?}", self.args))?;
+        let source_args = Source::try_parse_from(&args)
+            .map_err(|err| anyhow::anyhow!("Invalid source {:?}: {err}", self.args))?;
+
+        Ok(generate::collect(&source_args.args, &self.env, warnings)
+            .map_err(|err| anyhow::anyhow!("{}: {err}", self.args))?
+            .into_iter()
+            .filter(|host| self.keeps(&host.name))
+            .collect())
+    }
+}
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    /// Keep running, syncing at the interval of the settings
+    #[arg(long, default_value_t = false)]
+    daemon: bool,
+}
+
+/// Arguments of a source, parsed like the ones of `sshs generate`.
+#[derive(Parser, Debug)]
+#[command(no_binary_name = true)]
+struct Source {
+    #[command(flatten)]
+    args: generate::Args,
+}
+
+/// Hosts written by a sync.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Synced {
+    pub hosts: usize,
+    /// What the sources left out, like the keys OpenSSH cannot read.
+    pub warnings: Vec<String>,
+}
+
+/// Outcome of the last sync, shared with the TUI.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(default)]
+pub struct Status {
+    /// When the hosts were last written, in seconds since the Unix epoch.
+    pub synced_at: Option<u64>,
+    pub hosts: usize,
+    /// Error of the last sync if it failed, the hosts of the previous one being kept.
+    pub error: Option<String>,
+}
+
+fn status_path() -> PathBuf {
+    state::state_dir().join("sync.json")
+}
+
+impl Status {
+    #[must_use]
+    pub fn load() -> Status {
+        std::fs::read_to_string(status_path())
+            .ok()
+            .and_then(|content| serde_json::from_str(&content).ok())
+            .unwrap_or_default()
+    }
+
+    fn save(&self) -> Result<()> {
+        let path = status_path();
+        if let Some(parent) = path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        std::fs::write(&path, serde_json::to_string_pretty(self)?)?;
+
+        Ok(())
+    }
+}
+
+/// Syncs the hosts once, or at the interval of the settings with `--daemon`.
+///
+/// # Errors
+///
+/// Will return `Err` if the settings cannot be read or define no source, or if the sync fails
+/// without `--daemon`.
+pub fn run(args: &Args) -> Result<()> {
+    let Some(settings) = Settings::load()?.sync else {
+        anyhow::bail!(
+            "No source to sync, add some to {}:\n\n[sync]\nsources = [\"--tailscale\", \"--known-hosts\"]",
+            crate::settings::path().display()
+        );
+    };
+
+    if !args.daemon {
+        print_synced(&sync(&settings)?, &settings.output);
+        return Ok(());
+    }
+
+    let interval = parse_duration(&settings.interval).map_err(|err| anyhow::anyhow!("{err}"))?;
+    loop {
+        match sync(&settings) {
+            Ok(synced) => print_synced(&synced, &settings.output),
+            Err(err) => eprintln!("Sync failed: {err}"),
+        }
+        std::thread::sleep(interval.max(Duration::from_secs(60)));
+    }
+}
+
+fn print_synced(synced: &Synced, output: &str) {
+    for warning in &synced.warnings {
+        eprintln!("{warning}");
+    }
+    println!("Wrote {} hosts to {output}", synced.hosts);
+}
+
+/// Runs the sources and writes their hosts, a host found by several sources being kept once.
+/// The file is left as is if a source fails.
+///
+/// # Errors
+///
+/// Will return `Err` if a source is invalid or fails, or if the file cannot be written.
+pub fn sync(settings: &SyncSettings) -> Result<Synced> {
+    let result = write_hosts(settings);
+
+    let previous = Status::load();
+    let status = match &result {
+        Ok(synced) => Status {
+            synced_at: Some(state::now()),
+            hosts: synced.hosts,
+            error: None,
+        },
+        Err(err) => Status {
+            error: Some(err.to_string()),
+            ..previous
+        },
+    };
+    if let Err(err) = status.save() {
+        log::warn!(error:? = err; "Failed to save the sync status");
+    }
+
+    result
+}
+
+fn write_hosts(settings: &SyncSettings) -> Result<Synced> {
+    if settings.sources.is_empty() {
+        anyhow::bail!("No source to sync");
+    }
+
+    let mut hosts = Vec::new();
+    let mut warnings = Vec::new();
+    for source in &settings.sources {
+        let found = source.collect(&mut warnings)?;
+        log::info!(source = source.args.as_str(), hosts = found.len(); "Synced source");
+        hosts.extend(found);
+    }
+    let hosts = unique(hosts);
+
+    let path = PathBuf::from(shellexpand::tilde(&settings.output).to_string());
+    if let Some(parent) = path.parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+    // Written next to it then renamed, ssh never reading a half-written file
+    let temporary = path.with_extension("sshs-sync");
+    std::fs::write(&temporary, content(&hosts)?)?;
+    std::fs::rename(&temporary, &path)?;
+
+    Ok(Synced {
+        hosts: hosts.len(),
+        warnings,
+    })
+}
+
+/// The hosts without the ones named like a host before them.
+fn unique(hosts: Vec<GeneratedHost>) -> Vec<GeneratedHost> {
+    let mut names = HashSet::new();
+    hosts
+        .into_iter()
+        .filter(|host| names.insert(host.name.clone()))
+        .collect()
+}
+
+fn content(hosts: &[GeneratedHost]) -> Result<String> {
+    let mut content = format!(
+        "# Written by sshs sync from {}, changes are overwritten.\n",
+        crate::settings::path().display()
+    );
+    for host in hosts {
+        write!(content, "\n{host}")?;
+    }
+
+    Ok(content)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ssh_config::EntryType;
+
+    #[test]
+    fn test_write_hosts() {
+        let mut web = GeneratedHost::new("web.example.com");
+        web.push(EntryType::Hostname, "web.example.com");
+        let mut other = GeneratedHost::new("web.example.com");
+        other.push(EntryType::Port, "2222");
+
+        let hosts = unique(vec![web, other, GeneratedHost::new("db")]);
+        assert_eq!(hosts.len(), 2);
+        assert!(content(&hosts)
+            .unwrap()
+            .contains("\nHost web.example.com\n  Hostname web.example.com\n\nHost db\n"));
+
+        assert!(!SyncSource {
+            exclude: vec!["web.*".to_string()],
+            ..SyncSource::default()
+        }
+        .keeps("web.example.com"));
+
+        let invalid = SyncSettings {
+            sources: vec!["--unknown".to_string().into()],
+            ..SyncSettings::default()
+        };
+        assert!(write_hosts(&invalid).is_err());
+    }
+}
@@ -0,0 +1,203 @@
+use std::collections::{HashMap, HashSet};
+use std::hash::BuildHasher;
+use std::path::{Path, PathBuf};
+
+/// A row of the hierarchical host view.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum TreeRow {
+    Group {
+        /// Full path of the group, used as its identifier.
+        path: String,
+        name: String,
+        depth: usize,
+        /// Number of hosts of the group matching the current filter.
+        matched: usize,
+        /// Number of hosts of the group.
+        total: usize,
+        collapsed: bool,
+    },
+    Host {
+        /// Index of the host in the list given to [`build`].
+        index: usize,
+        depth: usize,
+    },
+}
+
+impl TreeRow {
+    #[allow(clippy::must_use_candidate)]
+    pub fn depth(&self) -> usize {
+        match self {
+            TreeRow::Group { depth, .. } | TreeRow::Host { depth, .. } => *depth,
+        }
+    }
+}
+
+/// Returns the path of each file relative to the deepest directory they have in common.
+#[must_use]
+pub fn relative_paths(paths: &[PathBuf]) -> Vec<String> {
+    let mut common: Option<PathBuf> = None;
+
+    for path in paths {
+        let parent = path.parent().unwrap_or(Path::new(""));
+        common = Some(match common {
+            None => parent.to_path_buf(),
+            Some(common) => common
+                .components()
+                .zip(parent.components())
+                .take_while(|(a, b)| a == b)
+                .map(|(a, _)| a)
+                .collect(),
+        });
+    }
+
+    let common = common.unwrap_or_default();
+
+    paths
+        .iter()
+        .map(|path| {
+            path.strip_prefix(&common)
+                .unwrap_or(path)
+                .to_string_lossy()
+                .replace('\\', "/")
+        })
+        .collect()
+}
+
+/// Counts the hosts of each group, including the hosts of their subgroups.
+#[must_use]
+pub fn count_by_group(groups: &[String]) -> HashMap<String, usize> {
+    let mut counts: HashMap<String, usize> = HashMap::new();
+    for group in groups {
+        for prefix in prefixes(group) {
+            *counts.entry(prefix).or_default() += 1;
+        }
+    }
+
+    counts
+}
+
+/// Builds the rows of the tree from the group path of each host.
+///
+/// Groups are nested following the `/` separated components of their path.
+/// Hosts keep their relative order inside their group.
+/// `totals` is the number of hosts of each group before filtering, see [`count_by_group`].
+#[must_use]
+pub fn build<S: BuildHasher>(
+    groups: &[String],
+    totals: &HashMap<String, usize, S>,
+    collapsed: &HashSet<String, S>,
+) -> Vec<TreeRow> {
+    let mut order = (0..groups.len()).collect::<Vec<_>>();
+    order.sort_by(|a, b| groups[*a].cmp(&groups[*b]));
+
+    let counts = count_by_group(groups);
+
+    let mut rows = Vec::new();
+    let mut previous: Vec<String> = Vec::new();
+
+    for index in order {
+        let current = prefixes(&groups[index]);
+
+        let common = previous
+            .iter()
+            .zip(&current)
+            .take_while(|(a, b)| a == b)
+            .count();
+
+        for (depth, prefix) in current.iter().enumerate().skip(common) {
+            if is_hidden(prefix, collapsed) {
+                break;
+            }
+
+            rows.push(TreeRow::Group {
+                path: prefix.clone(),
+                name: prefix.rsplit('/').next().unwrap_or_default().to_string(),
+                depth,
+                matched: counts.get(prefix).copied().unwrap_or_default(),
+                total: totals.get(prefix).copied().unwrap_or_default(),
+                collapsed: collapsed.contains(prefix),
+            });
+        }
+
+        let is_visible = current
+            .last()
+            .is_none_or(|group| !is_hidden(group, collapsed) && !collapsed.contains(group));
+        if is_visible {
+            rows.push(TreeRow::Host {
+                index,
+                depth: current.len(),
+            });
+        }
+
+        previous = current;
+    }
+
+    rows
+}
+
+/// Returns `"a"`, `"a/b"`, `"a/b/c"` for `"a/b/c"`.
+fn prefixes(group: &str) -> Vec<String> {
+    let mut prefixes = Vec::new();
+    let mut prefix = String::new();
+
+    for component in group.split('/').filter(|c| !c.is_empty()) {
+        if !prefix.is_empty() {
+            prefix.push('/');
+        }
+        prefix.push_str(component);
+        prefixes.push(prefix.clone());
+    }
+
+    prefixes
+}
+
+/// Whether one of the ancestors of the group is collapsed.
+fn is_hidden<S: BuildHasher>(group: &str, collapsed: &HashSet<String, S>) -> bool {
+    prefixes(group)
+        .iter()
+        .rev()
+        .skip(1)
+        .any(|prefix| collapsed.contains(prefix))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_build() {
+        let groups = vec![
+            "config".to_string(),
+            "zones/cust/cust1".to_string(),
+            "zones/cust/cust1".to_string(),
+            "zones/internal".to_string(),
+        ];
+
+        let mut totals = count_by_group(&groups);
+        totals.insert("zones/internal".to_string(), 4);
+
+        let rows = build(&groups, &totals, &HashSet::from(["zones/cust".to_string()]));
+
+        assert_eq!(
+            rows.iter()
+                .map(|row| match row {
+                    TreeRow::Group {
+                        name,
+                        matched,
+                        total,
+                        ..
+                    } => format!("{name}({matched}/{total})"),
+                    TreeRow::Host { index, depth } => format!("{index}@{depth}"),
+                })
+                .collect::<Vec<_>>(),
+            vec![
+                "config(1/1)",
+                "0@1",
+                "zones(3/3)",
+                "cust(2/2)",
+                "internal(1/4)",
+                "3@2"
+            ]
+        );
+    }
+}
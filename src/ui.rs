@@ -2,39 +2,463 @@ use anyhow::Result;
 use crossterm::{
     cursor::{Hide, Show},
     event::{
-        self, DisableMouseCapture, EnableMouseCapture, Event, KeyCode, KeyEventKind, KeyModifiers,
+        self, DisableMouseCapture, EnableMouseCapture, Event, KeyCode, KeyEvent, KeyEventKind,
+        KeyModifiers, MouseButton, MouseEvent, MouseEventKind,
     },
     execute,
     terminal::{disable_raw_mode, enable_raw_mode, EnterAlternateScreen, LeaveAlternateScreen},
 };
 use fuzzy_matcher::{skim::SkimMatcherV2, FuzzyMatcher};
+use itertools::Itertools;
 #[allow(clippy::wildcard_imports)]
 use ratatui::{prelude::*, widgets::*};
 use std::{
     cell::RefCell,
-    cmp::{max, min},
-    io,
+    cmp::min,
+    collections::{BTreeMap, HashMap, HashSet},
+    io::{self, Write},
+    path::{Path, PathBuf},
+    process::ExitStatus,
     rc::Rc,
+    sync::mpsc,
+    thread,
+    time::{Duration, Instant, SystemTime},
 };
 use style::palette::tailwind;
 use tui_input::backend::crossterm::EventHandler;
 use tui_input::Input;
 use unicode_width::UnicodeWidthStr;
 
-use crate::{searchable::Searchable, ssh};
+use crate::{
+    agent,
+    annotations::Annotations,
+    clock, doctor, fleet, generate, history, hooks, kubernetes, manage,
+    network::{self, Network},
+    probe::{self, Prober},
+    searchable::Searchable,
+    settings::{self, Column, Settings},
+    ssh,
+    ssh_config::{parser_error::ParseError, EntryType},
+    state::{self, State},
+    sync,
+    tree::{self, TreeRow},
+    vault,
+};
+
+const INFO_TEXT: &str = "(Esc) quit | (?) help | (↑) move up | (↓) move down | (enter) select | (ctrl+t) toggle tree view | (ctrl+d) toggle details | (ctrl+s) change sort | (ctrl+f) filter by origin | (ctrl+e) explain host | (ctrl+p) push file | (ctrl+g) get file | (ctrl+n) quick connect | (ctrl+o) open interactive shell | (ctrl+a) agent keys | (ctrl+r) actions | (ctrl+j) jump through | (ctrl+space) mark | (ctrl+l) tag | (ctrl+u) connect as | (ctrl+w) connect with key | (F3) shared connections | (F4) clone to another file | (F2) sync | (F5) reload | (F6) X11 | (F7) agent | (F8) compression | (F9) connect with profile | (F10) columns | (ctrl+y) status bar | (ctrl+v) connect with debug output | (F12) connect to a fleet";
+
+/// `-J` value connecting without jump host, overriding the `ProxyJump` of the host.
+const NO_JUMP: &str = "none";
+
+/// How long each port of a host with fallback ports is given to accept the connection.
+const FALLBACK_PORT_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// How long the ports of a host with fallback ports are tried before connecting to the configured one.
+const FALLBACK_PORTS_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// How long a host found unreachable is greyed out without probing it again, in seconds.
+const DEAD_HOST_MEMORY: u64 = 7 * 24 * 60 * 60;
+
+/// Keys of the settings mapped to the key of sshs they do the same as.
+type KeyAliases = HashMap<(KeyCode, KeyModifiers), (KeyCode, KeyModifiers)>;
+
+/// Longest time between the clicks of a double click.
+const DOUBLE_CLICK_INTERVAL: Duration = Duration::from_millis(400);
+
+/// Width under which the hosts are listed on two lines when their columns do not fit.
+const COMPACT_WIDTH: u16 = 100;
+
+/// Keys listed by the help only, the footer having no room for them.
+const OTHER_KEYS: [(&str, &str); 8] = [
+    ("ctrl+c", "quit"),
+    ("ctrl+x", "show the problems of the configuration"),
+    ("ctrl+k", "add the key of the host to the agent"),
+    ("←/→", "collapse or expand the group in the tree view"),
+    ("home/end", "first or last host"),
+    ("page up/down", "move by a page"),
+    ("click", "select, a double click connecting"),
+    ("wheel", "scroll"),
+];
+
+/// Keys of `--vim`, replacing typing in the search bar and `ctrl+d`/`ctrl+u`.
+const VIM_KEYS: [(&str, &str); 7] = [
+    ("j/k", "move down or up"),
+    ("gg/G", "first or last host"),
+    ("ctrl+d/ctrl+u", "move by a page"),
+    ("/", "search, enter keeping and Esc clearing it"),
+    ("n/N", "next or previous match"),
+    ("Esc", "quit"),
+    ("enter", "select"),
+];
+
+/// Frames of the spinner shown while the sources load, and how long each one is shown.
+const SPINNER: [&str; 10] = ["⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"];
+const SPINNER_INTERVAL: Duration = Duration::from_millis(100);
+
+/// How long the outcome of a session is shown once back in the list.
+const TOAST_DURATION: Duration = Duration::from_secs(5);
+
+/// How often the configuration files are checked for changes with `--watch`.
+const WATCH_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Colors of the origin badges, given to the source files in order.
+const ORIGIN_COLORS: [Color; 6] = [
+    tailwind::SKY.c300,
+    tailwind::EMERALD.c300,
+    tailwind::AMBER.c300,
+    tailwind::FUCHSIA.c300,
+    tailwind::ROSE.c300,
+    tailwind::LIME.c300,
+];
+
+enum Popup {
+    Text {
+        title: String,
+        lines: Vec<Line<'static>>,
+        scroll: u16,
+    },
+    Prompt {
+        title: String,
+        input: Input,
+        action: Box<PromptAction>,
+    },
+    /// The actions of the settings that can be run on the host.
+    Actions { host: Box<ssh::Host> },
+    /// Jump hosts the host can be connected through, `none` connecting directly.
+    Jump {
+        host: Box<ssh::Host>,
+        candidates: Vec<String>,
+        selected: usize,
+        /// Hops picked one by one, used instead of the selected candidate when not empty.
+        chain: Vec<String>,
+    },
+    /// Files the host can be copied to, as a new host of another zone.
+    Clone {
+        host: Box<ssh::Host>,
+        files: Vec<PathBuf>,
+        selected: usize,
+    },
+    /// Profiles of the settings the host can be connected with, by name.
+    Profiles {
+        host: Box<ssh::Host>,
+        names: Vec<String>,
+        selected: usize,
+    },
+    /// Connections shared from sshs, with whether they are open.
+    Connections {
+        connections: Vec<(ssh::SharedConnection, bool)>,
+        selected: usize,
+    },
+    /// Columns of the list, with whether they are shown.
+    Columns {
+        columns: Vec<(Column, bool)>,
+        selected: usize,
+    },
+    /// Command about to connect to the host, with `--confirm`.
+    Confirm {
+        host: Box<ssh::Host>,
+        args: Vec<String>,
+        command: String,
+    },
+    /// Session that failed or was dropped, offering to connect again with the same
+    /// arguments.
+    Reconnect {
+        host: Box<ssh::Host>,
+        args: Vec<String>,
+        outcome: String,
+    },
+    /// Keys the host can be connected with for this session.
+    Keys {
+        host: Box<ssh::Host>,
+        keys: Vec<KeyChoice>,
+        selected: usize,
+    },
+    /// Tags of the hosts, one of their hosts being connected to.
+    Fleets {
+        fleets: Vec<fleet::Fleet>,
+        selected: usize,
+    },
+}
+
+/// A key of [`Popup::Keys`].
+struct KeyChoice {
+    label: String,
+    source: KeySource,
+}
+
+enum KeySource {
+    File(PathBuf),
+    /// Public key loaded in the agent without its private key file in `~/.ssh`.
+    Agent(String),
+}
+
+/// What to do with the value entered in a [`Popup::Prompt`].
+enum PromptAction {
+    TransferSource {
+        host: ssh::Host,
+        transfer: ssh::Transfer,
+    },
+    TransferDestination {
+        host: ssh::Host,
+        transfer: ssh::Transfer,
+        source: String,
+    },
+    /// Path on the first host to copy to the second one.
+    CopySource {
+        from: ssh::Host,
+        to: ssh::Host,
+    },
+    CopyDestination {
+        from: ssh::Host,
+        to: ssh::Host,
+        source: String,
+    },
+    /// Name of the copy of the host added to the file.
+    CloneName {
+        host: ssh::Host,
+        file: PathBuf,
+    },
+    CloneHostName {
+        host: ssh::Host,
+        file: PathBuf,
+        name: String,
+    },
+    /// User to connect to the host as, instead of its `User`.
+    ConnectAs {
+        host: ssh::Host,
+    },
+    QuickConnect,
+    /// Position of the member of the fleet to connect to.
+    FleetMember {
+        fleet: fleet::Fleet,
+    },
+    SaveDestination {
+        destination: ssh::Destination,
+    },
+    /// Tag to add to the hosts, or to remove with a leading `-`.
+    Tag {
+        hosts: Vec<ssh::Host>,
+    },
+    /// A question of the wizard creating the first host, with the answers so far.
+    Wizard {
+        step: WizardStep,
+        host: generate::GeneratedHost,
+    },
+}
+
+/// Questions asked by the wizard creating the first host when none is configured.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum WizardStep {
+    Alias,
+    HostName,
+    User,
+    Port,
+    IdentityFile,
+}
+
+impl WizardStep {
+    fn title(self) -> &'static str {
+        match self {
+            WizardStep::Alias => "No host configured yet, name of the first one (Esc to skip)",
+            WizardStep::HostName => "Host name or address",
+            WizardStep::User => "User (empty for your local user)",
+            WizardStep::Port => "Port (empty for 22)",
+            WizardStep::IdentityFile => "Private key (empty for the default keys)",
+        }
+    }
+
+    fn next(self) -> Option<WizardStep> {
+        match self {
+            WizardStep::Alias => Some(WizardStep::HostName),
+            WizardStep::HostName => Some(WizardStep::User),
+            WizardStep::User => Some(WizardStep::Port),
+            WizardStep::Port => Some(WizardStep::IdentityFile),
+            WizardStep::IdentityFile => None,
+        }
+    }
+
+    /// Entry the answer is written to, the alias being the name of the block.
+    fn entry(self) -> Option<EntryType> {
+        match self {
+            WizardStep::Alias => None,
+            WizardStep::HostName => Some(EntryType::Hostname),
+            WizardStep::User => Some(EntryType::User),
+            WizardStep::Port => Some(EntryType::Port),
+            WizardStep::IdentityFile => Some(EntryType::IdentityFile),
+        }
+    }
+
+    fn is_optional(self) -> bool {
+        matches!(
+            self,
+            WizardStep::User | WizardStep::Port | WizardStep::IdentityFile
+        )
+    }
+}
+
+/// Mode of the keys with `--vim`, typing goes to the search bar only after `/`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum VimMode {
+    Normal,
+    /// A first `g` was typed, a second one goes to the top of the list.
+    PendingG,
+    Search,
+}
+
+/// What to print instead of connecting to the selected host.
+#[derive(clap::ValueEnum, Clone, Copy, Debug, PartialEq, Eq)]
+pub enum PrintMode {
+    /// The name of the host
+    Name,
+    /// The rendered command template
+    Command,
+}
+
+/// Order of the hosts in the list.
+#[derive(clap::ValueEnum, Clone, Copy, Debug, PartialEq, Eq)]
+pub enum SortOrder {
+    /// By host name
+    Name,
+    /// By destination
+    Hostname,
+    /// By user
+    User,
+    /// Most recently connected first
+    Recent,
+    /// As written in the configuration files
+    Config,
+}
+
+impl SortOrder {
+    fn next(self) -> SortOrder {
+        match self {
+            SortOrder::Name => SortOrder::Hostname,
+            SortOrder::Hostname => SortOrder::User,
+            SortOrder::User => SortOrder::Recent,
+            SortOrder::Recent => SortOrder::Config,
+            SortOrder::Config => SortOrder::Name,
+        }
+    }
+
+    fn label(self) -> &'static str {
+        match self {
+            SortOrder::Name => "name",
+            SortOrder::Hostname => "hostname",
+            SortOrder::User => "user",
+            SortOrder::Recent => "recent",
+            SortOrder::Config => "config file",
+        }
+    }
+}
+
+/// A configuration file the hosts are read from, loaded in the background.
+struct Source {
+    path: String,
+    status: SourceStatus,
+    hosts: Vec<ssh::Host>,
+    problems: Vec<String>,
+    /// Hosts and problems read before the source was reloaded, kept if the file now has
+    /// more problems, as it happens while it is being edited.
+    last_good: Option<(Vec<ssh::Host>, Vec<String>)>,
+    /// Why the hosts read when reloading were dropped for the last good ones.
+    broken: Option<String>,
+}
+
+impl Source {
+    /// Takes the result of the loading, or keeps the last good hosts if it has more problems.
+    fn finish(&mut self, result: Result<(Vec<ssh::Host>, Vec<ParseError>)>) {
+        let (status, hosts, problems) = match result {
+            Ok((hosts, problems)) => (
+                SourceStatus::Loaded,
+                hosts,
+                problems.iter().map(ToString::to_string).collect::<Vec<_>>(),
+            ),
+            Err(err) => (SourceStatus::Failed, Vec::new(), vec![err.to_string()]),
+        };
+
+        if let Some((good_hosts, good_problems)) = &self.last_good {
+            if status == SourceStatus::Failed || problems.len() > good_problems.len() {
+                let error = problems
+                    .iter()
+                    .find(|problem| !good_problems.contains(problem))
+                    .unwrap_or(&problems[0]);
+                log::warn!(path = self.path.as_str(), error = error.as_str(); "Keeping the hosts read before the source broke");
+                self.status = SourceStatus::Loaded;
+                self.broken = Some(error.clone());
+                self.hosts.clone_from(good_hosts);
+                self.problems.clone_from(good_problems);
+                return;
+            }
+        }
+
+        self.status = status;
+        self.broken = None;
+        self.hosts = hosts;
+        self.problems = problems;
+    }
+}
 
-const INFO_TEXT: &str = "(Esc) quit | (↑) move up | (↓) move down | (enter) select";
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum SourceStatus {
+    Loading,
+    Loaded,
+    Failed,
+}
+
+/// News of the loading of the source at the given index.
+enum SourceUpdate {
+    /// Hosts read so far, more of them coming from the files it includes.
+    Partial(usize, Vec<ssh::Host>),
+    Done(usize, Result<(Vec<ssh::Host>, Vec<ParseError>)>),
+}
 
 #[derive(Clone)]
+#[allow(clippy::struct_excessive_bools)]
 pub struct AppConfig {
     pub config_paths: Vec<String>,
 
     pub search_filter: Option<String>,
-    pub sort_by_name: bool,
+    pub sort_order: SortOrder,
     pub show_proxy_command: bool,
+    pub show_identity_file: bool,
+    pub show_local_command: bool,
+    pub tree_view: bool,
+    /// Show each alias of a `Host` line as its own host.
+    pub expand_aliases: bool,
+    pub ping: bool,
+    pub remember_state: bool,
 
     pub command_template: String,
     pub exit_after_ssh: bool,
+    pub print: Option<PrintMode>,
+    /// How long to wait for each configuration file before showing the hosts of the others.
+    pub source_timeout: Duration,
+    pub strip_untrusted_agent: bool,
+    pub multiplexer: Option<ssh::Multiplexer>,
+    pub ticket: Option<String>,
+    /// Share the connections to each host, keeping them open for this long after the last session.
+    pub control_persist: Option<Duration>,
+    /// Share the connections to the jump hosts, see [`ssh::Host::shared_jump`].
+    pub share_jump_hosts: bool,
+    /// Connect to the EC2 instances through Session Manager.
+    pub ssm: bool,
+    /// List the pods of Kubernetes after the hosts of the configuration files.
+    pub kubernetes: Option<kubernetes::Options>,
+    /// Key to authenticate with, instead of the keys of the configuration.
+    pub identity: Option<PathBuf>,
+    /// Reload the configuration when one of its files changes.
+    pub watch: bool,
+    /// Click and scroll the list with the mouse.
+    pub mouse: bool,
+    /// Move with `j`/`k`/`gg`/`G`/`ctrl+d`/`ctrl+u`, search after `/` and jump between the
+    /// matches with `n`/`N`.
+    pub vim: bool,
+    /// Show the command in a popup before connecting.
+    pub confirm: bool,
+    /// Print the command instead of connecting.
+    pub dry_run: bool,
+    /// Ring the bell when a session ends while sshs is in a tmux pane in the background.
+    pub bell: bool,
 }
 
 pub struct App {
@@ -43,264 +467,2839 @@ pub struct App {
     search: Input,
 
     table_state: TableState,
+    /// Hosts in the order of the configuration files.
+    loaded_hosts: Vec<ssh::Host>,
     hosts: Searchable<ssh::Host>,
+    sort_order: SortOrder,
     table_columns_constraints: Vec<Constraint>,
+    /// Columns shown after the name of the hosts.
+    columns: Vec<Column>,
+    /// Where the list was last drawn, to find the rows clicked.
+    table_area: Rect,
+    /// Lines taken by each host in the list as last drawn, two in a narrow terminal.
+    table_host_height: u16,
+    /// Row last clicked and when, to connect on a double click.
+    last_click: Option<(usize, Instant)>,
+    /// Mode of the keys, `None` without `--vim`.
+    vim: Option<VimMode>,
+
+    tree_view: bool,
+    detail_pane: bool,
+    status_bar: bool,
+    rows: Vec<TreeRow>,
+    groups: HashMap<PathBuf, String>,
+    /// Only the hosts defined in this file are listed when set.
+    origin_filter: Option<PathBuf>,
+    group_totals: HashMap<String, usize>,
+    collapsed_groups: HashSet<String>,
 
     palette: tailwind::Palette,
+    /// Keys of the settings, with the key of sshs each one stands for.
+    key_aliases: KeyAliases,
+
+    prober: Option<Prober>,
+
+    state: State,
+
+    warning: Option<String>,
+    /// Lines of the configuration that could not be parsed.
+    problems: Vec<String>,
+    settings: Settings,
+    annotations: Annotations,
+    /// Connections shared with `--control-persist` and `--share-jump-hosts`, closed when sshs
+    /// exits.
+    control_hosts: Vec<ssh::SharedConnection>,
+    /// Names of the hosts marked for the actions applying to several hosts.
+    marked: HashSet<String>,
+    /// Forwardings and compression of the next connections, from the settings at first.
+    session: settings::SessionOptions,
+    /// Network of the settings the machine is on, detected again when reloading.
+    network: Option<Network>,
+    /// Outcome of the last `sshs sync`, `None` without sources to sync.
+    sync_status: Option<sync::Status>,
+    /// Result of the sync started with F2, until it is done.
+    syncing: Option<mpsc::Receiver<Result<sync::Synced, String>>>,
+    /// Keys loaded in the SSH agent, `None` without agent.
+    agent_keys: Option<Vec<String>>,
+    sources: Vec<Source>,
+    source_updates: Option<mpsc::Receiver<SourceUpdate>>,
+    /// When the sources started loading, to animate the spinner.
+    loading_since: Instant,
+    /// Host selected when sshs last exited, selected once its source is read.
+    remembered_host: Option<String>,
+    /// Modification times of the configuration files, to reload them when they change.
+    watched: HashMap<PathBuf, Option<SystemTime>>,
+    watch_checked: Instant,
+    /// Hosts defined several times under different names, by [`ssh::Host::endpoint`].
+    duplicates: HashMap<String, Vec<ssh::Host>>,
+    popup: Option<Popup>,
+
+    /// Command to run once the terminal is released.
+    pending_command: Option<Vec<String>>,
+    /// Connection chosen from a popup, made once the popup is closed.
+    pending_connect: Option<(ssh::Host, Vec<String>)>,
+    /// Connection confirmed with `--confirm`, with all its arguments.
+    pending_launch: Option<(ssh::Host, Vec<String>)>,
+
+    /// Printed to stdout once the terminal is restored, see [`PrintMode`] and `--dry-run`.
+    output: Option<String>,
+    /// How the last session went and when it ended, shown for [`TOAST_DURATION`].
+    toast: Option<(String, Instant)>,
 }
 
 impl App {
-    /// # Errors
-    ///
-    /// Will return `Err` if the SSH configuration file cannot be parsed.
-    pub fn new(config: &AppConfig) -> Result<App> {
-        let mut hosts = Vec::new();
+    /// Loads the hosts, the configuration files that cannot be read being listed in the
+    /// problems panel.
+    #[must_use]
+    pub fn new(config: &AppConfig) -> App {
+        let state = if config.remember_state {
+            State::load()
+        } else {
+            State::default()
+        };
 
-        for path in &config.config_paths {
-            let parsed_hosts = match ssh::parse_config(path) {
-                Ok(hosts) => hosts,
-                Err(err) => {
-                    if path == "/etc/ssh/ssh_config" {
-                        if let ssh::ParseConfigError::Io(io_err) = &err {
-                            // Ignore missing system-wide SSH configuration file
-                            if io_err.kind() == std::io::ErrorKind::NotFound {
-                                continue;
-                            }
-                        }
-                    }
+        let (settings, settings_error) = match Settings::load() {
+            Ok(settings) => (settings, None),
+            Err(err) => {
+                log::warn!(error:? = err; "Failed to load settings");
+                (Settings::default(), Some(err.to_string()))
+            }
+        };
 
-                    anyhow::bail!("Failed to parse SSH configuration file: {err:?}");
-                }
-            };
+        // The columns asked for on the command line are shown even with columns picked with F10
+        let columns = match state.columns.clone() {
+            Some(columns) => with_flag_columns(config, columns),
+            None => default_columns(config, &settings),
+        };
 
-            hosts.extend(parsed_hosts);
-        }
+        let (key_aliases, keys_error) = match key_aliases(&settings.keys) {
+            Ok(aliases) => (aliases, None),
+            Err(err) => (HashMap::new(), Some(err)),
+        };
 
-        if config.sort_by_name {
-            hosts.sort_by(|a, b| a.name.to_lowercase().cmp(&b.name.to_lowercase()));
-        }
+        let (annotations, annotations_error) = match Annotations::load() {
+            Ok(annotations) => (annotations, None),
+            Err(err) => {
+                log::warn!(error:? = err; "Failed to load annotations");
+                (Annotations::default(), Some(err.to_string()))
+            }
+        };
 
-        let search_input = config.search_filter.clone().unwrap_or_default();
-        let matcher = SkimMatcherV2::default();
+        let search_input = config.search_filter.clone().unwrap_or(state.search.clone());
+        let selected_host = state.selected_host.clone();
 
         let mut app = App {
             config: config.clone(),
 
-            search: search_input.clone().into(),
+            search: search_input.into(),
 
             table_state: TableState::default().with_selected(0),
+            loaded_hosts: Vec::new(),
+            sort_order: config.sort_order,
             table_columns_constraints: Vec::new(),
-            palette: tailwind::BLUE,
+            columns,
+            table_area: Rect::default(),
+            table_host_height: 1,
+            last_click: None,
+            vim: config.vim.then_some(VimMode::Normal),
+            palette: theme_palette(settings.theme),
+            key_aliases,
 
-            hosts: Searchable::new(
-                hosts,
-                &search_input,
-                move |host: &&ssh::Host, search_value: &str| -> bool {
-                    search_value.is_empty()
-                        || matcher.fuzzy_match(&host.name, search_value).is_some()
-                        || matcher.fuzzy_match(&host.aliases, search_value).is_some()
-                },
-            ),
+            tree_view: config.tree_view,
+            detail_pane: state.detail_pane,
+            status_bar: !state.hide_status_bar,
+            rows: Vec::new(),
+            groups: HashMap::new(),
+            origin_filter: None,
+            group_totals: HashMap::new(),
+            collapsed_groups: HashSet::new(),
+
+            prober: config
+                .ping
+                .then(|| Prober::new(Duration::from_secs(2), Duration::from_secs(60))),
+
+            state,
+
+            warning: ssh::check_command_program(&config.command_template)
+                .or(settings_error)
+                .or(keys_error)
+                .or(annotations_error),
+            problems: Vec::new(),
+            session: settings.session,
+            network: if settings.networks.is_empty() {
+                None
+            } else {
+                network::current(&settings.networks, &network::Context::detect()).cloned()
+            },
+            sync_status: settings.sync.is_some().then(sync::Status::load),
+            syncing: None,
+            settings,
+            annotations,
+            control_hosts: Vec::new(),
+            marked: HashSet::new(),
+            agent_keys: agent::loaded_keys(),
+            sources: Vec::new(),
+            source_updates: None,
+            loading_since: Instant::now(),
+            remembered_host: selected_host,
+            watched: HashMap::new(),
+            watch_checked: Instant::now(),
+            duplicates: HashMap::new(),
+            popup: None,
+
+            pending_command: None,
+            pending_connect: None,
+            pending_launch: None,
+            output: None,
+            toast: None,
+
+            hosts: Searchable::new(Vec::new(), "", |_, _| true),
         };
-        app.calculate_table_columns_constraints();
+        // The list fills up as the sources are read, see `App::update_sources`
+        app.reload_hosts(None);
+        app.reselect(None);
+        app.show_problems();
+        app.prompt_first_host();
 
-        Ok(app)
+        app
     }
 
-    /// # Errors
+    /// Reads the hosts from the SSH configuration files again, each one in its own thread.
     ///
-    /// Will return `Err` if the terminal cannot be configured.
-    pub fn start(&mut self) -> Result<()> {
-        let stdout = io::stdout().lock();
-        let backend = CrosstermBackend::new(stdout);
-        let terminal = Rc::new(RefCell::new(Terminal::new(backend)?));
-
-        setup_terminal(&terminal)?;
+    /// Waits for the files until the deadline if any, the slower ones being added by
+    /// [`App::update_sources`] as they are read.
+    fn reload_hosts(&mut self, deadline: Option<Instant>) {
+        let (sender, receiver) = mpsc::channel::<SourceUpdate>();
+        let previous = std::mem::take(&mut self.sources);
+        let pods = self.config.kubernetes.as_ref();
+        let names = self
+            .config
+            .config_paths
+            .iter()
+            .cloned()
+            .chain(pods.map(kubernetes::Options::source_name));
 
-        // create app and run it
-        let res = self.run(&terminal);
+        for (index, path) in names.enumerate() {
+            let last_good = previous
+                .get(index)
+                .filter(|source| source.path == path && source.status == SourceStatus::Loaded)
+                .map(|source| (source.hosts.clone(), source.problems.clone()));
+            let (hosts, problems) = last_good.clone().unwrap_or_default();
+            self.sources.push(Source {
+                path: path.clone(),
+                status: SourceStatus::Loading,
+                hosts,
+                problems,
+                last_good,
+                broken: None,
+            });
 
-        restore_terminal(&terminal)?;
+            let sender = sender.clone();
+            // The pods come after the configuration files
+            let pods = pods
+                .filter(|_| index == self.config.config_paths.len())
+                .cloned();
+            thread::spawn(move || {
+                if let Some(options) = pods {
+                    let result = kubernetes::pods(&options).map(|hosts| (hosts, Vec::new()));
+                    let _ = sender.send(SourceUpdate::Done(index, result));
+                    return;
+                }
 
-        if let Err(err) = res {
-            println!("{err:?}");
+                // The receiver is gone when the sources were reloaded in the meantime
+                let on_hosts = |hosts| {
+                    let _ = sender.send(SourceUpdate::Partial(index, hosts));
+                };
+                let result = ssh::load_source_with_progress(&path, Some(&on_hosts));
+                let _ = sender.send(SourceUpdate::Done(index, result));
+            });
         }
+        drop(sender);
 
-        Ok(())
+        self.source_updates = Some(receiver);
+        self.loading_since = Instant::now();
+        self.receive_sources(deadline);
+        self.apply_sources();
     }
 
-    fn run<B: Backend>(&mut self, terminal: &Rc<RefCell<Terminal<B>>>) -> Result<()>
-    where
-        B: std::io::Write,
-    {
-        loop {
-            terminal.borrow_mut().draw(|f| ui(f, self))?;
-
-            let ev = event::read()?;
-
-            if let Event::Key(key) = ev {
-                if key.kind == KeyEventKind::Press {
-                    #[allow(clippy::enum_glob_use)]
-                    use KeyCode::*;
+    /// Collects the hosts read in the background, waiting for the sources still loading until
+    /// the deadline if any.
+    ///
+    /// Returns whether hosts were read.
+    fn receive_sources(&mut self, deadline: Option<Instant>) -> bool {
+        let Some(receiver) = &self.source_updates else {
+            return false;
+        };
 
-                    if key.modifiers.contains(KeyModifiers::CONTROL) {
-                        #[allow(clippy::single_match)]
-                        match key.code {
-                            Char('c') => return Ok(()),
-                            _ => {}
-                        }
+        let mut changed = false;
+        loop {
+            let update = match deadline {
+                Some(deadline) => receiver
+                    .recv_timeout(deadline.saturating_duration_since(Instant::now()))
+                    .ok(),
+                None => receiver.try_recv().ok(),
+            };
+            let (index, result) = match update {
+                Some(SourceUpdate::Partial(index, hosts)) => {
+                    // A reloaded source shows its previous hosts until it is read entirely
+                    if self.sources[index].last_good.is_none() {
+                        self.sources[index].hosts = hosts;
+                        changed = true;
                     }
+                    continue;
+                }
+                Some(SourceUpdate::Done(index, result)) => (index, result),
+                None => break,
+            };
 
-                    match key.code {
-                        Esc => return Ok(()),
-                        Down => self.next(),
-                        Up => self.previous(),
-                        Home => self.table_state.select(Some(0)),
-                        End => self.table_state.select(Some(self.hosts.len() - 1)),
-                        PageDown => {
-                            let i = self.table_state.selected().unwrap_or(0);
-                            let target = min(i.saturating_add(21), self.hosts.len() - 1);
+            let source = &mut self.sources[index];
+            source.finish(result);
+            log::debug!(path = source.path.as_str(), status:? = source.status; "Source loaded");
+            changed = true;
+        }
 
-                            self.table_state.select(Some(target));
-                        }
-                        PageUp => {
-                            let i = self.table_state.selected().unwrap_or(0);
-                            let target = max(i.saturating_sub(21), 0);
+        if !self.is_loading() {
+            self.source_updates = None;
+        }
 
-                            self.table_state.select(Some(target));
-                        }
-                        Enter => {
-                            let selected = self.table_state.selected().unwrap_or(0);
-                            if selected >= self.hosts.len() {
-                                continue;
-                            }
+        changed
+    }
 
-                            let host: &ssh::Host = &self.hosts[selected];
+    /// Warning shown above the list, a configuration file broken since sshs started first.
+    fn banner(&self) -> Option<String> {
+        self.sources
+            .iter()
+            .find_map(|source| source.broken.as_ref())
+            .map(|error| format!("{error} | the hosts from before the change are shown"))
+            .or_else(|| self.warning.clone())
+    }
 
-                            restore_terminal(terminal).expect("Failed to restore terminal");
+    fn is_loading(&self) -> bool {
+        self.sources
+            .iter()
+            .any(|source| source.status == SourceStatus::Loading)
+    }
 
-                            host.run_command_template(&self.config.command_template)?;
+    /// Adds the sources that finished loading in the background to the list.
+    fn update_sources(&mut self) {
+        if !self.receive_sources(None) {
+            return;
+        }
 
-                            setup_terminal(terminal).expect("Failed to setup terminal");
+        let selected = self.selected_host().map(|host| host.name.clone());
+        let had_problems = !self.problems.is_empty();
+        self.apply_sources();
+        self.reselect(selected.as_deref());
+        if !had_problems && self.popup.is_none() {
+            self.show_problems();
+        }
+        self.prompt_first_host();
+    }
 
-                            if self.config.exit_after_ssh {
-                                return Ok(());
-                            }
-                        }
-                        _ => {
-                            self.search.handle_event(&ev);
-                            self.hosts.search(self.search.value());
+    /// Reads the configuration files again, for changes made in another window, keeping the
+    /// search, the sort and the selection.
+    fn refresh(&mut self) {
+        let selected = self.selected_host().map(|host| host.name.clone());
+        let had_problems = !self.problems.is_empty();
+        log::info!(sources = self.config.config_paths.len(); "Refreshing hosts");
 
-                            let selected = self.table_state.selected().unwrap_or(0);
-                            if selected >= self.hosts.len() {
-                                self.table_state.select(Some(match self.hosts.len() {
-                                    0 => 0,
-                                    _ => self.hosts.len() - 1,
-                                }));
-                            }
-                        }
-                    }
-                }
-            }
+        self.reload_hosts(Some(Instant::now() + self.config.source_timeout));
+        self.reselect(selected.as_deref());
+        if !self.settings.networks.is_empty() {
+            self.network =
+                network::current(&self.settings.networks, &network::Context::detect()).cloned();
+        }
+        if self.sync_status.is_some() {
+            self.sync_status = Some(sync::Status::load());
+        }
+        if !had_problems {
+            self.show_problems();
         }
     }
 
-    fn next(&mut self) {
-        let i = match self.table_state.selected() {
-            Some(i) => {
-                if self.hosts.is_empty() || i >= self.hosts.len() - 1 {
-                    0
-                } else {
-                    i + 1
-                }
-            }
-            None => 0,
+    /// Runs the generators of the settings in the background, the hosts being reloaded once
+    /// they are written.
+    fn start_sync(&mut self) {
+        if self.syncing.is_some() {
+            return;
+        }
+        let Some(settings) = self.settings.sync.clone() else {
+            self.show_message(
+                "Sync",
+                &format!(
+                    "No source to sync, add some to {}:\n\n[sync]\nsources = [\"--tailscale\", \"--known-hosts\"]",
+                    settings::path().display()
+                ),
+            );
+            return;
         };
-        self.table_state.select(Some(i));
+
+        log::info!(sources = settings.sources.len(); "Syncing hosts");
+        let (sender, receiver) = mpsc::channel();
+        std::thread::spawn(move || {
+            let _ = sender.send(sync::sync(&settings).map_err(|err| err.to_string()));
+        });
+        self.syncing = Some(receiver);
     }
 
-    fn previous(&mut self) {
-        let i = match self.table_state.selected() {
-            Some(i) => {
-                if self.hosts.is_empty() {
-                    0
-                } else if i == 0 {
-                    self.hosts.len() - 1
-                } else {
-                    i - 1
+    fn update_sync(&mut self) {
+        let Some(receiver) = &self.syncing else {
+            return;
+        };
+        let result = match receiver.try_recv() {
+            Ok(result) => result,
+            Err(mpsc::TryRecvError::Empty) => return,
+            Err(mpsc::TryRecvError::Disconnected) => Err("The sync stopped".to_string()),
+        };
+        self.syncing = None;
+
+        self.refresh();
+        match result {
+            Ok(synced) => {
+                log::info!(hosts = synced.hosts; "Synced hosts");
+                // Given back by the sources instead of written to stderr, under the list
+                if !synced.warnings.is_empty() {
+                    self.show_message(
+                        "Sync",
+                        &format!(
+                            "Synced {} hosts, with these warnings:\n\n{}",
+                            synced.hosts,
+                            synced.warnings.join("\n")
+                        ),
+                    );
                 }
             }
-            None => 0,
-        };
-        self.table_state.select(Some(i));
+            Err(err) => self.show_message("Sync failed", &err),
+        }
     }
 
-    fn calculate_table_columns_constraints(&mut self) {
-        let mut lengths = Vec::new();
+    /// Reloads the configuration with `--watch` when one of its files changed since the last
+    /// check, a file broken by the change keeping its previous hosts.
+    fn check_watched(&mut self) {
+        if !self.config.watch || self.is_loading() || self.watch_checked.elapsed() < WATCH_INTERVAL
+        {
+            return;
+        }
+        self.watch_checked = Instant::now();
 
-        let name_len = self
-            .hosts
+        let files = self
+            .config
+            .config_paths
             .iter()
-            .map(|d| d.name.as_str())
-            .map(UnicodeWidthStr::width)
-            .max()
-            .unwrap_or(0);
-        lengths.push(name_len);
+            .map(|path| PathBuf::from(shellexpand::tilde(path).to_string()))
+            .chain(
+                self.loaded_hosts
+                    .iter()
+                    .filter_map(|host| host.origin.as_ref().map(|origin| origin.path.clone())),
+            )
+            .unique()
+            .map(|path| {
+                let modified = std::fs::metadata(&path)
+                    .and_then(|metadata| metadata.modified())
+                    .ok();
+                (path, modified)
+            })
+            .collect::<HashMap<_, _>>();
 
-        let aliases_len = self
-            .hosts
-            .non_filtered_iter()
-            .map(|d| d.aliases.as_str())
-            .map(UnicodeWidthStr::width)
-            .max()
-            .unwrap_or(0);
-        lengths.push(aliases_len);
+        // Files seen for the first time are only watched from now on
+        let changed = files.iter().any(|(path, modified)| {
+            self.watched
+                .get(path)
+                .is_some_and(|previous| previous != modified)
+        });
+        self.watched = files;
 
-        let user_len = self
-            .hosts
-            .non_filtered_iter()
-            .map(|d| match &d.user {
-                Some(user) => user.as_str(),
-                None => "",
-            })
-            .map(UnicodeWidthStr::width)
-            .max()
-            .unwrap_or(0);
-        lengths.push(user_len);
+        if changed {
+            let selected = self.selected_host().map(|host| host.name.clone());
+            log::info!(sources = self.config.config_paths.len(); "Configuration changed, reloading hosts");
+            self.reload_hosts(None);
+            self.reselect(selected.as_deref());
+        }
+    }
 
-        let destination_len = self
-            .hosts
-            .non_filtered_iter()
-            .map(|d| d.destination.as_str())
-            .map(UnicodeWidthStr::width)
-            .max()
-            .unwrap_or(0);
-        lengths.push(destination_len);
+    /// Selects the host again after the list changed, the one selected when sshs last exited
+    /// as soon as it is read.
+    fn reselect(&mut self, selected: Option<&str>) {
+        if let Some(name) = self.remembered_host.take() {
+            self.select_host(&name);
+            if self.selected_host().is_some_and(|host| host.name == name) {
+                return;
+            }
+            if self.is_loading() {
+                self.remembered_host = Some(name);
+            }
+        }
 
-        let port_len = self
-            .hosts
-            .non_filtered_iter()
-            .map(|d| match &d.port {
-                Some(port) => port.as_str(),
-                None => "",
-            })
-            .map(UnicodeWidthStr::width)
-            .max()
-            .unwrap_or(0);
-        lengths.push(port_len);
+        if let Some(name) = selected {
+            self.select_host(name);
+        }
+    }
 
-        if self.config.show_proxy_command {
-            let proxy_len = self
-                .hosts
-                .non_filtered_iter()
-                .map(|d| match &d.proxy_command {
-                    Some(proxy) => proxy.as_str(),
-                    None => "",
-                })
-                .map(UnicodeWidthStr::width)
-                .max()
-                .unwrap_or(0);
-            lengths.push(proxy_len);
+    /// Opens the wizard adding a host when the configuration has none.
+    fn prompt_first_host(&mut self) {
+        if !self.loaded_hosts.is_empty()
+            || !self.problems.is_empty()
+            || self.is_loading()
+            || self.popup.is_some()
+        {
+            return;
+        }
+
+        self.prompt(
+            WizardStep::Alias.title(),
+            "",
+            PromptAction::Wizard {
+                step: WizardStep::Alias,
+                host: generate::GeneratedHost::default(),
+            },
+        );
+    }
+
+    /// Rebuilds the host list from the hosts of the loaded sources.
+    fn apply_sources(&mut self) {
+        self.loaded_hosts = self
+            .sources
+            .iter()
+            .flat_map(|source| source.hosts.iter().cloned())
+            .collect();
+        for host in &mut self.loaded_hosts {
+            self.annotations.apply(host);
+            for tag in self.state.tags.get(&host.name).into_iter().flatten() {
+                if !host.tags.contains(tag) {
+                    host.tags.push(tag.clone());
+                }
+            }
+        }
+        self.duplicates = ssh::find_duplicates(&self.loaded_hosts);
+        if self.config.expand_aliases {
+            self.loaded_hosts = ssh::expand_aliases(&self.loaded_hosts);
+        }
+        self.problems = self
+            .sources
+            .iter()
+            .flat_map(|source| source.problems.iter().cloned())
+            .collect();
+
+        let source_paths = self
+            .loaded_hosts
+            .iter()
+            .filter_map(|host| host.origin.as_ref().map(|origin| origin.path.clone()))
+            .collect::<HashSet<_>>()
+            .into_iter()
+            .collect::<Vec<_>>();
+        self.groups = source_paths
+            .iter()
+            .cloned()
+            .zip(tree::relative_paths(&source_paths))
+            .collect();
+
+        self.sort_hosts();
+    }
+
+    /// Rebuilds the host list from the loaded hosts following the sort order.
+    fn sort_hosts(&mut self) {
+        let mut hosts = self.loaded_hosts.clone();
+        if let Some(path) = &self.origin_filter {
+            hosts.retain(|host| {
+                host.origin
+                    .as_ref()
+                    .is_some_and(|origin| &origin.path == path)
+            });
+        }
+        match self.sort_order {
+            SortOrder::Name => hosts.sort_by_cached_key(|host| host.name.to_lowercase()),
+            SortOrder::Hostname => hosts.sort_by_cached_key(|host| host.destination.to_lowercase()),
+            SortOrder::User => hosts.sort_by_cached_key(|host| host.user.clone()),
+            SortOrder::Recent => hosts.sort_by_cached_key(|host| {
+                std::cmp::Reverse(self.state.last_connected.get(&host.name).copied())
+            }),
+            SortOrder::Config => {}
+        }
+
+        let matcher = SkimMatcherV2::default();
+        self.hosts = Searchable::new(
+            hosts,
+            self.search.value(),
+            move |host: &&ssh::Host, search_value: &str| -> bool {
+                let (filters, search_value) = parse_search(search_value);
+                if !filters
+                    .iter()
+                    .all(|(key, value)| matches_filter(host, key, value))
+                {
+                    return false;
+                }
+
+                search_value.is_empty()
+                    || matcher.fuzzy_match(&host.name, &search_value).is_some()
+                    || matcher.fuzzy_match(&host.aliases, &search_value).is_some()
+                    || host
+                        .tags
+                        .iter()
+                        .any(|tag| matcher.fuzzy_match(tag, &search_value).is_some())
+                    // Notes are sentences that would match most searches fuzzily
+                    || host.note.as_ref().is_some_and(|note| {
+                        note.to_lowercase().contains(&search_value.to_lowercase())
+                    })
+            },
+        )
+        .with_narrowing(search_narrows);
+
+        self.calculate_table_columns_constraints();
+        self.group_totals = tree::count_by_group(
+            &self
+                .hosts
+                .non_filtered_iter()
+                .map(|host| self.group_of(host))
+                .collect::<Vec<_>>(),
+        );
+        self.update_rows();
+    }
+
+    /// Lists the hosts of the next source file only, all of them after the last one.
+    fn cycle_origin_filter(&mut self) {
+        let sources = self.sorted_sources();
+        self.origin_filter = match &self.origin_filter {
+            None => sources.first().cloned(),
+            Some(path) => sources
+                .iter()
+                .skip_while(|source| *source != path)
+                .nth(1)
+                .cloned(),
+        };
+
+        let selected = self.selected_host().map(|host| host.name.clone());
+        self.sort_hosts();
+        if let Some(name) = &selected {
+            self.select_host(name);
+        }
+    }
+
+    fn sorted_sources(&self) -> Vec<PathBuf> {
+        let mut sources = self.groups.keys().cloned().collect::<Vec<_>>();
+        sources.sort();
+        sources
+    }
+
+    /// Badge naming the file the host comes from, colored after it, when hosts come from several files.
+    fn origin_badge(&self, host: &ssh::Host) -> Option<Span<'static>> {
+        if self.groups.len() < 2 {
+            return None;
+        }
+
+        let path = &host.origin.as_ref()?.path;
+        let position = self
+            .sorted_sources()
+            .iter()
+            .position(|source| source == path)?;
+        let color = ORIGIN_COLORS[position % ORIGIN_COLORS.len()];
+
+        Some(Span::styled(
+            format!(" {} ", self.groups.get(path)?),
+            Style::default().fg(tailwind::SLATE.c950).bg(color),
+        ))
+    }
+
+    fn cycle_sort_order(&mut self) {
+        let selected = self.selected_host().map(|host| host.name.clone());
+
+        self.sort_order = self.sort_order.next();
+        self.sort_hosts();
+
+        if let Some(name) = &selected {
+            self.select_host(name);
+        }
+    }
+
+    /// # Errors
+    ///
+    /// Will return `Err` if the terminal cannot be configured.
+    pub fn start(&mut self) -> Result<()> {
+        // Keep stdout for the selected host so it can be captured by the shell.
+        if self.config.print.is_some() || self.config.dry_run {
+            self.start_on(io::stderr())
+        } else {
+            self.start_on(io::stdout().lock())
+        }
+    }
+
+    fn start_on<W: io::Write>(&mut self, writer: W) -> Result<()> {
+        let backend = CrosstermBackend::new(writer);
+        let terminal = Rc::new(RefCell::new(Terminal::new(backend)?));
+
+        setup_terminal(&terminal, self.config.mouse)?;
+
+        // create app and run it
+        let res = self.run(&terminal);
+
+        restore_terminal(&terminal)?;
+
+        self.close_control_masters();
+
+        self.save_state();
+
+        if let Err(err) = res {
+            log::error!(error:? = err; "Application error");
+            println!("{err:?}");
+        }
+
+        if let Some(output) = self.output.take() {
+            println!("{output}");
+        }
+
+        Ok(())
+    }
+
+    fn run<B: Backend>(&mut self, terminal: &Rc<RefCell<Terminal<B>>>) -> Result<()>
+    where
+        B: std::io::Write,
+    {
+        loop {
+            if self.run_pending(terminal)? {
+                return Ok(());
+            }
+
+            self.probe_hosts();
+            self.update_sources();
+            self.check_watched();
+            self.update_sync();
+
+            terminal.borrow_mut().draw(|f| ui(f, self))?;
+
+            if !self.poll_event()? {
+                continue;
+            }
+
+            let ev = event::read()?;
+
+            if let Event::Mouse(mouse) = ev {
+                if self.on_mouse(mouse) && self.on_enter(terminal)? {
+                    return Ok(());
+                }
+                continue;
+            }
+
+            if let Event::Key(key) = ev {
+                if key.kind == KeyEventKind::Press && self.popup.is_some() {
+                    self.on_popup_key(&ev, key.code);
+                    continue;
+                }
+
+                let key = self.alias_key(key);
+                let ev = Event::Key(key);
+
+                if key.kind == KeyEventKind::Press && self.on_vim_key(key) {
+                    continue;
+                }
+
+                if key.kind == KeyEventKind::Press {
+                    #[allow(clippy::enum_glob_use)]
+                    use KeyCode::*;
+
+                    if key.modifiers.contains(KeyModifiers::CONTROL) {
+                        if key.code == Char('c') {
+                            return Ok(());
+                        }
+
+                        if key.code == Char('o') {
+                            if let Some(host) = self.selected_host().cloned() {
+                                if self.connect(terminal, &host, &ssh::INTERACTIVE_ARGUMENTS)? {
+                                    return Ok(());
+                                }
+                            }
+                            continue;
+                        }
+
+                        if key.code == Char('v') {
+                            if let Some(host) = self.selected_host().cloned() {
+                                if self.debug_connect(terminal, &host)? {
+                                    return Ok(());
+                                }
+                            }
+                            continue;
+                        }
+
+                        if self.on_control_key(key.code) {
+                            continue;
+                        }
+                    }
+
+                    match key.code {
+                        Esc => return Ok(()),
+                        Char('?') if key.modifiers.difference(KeyModifiers::SHIFT).is_empty() => {
+                            self.show_help();
+                        }
+                        Down => self.next(),
+                        Up => self.previous(),
+                        Left if self.tree_view => self.collapse_selected(),
+                        Right if self.tree_view => self.expand_selected(),
+                        F(n) => self.on_function_key(n),
+                        Home => self.table_state.select(Some(0)),
+                        End => self
+                            .table_state
+                            .select(Some(self.rows.len().saturating_sub(1))),
+                        PageDown => self.page_down(),
+                        PageUp => self.page_up(),
+                        Enter => {
+                            if self.on_enter(terminal)? {
+                                return Ok(());
+                            }
+                        }
+                        _ => {
+                            self.search.handle_event(&ev);
+                            self.hosts.search(self.search.value());
+                            self.update_rows();
+                        }
+                    }
+                }
+            }
+        }
+    }
+
+    fn on_function_key(&mut self, n: u8) {
+        match n {
+            2 => self.start_sync(),
+            3 => self.show_connections(),
+            4 => self.show_clone_files(),
+            5 => self.refresh(),
+            6 => self.session.x11 = self.session.x11.next(),
+            7 => self.session.agent = !self.session.agent,
+            8 => self.session.compression = !self.session.compression,
+            9 => self.show_profiles(),
+            10 => self.show_columns(),
+            12 => self.show_fleets(),
+            _ => {}
+        }
+    }
+
+    /// Handles the keys of `--vim` that differ from the default ones, returns whether the key
+    /// was handled.
+    fn on_vim_key(&mut self, key: KeyEvent) -> bool {
+        #[allow(clippy::enum_glob_use)]
+        use KeyCode::*;
+
+        let Some(mode) = self.vim else {
+            return false;
+        };
+
+        if mode == VimMode::Search {
+            match key.code {
+                Enter => self.vim = Some(VimMode::Normal),
+                Esc => {
+                    self.search.reset();
+                    self.hosts.search("");
+                    self.update_rows();
+                    self.vim = Some(VimMode::Normal);
+                }
+                _ => return false,
+            }
+            return true;
+        }
+
+        if key.modifiers.contains(KeyModifiers::CONTROL) {
+            match key.code {
+                Char('d') => self.page_down(),
+                Char('u') => self.page_up(),
+                _ => return false,
+            }
+            return true;
+        }
+
+        if !key.modifiers.difference(KeyModifiers::SHIFT).is_empty() {
+            return false;
+        }
+
+        self.vim = Some(VimMode::Normal);
+        match key.code {
+            Char('j') => self.next(),
+            Char('k') => self.previous(),
+            Char('g') if mode == VimMode::PendingG => self.table_state.select(Some(0)),
+            Char('g') => self.vim = Some(VimMode::PendingG),
+            Char('G') => self
+                .table_state
+                .select(Some(self.rows.len().saturating_sub(1))),
+            Char('/') => self.vim = Some(VimMode::Search),
+            Char('n') => self.next_match(true),
+            Char('N') => self.next_match(false),
+            Char('?') => return false,
+            // The other letters would go to the search bar
+            Char(_) => {}
+            _ => return false,
+        }
+        true
+    }
+
+    /// Runs the command or the connection queued from a popup, returns whether sshs should
+    /// exit.
+    fn run_pending<B: Backend>(&mut self, terminal: &Rc<RefCell<Terminal<B>>>) -> Result<bool>
+    where
+        B: std::io::Write,
+    {
+        if let Some(command) = self.pending_command.take() {
+            restore_terminal(terminal)?;
+            run_and_wait(&command)?;
+            setup_terminal(terminal, self.config.mouse)?;
+
+            // The command may have been ssh-add
+            self.agent_keys = agent::loaded_keys();
+        }
+
+        if let Some((host, extra_args)) = self.pending_connect.take() {
+            let extra_args = extra_args.iter().map(String::as_str).collect::<Vec<_>>();
+            return self.connect(terminal, &host, &extra_args);
+        }
+
+        if let Some((host, args)) = self.pending_launch.take() {
+            let args = args.iter().map(String::as_str).collect::<Vec<_>>();
+            return self.launch(terminal, &host, &args);
+        }
+
+        Ok(false)
+    }
+
+    /// Selects the row clicked and scrolls the list, returns whether a row was double-clicked.
+    fn on_mouse(&mut self, mouse: MouseEvent) -> bool {
+        if self.popup.is_some() {
+            return false;
+        }
+
+        match mouse.kind {
+            MouseEventKind::ScrollDown => self.next(),
+            MouseEventKind::ScrollUp => self.previous(),
+            MouseEventKind::Down(MouseButton::Left) => {
+                let Some(index) = self.row_at(mouse.column, mouse.row) else {
+                    return false;
+                };
+                let double_click = self.last_click.is_some_and(|(last, at)| {
+                    last == index && at.elapsed() < DOUBLE_CLICK_INTERVAL
+                });
+                self.table_state.select(Some(index));
+                self.last_click = (!double_click).then(|| (index, Instant::now()));
+                return double_click;
+            }
+            _ => {}
+        }
+
+        false
+    }
+
+    /// Index of the row of the list at the position on the screen.
+    fn row_at(&self, column: u16, row: u16) -> Option<usize> {
+        let area = self.table_area;
+        // The border and the header come before the rows
+        let mut top = area.y + 2;
+        if column <= area.x || column + 1 >= area.right() || row + 1 >= area.bottom() {
+            return None;
+        }
+
+        for (index, table_row) in self.rows.iter().enumerate().skip(self.table_state.offset()) {
+            let height = match table_row {
+                TreeRow::Host { .. } => self.table_host_height,
+                TreeRow::Group { .. } => 1,
+            };
+            if row < top {
+                return None;
+            }
+            if row < top + height {
+                return Some(index);
+            }
+            top += height;
+        }
+
+        None
+    }
+
+    /// Key of sshs the key is bound to in the settings, the key itself otherwise.
+    fn alias_key(&self, key: KeyEvent) -> KeyEvent {
+        self.key_aliases
+            .get(&(key.code, key.modifiers))
+            .map_or(key, |&(code, modifiers)| KeyEvent {
+                code,
+                modifiers,
+                ..key
+            })
+    }
+
+    /// Connects to the selected host, toggles the selected group or connects to the search
+    /// when it is an ad-hoc destination, returns whether sshs should exit.
+    fn on_enter<B: Backend>(&mut self, terminal: &Rc<RefCell<Terminal<B>>>) -> Result<bool>
+    where
+        B: std::io::Write,
+    {
+        let selected = self.table_state.selected().unwrap_or(0);
+        let host = match self.rows.get(selected) {
+            Some(TreeRow::Host { index, .. }) => self.hosts[*index].clone(),
+            Some(TreeRow::Group { path, .. }) => {
+                let path = path.clone();
+                self.toggle_group(&path);
+                return Ok(false);
+            }
+            None => {
+                if let Some(destination) = self.ad_hoc_destination() {
+                    self.quick_connect(destination);
+                }
+                return Ok(false);
+            }
+        };
+
+        self.connect(terminal, &host, &[])
+    }
+
+    /// Waits for an event, returns whether one is ready.
+    ///
+    /// Probe results and slow sources come in the background, this wakes up regularly to
+    /// display them.
+    fn poll_event(&self) -> Result<bool> {
+        if self.is_loading() || self.syncing.is_some() {
+            return Ok(event::poll(SPINNER_INTERVAL)?);
+        }
+        if self.prober.is_some() {
+            return Ok(event::poll(Duration::from_millis(250))?);
+        }
+        if let Some((_, shown)) = &self.toast {
+            return Ok(event::poll(
+                TOAST_DURATION
+                    .saturating_sub(shown.elapsed())
+                    .max(SPINNER_INTERVAL),
+            )?);
+        }
+        if self.config.watch {
+            return Ok(event::poll(WATCH_INTERVAL)?);
+        }
+
+        Ok(true)
+    }
+
+    /// Connects to the host, returns whether sshs should exit.
+    fn connect<B: Backend>(
+        &mut self,
+        terminal: &Rc<RefCell<Terminal<B>>>,
+        host: &ssh::Host,
+        extra_args: &[&str],
+    ) -> Result<bool>
+    where
+        B: std::io::Write,
+    {
+        log::info!(host = host.name.as_str(), extra_args:? = extra_args; "Host selected");
+
+        if let Some(mode) = self.config.print {
+            self.state.record_connection(&host.name);
+            self.save_state();
+            self.output = Some(match mode {
+                PrintMode::Name => host.name.clone(),
+                PrintMode::Command => host.render_command_template(self.command_template(host))?,
+            });
+            return Ok(true);
+        }
+
+        let mut extra_args = extra_args.to_vec();
+        let port = self.reachable_port(host).map(|port| port.to_string());
+        if let Some(port) = &port {
+            extra_args.extend(["-p", port]);
+        }
+        extra_args.extend(self.session.arguments());
+        if host.is_untrusted() && self.forwards_agent(host) {
+            if self.config.strip_untrusted_agent {
+                log::info!(host = host.name.as_str(); "Disabling agent forwarding to untrusted host");
+                extra_args.push(ssh::NO_AGENT_FORWARDING);
+            } else {
+                log::warn!(host = host.name.as_str(); "Forwarding agent to untrusted host");
+            }
+        }
+
+        let profiles = self.settings.profiles_for(host).collect::<Vec<_>>();
+        let profile_args = profiles
+            .iter()
+            .flat_map(|(_, profile)| profile.arguments())
+            .collect::<Vec<_>>();
+        if !profiles.is_empty() {
+            log::info!(host = host.name.as_str(), profiles = self.profile_names(host).as_str(); "Applying profiles");
+            extra_args.extend(profile_args.iter().map(String::as_str));
+        }
+
+        let network_args = self
+            .network_for(host)
+            .map(Network::arguments)
+            .unwrap_or_default();
+        if !network_args.is_empty() {
+            log::info!(host = host.name.as_str(), args:? = network_args; "Applying network defaults");
+            extra_args.extend(network_args.iter().map(String::as_str));
+        }
+
+        let identity_args = self
+            .config
+            .identity
+            .as_deref()
+            .filter(|_| !extra_args.contains(&"-i"))
+            .map(ssh::identity_arguments)
+            .unwrap_or_default();
+        extra_args.extend(identity_args.iter().map(String::as_str));
+
+        let vault_args = self
+            .vault_signer(host)
+            .map(|signer| signer.arguments(host))
+            .unwrap_or_default();
+        extra_args.extend(vault_args.iter().map(String::as_str));
+
+        let tunnel_args = self.tunnel_arguments(host, &extra_args);
+        extra_args.extend(tunnel_args.iter().map(String::as_str));
+
+        let no_multiplexing = profiles.iter().any(|(_, profile)| profile.no_multiplexing);
+        let sharing_args = self.sharing_arguments(host, &extra_args, no_multiplexing);
+        extra_args.extend(sharing_args.iter().map(String::as_str));
+
+        if self.config.dry_run {
+            log::info!(host = host.name.as_str(); "Printing command instead of connecting");
+            self.output = Some(host.command_line(self.command_template(host), &extra_args)?);
+            return Ok(true);
+        }
+
+        if self.config.confirm {
+            let command = host.command_line(self.command_template(host), &extra_args)?;
+            self.popup = Some(Popup::Confirm {
+                host: Box::new(host.clone()),
+                args: extra_args.iter().map(ToString::to_string).collect(),
+                command,
+            });
+            return Ok(false);
+        }
+
+        self.launch(terminal, host, &extra_args)
+    }
+
+    /// Connects to the host with all its arguments, returns whether sshs should exit.
+    fn launch<B: Backend>(
+        &mut self,
+        terminal: &Rc<RefCell<Terminal<B>>>,
+        host: &ssh::Host,
+        extra_args: &[&str],
+    ) -> Result<bool>
+    where
+        B: std::io::Write,
+    {
+        let command = host.command_line(self.command_template(host), extra_args)?;
+        let ticket = self.config.ticket.clone();
+        let mut session = hooks::Session {
+            host,
+            command: &command,
+            ticket: ticket.as_deref(),
+            outcome: None,
+        };
+        if hooks::any(&self.settings.hooks, hooks::When::Before, host) {
+            restore_terminal(terminal)?;
+            let result = hooks::run(&self.settings.hooks, hooks::When::Before, &session);
+            setup_terminal(terminal, self.config.mouse)?;
+
+            if let Err(err) = result {
+                log::error!(host = host.name.as_str(), error:? = err; "Hook failed, not connecting");
+                self.show_message(
+                    " Hooks ",
+                    &format!("Not connecting to {}: {err}", host.name),
+                );
+                return Ok(false);
+            }
+        }
+
+        if let Some(signer) = self.vault_signer(host) {
+            if let Err(err) = signer.renew(host) {
+                log::error!(host = host.name.as_str(), error:? = err; "Failed to sign key with Vault");
+                self.show_message(
+                    " Vault ",
+                    &format!("Not connecting to {}: {err}", host.name),
+                );
+                return Ok(false);
+            }
+        }
+
+        self.state.record_connection(&host.name);
+        self.save_state();
+
+        if let Some(window) = host.current_maintenance() {
+            log::warn!(host = host.name.as_str(), window = window.text.as_str(); "Connecting during a maintenance window");
+            eprintln!(
+                "Warning: {} is in its maintenance window {window}",
+                host.name
+            );
+        }
+
+        if self.config.remember_state {
+            let record = history::Record::new(host, self.config.ticket.as_deref());
+            if let Err(err) = history::append(&record) {
+                log::warn!(error:? = err; "Failed to record connection history");
+            }
+        }
+
+        if let Some(multiplexer) = self.config.multiplexer {
+            // The session outlives this call, its pane runs the hooks once it ends
+            let after = if hooks::any(&self.settings.hooks, hooks::When::After, host) {
+                hooks::after_command(&self.config.config_paths, &session)?
+            } else {
+                Vec::new()
+            };
+            if let Err(err) = host.open_in_multiplexer(
+                multiplexer,
+                self.command_template(host),
+                extra_args,
+                &after,
+            ) {
+                log::error!(host = host.name.as_str(), error:? = err; "Failed to open session");
+                self.show_message("Error", &err.to_string());
+            }
+            return Ok(false);
+        }
+
+        restore_terminal(terminal)?;
+
+        let started = Instant::now();
+        let status = host.run_command_template(self.command_template(host), extra_args)?;
+        let elapsed = started.elapsed();
+        session.outcome = Some((status.code(), elapsed));
+        if let Err(err) = hooks::run(&self.settings.hooks, hooks::When::After, &session) {
+            log::warn!(host = host.name.as_str(), error:? = err; "Hook failed");
+            eprintln!("Warning: {err}");
+        }
+        if !status.success() && self.config.exit_after_ssh {
+            std::process::exit(status.code().unwrap_or(1));
+        }
+
+        setup_terminal(terminal, self.config.mouse)?;
+        self.end_session(host, extra_args, status, elapsed);
+
+        Ok(self.config.exit_after_ssh)
+    }
+
+    /// Shows how the session went once back in the list, offering to connect again when it
+    /// failed, and rings the bell with `--bell` when nobody is looking at sshs.
+    fn end_session(
+        &mut self,
+        host: &ssh::Host,
+        extra_args: &[&str],
+        status: ExitStatus,
+        elapsed: Duration,
+    ) {
+        let outcome = match status.code() {
+            Some(0) => "exited".to_string(),
+            // What ssh exits with when the connection fails or drops
+            Some(255) if host.protocol == ssh::Protocol::Ssh => {
+                "lost its connection (status 255)".to_string()
+            }
+            Some(code) => format!("exited with status {code}"),
+            None => format!("ended ({status})"),
+        };
+        let outcome = format!(
+            "Session on {} {outcome} after {}",
+            host.name,
+            format_elapsed(elapsed)
+        );
+
+        if status.success() {
+            self.toast = Some((outcome, Instant::now()));
+        } else {
+            log::info!(host = host.name.as_str(), status:% = status; "Offering to reconnect");
+            self.popup = Some(Popup::Reconnect {
+                host: Box::new(host.clone()),
+                args: extra_args.iter().map(ToString::to_string).collect(),
+                outcome,
+            });
+        }
+
+        if self.config.bell && ssh::in_background_tmux_pane() {
+            log::debug!(host = host.name.as_str(); "Ringing the bell for the session that ended");
+            let mut stdout = io::stdout();
+            let _ = stdout.write_all(b"\x07").and_then(|()| stdout.flush());
+        }
+    }
+
+    fn reconnects_with_ssh(&self) -> bool {
+        matches!(&self.popup, Some(Popup::Reconnect { host, .. }) if host.takes_ssh_arguments())
+    }
+
+    /// Connects again with the arguments of the failed session, with `-vvv` after `v`.
+    fn on_reconnect_key(&mut self, key: KeyCode) {
+        let verbose = match key {
+            KeyCode::Enter | KeyCode::Char('r') => false,
+            // Only offered for the hosts connected to with ssh
+            KeyCode::Char('v') if self.reconnects_with_ssh() => true,
+            KeyCode::Esc | KeyCode::Char('q') => {
+                self.popup = None;
+                return;
+            }
+            _ => return,
+        };
+        let Some(Popup::Reconnect { host, mut args, .. }) = self.popup.take() else {
+            return;
+        };
+
+        if verbose {
+            args.insert(0, "-vvv".to_string());
+        }
+        log::info!(host = host.name.as_str(), verbose = verbose; "Reconnecting");
+        self.pending_launch = Some((*host, args));
+    }
+
+    /// The outcome of the last session, until it has been shown long enough.
+    fn toast(&mut self) -> Option<&str> {
+        if self
+            .toast
+            .as_ref()
+            .is_some_and(|(_, shown)| shown.elapsed() >= TOAST_DURATION)
+        {
+            self.toast = None;
+        }
+
+        self.toast.as_ref().map(|(message, _)| message.as_str())
+    }
+
+    /// Arguments of `ssh` reaching the EC2 instance of the host through Session Manager with
+    /// `--ssm`, or its Compute Engine instance through Identity-Aware Proxy, unless a jump host
+    /// is given for this connection or by the network.
+    fn tunnel_arguments(&self, host: &ssh::Host, extra_args: &[&str]) -> Vec<String> {
+        let jump_given = extra_args.iter().any(|arg| {
+            *arg == "-J" || arg.starts_with("ProxyJump=") || arg.starts_with("ProxyCommand=")
+        });
+        if jump_given {
+            return Vec::new();
+        }
+
+        self.config
+            .ssm
+            .then(|| host.ssm_arguments())
+            .flatten()
+            .or_else(|| host.iap_arguments())
+            .unwrap_or_default()
+    }
+
+    /// The first role of Vault of the settings signing the key of the host, none for the
+    /// hosts not reached through SSH.
+    fn vault_signer(&self, host: &ssh::Host) -> Option<&vault::Signer> {
+        self.settings
+            .vault
+            .iter()
+            .filter(|_| host.protocol == ssh::Protocol::Ssh)
+            .find(|signer| signer.applies_to(host))
+    }
+
+    /// The template of the command connecting to the host, depending on its protocol.
+    fn command_template(&self, host: &ssh::Host) -> &str {
+        self.settings
+            .protocols
+            .template(host.protocol)
+            .unwrap_or(&self.config.command_template)
+    }
+
+    /// Connects with the most verbose output of `ssh` written to a file that can be shared in
+    /// bug reports, returns whether sshs should exit.
+    fn debug_connect<B: Backend>(
+        &mut self,
+        terminal: &Rc<RefCell<Terminal<B>>>,
+        host: &ssh::Host,
+    ) -> Result<bool>
+    where
+        B: std::io::Write,
+    {
+        let path = host.debug_log_path();
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+
+        let debug_args = ssh::debug_arguments(&path);
+        let debug_args = debug_args.iter().map(String::as_str).collect::<Vec<_>>();
+        let should_exit = self.connect(terminal, host, &debug_args)?;
+        if !path.exists() {
+            return Ok(should_exit);
+        }
+
+        log::info!(host = host.name.as_str(), path:? = path; "Wrote connection debug output");
+        let message = format!(
+            "The debug output of the connection to {} is in {}",
+            host.name,
+            path.display()
+        );
+        if should_exit {
+            eprintln!("{message}");
+        } else {
+            self.show_message(" Debug output ", &message);
+        }
+
+        Ok(should_exit)
+    }
+
+    /// Tries the ports of a host with fallback ports, the one that worked last time first.
+    ///
+    /// Returns the port to connect to when it is not the configured one, the configured port
+    /// being used when none answers within [`FALLBACK_PORTS_TIMEOUT`].
+    fn reachable_port(&mut self, host: &ssh::Host) -> Option<u16> {
+        if host.fallback_ports.is_empty() {
+            return None;
+        }
+
+        let mut ports = host.ports();
+        let configured = ports[0];
+        if let Some(index) = self
+            .state
+            .ports
+            .get(&host.name)
+            .and_then(|last| ports.iter().position(|port| port == last))
+        {
+            let last = ports.remove(index);
+            ports.insert(0, last);
+        }
+
+        let deadline = Instant::now() + FALLBACK_PORTS_TIMEOUT;
+        let port = ports.into_iter().find(|port| {
+            let timeout = deadline
+                .saturating_duration_since(Instant::now())
+                .min(FALLBACK_PORT_TIMEOUT);
+            !timeout.is_zero()
+                && host
+                    .probe_address_on(&port.to_string())
+                    .is_some_and(|address| probe::is_reachable(&address, timeout))
+        });
+        log::info!(host = host.name.as_str(), port:? = port; "Tried fallback ports");
+
+        let port = port?;
+        if self.state.ports.insert(host.name.clone(), port) != Some(port) {
+            self.save_state();
+        }
+
+        (port != configured).then_some(port)
+    }
+
+    /// Closes the connections kept open by `--control-persist`.
+    ///
+    /// Sessions opened in a terminal multiplexer can outlive sshs, their connection only stops
+    /// accepting new sessions then.
+    fn close_control_masters(&self) {
+        let operation = if self.config.multiplexer.is_some() {
+            "stop"
+        } else {
+            "exit"
+        };
+
+        for connection in &self.control_hosts {
+            let closed = connection.control(operation);
+            log::info!(destination = connection.destination.as_str(), operation = operation, closed = closed; "Closed shared connection");
+        }
+    }
+
+    /// Options sharing the connection to the host and to its jump host, as asked on the
+    /// command line.
+    fn sharing_arguments(
+        &mut self,
+        host: &ssh::Host,
+        extra_args: &[&str],
+        no_multiplexing: bool,
+    ) -> Vec<String> {
+        let mut args = Vec::new();
+        if let Some(persist) = self.config.control_persist.filter(|_| !no_multiplexing) {
+            args.extend(ssh::control_arguments(persist));
+            // `%C` in the control path depends on the user, port and jump host of the session
+            self.share(host.shared_connection(extra_args));
+        }
+
+        // A jump host given for this connection or by the network is not the one of the host
+        let jump_given = extra_args.iter().any(|arg| {
+            *arg == "-J" || arg.starts_with("ProxyJump=") || arg.starts_with("ProxyCommand=")
+        });
+        if self.config.share_jump_hosts && !jump_given {
+            let persist = self
+                .config
+                .control_persist
+                .unwrap_or(ssh::DEFAULT_CONTROL_PERSIST);
+            if let Some((connection, jump_args)) = host.shared_jump(persist) {
+                log::info!(host = host.name.as_str(), jump = connection.destination.as_str(); "Sharing the jump host connection");
+                args.extend(jump_args);
+                self.share(connection);
+            }
+        }
+
+        if !args.is_empty() {
+            if let Err(err) = std::fs::create_dir_all(ssh::control_dir()) {
+                log::warn!(error:? = err; "Failed to create the control socket directory");
+            }
+        }
+        args
+    }
+
+    fn share(&mut self, connection: ssh::SharedConnection) {
+        if !self.control_hosts.contains(&connection) {
+            self.control_hosts.push(connection);
+        }
+    }
+
+    fn on_connections_key(&mut self, key: KeyCode) {
+        let Some(Popup::Connections {
+            connections,
+            selected,
+        }) = &mut self.popup
+        else {
+            return;
+        };
+
+        match key {
+            KeyCode::Esc | KeyCode::Char('q') => self.popup = None,
+            KeyCode::Down => *selected = (*selected + 1).min(connections.len() - 1),
+            KeyCode::Up => *selected = selected.saturating_sub(1),
+            KeyCode::Enter => {
+                let (connection, open) = &mut connections[*selected];
+                let closed = connection.control("exit");
+                log::info!(destination = connection.destination.as_str(), closed = closed; "Closed shared connection");
+                *open = false;
+            }
+            _ => {}
+        }
+    }
+
+    /// Lists the keys, the ones of the settings included, and what the command template and
+    /// the actions can use.
+    fn show_help(&mut self) {
+        let keys = INFO_TEXT
+            .split(" | ")
+            .filter_map(|binding| binding.strip_prefix('(')?.split_once(") "))
+            .chain(OTHER_KEYS);
+
+        let mut help = vec!["Keys".to_string()];
+        help.extend(keys.map(|(key, what)| format!("  {key:<14} {what}")));
+        if self.vim.is_some() {
+            help.extend([String::new(), "Keys of --vim".to_string()]);
+            help.extend(VIM_KEYS.map(|(key, what)| format!("  {key:<14} {what}")));
+        }
+        if !self.settings.keys.is_empty() {
+            help.extend([String::new(), "Keys of the settings".to_string()]);
+            help.extend(
+                self.settings
+                    .keys
+                    .iter()
+                    .map(|(key, target)| format!("  {key:<14} same as {target}")),
+            );
+        }
+        if !self.settings.actions.is_empty() {
+            help.extend([String::new(), "Actions, after ctrl+r".to_string()]);
+            help.extend(
+                self.settings
+                    .actions
+                    .iter()
+                    .map(|action| format!("  {:<14} {}", action.key, action.name)),
+            );
+        }
+
+        help.extend([
+            String::new(),
+            format!("Command template, {}", self.config.command_template),
+        ]);
+        let fields = ssh::TEMPLATE_FIELDS
+            .iter()
+            .map(|field| format!("{{{{{{{field}}}}}}}"))
+            .chain([format!("{{{{{} \"REFERENCE\"}}}}", ssh::SECRET_HELPER)])
+            .collect::<Vec<_>>();
+        help.extend(
+            fields
+                .chunks(5)
+                .map(|fields| format!("  {}", fields.join(" "))),
+        );
+        help.extend([
+            String::new(),
+            "Commands of the actions".to_string(),
+            "  %h host name, %n name in the configuration, %p port, %r user".to_string(),
+        ]);
+
+        self.show_message(" Help (Esc to close) ", &help.join("\n"));
+    }
+
+    /// Opens the list of the columns to pick the ones shown and their order.
+    fn show_columns(&mut self) {
+        let columns = self
+            .columns
+            .iter()
+            .map(|column| (*column, true))
+            .chain(
+                Column::ALL
+                    .into_iter()
+                    .filter(|column| !self.columns.contains(column))
+                    .map(|column| (column, false)),
+            )
+            .collect();
+        self.popup = Some(Popup::Columns {
+            columns,
+            selected: 0,
+        });
+    }
+
+    fn on_columns_key(&mut self, ev: &Event, key: KeyCode) {
+        let Some(Popup::Columns { columns, selected }) = &mut self.popup else {
+            return;
+        };
+        let shift = matches!(ev, Event::Key(key) if key.modifiers.contains(KeyModifiers::SHIFT));
+
+        match key {
+            KeyCode::Esc | KeyCode::Char('q') => self.popup = None,
+            KeyCode::Down if shift && *selected + 1 < columns.len() => {
+                columns.swap(*selected, *selected + 1);
+                *selected += 1;
+            }
+            KeyCode::Up if shift && *selected > 0 => {
+                columns.swap(*selected, *selected - 1);
+                *selected -= 1;
+            }
+            KeyCode::Down => *selected = (*selected + 1).min(columns.len() - 1),
+            KeyCode::Up => *selected = selected.saturating_sub(1),
+            KeyCode::Char(' ') => columns[*selected].1 = !columns[*selected].1,
+            KeyCode::Enter => {
+                self.columns = columns
+                    .iter()
+                    .filter(|(_, shown)| *shown)
+                    .map(|(column, _)| *column)
+                    .collect();
+                self.state.columns = Some(self.columns.clone());
+                self.popup = None;
+                self.calculate_table_columns_constraints();
+            }
+            KeyCode::Char('r') => {
+                self.columns = default_columns(&self.config, &self.settings);
+                self.state.columns = None;
+                self.popup = None;
+                self.calculate_table_columns_constraints();
+            }
+            _ => {}
+        }
+    }
+
+    /// Lists the connections shared from sshs, whether they are still open.
+    fn show_connections(&mut self) {
+        if self.control_hosts.is_empty() {
+            self.show_message(
+                " Shared connections ",
+                "No connection is shared, start sshs with --control-persist or --share-jump-hosts",
+            );
+            return;
+        }
+
+        let connections = self
+            .control_hosts
+            .iter()
+            .map(|connection| (connection.clone(), connection.control("check")))
+            .collect();
+        self.popup = Some(Popup::Connections {
+            connections,
+            selected: 0,
+        });
+    }
+
+    /// Queues a probe of the hosts whose status is stale and collects the finished ones.
+    fn probe_hosts(&mut self) {
+        let Some(prober) = &mut self.prober else {
+            return;
+        };
+
+        for host in self.hosts.non_filtered_iter() {
+            if let Some(address) = host.probe_address() {
+                prober.probe(&address);
+            }
+        }
+        prober.update();
+
+        // Remembered so that dead hosts stand out without probing them again
+        let finished = prober
+            .take_finished()
+            .into_iter()
+            .collect::<HashMap<_, _>>();
+        if finished.is_empty() {
+            return;
+        }
+        let at = state::now();
+        for host in self.hosts.non_filtered_iter() {
+            let status = host
+                .probe_address()
+                .and_then(|address| finished.get(&address));
+            if let Some(status) = status.filter(|status| **status != probe::Status::Unknown) {
+                let reachable = *status == probe::Status::Up;
+                self.state
+                    .liveness
+                    .insert(host.name.clone(), state::Liveness { reachable, at });
+            }
+        }
+    }
+
+    /// The host did not accept connections when last probed, this run or a recent one.
+    fn seems_dead(&self, host: &ssh::Host) -> bool {
+        match self.host_status(host) {
+            Some(probe::Status::Up) => false,
+            Some(probe::Status::Down) => true,
+            _ => self.state.liveness.get(&host.name).is_some_and(|liveness| {
+                !liveness.reachable && state::now().saturating_sub(liveness.at) < DEAD_HOST_MEMORY
+            }),
+        }
+    }
+
+    fn host_status(&self, host: &ssh::Host) -> Option<probe::Status> {
+        let prober = self.prober.as_ref()?;
+
+        Some(
+            host.probe_address()
+                .map_or(probe::Status::Unknown, |address| prober.status(&address)),
+        )
+    }
+
+    /// Handles the actions bound to Ctrl, returns whether the key was used.
+    fn on_control_key(&mut self, key: KeyCode) -> bool {
+        match key {
+            KeyCode::Char('t') => {
+                self.tree_view = !self.tree_view;
+                self.update_rows();
+            }
+            KeyCode::Char('d') => self.detail_pane = !self.detail_pane,
+            KeyCode::Char('y') => self.status_bar = !self.status_bar,
+            KeyCode::Char('e') => self.explain_selected(),
+            KeyCode::Char('x') => self.show_problems(),
+            KeyCode::Char('a') => self.show_message(
+                " Keys loaded in the SSH agent ",
+                &agent::describe_keys().join("\n"),
+            ),
+            KeyCode::Char('k') => self.add_selected_key(),
+            KeyCode::Char('r') => self.show_actions(),
+            KeyCode::Char('j') => self.show_jump_hosts(),
+            KeyCode::Char('w') => self.show_keys(),
+            KeyCode::Char(' ') => self.toggle_mark(),
+            KeyCode::Char('l') => self.prompt_tag(),
+            KeyCode::Char('u') => self.prompt_user(),
+            KeyCode::Char('s') => self.cycle_sort_order(),
+            KeyCode::Char('f') => self.cycle_origin_filter(),
+            KeyCode::Char('p') if self.marked.len() == 2 => self.prompt_copy_between(),
+            KeyCode::Char('p') => self.prompt_transfer(ssh::Transfer::Push),
+            KeyCode::Char('g') => self.prompt_transfer(ssh::Transfer::Pull),
+            KeyCode::Char('n') => self.prompt(
+                "Quick connect to [user@]host[:port]",
+                "",
+                PromptAction::QuickConnect,
+            ),
+            _ => return false,
+        }
+
+        true
+    }
+
+    /// Remembers the search and the selected host for the next run.
+    fn save_state(&mut self) {
+        if !self.config.remember_state {
+            return;
+        }
+
+        self.state.search = self.search.value().to_string();
+        self.state.detail_pane = self.detail_pane;
+        self.state.hide_status_bar = !self.status_bar;
+        self.state.selected_host = self.selected_host().map(|host| host.name.clone());
+        if let Err(err) = self.state.save() {
+            log::warn!(error:? = err; "Failed to save state");
+        }
+    }
+
+    fn select_host(&mut self, name: &str) {
+        let position = self.rows.iter().position(|row| match row {
+            TreeRow::Host { index, .. } => self.hosts[*index].name == name,
+            TreeRow::Group { .. } => false,
+        });
+
+        if let Some(position) = position {
+            self.table_state.select(Some(position));
+        }
+    }
+
+    fn selected_host(&self) -> Option<&ssh::Host> {
+        match self.rows.get(self.table_state.selected()?) {
+            Some(TreeRow::Host { index, .. }) => Some(&self.hosts[*index]),
+            _ => None,
+        }
+    }
+
+    fn on_popup_key(&mut self, ev: &Event, key: KeyCode) {
+        match &mut self.popup {
+            Some(Popup::Text { scroll, .. }) => match key {
+                KeyCode::Esc | KeyCode::Enter | KeyCode::Char('q') => self.popup = None,
+                KeyCode::Down => *scroll = scroll.saturating_add(1),
+                KeyCode::Up => *scroll = scroll.saturating_sub(1),
+                KeyCode::PageDown => *scroll = scroll.saturating_add(10),
+                KeyCode::PageUp => *scroll = scroll.saturating_sub(10),
+                _ => {}
+            },
+            Some(Popup::Prompt { input, .. }) => match key {
+                KeyCode::Esc => self.popup = None,
+                KeyCode::Enter => {
+                    if let Some(Popup::Prompt { input, action, .. }) = self.popup.take() {
+                        self.submit_prompt(*action, input.value().trim());
+                    }
+                }
+                _ => {
+                    input.handle_event(ev);
+                }
+            },
+            Some(Popup::Actions { .. }) => {
+                let Some(Popup::Actions { host }) = self.popup.take() else {
+                    return;
+                };
+
+                let action = match key {
+                    KeyCode::Char(c) => self
+                        .settings
+                        .actions
+                        .iter()
+                        .find(|action| action.key == c)
+                        .cloned(),
+                    _ => None,
+                };
+                match action {
+                    Some(action) => self.run_action(&host, &action),
+                    None if !matches!(key, KeyCode::Esc | KeyCode::Char('q')) => {
+                        self.popup = Some(Popup::Actions { host });
+                    }
+                    None => {}
+                }
+            }
+            Some(Popup::Jump { .. }) => self.on_jump_key(key),
+            Some(Popup::Confirm { .. }) => match key {
+                KeyCode::Enter => {
+                    if let Some(Popup::Confirm { host, args, .. }) = self.popup.take() {
+                        log::info!(host = host.name.as_str(); "Connection confirmed");
+                        self.pending_launch = Some((*host, args));
+                    }
+                }
+                KeyCode::Esc | KeyCode::Char('q') => self.popup = None,
+                _ => {}
+            },
+            Some(Popup::Reconnect { .. }) => self.on_reconnect_key(key),
+            Some(Popup::Fleets { .. }) => self.on_fleets_key(key),
+            Some(Popup::Keys { keys, selected, .. }) => match key {
+                KeyCode::Esc | KeyCode::Char('q') => self.popup = None,
+                KeyCode::Down => *selected = (*selected + 1).min(keys.len() - 1),
+                KeyCode::Up => *selected = selected.saturating_sub(1),
+                KeyCode::Enter => {
+                    if let Some(Popup::Keys {
+                        host,
+                        mut keys,
+                        selected,
+                    }) = self.popup.take()
+                    {
+                        self.connect_with_key(*host, keys.swap_remove(selected));
+                    }
+                }
+                _ => {}
+            },
+            Some(Popup::Clone {
+                files, selected, ..
+            }) => match key {
+                KeyCode::Esc | KeyCode::Char('q') => self.popup = None,
+                KeyCode::Down => *selected = (*selected + 1).min(files.len() - 1),
+                KeyCode::Up => *selected = selected.saturating_sub(1),
+                KeyCode::Enter => self.prompt_clone_name(),
+                _ => {}
+            },
+            Some(Popup::Profiles {
+                host,
+                names,
+                selected,
+            }) => match key {
+                KeyCode::Esc | KeyCode::Char('q') => self.popup = None,
+                KeyCode::Down => *selected = (*selected + 1).min(names.len() - 1),
+                KeyCode::Up => *selected = selected.saturating_sub(1),
+                KeyCode::Enter => {
+                    let name = &names[*selected];
+                    let args = self.settings.profiles[name].arguments();
+                    log::info!(host = host.name.as_str(), profile = name.as_str(); "Profile chosen");
+                    self.pending_connect = Some(((**host).clone(), args));
+                    self.popup = None;
+                }
+                _ => {}
+            },
+            Some(Popup::Connections { .. }) => self.on_connections_key(key),
+            Some(Popup::Columns { .. }) => self.on_columns_key(ev, key),
+            None => {}
+        }
+    }
+
+    fn on_fleets_key(&mut self, key: KeyCode) {
+        let Some(Popup::Fleets { fleets, selected }) = &mut self.popup else {
+            return;
+        };
+
+        match key {
+            KeyCode::Esc | KeyCode::Char('q') => self.popup = None,
+            KeyCode::Down => *selected = (*selected + 1).min(fleets.len() - 1),
+            KeyCode::Up => *selected = selected.saturating_sub(1),
+            KeyCode::Enter | KeyCode::Char('l' | 'i') => {
+                if let Some(Popup::Fleets {
+                    mut fleets,
+                    selected,
+                }) = self.popup.take()
+                {
+                    let fleet = fleets.swap_remove(selected);
+                    match key {
+                        KeyCode::Char('i') => self.prompt(
+                            &format!(
+                                "Member of {} to connect to, 1 to {}",
+                                fleet.name,
+                                fleet.members.len()
+                            ),
+                            "1",
+                            PromptAction::FleetMember { fleet },
+                        ),
+                        KeyCode::Char('l') => {
+                            self.connect_to_fleet(&fleet, fleet::Pick::LeastRecentlyUsed);
+                        }
+                        _ => self.connect_to_fleet(&fleet, fleet::Pick::Random),
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Lists the fleets of hosts sharing a tag, to connect to one of their hosts.
+    fn show_fleets(&mut self) {
+        let fleets = fleet::fleets(self.hosts.non_filtered_iter());
+        if fleets.is_empty() {
+            self.show_message(
+                " Fleets ",
+                "No host is tagged, hosts sharing a tag make a fleet",
+            );
+            return;
+        }
+
+        self.popup = Some(Popup::Fleets {
+            fleets,
+            selected: 0,
+        });
+    }
+
+    /// Connects to the member of the fleet once the popup is closed.
+    fn connect_to_fleet(&mut self, fleet: &fleet::Fleet, pick: fleet::Pick) {
+        let host = fleet
+            .pick(pick, &self.state.last_connected)
+            .and_then(|name| {
+                self.hosts
+                    .non_filtered_iter()
+                    .find(|host| host.name == name)
+            });
+
+        match host {
+            Some(host) => {
+                log::info!(fleet = fleet.name.as_str(), host = host.name.as_str(), pick:? = pick; "Connecting to fleet member");
+                self.pending_connect = Some((host.clone(), Vec::new()));
+            }
+            None => self.show_message(" Fleets ", &format!("{} has no such member", fleet.name)),
+        }
+    }
+
+    /// Opens the list of the keys in `~/.ssh` and in the agent to connect to the selected
+    /// host with.
+    fn show_keys(&mut self) {
+        let Some(host) = self.selected_host().cloned() else {
+            return;
+        };
+
+        let agent_keys = self.agent_keys.clone().unwrap_or_default();
+        let files = agent::key_files(Path::new(&shellexpand::tilde("~/.ssh").to_string()))
+            .into_iter()
+            .map(|file| {
+                let key = agent::public_key_of(&file.display().to_string());
+                (file, key)
+            })
+            .collect::<Vec<_>>();
+        let agent_only = agent_keys
+            .iter()
+            .filter(|key| {
+                !files
+                    .iter()
+                    .any(|(_, file_key)| file_key.as_ref() == Some(key))
+            })
+            .cloned()
+            .collect::<Vec<_>>();
+
+        let keys = files
+            .into_iter()
+            .map(|(file, key)| {
+                let mut label = file.display().to_string();
+                let is_identity_file = host.identity_file.as_deref() == Some(label.as_str());
+                if key.is_some_and(|key| agent_keys.contains(&key)) {
+                    label.push_str(" (loaded in agent)");
+                }
+                if is_identity_file {
+                    label.push_str(" (IdentityFile)");
+                }
+
+                KeyChoice {
+                    label,
+                    source: KeySource::File(file),
+                }
+            })
+            .chain(agent_only.into_iter().map(|key| KeyChoice {
+                label: format!("{key} (agent only)"),
+                source: KeySource::Agent(key),
+            }))
+            .collect::<Vec<_>>();
+
+        if keys.is_empty() {
+            self.show_message(" Keys ", "No key found in ~/.ssh nor in the SSH agent");
+            return;
+        }
+
+        self.popup = Some(Popup::Keys {
+            host: Box::new(host),
+            keys,
+            selected: 0,
+        });
+    }
+
+    /// Connects to the host with the key only, a key of the agent being given to `ssh` by
+    /// its public key.
+    fn connect_with_key(&mut self, host: ssh::Host, key: KeyChoice) {
+        let path = match key.source {
+            KeySource::File(path) => path,
+            KeySource::Agent(public_key) => match agent::write_public_key(&public_key) {
+                Ok(path) => path,
+                Err(err) => {
+                    log::error!(error:? = err; "Failed to write the public key of the agent");
+                    self.show_message(" Keys ", &err.to_string());
+                    return;
+                }
+            },
+        };
+
+        log::info!(host = host.name.as_str(), key:? = path; "Key chosen");
+        self.pending_connect = Some((host, ssh::identity_arguments(&path)));
+    }
+
+    /// Handles the keys of [`Popup::Jump`], building the chain of jump hosts.
+    fn on_jump_key(&mut self, key: KeyCode) {
+        let Some(Popup::Jump {
+            candidates,
+            selected,
+            chain,
+            ..
+        }) = &mut self.popup
+        else {
+            return;
+        };
+
+        match key {
+            KeyCode::Esc | KeyCode::Char('q') => self.popup = None,
+            KeyCode::Down => *selected = (*selected + 1).min(candidates.len() - 1),
+            KeyCode::Up => *selected = selected.saturating_sub(1),
+            KeyCode::Char(' ') if candidates[*selected] != NO_JUMP => {
+                chain.extend(candidates[*selected].split(',').map(ToString::to_string));
+            }
+            KeyCode::Backspace => {
+                chain.pop();
+            }
+            KeyCode::Enter | KeyCode::Char('s') => {
+                if let Some(Popup::Jump {
+                    host,
+                    candidates,
+                    selected,
+                    chain,
+                }) = self.popup.take()
+                {
+                    let jump = if chain.is_empty() {
+                        candidates[selected].clone()
+                    } else {
+                        chain.join(",")
+                    };
+
+                    if key == KeyCode::Enter {
+                        log::info!(host = host.name.as_str(), jump = jump.as_str(); "Jump host chosen");
+                        self.pending_connect = Some((*host, vec!["-J".to_string(), jump]));
+                    } else {
+                        self.save_proxy_jump(&host, &jump);
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Opens the list of the jump hosts the selected host can be connected through.
+    ///
+    /// The candidates are its own `ProxyJump`, the jump hosts of the other hosts, the other
+    /// hosts to build a chain from and a direct connection.
+    fn show_jump_hosts(&mut self) {
+        let Some(host) = self.selected_host().cloned() else {
+            return;
+        };
+
+        let candidates = host
+            .proxy_jump
+            .iter()
+            .chain(
+                self.hosts
+                    .non_filtered_iter()
+                    .filter_map(|other| other.proxy_jump.as_ref()),
+            )
+            .chain(self.hosts.non_filtered_iter().map(|other| &other.name))
+            .filter(|jump| jump.split(',').all(|hop| hop != host.name))
+            .cloned()
+            .chain(std::iter::once(NO_JUMP.to_string()))
+            .unique()
+            .collect();
+
+        self.popup = Some(Popup::Jump {
+            host: Box::new(host),
+            candidates,
+            selected: 0,
+            chain: Vec::new(),
+        });
+    }
+
+    /// Opens the list of the files the selected host can be copied to, the files defining
+    /// hosts and the configuration files.
+    fn show_clone_files(&mut self) {
+        let Some(host) = self.selected_host().cloned() else {
+            return;
+        };
+
+        let files = self
+            .loaded_hosts
+            .iter()
+            .filter_map(|host| host.origin.as_ref().map(|origin| origin.path.clone()))
+            .chain(
+                self.config
+                    .config_paths
+                    .iter()
+                    .map(|path| PathBuf::from(shellexpand::tilde(path).to_string()))
+                    .filter(|path| path.exists()),
+            )
+            .unique()
+            .sorted()
+            .collect::<Vec<_>>();
+        if files.is_empty() {
+            return;
+        }
+
+        self.popup = Some(Popup::Clone {
+            host: Box::new(host),
+            files,
+            selected: 0,
+        });
+    }
+
+    /// Asks for the name of the copy once its file is chosen.
+    fn prompt_clone_name(&mut self) {
+        if let Some(Popup::Clone {
+            host,
+            mut files,
+            selected,
+        }) = self.popup.take()
+        {
+            let name = host.name.clone();
+            self.prompt(
+                "Name of the copy",
+                &name,
+                PromptAction::CloneName {
+                    host: *host,
+                    file: files.swap_remove(selected),
+                },
+            );
+        }
+    }
+
+    /// Copies the block of the host to the file under a new name and host name.
+    fn clone_host(&mut self, host: &ssh::Host, file: &Path, name: &str, hostname: &str) {
+        if name.is_empty() || hostname.is_empty() {
+            return;
+        }
+        if self
+            .hosts
+            .non_filtered_iter()
+            .any(|other| other.name == name)
+        {
+            self.show_message(" Clone ", &format!("A host named {name} already exists"));
+            return;
+        }
+
+        let written = match &host.origin {
+            Some(origin) => manage::clone_block(origin, &host.name, name, hostname, file),
+            None => Err(anyhow::anyhow!("Unknown configuration file")),
+        };
+
+        match written {
+            Ok(()) => {
+                self.reload_hosts(Some(Instant::now() + self.config.source_timeout));
+                self.select_host(name);
+            }
+            Err(err) => {
+                log::warn!(host = host.name.as_str(), error:? = err; "Failed to clone host");
+                self.show_message(" Clone ", &format!("{err:?}"));
+            }
+        }
+    }
+
+    /// Writes the jump hosts to the `ProxyJump` of the block defining the host.
+    fn save_proxy_jump(&mut self, host: &ssh::Host, jump: &str) {
+        let written = match &host.origin {
+            Some(origin) => manage::set_entry(origin, &host.name, "ProxyJump", jump),
+            None => Err(anyhow::anyhow!("Unknown configuration file")),
+        };
+
+        match written {
+            Ok(()) => {
+                self.reload_hosts(Some(Instant::now() + self.config.source_timeout));
+                self.select_host(&host.name);
+            }
+            Err(err) => {
+                log::warn!(host = host.name.as_str(), error:? = err; "Failed to save ProxyJump");
+                self.show_message(" Jump hosts ", &format!("{err:?}"));
+            }
+        }
+    }
+
+    /// Opens the list of the profiles of the settings to connect to the selected host with,
+    /// on top of the profiles applying to it.
+    fn show_profiles(&mut self) {
+        if self.settings.profiles.is_empty() {
+            self.show_message(
+                " Profiles ",
+                &format!(
+                    "No profile is defined, add some to {}:\n\n[profiles.socks]\nargs = [\"-D\", \"1080\", \"-N\"]",
+                    settings::path().display()
+                ),
+            );
+            return;
+        }
+
+        if let Some(host) = self.selected_host().cloned() {
+            self.popup = Some(Popup::Profiles {
+                host: Box::new(host),
+                names: self.settings.profiles.keys().cloned().collect(),
+                selected: 0,
+            });
+        }
+    }
+
+    /// Opens the menu of the actions of the settings for the selected host.
+    fn show_actions(&mut self) {
+        if self.settings.actions.is_empty() {
+            self.show_message(
+                " Actions ",
+                &format!(
+                    "No action is defined, add some to {}:\n\n[[actions]]\nname = \"ping\"\nkey = \"p\"\ncommand = \"ping -c 4 %h\"",
+                    settings::path().display()
+                ),
+            );
+            return;
+        }
+
+        if let Some(host) = self.selected_host().cloned() {
+            self.popup = Some(Popup::Actions {
+                host: Box::new(host),
+            });
+        }
+    }
+
+    fn run_action(&mut self, host: &ssh::Host, action: &settings::Action) {
+        let command = host.expand_tokens(&action.command);
+        log::info!(host = host.name.as_str(), action = action.name.as_str(), command = command.as_str(); "Running action");
+
+        match host.expand_command(&action.command) {
+            Some(args) if !args.is_empty() => self.pending_command = Some(args),
+            _ => self.show_message(" Actions ", &format!("Failed to parse command: {command}")),
+        }
+    }
+
+    fn prompt(&mut self, title: &str, value: &str, action: PromptAction) {
+        self.popup = Some(Popup::Prompt {
+            title: format!(" {title} "),
+            input: value.to_string().into(),
+            action: Box::new(action),
+        });
+    }
+
+    fn submit_prompt(&mut self, action: PromptAction, value: &str) {
+        let is_optional =
+            matches!(&action, PromptAction::Wizard { step, .. } if step.is_optional());
+        if value.is_empty() && !is_optional {
+            return;
+        }
+
+        match action {
+            PromptAction::TransferSource { host, transfer } => {
+                let (title, default) = match transfer {
+                    ssh::Transfer::Push => ("Remote destination", "~/"),
+                    ssh::Transfer::Pull => ("Local destination", "."),
+                };
+
+                self.prompt(
+                    title,
+                    default,
+                    PromptAction::TransferDestination {
+                        host,
+                        transfer,
+                        source: value.to_string(),
+                    },
+                );
+            }
+            PromptAction::TransferDestination {
+                host,
+                transfer,
+                source,
+            } => {
+                let command = match transfer {
+                    ssh::Transfer::Push => host.scp_command(transfer, &source, value),
+                    ssh::Transfer::Pull => host.scp_command(transfer, value, &source),
+                };
+                self.pending_command = Some(command);
+            }
+            PromptAction::CopySource { from, to } => {
+                self.prompt(
+                    &format!("Destination on {}", to.name),
+                    "~/",
+                    PromptAction::CopyDestination {
+                        from,
+                        to,
+                        source: value.to_string(),
+                    },
+                );
+            }
+            PromptAction::CopyDestination { from, to, source } => {
+                match ssh::scp_between_command(&from, &source, &to, value) {
+                    Ok(command) => self.pending_command = Some(command),
+                    Err(err) => self.show_message(" Copy ", &err.to_string()),
+                }
+            }
+            PromptAction::CloneName { host, file } => {
+                let hostname = host.destination.clone();
+                self.prompt(
+                    &format!("HostName of {value}"),
+                    &hostname,
+                    PromptAction::CloneHostName {
+                        host,
+                        file,
+                        name: value.to_string(),
+                    },
+                );
+            }
+            PromptAction::CloneHostName { host, file, name } => {
+                self.clone_host(&host, &file, &name, value);
+            }
+            PromptAction::FleetMember { fleet } => {
+                self.connect_to_fleet(&fleet, fleet::Pick::Index(value.parse().unwrap_or(0)));
+            }
+            PromptAction::ConnectAs { host } => {
+                log::info!(host = host.name.as_str(), user = value; "Connecting as another user");
+                self.pending_connect = Some((host, vec!["-l".to_string(), value.to_string()]));
+            }
+            PromptAction::QuickConnect => match value.parse::<ssh::Destination>() {
+                Ok(destination) => self.quick_connect(destination),
+                Err(err) => self.show_message(" Quick connect ", &format!("{err}")),
+            },
+            PromptAction::SaveDestination { destination } => {
+                if let Err(err) = self.save_host(&destination.to_host_block(value)) {
+                    self.show_message(" Save host ", &format!("{err:?}"));
+                }
+            }
+            PromptAction::Tag { hosts } => self.tag_hosts(hosts, value),
+            PromptAction::Wizard { step, host } => self.answer_wizard(step, host, value),
+        }
+    }
+
+    /// Records the answer to the question of the wizard, then asks the next one or saves the
+    /// host.
+    fn answer_wizard(&mut self, step: WizardStep, mut host: generate::GeneratedHost, value: &str) {
+        match step.entry() {
+            Some(entry) => host.push(entry, value),
+            None => host.name = value.to_string(),
+        }
+
+        match step.next() {
+            Some(next) => {
+                // The alias is often the host name already
+                let default = if next == WizardStep::HostName {
+                    host.name.clone()
+                } else {
+                    String::new()
+                };
+                self.prompt(
+                    next.title(),
+                    &default,
+                    PromptAction::Wizard { step: next, host },
+                );
+            }
+            None => {
+                if let Err(err) = self.save_host(&host) {
+                    self.show_message(" Save host ", &format!("{err:?}"));
+                }
+            }
+        }
+    }
+
+    /// Connects to a destination that is not in the configuration, then offers to save it.
+    fn quick_connect(&mut self, destination: ssh::Destination) {
+        log::info!(destination:? = destination; "Quick connect");
+        self.pending_command = Some(destination.ssh_command());
+
+        // Shown once the session ends.
+        let name = destination.hostname.clone();
+        self.prompt(
+            "Save as a new Host? Enter a name or press Esc to skip",
+            &name,
+            PromptAction::SaveDestination { destination },
+        );
+    }
+
+    /// The search as a destination to connect to directly, when it matches no host and looks
+    /// like `user@host`, `host:port` or an address rather than a host name being typed.
+    fn ad_hoc_destination(&self) -> Option<ssh::Destination> {
+        let value = self.search.value().trim();
+        if !self.rows.is_empty()
+            || value.contains(char::is_whitespace)
+            || !value.contains(['@', ':', '.'])
+        {
+            return None;
+        }
+
+        value.parse().ok()
+    }
+
+    /// Marks the selected host for the actions applying to several hosts, or unmarks it.
+    fn toggle_mark(&mut self) {
+        let Some(name) = self.selected_host().map(|host| host.name.clone()) else {
+            return;
+        };
+
+        if !self.marked.remove(&name) {
+            self.marked.insert(name);
+        }
+        self.next();
+    }
+
+    /// Asks for a tag to give to the marked hosts, or to the selected one when none is marked.
+    fn prompt_tag(&mut self) {
+        let hosts = if self.marked.is_empty() {
+            self.selected_host()
+                .cloned()
+                .into_iter()
+                .collect::<Vec<_>>()
+        } else {
+            self.loaded_hosts
+                .iter()
+                .filter(|host| self.marked.contains(&host.name))
+                .cloned()
+                .collect()
+        };
+        if hosts.is_empty() {
+            return;
+        }
+
+        let title = match hosts.as_slice() {
+            [host] => format!("Tag {}, -TAG removes it", host.name),
+            hosts => format!("Tag the {} marked hosts, -TAG removes it", hosts.len()),
+        };
+        self.prompt(&title, "", PromptAction::Tag { hosts });
+    }
+
+    /// Adds the tag to the hosts, or removes it with a leading `-`.
+    ///
+    /// The tags are written to the `# sshs-tags:` comment of the host blocks, the state keeping
+    /// those of the hosts whose file cannot be written.
+    fn tag_hosts(&mut self, mut hosts: Vec<ssh::Host>, value: &str) {
+        let (tag, remove) = match value.strip_prefix('-') {
+            Some(tag) => (tag.trim(), true),
+            None => (value.strip_prefix('+').unwrap_or(value).trim(), false),
+        };
+        if tag.is_empty() || tag.contains(',') {
+            self.show_message(" Tag ", &format!("Invalid tag {value:?}"));
+            return;
+        }
+
+        let edit = |tags: &mut Vec<String>| {
+            tags.retain(|existing| existing != tag);
+            if !remove {
+                tags.push(tag.to_string());
+            }
+        };
+
+        // From the end of the files, so that adding a line does not move the blocks left to edit
+        hosts.sort_by_key(|host| {
+            std::cmp::Reverse(
+                host.origin
+                    .as_ref()
+                    .map(|origin| (origin.path.clone(), origin.line)),
+            )
+        });
+        hosts.dedup_by(|a, b| a.origin.is_some() && a.origin == b.origin);
+
+        let mut kept_in_state = Vec::new();
+        for host in &hosts {
+            let state_tags = self.state.tags.get(&host.name).cloned().unwrap_or_default();
+            let mut file_tags = host.tags.clone();
+            file_tags.retain(|existing| !state_tags.contains(existing));
+            edit(&mut file_tags);
+
+            let written = match &host.origin {
+                Some(origin) => {
+                    manage::set_metadata(origin, &host.name, "tags", &file_tags.join(", "))
+                }
+                None => Err(anyhow::anyhow!("Unknown configuration file")),
+            };
+            if let Err(err) = &written {
+                log::warn!(host = host.name.as_str(), error:? = err; "Keeping tags in the state");
+            }
+
+            if written.is_err() || remove {
+                let tags = self.state.tags.entry(host.name.clone()).or_default();
+                edit(tags);
+                if tags.is_empty() {
+                    self.state.tags.remove(&host.name);
+                }
+                if written.is_err() {
+                    kept_in_state.push(host.name.clone());
+                }
+            }
+        }
+
+        self.marked.clear();
+        self.save_state();
+        self.reload_hosts(Some(Instant::now() + self.config.source_timeout));
+
+        if !kept_in_state.is_empty() {
+            self.show_message(
+                " Tag ",
+                &format!(
+                    "The configuration of {} cannot be written, their tags are kept by sshs instead.",
+                    kept_in_state.join(", ")
+                ),
+            );
+        }
+    }
+
+    /// Appends the host block to the last configuration file.
+    fn save_host(&mut self, host: &generate::GeneratedHost) -> Result<()> {
+        let path = self
+            .config
+            .config_paths
+            .last()
+            .ok_or(anyhow::anyhow!("No configuration file to save the host to"))?;
+
+        generate::append_to_config(path, std::slice::from_ref(host))?;
+        self.reload_hosts(Some(Instant::now() + self.config.source_timeout));
+
+        Ok(())
+    }
+
+    /// Opens the problems panel if some lines of the configuration could not be parsed.
+    fn show_problems(&mut self) {
+        if self.problems.is_empty() {
+            return;
+        }
+
+        let mut lines = vec![
+            Line::styled(
+                "These lines were skipped, the other hosts were loaded normally:",
+                Style::default().add_modifier(Modifier::BOLD),
+            ),
+            Line::default(),
+        ];
+        lines.extend(
+            self.problems
+                .iter()
+                .map(|problem| Line::from(format!("• {problem}"))),
+        );
+
+        self.popup = Some(Popup::Text {
+            title: format!(
+                " {} configuration problems (ctrl+x to show again) ",
+                self.problems.len()
+            ),
+            lines,
+            scroll: 0,
+        });
+    }
+
+    /// Whether connecting forwards the agent to the host, from its configuration, the command
+    /// template or the options of the session.
+    fn forwards_agent(&self, host: &ssh::Host) -> bool {
+        self.session.agent || host.forwards_agent(&self.config.command_template)
+    }
+
+    /// Whether the key of the host is loaded in the agent, `None` when it cannot be told.
+    fn key_in_agent(&self, host: &ssh::Host) -> Option<bool> {
+        let agent_keys = self.agent_keys.as_ref()?;
+        let key = agent::public_key_of(host.identity_file.as_deref()?)?;
+
+        Some(agent_keys.contains(&key))
+    }
+
+    /// Adds the key of the selected host to the agent, `ssh-add` asking for its passphrase.
+    fn add_selected_key(&mut self) {
+        let Some(identity_file) = self
+            .selected_host()
+            .and_then(|host| host.identity_file.clone())
+        else {
+            self.show_message(" Agent ", "The host has no IdentityFile");
+            return;
+        };
+
+        self.pending_command = Some(vec!["ssh-add".to_string(), identity_file]);
+    }
+
+    fn show_message(&mut self, title: &str, message: &str) {
+        self.popup = Some(Popup::Text {
+            title: title.to_string(),
+            lines: message
+                .lines()
+                .map(|line| Line::from(line.to_string()))
+                .collect(),
+            scroll: 0,
+        });
+    }
+
+    /// Asks for the paths of a file to copy to or from the selected host.
+    fn prompt_transfer(&mut self, transfer: ssh::Transfer) {
+        let Some(host) = self.selected_host().cloned() else {
+            return;
+        };
+
+        let title = match transfer {
+            ssh::Transfer::Push => format!("Local file to push to {}", host.name),
+            ssh::Transfer::Pull => format!("Remote file to get from {}", host.name),
+        };
+        self.prompt(&title, "", PromptAction::TransferSource { host, transfer });
+    }
+
+    /// Network of the settings the machine is on, if its defaults apply to the host.
+    fn network_for(&self, host: &ssh::Host) -> Option<&Network> {
+        self.network
+            .as_ref()
+            .filter(|network| network.applies_to(host))
+    }
+
+    /// Names of the profiles of the settings applying to the host.
+    fn profile_names(&self, host: &ssh::Host) -> String {
+        self.settings
+            .profiles_for(host)
+            .map(|(name, _)| name)
+            .join(", ")
+    }
+
+    /// Asks for the user to connect to the selected host as, starting from its own.
+    fn prompt_user(&mut self) {
+        let Some(host) = self.selected_host().cloned() else {
+            return;
+        };
+
+        let user = host.user.clone().unwrap_or_else(ssh::local_user);
+        self.prompt(
+            &format!("Connect to {} as", host.name),
+            &user,
+            PromptAction::ConnectAs { host },
+        );
+    }
+
+    /// Asks for a path to copy from the selected host to the other marked one.
+    fn prompt_copy_between(&mut self) {
+        let Some(from) = self.selected_host().cloned() else {
+            return;
+        };
+        let Some(to) = self
+            .marked
+            .iter()
+            .find(|name| **name != from.name)
+            .and_then(|name| self.loaded_hosts.iter().find(|host| host.name == *name))
+            .cloned()
+        else {
+            return;
+        };
+        if !self.marked.contains(&from.name) {
+            self.show_message(
+                " Copy ",
+                "Select the marked host to copy from, the file goes to the other one.",
+            );
+            return;
+        }
+
+        self.prompt(
+            &format!("File on {} to copy to {}", from.name, to.name),
+            "",
+            PromptAction::CopySource { from, to },
+        );
+    }
+
+    /// Opens a popup listing the configuration blocks applying to the selected host.
+    fn explain_selected(&mut self) {
+        let Some(host) = self.selected_host() else {
+            return;
+        };
+        let name = host.name.clone();
+
+        let lines = match ssh::explain_host(&self.config.config_paths, &name) {
+            Ok(blocks) => explanation_lines(&blocks),
+            Err(err) => vec![Line::from(format!(
+                "Failed to parse the configuration: {err}"
+            ))],
+        };
+
+        self.popup = Some(Popup::Text {
+            title: format!(" {name} "),
+            lines,
+            scroll: 0,
+        });
+    }
+
+    fn group_of(&self, host: &ssh::Host) -> String {
+        host.origin
+            .as_ref()
+            .and_then(|origin| self.groups.get(&origin.path))
+            .cloned()
+            .unwrap_or_default()
+    }
+
+    /// Rebuilds the displayed rows from the filtered hosts.
+    fn update_rows(&mut self) {
+        self.rows = if self.tree_view {
+            let groups = self
+                .hosts
+                .iter()
+                .map(|host| self.group_of(host))
+                .collect::<Vec<_>>();
+
+            tree::build(&groups, &self.group_totals, &self.collapsed_groups)
+        } else {
+            (0..self.hosts.len())
+                .map(|index| TreeRow::Host { index, depth: 0 })
+                .collect()
+        };
+
+        let selected = self.table_state.selected().unwrap_or(0);
+        if selected >= self.rows.len() {
+            self.table_state
+                .select(Some(self.rows.len().saturating_sub(1)));
+        }
+    }
+
+    fn toggle_group(&mut self, path: &str) {
+        if !self.collapsed_groups.remove(path) {
+            self.collapsed_groups.insert(path.to_string());
+        }
+        self.update_rows();
+    }
+
+    /// Collapses the selected group, or moves the selection to the parent group.
+    fn collapse_selected(&mut self) {
+        let selected = self.table_state.selected().unwrap_or(0);
+        let Some(row) = self.rows.get(selected) else {
+            return;
+        };
+
+        if let TreeRow::Group {
+            path,
+            collapsed: false,
+            ..
+        } = row
+        {
+            let path = path.clone();
+            self.toggle_group(&path);
+            return;
+        }
+
+        let depth = row.depth();
+        if let Some(parent) = self.rows[..selected]
+            .iter()
+            .rposition(|row| row.depth() < depth)
+        {
+            self.table_state.select(Some(parent));
+        }
+    }
+
+    fn expand_selected(&mut self) {
+        let selected = self.table_state.selected().unwrap_or(0);
+        if let Some(TreeRow::Group {
+            path,
+            collapsed: true,
+            ..
+        }) = self.rows.get(selected)
+        {
+            let path = path.clone();
+            self.toggle_group(&path);
+        }
+    }
+
+    fn next(&mut self) {
+        let i = match self.table_state.selected() {
+            Some(i) => {
+                if self.rows.is_empty() || i >= self.rows.len() - 1 {
+                    0
+                } else {
+                    i + 1
+                }
+            }
+            None => 0,
+        };
+        self.table_state.select(Some(i));
+    }
+
+    fn previous(&mut self) {
+        let i = match self.table_state.selected() {
+            Some(i) => {
+                if self.rows.is_empty() {
+                    0
+                } else if i == 0 {
+                    self.rows.len() - 1
+                } else {
+                    i - 1
+                }
+            }
+            None => 0,
+        };
+        self.table_state.select(Some(i));
+    }
+
+    fn page_down(&mut self) {
+        let i = self.table_state.selected().unwrap_or(0);
+        let target = min(i.saturating_add(21), self.rows.len().saturating_sub(1));
+
+        self.table_state.select(Some(target));
+    }
+
+    fn page_up(&mut self) {
+        let i = self.table_state.selected().unwrap_or(0);
+        self.table_state.select(Some(i.saturating_sub(21)));
+    }
+
+    /// Selects the next host matching the search, or the previous one, skipping the groups of
+    /// the tree view and wrapping around.
+    fn next_match(&mut self, forward: bool) {
+        let len = self.rows.len();
+        let start = self.table_state.selected().unwrap_or(0);
+
+        let found = (1..=len)
+            .map(|step| {
+                if forward {
+                    (start + step) % len
+                } else {
+                    (start + len - step) % len
+                }
+            })
+            .find(|&i| matches!(self.rows[i], TreeRow::Host { .. }));
+        if found.is_some() {
+            self.table_state.select(found);
+        }
+    }
+
+    fn calculate_table_columns_constraints(&mut self) {
+        let mut lengths = Vec::new();
+
+        let name_len = self
+            .hosts
+            .iter()
+            .map(|d| d.name.as_str())
+            .map(UnicodeWidthStr::width)
+            .max()
+            .unwrap_or(0);
+        lengths.push(name_len);
+
+        for column in &self.columns {
+            let len = self
+                .hosts
+                .non_filtered_iter()
+                .map(|host| column_text(self, host, *column).width())
+                .max()
+                .unwrap_or(0);
+            lengths.push(len.max(column.title().width()));
         }
 
         let mut new_constraints = vec![
@@ -316,7 +3315,7 @@ impl App {
     }
 }
 
-fn setup_terminal<B: Backend>(terminal: &Rc<RefCell<Terminal<B>>>) -> Result<()>
+fn setup_terminal<B: Backend>(terminal: &Rc<RefCell<Terminal<B>>>, mouse: bool) -> Result<()>
 where
     B: std::io::Write,
 {
@@ -324,12 +3323,10 @@ where
 
     // setup terminal
     enable_raw_mode()?;
-    execute!(
-        terminal.backend_mut(),
-        Hide,
-        EnterAlternateScreen,
-        EnableMouseCapture
-    )?;
+    execute!(terminal.backend_mut(), Hide, EnterAlternateScreen)?;
+    if mouse {
+        execute!(terminal.backend_mut(), EnableMouseCapture)?;
+    }
 
     Ok(())
 }
@@ -353,24 +3350,194 @@ where
     Ok(())
 }
 
-fn ui(f: &mut Frame, app: &mut App) {
-    let rects = Layout::vertical([
-        Constraint::Length(3),
-        Constraint::Min(5),
-        Constraint::Length(3),
+fn ui(f: &mut Frame, app: &mut App) {
+    let banner_height = u16::from(app.banner().is_some());
+
+    let rects = Layout::vertical([
+        Constraint::Length(banner_height),
+        Constraint::Length(3),
+        Constraint::Min(5),
+        Constraint::Length(3),
+        Constraint::Length(u16::from(app.status_bar)),
+    ])
+    .split(f.size());
+
+    render_banner(f, app, rects[0]);
+
+    render_searchbar(f, app, rects[1]);
+
+    if app.detail_pane {
+        let panes = Layout::horizontal([Constraint::Percentage(60), Constraint::Percentage(40)])
+            .split(rects[2]);
+
+        render_table(f, app, panes[0]);
+        render_details(f, app, panes[1]);
+    } else {
+        render_table(f, app, rects[2]);
+    }
+
+    render_footer(f, app, rects[3]);
+
+    if app.status_bar {
+        render_status_bar(f, app, rects[4]);
+    }
+
+    if !matches!(app.vim, Some(VimMode::Normal | VimMode::PendingG)) {
+        f.set_cursor(
+            rects[1].x + u16::try_from(app.search.cursor()).unwrap_or_default() + 4,
+            rects[1].y + 1,
+        );
+    }
+
+    render_toast(f, app, rects[2]);
+
+    render_popup(f, app);
+}
+
+/// Draws the outcome of the last session over the bottom right corner of the list.
+fn render_toast(f: &mut Frame, app: &mut App, area: Rect) {
+    let Some(message) = app.toast() else {
+        return;
+    };
+
+    let width = u16::try_from(message.chars().count() + 4)
+        .unwrap_or(u16::MAX)
+        .min(area.width);
+    let toast_area = Rect {
+        x: area.x + area.width - width,
+        y: (area.y + area.height).saturating_sub(3).max(area.y),
+        width,
+        height: 3.min(area.height),
+    };
+    let toast = Paragraph::new(Line::from(format!(" {message}"))).block(
+        Block::default()
+            .borders(Borders::ALL)
+            .border_type(BorderType::Rounded)
+            .border_style(Style::new().fg(app.palette.c400)),
+    );
+
+    f.render_widget(Clear, toast_area);
+    f.render_widget(toast, toast_area);
+}
+
+fn render_status_bar(f: &mut Frame, app: &App, area: Rect) {
+    let mut parts = vec![
+        format!(
+            "{} of {} hosts",
+            app.hosts.len(),
+            app.hosts.non_filtered_iter().count()
+        ),
+        format!("sort: {}", app.sort_order.label()),
+    ];
+
+    if !app.marked.is_empty() {
+        parts.push(format!("{} marked", app.marked.len()));
+    }
+
+    let sources = app
+        .sources
+        .iter()
+        .map(|source| match source.status {
+            SourceStatus::Loading => format!("{}…", source.path),
+            SourceStatus::Loaded => source.path.clone(),
+            SourceStatus::Failed => format!("{} ✗", source.path),
+        })
+        .join(", ");
+    parts.push(sources);
+
+    let flags = [
+        (app.prober.is_some(), "ping"),
+        (app.tree_view, "tree"),
+        (app.config.expand_aliases, "expand-aliases"),
+        (app.config.control_persist.is_some(), "control-persist"),
+        (app.config.ssm, "ssm"),
+        (app.config.strip_untrusted_agent, "strip-untrusted-agent"),
+        (
+            app.config.multiplexer == Some(ssh::Multiplexer::Tmux),
+            "tmux",
+        ),
+        (
+            app.config.multiplexer == Some(ssh::Multiplexer::Zellij),
+            "zellij",
+        ),
+        (
+            matches!(
+                app.config.multiplexer,
+                Some(ssh::Multiplexer::WindowsTerminal(_))
+            ),
+            "windows-terminal",
+        ),
+        (app.config.print.is_some(), "print"),
+    ]
+    .into_iter()
+    .filter_map(|(enabled, flag)| enabled.then_some(flag))
+    .join(" ");
+    if !flags.is_empty() {
+        parts.push(flags);
+    }
+    if let Some(mode) = app.vim {
+        parts.push(
+            if mode == VimMode::Search {
+                "-- SEARCH --"
+            } else {
+                "-- NORMAL --"
+            }
+            .to_string(),
+        );
+    }
+    if let Some(network) = &app.network {
+        parts.push(format!("network: {}", network.name));
+    }
+    if app.syncing.is_some() {
+        parts.push(format!(
+            "{} syncing",
+            spinner_frame(app.loading_since.elapsed())
+        ));
+    } else if let Some(status) = &app.sync_status {
+        parts.push(match (status.synced_at, &status.error) {
+            (_, Some(_)) => "sync failed".to_string(),
+            (Some(at), None) => format!("synced {}", format_age(state::now().saturating_sub(at))),
+            (None, None) => "never synced".to_string(),
+        });
+    }
+    let session = app.session.arguments();
+    if !session.is_empty() {
+        parts.push(format!("ssh {}", session.join(" ")));
+    }
+    if let Some(ticket) = &app.config.ticket {
+        parts.push(format!("ticket: {ticket}"));
+    }
+
+    let style = Style::new().fg(app.palette.c200).bg(app.palette.c900);
+    let hint = " (ctrl+y) hide ";
+    let [status_area, hint_area] = Layout::horizontal([
+        Constraint::Min(0),
+        Constraint::Length(u16::try_from(hint.width()).unwrap_or_default()),
     ])
-    .split(f.size());
-
-    render_searchbar(f, app, rects[0]);
+    .areas(area);
 
-    render_table(f, app, rects[1]);
+    f.render_widget(
+        Paragraph::new(format!(" {}", parts.join(" │ "))).style(style),
+        status_area,
+    );
+    f.render_widget(
+        Paragraph::new(hint).style(style.fg(app.palette.c400)),
+        hint_area,
+    );
+}
 
-    render_footer(f, app, rects[2]);
+fn render_banner(f: &mut Frame, app: &mut App, area: Rect) {
+    let Some(warning) = app.banner() else {
+        return;
+    };
 
-    f.set_cursor(
-        rects[0].x + u16::try_from(app.search.cursor()).unwrap_or_default() + 4,
-        rects[0].y + 1,
+    let banner = Paragraph::new(Line::from(format!(" ⚠ {warning}"))).style(
+        Style::default()
+            .fg(tailwind::AMBER.c950)
+            .bg(tailwind::AMBER.c400)
+            .add_modifier(Modifier::BOLD),
     );
+    f.render_widget(banner, area);
 }
 
 fn render_searchbar(f: &mut Frame, app: &mut App, area: Rect) {
@@ -388,10 +3555,16 @@ fn render_table(f: &mut Frame, app: &mut App, area: Rect) {
     let header_style = Style::default().fg(tailwind::CYAN.c500);
     let selected_style = Style::default().add_modifier(Modifier::REVERSED);
 
-    let mut header_names = vec!["Name", "Aliases", "User", "Destination", "Port"];
-    if app.config.show_proxy_command {
-        header_names.push("Proxy");
-    }
+    let compact = is_compact(app, area.width);
+    app.table_area = area;
+    app.table_host_height = if compact { 2 } else { 1 };
+    let header_names = if compact {
+        vec!["Host"]
+    } else {
+        std::iter::once("Name")
+            .chain(app.columns.iter().map(|column| column.title()))
+            .collect::<Vec<_>>()
+    };
 
     let header = header_names
         .iter()
@@ -401,47 +3574,1110 @@ fn render_table(f: &mut Frame, app: &mut App, area: Rect) {
         .style(header_style)
         .height(1);
 
-    let rows = app.hosts.iter().map(|host| {
-        let mut content = vec![
-            host.name.clone(),
-            host.aliases.clone(),
-            host.user.clone().unwrap_or_default(),
-            host.destination.clone(),
-            host.port.clone().unwrap_or_default(),
-        ];
-        if app.config.show_proxy_command {
-            content.push(host.proxy_command.clone().unwrap_or_default());
-        }
+    let group_style = Style::default()
+        .fg(app.palette.c300)
+        .add_modifier(Modifier::BOLD);
+    let badge_style = Style::default()
+        .fg(tailwind::SLATE.c950)
+        .bg(app.palette.c300);
 
-        content
-            .iter()
-            .map(|content| Cell::from(Text::from(content.to_string())))
-            .collect::<Row>()
+    // Only the visible rows are built, thousands of hosts would slow down every keystroke
+    let visible = (usize::from(area.height.saturating_sub(3)) / if compact { 2 } else { 1 }).max(1);
+    let mut table_state = scroll_table(&mut app.table_state, app.rows.len(), visible);
+    let offset = app.table_state.offset();
+
+    let rows = app.rows.iter().skip(offset).take(visible).map(|row| {
+        let (host, indent) = match row {
+            TreeRow::Group {
+                name,
+                depth,
+                matched,
+                total,
+                collapsed,
+                ..
+            } => {
+                let icon = if *collapsed { "▸" } else { "▾" };
+                let indent = "  ".repeat(*depth);
+                let badge = if matched == total {
+                    format!(" {total} ")
+                } else {
+                    format!(" {matched}/{total} ")
+                };
+
+                return Row::new(vec![Cell::from(Line::from(vec![
+                    Span::styled(format!("{indent}{icon} {name} "), group_style),
+                    Span::styled(badge, badge_style),
+                ]))]);
+            }
+            TreeRow::Host { index, depth } => (&app.hosts[*index], "  ".repeat(*depth)),
+        };
+
+        if compact {
+            compact_host_row(app, host, indent)
+        } else {
+            host_row(app, host, indent)
+        }
     });
+    let ad_hoc = ad_hoc_row(app, compact);
+    let rows = rows.chain(ad_hoc);
 
     let bar = " █ ";
-    let t = Table::new(rows, app.table_columns_constraints.clone())
+    let (constraints, highlight_symbol) = if compact {
+        (
+            vec![Constraint::Min(0)],
+            Text::from(vec![bar.into(), bar.into()]),
+        )
+    } else {
+        (
+            app.table_columns_constraints.clone(),
+            Text::from(vec!["".into(), bar.into(), bar.into(), "".into()]),
+        )
+    };
+    let t = Table::new(rows, constraints)
         .header(header)
         .highlight_style(selected_style)
-        .highlight_symbol(Text::from(vec![
-            "".into(),
-            bar.into(),
-            bar.into(),
-            "".into(),
-        ]))
+        .highlight_symbol(highlight_symbol)
         .highlight_spacing(HighlightSpacing::Always)
         .block(
             Block::default()
+                .title(block::Title::from(table_title(app)).alignment(Alignment::Right))
                 .borders(Borders::ALL)
                 .border_style(Style::new().fg(app.palette.c400))
                 .border_type(BorderType::Rounded),
         );
 
-    f.render_stateful_widget(t, area, &mut app.table_state);
+    f.render_stateful_widget(t, area, &mut table_state);
+}
+
+/// Row of the destination typed in the search, when it is not a host of the configuration.
+fn ad_hoc_row(app: &App, compact: bool) -> Option<Row<'static>> {
+    let destination = app.ad_hoc_destination()?;
+    let name = Line::styled(
+        "↪ connect directly",
+        Style::default()
+            .fg(app.palette.c300)
+            .add_modifier(Modifier::ITALIC),
+    );
+    let style = Style::default().fg(tailwind::SLATE.c400);
+
+    if compact {
+        let target = Line::raw(format!("  {}", destination.hostname));
+        return Some(
+            Row::new(vec![Cell::from(Text::from(vec![name, target]))])
+                .height(2)
+                .style(style),
+        );
+    }
+
+    let cells = app.columns.iter().map(|column| match column {
+        Column::Aliases => Cell::from("not in the configuration"),
+        Column::User => Cell::from(destination.user.clone().unwrap_or_default()),
+        Column::Destination => Cell::from(destination.hostname.clone()),
+        Column::Port => Cell::from(destination.port.clone().unwrap_or_default()),
+        _ => Cell::from(""),
+    });
+    Some(
+        std::iter::once(Cell::from(name))
+            .chain(cells)
+            .collect::<Row>()
+            .style(style),
+    )
+}
+
+/// Whether the columns do not fit in the width of the table, the hosts being listed on two
+/// lines then.
+fn is_compact(app: &App, width: u16) -> bool {
+    let columns: u16 = app
+        .table_columns_constraints
+        .iter()
+        .map(|constraint| match constraint {
+            Constraint::Length(len) | Constraint::Min(len) => *len,
+            _ => 0,
+        })
+        .sum();
+    let spacing = u16::try_from(app.table_columns_constraints.len()).unwrap_or_default();
+
+    // The borders and the highlight symbol take 5 columns
+    width < COMPACT_WIDTH && columns + spacing + 5 > width
+}
+
+/// Row of a host on two lines, its name then where it connects to.
+fn compact_host_row(app: &App, host: &ssh::Host, indent: String) -> Row<'static> {
+    let user = host
+        .user
+        .as_ref()
+        .map(|user| format!("{user}@"))
+        .unwrap_or_default();
+    let port = host
+        .port
+        .as_ref()
+        .map(|port| format!(":{port}"))
+        .unwrap_or_default();
+    let target = format!("{indent}  {user}{}{port}", host.destination);
+
+    let lines = vec![
+        host_name_line(app, host, indent),
+        Line::styled(target, Style::default().fg(tailwind::SLATE.c400)),
+    ];
+    Row::new(vec![Cell::from(Text::from(lines))])
+        .height(2)
+        .style(if app.seems_dead(host) {
+            Style::default().fg(tailwind::SLATE.c500)
+        } else {
+            Style::default()
+        })
+}
+
+/// Row of a host in the table, hosts that seem dead being greyed out but still selectable.
+fn host_row(app: &App, host: &ssh::Host, indent: String) -> Row<'static> {
+    let name = host_name_line(app, host, indent);
+
+    let content = app
+        .columns
+        .iter()
+        .map(|column| column_text(app, host, *column))
+        .collect::<Vec<_>>();
+
+    std::iter::once(Cell::from(name))
+        .chain(
+            content
+                .iter()
+                .map(|content| Cell::from(Text::from(content.to_string()))),
+        )
+        .collect::<Row>()
+        .style(if app.seems_dead(host) {
+            Style::default().fg(tailwind::SLATE.c500)
+        } else {
+            Style::default()
+        })
+}
+
+/// Content of the column for the host.
+fn column_text(app: &App, host: &ssh::Host, column: Column) -> String {
+    match column {
+        Column::Aliases => host.aliases_label(),
+        Column::User => host.user.clone().unwrap_or_default(),
+        Column::Destination => host.destination.clone(),
+        Column::Port => host.port.clone().unwrap_or_default(),
+        Column::IdentityFile => host.identity_file.clone().unwrap_or_default(),
+        Column::ProxyCommand => host.proxy_command.clone().unwrap_or_default(),
+        Column::ProxyJump => host.proxy_jump.clone().unwrap_or_default(),
+        Column::LocalCommand => match &host.local_command {
+            Some(command) if !host.permit_local_command => {
+                format!("{command} (not permitted)")
+            }
+            Some(command) => command.clone(),
+            None => String::new(),
+        },
+        Column::Tags => host.tags.join(", "),
+        Column::LastConnected => app
+            .state
+            .last_connected
+            .get(&host.name)
+            .map(|at| format_age(state::now().saturating_sub(*at)))
+            .unwrap_or_default(),
+    }
+}
+
+/// Columns of the settings, or the default ones, with the ones asked on the command line.
+fn default_columns(config: &AppConfig, settings: &Settings) -> Vec<Column> {
+    with_flag_columns(
+        config,
+        settings.columns.clone().unwrap_or_else(|| {
+            vec![
+                Column::Aliases,
+                Column::User,
+                Column::Destination,
+                Column::Port,
+            ]
+        }),
+    )
+}
+
+/// Adds the columns of `--show-identity-file`, `--show-proxy-command` and `--show-local-command`
+/// that are not shown yet.
+fn with_flag_columns(config: &AppConfig, mut columns: Vec<Column>) -> Vec<Column> {
+    for (shown, column) in [
+        (config.show_identity_file, Column::IdentityFile),
+        (config.show_proxy_command, Column::ProxyCommand),
+        (config.show_local_command, Column::LocalCommand),
+    ] {
+        if shown && !columns.contains(&column) {
+            columns.push(column);
+        }
+    }
+
+    columns
+}
+
+/// Scrolls the table like ratatui would to keep the selected row visible, returns the state
+/// of the table made of the visible rows only.
+fn scroll_table(state: &mut TableState, len: usize, visible: usize) -> TableState {
+    let selected = state.selected().unwrap_or(0);
+    let mut offset = state.offset();
+    if selected < offset {
+        offset = selected;
+    } else if selected >= offset + visible {
+        offset = selected + 1 - visible;
+    }
+    offset = offset.min(len.saturating_sub(visible));
+    *state.offset_mut() = offset;
+
+    TableState::default().with_selected(state.selected().map(|_| selected - offset))
+}
+
+/// Frame of the spinner shown while the sources load.
+fn spinner_frame(elapsed: Duration) -> &'static str {
+    let frames = u128::try_from(SPINNER.len()).unwrap_or(1);
+    let index = elapsed.as_millis() / SPINNER_INTERVAL.as_millis() % frames;
+    SPINNER[usize::try_from(index).unwrap_or_default()]
+}
+
+/// Sources still loading, origin filter and current sort order.
+fn table_title(app: &App) -> String {
+    let mut parts = Vec::new();
+
+    let loading = app
+        .sources
+        .iter()
+        .filter(|source| source.status == SourceStatus::Loading)
+        .map(|source| source.path.as_str())
+        .collect::<Vec<_>>();
+    if !loading.is_empty() {
+        parts.push(format!(
+            "{} loading {}",
+            spinner_frame(app.loading_since.elapsed()),
+            loading.join(", ")
+        ));
+    }
+
+    if let Some(origin) = app
+        .origin_filter
+        .as_ref()
+        .and_then(|path| app.groups.get(path))
+    {
+        parts.push(format!("from: {origin}"));
+    }
+
+    parts.push(format!("sort: {}", app.sort_order.label()));
+    format!(" {} ", parts.join(" | "))
+}
+
+/// Keys of the `KEY:VALUE` filters of the search.
+const SEARCH_FILTERS: [&str; 3] = ["owner", "team", "key"];
+
+/// Splits the search into its `owner:NAME` filters and the text matched against the hosts.
+fn parse_search(value: &str) -> (Vec<(&str, &str)>, String) {
+    let mut filters = Vec::new();
+    let mut words = Vec::new();
+    for word in value.split_whitespace() {
+        match word.split_once(':') {
+            Some((key, value)) if SEARCH_FILTERS.contains(&key) => filters.push((key, value)),
+            _ => words.push(word),
+        }
+    }
+
+    (filters, words.join(" "))
+}
+
+/// Whether a search extending the previous one can only match hosts that matched it, which
+/// is not the case when a word becomes a filter such as `owner:`.
+fn search_narrows(previous: &str, value: &str) -> bool {
+    parse_search(previous).0.len() == parse_search(value).0.len()
+}
+
+fn matches_filter(host: &ssh::Host, key: &str, value: &str) -> bool {
+    match key {
+        "owner" | "team" => host
+            .owner
+            .as_ref()
+            .is_some_and(|owner| owner.to_lowercase().contains(&value.to_lowercase())),
+        "key" => host
+            .identity_file
+            .as_ref()
+            .is_some_and(|file| file.to_lowercase().contains(&value.to_lowercase())),
+        _ => true,
+    }
+}
+
+fn liveness_label(app: &App, host: &ssh::Host) -> Option<String> {
+    let liveness = app.state.liveness.get(&host.name)?;
+    let age = format_age(state::now().saturating_sub(liveness.at));
+
+    Some(if liveness.reachable {
+        format!("reachable {age}")
+    } else {
+        format!("unreachable {age}")
+    })
+}
+
+fn theme_palette(theme: settings::Theme) -> tailwind::Palette {
+    match theme {
+        settings::Theme::Blue => tailwind::BLUE,
+        settings::Theme::Slate => tailwind::SLATE,
+        settings::Theme::Emerald => tailwind::EMERALD,
+        settings::Theme::Teal => tailwind::TEAL,
+        settings::Theme::Violet => tailwind::VIOLET,
+        settings::Theme::Rose => tailwind::ROSE,
+        settings::Theme::Amber => tailwind::AMBER,
+    }
+}
+
+/// Reads the keys of the settings, like `ctrl+t`, `alt+x`, `f2` or `esc`.
+fn parse_key(key: &str) -> Option<(KeyCode, KeyModifiers)> {
+    let mut parts = key.split('+').collect::<Vec<_>>();
+    // `ctrl++` splits into empty parts
+    let name = match parts.pop()? {
+        "" if key.ends_with('+') => {
+            parts.pop();
+            "+"
+        }
+        name => name,
+    };
+
+    let mut modifiers = KeyModifiers::NONE;
+    for part in parts {
+        modifiers |= match part.to_lowercase().as_str() {
+            "ctrl" | "control" => KeyModifiers::CONTROL,
+            "alt" | "meta" => KeyModifiers::ALT,
+            "shift" => KeyModifiers::SHIFT,
+            _ => return None,
+        };
+    }
+
+    let code = match name.to_lowercase().as_str() {
+        "esc" | "escape" => KeyCode::Esc,
+        "enter" | "return" => KeyCode::Enter,
+        "tab" => KeyCode::Tab,
+        "backspace" => KeyCode::Backspace,
+        "delete" | "del" => KeyCode::Delete,
+        "up" => KeyCode::Up,
+        "down" => KeyCode::Down,
+        "left" => KeyCode::Left,
+        "right" => KeyCode::Right,
+        "home" => KeyCode::Home,
+        "end" => KeyCode::End,
+        "pageup" => KeyCode::PageUp,
+        "pagedown" => KeyCode::PageDown,
+        "space" => KeyCode::Char(' '),
+        lowercase => {
+            let mut chars = name.chars();
+            match (chars.next()?, chars.next()) {
+                (char, None) => KeyCode::Char(char),
+                ('f' | 'F', Some(_)) => KeyCode::F(lowercase[1..].parse().ok()?),
+                _ => return None,
+            }
+        }
+    };
+
+    Some((code, modifiers))
+}
+
+fn key_aliases(keys: &BTreeMap<String, String>) -> std::result::Result<KeyAliases, String> {
+    keys.iter()
+        .map(|(key, target)| match (parse_key(key), parse_key(target)) {
+            (Some(key), Some(target)) => Ok((key, target)),
+            (None, _) => Err(format!("Unknown key {key:?} in the keys of the settings")),
+            (_, None) => Err(format!(
+                "Unknown key {target:?} in the keys of the settings"
+            )),
+        })
+        .collect()
+}
+
+/// Formats how long something lasted, in its two largest units.
+fn format_elapsed(elapsed: Duration) -> String {
+    let seconds = elapsed.as_secs();
+    match seconds {
+        0..=59 => format!("{seconds}s"),
+        60..=3599 => format!("{}m {:02}s", seconds / 60, seconds % 60),
+        _ => format!("{}h {:02}m", seconds / 3600, seconds % 3600 / 60),
+    }
+}
+
+/// Formats how long ago something happened, in the largest unit.
+fn format_age(seconds: u64) -> String {
+    match seconds {
+        0..=59 => "just now".to_string(),
+        60..=3599 => format!("{}m ago", seconds / 60),
+        3600..=86399 => format!("{}h ago", seconds / 3600),
+        _ => format!("{}d ago", seconds / 86400),
+    }
+}
+
+fn host_log_level(host: &ssh::Host) -> Option<String> {
+    let level = host.log_level.as_deref()?;
+    if host.hides_banner() {
+        Some(format!("{level}, the server banner is hidden"))
+    } else {
+        Some(level.to_string())
+    }
+}
+
+/// The EC2 instance of the host with its region, or its Compute Engine zone.
+fn host_instance(host: &ssh::Host) -> Option<String> {
+    if let Some(id) = &host.instance_id {
+        return Some(match &host.region {
+            Some(region) => format!("EC2 {id} ({region})"),
+            None => format!("EC2 {id}"),
+        });
+    }
+
+    let zone = host.zone.as_deref()?;
+    let iap = if host.iap { ", through IAP" } else { "" };
+    Some(match &host.project {
+        Some(project) => format!("GCE {project}/{zone}{iap}"),
+        None => format!("GCE {zone}{iap}"),
+    })
+}
+
+fn host_local_time(host: &ssh::Host) -> Option<String> {
+    let timezone = host.timezone.as_ref()?;
+
+    Some(match host.local_time() {
+        Some(local_time) => format!("{} ({timezone})", clock::format_time_of_week(local_time)),
+        None => format!("unknown time zone {timezone}, give it as an offset like UTC+02:00"),
+    })
+}
+
+fn host_agent_status(app: &App, host: &ssh::Host) -> Option<&'static str> {
+    app.key_in_agent(host).map(|loaded| {
+        if loaded {
+            "key loaded"
+        } else {
+            "key not loaded, ctrl+k to add it"
+        }
+    })
+}
+
+fn render_details(f: &mut Frame, app: &mut App, area: Rect) {
+    let label_style = Style::default().fg(tailwind::CYAN.c500);
+
+    let mut lines = Vec::new();
+    let mut findings = Vec::new();
+    let mut field = |label: &str, value: Option<&str>| {
+        if let Some(value) = value.filter(|value| !value.is_empty()) {
+            lines.push(Line::from(vec![
+                Span::styled(format!("{label:<15}"), label_style),
+                Span::raw(value.to_string()),
+            ]));
+        }
+    };
+
+    let selected = app.table_state.selected().unwrap_or(0);
+    match app.rows.get(selected) {
+        Some(TreeRow::Host { index, .. }) => {
+            let host = &app.hosts[*index];
+            let source = host_source(host);
+            let status = app.host_status(host).map(|status| match status {
+                probe::Status::Up => "reachable",
+                probe::Status::Down => "unreachable",
+                probe::Status::Unknown => "unknown",
+            });
+
+            field("Host", Some(&host.name));
+            field("Aliases", Some(&host.aliases));
+            field("HostName", Some(&host.destination));
+            field("User", host.user.as_deref());
+            field("Port", host.port.as_deref());
+            field(
+                "Fallback ports",
+                Some(&host.fallback_ports.iter().join(", ")),
+            );
+            field("IdentityFile", host.identity_file.as_deref());
+            field("Agent", host_agent_status(app, host));
+            field("ForwardAgent", host.forward_agent.as_deref());
+            field("Tag", host.tag.as_deref());
+            field("Tags", Some(&host.tags.join(", ")));
+            field("Owner", host.owner.as_deref());
+            field("Profiles", Some(&app.profile_names(host)));
+            field(
+                "Network",
+                app.network_for(host).map(|network| network.name.as_str()),
+            );
+            field("Note", host.note.as_deref());
+            field("Instance", host_instance(host).as_deref());
+            field(
+                "Protocol",
+                Some(host.protocol.name()).filter(|_| host.protocol != ssh::Protocol::Ssh),
+            );
+            field("ProxyCommand", host.proxy_command.as_deref());
+            field("ProxyJump", host.proxy_jump.as_deref());
+            field("LocalCommand", host.local_command.as_deref());
+            field("RemoteCommand", host.remote_command.as_deref());
+            field("RequestTTY", host.request_tty.as_deref());
+            field("LogLevel", host_log_level(host).as_deref());
+            field("Local time", host_local_time(host).as_deref());
+            field("Maintenance", Some(&host.maintenance.iter().join(", ")));
+            field("Status", status);
+            field("Last probe", liveness_label(app, host).as_deref());
+            field("Defined in", source.as_deref());
+
+            let duplicates = app.duplicates.get(&host.endpoint()).into_iter().flatten();
+            for duplicate in duplicates.filter(|duplicate| duplicate.origin != host.origin) {
+                let name = match host_source(duplicate) {
+                    Some(source) => format!("{} ({source})", duplicate.name),
+                    None => duplicate.name.clone(),
+                };
+                field("Duplicate", Some(&name));
+            }
+
+            findings = doctor::check_host(host, &app.loaded_hosts);
+        }
+        Some(TreeRow::Group {
+            path,
+            matched,
+            total,
+            ..
+        }) => {
+            field("Group", Some(path));
+            field("Hosts", Some(&total.to_string()));
+            field("Matching", Some(&matched.to_string()));
+        }
+        None => {}
+    }
+
+    if !findings.is_empty() {
+        lines.push(Line::default());
+    }
+    for finding in findings {
+        lines.push(Line::styled(
+            format!("⚠ {finding}"),
+            Style::default().fg(tailwind::AMBER.c400),
+        ));
+    }
+
+    let details = Paragraph::new(lines).wrap(Wrap { trim: false }).block(
+        Block::default()
+            .title(" Details ")
+            .borders(Borders::ALL)
+            .border_style(Style::new().fg(app.palette.c400))
+            .border_type(BorderType::Rounded)
+            .padding(Padding::horizontal(1)),
+    );
+    f.render_widget(details, area);
+}
+
+/// Location of the block defining the host.
+fn host_source(host: &ssh::Host) -> Option<String> {
+    host.origin.as_ref().map(|origin| {
+        if origin.line > 0 {
+            format!("{}:{}", origin.path.display(), origin.line)
+        } else {
+            origin.path.display().to_string()
+        }
+    })
+}
+
+/// Name of the host prefixed by its reachability and a mark when it runs a local command,
+/// followed by a badge when it is defined several times.
+fn host_name_line(app: &App, host: &ssh::Host, indent: String) -> Line<'static> {
+    let mut name = vec![Span::raw(indent)];
+
+    if let Some(status) = app.host_status(host) {
+        name.push(match status {
+            probe::Status::Up => Span::styled("● ", Style::default().fg(tailwind::GREEN.c500)),
+            probe::Status::Down => Span::styled("● ", Style::default().fg(tailwind::RED.c500)),
+            probe::Status::Unknown => Span::styled("○ ", Style::default().fg(tailwind::SLATE.c500)),
+        });
+    }
+
+    if host.runs_local_command() {
+        name.push(Span::styled(
+            "⚠ ",
+            Style::default()
+                .fg(tailwind::AMBER.c400)
+                .add_modifier(Modifier::BOLD),
+        ));
+    }
+
+    if app.marked.contains(&host.name) {
+        name.push(Span::styled(
+            "✓ ",
+            Style::default()
+                .fg(app.palette.c400)
+                .add_modifier(Modifier::BOLD),
+        ));
+    }
+
+    name.push(Span::raw(host.name.clone()));
+
+    if let Some(badge) = app.origin_badge(host) {
+        name.push(Span::raw(" "));
+        name.push(badge);
+    }
+
+    if let Some(duplicates) = app.duplicates.get(&host.endpoint()) {
+        name.push(Span::styled(
+            format!(" ×{}", duplicates.len()),
+            Style::default().fg(tailwind::AMBER.c400),
+        ));
+    }
+
+    Line::from(name)
+}
+
+fn explanation_lines(blocks: &[ssh::ContributingBlock]) -> Vec<Line<'static>> {
+    let mut lines = Vec::new();
+
+    for block in blocks {
+        let location = match &block.origin {
+            Some(origin) if origin.line > 0 => {
+                format!("{}:{}", origin.path.display(), origin.line)
+            }
+            Some(origin) => origin.path.display().to_string(),
+            None => String::new(),
+        };
+        let header = match &block.patterns {
+            Some(patterns) => format!("Host {}", patterns.join(" ")),
+            None => "(outside of any Host block)".to_string(),
+        };
+
+        lines.push(Line::from(vec![
+            Span::styled(header, Style::default().add_modifier(Modifier::BOLD)),
+            Span::styled(
+                format!("  {location}"),
+                Style::default().fg(tailwind::SLATE.c400),
+            ),
+        ]));
+
+        for (entry, value, wins) in &block.entries {
+            lines.push(if *wins {
+                Line::from(Span::styled(
+                    format!("  ✓ {entry} {value}"),
+                    Style::default().fg(tailwind::GREEN.c400),
+                ))
+            } else {
+                Line::from(Span::styled(
+                    format!("  ✗ {entry} {value} (overridden by an earlier block)"),
+                    Style::default()
+                        .fg(tailwind::SLATE.c500)
+                        .add_modifier(Modifier::CROSSED_OUT),
+                ))
+            });
+        }
+
+        lines.push(Line::default());
+    }
+
+    if lines.is_empty() {
+        lines.push(Line::from("No configuration block applies to this host"));
+    }
+
+    lines
+}
+
+fn centered_rect(percent_x: u16, percent_y: u16, area: Rect) -> Rect {
+    let vertical = Layout::vertical([
+        Constraint::Percentage((100 - percent_y) / 2),
+        Constraint::Percentage(percent_y),
+        Constraint::Percentage((100 - percent_y) / 2),
+    ])
+    .split(area);
+
+    Layout::horizontal([
+        Constraint::Percentage((100 - percent_x) / 2),
+        Constraint::Percentage(percent_x),
+        Constraint::Percentage((100 - percent_x) / 2),
+    ])
+    .split(vertical[1])[1]
+}
+
+fn render_popup(f: &mut Frame, app: &mut App) {
+    let (title, lines, scroll) = match &app.popup {
+        Some(Popup::Text {
+            title,
+            lines,
+            scroll,
+        }) => (title.clone(), lines.clone(), *scroll),
+        Some(Popup::Actions { host }) => (
+            format!(" Actions for {} (Esc to close) ", host.name),
+            action_lines(&app.settings.actions, host),
+            0,
+        ),
+        Some(Popup::Jump {
+            host,
+            candidates,
+            selected,
+            chain,
+        }) => (
+            format!(
+                " Connect to {} through (Space add hop, Backspace remove hop, Enter connect, s save to the host, Esc close) ",
+                host.name
+            ),
+            jump_lines(app, host, candidates, *selected, chain),
+            u16::try_from(selected.saturating_sub(10)).unwrap_or_default(),
+        ),
+        Some(Popup::Keys {
+            host,
+            keys,
+            selected,
+        }) => (
+            format!(
+                " Connect to {} with the key (Enter connect, Esc close) ",
+                host.name
+            ),
+            keys.iter()
+                .enumerate()
+                .map(|(i, key)| choice_line(app, &key.label, i == *selected))
+                .collect(),
+            u16::try_from(selected.saturating_sub(10)).unwrap_or_default(),
+        ),
+        Some(Popup::Clone {
+            host,
+            files,
+            selected,
+        }) => (
+            format!(
+                " Copy {} to the file (Enter choose, Esc close) ",
+                host.name
+            ),
+            clone_lines(app, host, files, *selected),
+            u16::try_from(selected.saturating_sub(10)).unwrap_or_default(),
+        ),
+        Some(Popup::Profiles {
+            host,
+            names,
+            selected,
+        }) => (
+            format!(
+                " Connect to {} with the profile (Enter connect, Esc close) ",
+                host.name
+            ),
+            profile_lines(app, names, *selected),
+            u16::try_from(selected.saturating_sub(10)).unwrap_or_default(),
+        ),
+        Some(Popup::Columns { columns, selected }) => (
+            " Columns (Space show/hide, Shift+↑/↓ move, Enter apply, r reset, Esc close) "
+                .to_string(),
+            column_lines(app, columns, *selected),
+            0,
+        ),
+        Some(Popup::Confirm { host, command, .. }) => (
+            format!(" Connect to {} (Enter run, Esc cancel) ", host.name),
+            vec![Line::from(command.clone())],
+            0,
+        ),
+        Some(Popup::Reconnect { host, outcome, .. }) => (
+            format!(" Reconnect to {} ", host.name),
+            reconnect_lines(outcome, host.takes_ssh_arguments()),
+            0,
+        ),
+        Some(Popup::Connections {
+            connections,
+            selected,
+        }) => (
+            " Shared connections (Enter close, Esc back) ".to_string(),
+            connection_lines(app, connections, *selected),
+            u16::try_from(selected.saturating_sub(10)).unwrap_or_default(),
+        ),
+        Some(Popup::Fleets { fleets, selected }) => fleets_popup(app, fleets, *selected),
+        Some(Popup::Prompt { title, input, .. }) => {
+            render_prompt(f, app, title, input);
+            return;
+        }
+        None => return,
+    };
+
+    render_popup_block(f, app, title, lines, scroll);
+}
+
+fn render_popup_block(
+    f: &mut Frame,
+    app: &App,
+    title: String,
+    lines: Vec<Line<'static>>,
+    scroll: u16,
+) {
+    let area = centered_rect(80, 80, f.size());
+    let popup = Paragraph::new(lines)
+        .scroll((scroll, 0))
+        .wrap(Wrap { trim: false })
+        .block(
+            Block::default()
+                .title(title)
+                .borders(Borders::ALL)
+                .border_style(Style::new().fg(app.palette.c400))
+                .border_type(BorderType::Rounded)
+                .padding(Padding::horizontal(1)),
+        );
+
+    f.render_widget(Clear, area);
+    f.render_widget(popup, area);
+}
+
+fn action_lines(actions: &[settings::Action], host: &ssh::Host) -> Vec<Line<'static>> {
+    actions
+        .iter()
+        .map(|action| {
+            Line::from(vec![
+                Span::styled(
+                    format!("({}) {:<20}", action.key, action.name),
+                    Style::default().fg(tailwind::CYAN.c500),
+                ),
+                Span::raw(host.expand_tokens(&action.command)),
+            ])
+        })
+        .collect()
+}
+
+fn reconnect_lines(outcome: &str, verbose: bool) -> Vec<Line<'static>> {
+    let mut lines = vec![
+        Line::from(outcome.to_string()),
+        Line::default(),
+        Line::from("Enter  reconnect"),
+    ];
+    if verbose {
+        lines.push(Line::from(
+            "v      reconnect with -vvv, showing how ssh connects",
+        ));
+    }
+    lines.push(Line::from("Esc    back to the list"));
+
+    lines
+}
+
+/// Title, lines and scroll of [`Popup::Fleets`].
+fn fleets_popup(
+    app: &App,
+    fleets: &[fleet::Fleet],
+    selected: usize,
+) -> (String, Vec<Line<'static>>, u16) {
+    let lines = fleets
+        .iter()
+        .enumerate()
+        .map(|(i, fleet)| {
+            let label = format!("{} ({} hosts)", fleet.name, fleet.members.len());
+            choice_line(app, &label, i == selected)
+        })
+        .collect();
+    (
+        " Connect to a fleet (Enter random host, l least recently used, i host by number, Esc close) ".to_string(),
+        lines,
+        u16::try_from(selected.saturating_sub(10)).unwrap_or_default(),
+    )
+}
+
+fn jump_lines(
+    app: &App,
+    host: &ssh::Host,
+    candidates: &[String],
+    selected: usize,
+    chain: &[String],
+) -> Vec<Line<'static>> {
+    let mut lines = Vec::new();
+    if !chain.is_empty() {
+        lines.push(Line::from(vec![
+            Span::styled("Chain: ", Style::default().fg(tailwind::CYAN.c500)),
+            Span::raw(format!("{} → {}", chain.join(" → "), host.name)),
+        ]));
+        lines.push(Line::default());
+    }
+
+    lines.extend(candidates.iter().enumerate().map(|(i, candidate)| {
+        let mut label = if candidate == NO_JUMP {
+            "none, connect directly".to_string()
+        } else {
+            candidate.clone()
+        };
+        if host.proxy_jump.as_ref() == Some(candidate) {
+            label.push_str(" (ProxyJump)");
+        }
+
+        choice_line(app, &label, i == selected)
+    }));
+
+    lines
+}
+
+/// Lines of the files the host can be copied to, marking the one defining it.
+fn clone_lines(
+    app: &App,
+    host: &ssh::Host,
+    files: &[PathBuf],
+    selected: usize,
+) -> Vec<Line<'static>> {
+    files
+        .iter()
+        .enumerate()
+        .map(|(i, file)| {
+            let mut label = file.display().to_string();
+            if host
+                .origin
+                .as_ref()
+                .is_some_and(|origin| origin.path == *file)
+            {
+                label.push_str(" (defines it)");
+            }
+            choice_line(app, &label, i == selected)
+        })
+        .collect()
+}
+
+fn profile_lines(app: &App, names: &[String], selected: usize) -> Vec<Line<'static>> {
+    names
+        .iter()
+        .enumerate()
+        .map(|(i, name)| {
+            let args = app.settings.profiles[name].arguments();
+            choice_line(
+                app,
+                &format!("{name:<20} {}", args.join(" ")),
+                i == selected,
+            )
+        })
+        .collect()
+}
+
+fn column_lines(app: &App, columns: &[(Column, bool)], selected: usize) -> Vec<Line<'static>> {
+    columns
+        .iter()
+        .enumerate()
+        .map(|(i, (column, shown))| {
+            let check = if *shown { "[x]" } else { "[ ]" };
+            choice_line(app, &format!("{check} {}", column.title()), i == selected)
+        })
+        .collect()
+}
+
+fn connection_lines(
+    app: &App,
+    connections: &[(ssh::SharedConnection, bool)],
+    selected: usize,
+) -> Vec<Line<'static>> {
+    connections
+        .iter()
+        .enumerate()
+        .map(|(i, (connection, open))| {
+            let label = format!(
+                "{:<40} {:<10} {}",
+                connection.destination,
+                if connection.jump { "jump host" } else { "host" },
+                if *open { "open" } else { "closed" }
+            );
+            choice_line(app, &label, i == selected)
+        })
+        .collect()
+}
+
+/// A line of a popup listing choices, the selected one being highlighted.
+fn choice_line(app: &App, label: &str, selected: bool) -> Line<'static> {
+    if selected {
+        Line::styled(
+            format!("> {label}"),
+            Style::new()
+                .fg(app.palette.c400)
+                .add_modifier(Modifier::BOLD),
+        )
+    } else {
+        Line::raw(format!("  {label}"))
+    }
+}
+
+fn render_prompt(f: &mut Frame, app: &App, title: &str, input: &Input) {
+    let area = f.size();
+    let width = area.width * 3 / 5;
+    let area = Rect::new(
+        area.x + (area.width - width) / 2,
+        area.y + area.height.saturating_sub(3) / 2,
+        width,
+        3.min(area.height),
+    );
+
+    let prompt = Paragraph::new(input.value()).block(
+        Block::default()
+            .title(title.to_string())
+            .borders(Borders::ALL)
+            .border_style(Style::new().fg(app.palette.c400))
+            .border_type(BorderType::Rounded)
+            .padding(Padding::horizontal(1)),
+    );
+
+    f.render_widget(Clear, area);
+    f.render_widget(prompt, area);
+    f.set_cursor(
+        area.x + u16::try_from(input.cursor()).unwrap_or_default() + 2,
+        area.y + 1,
+    );
+}
+
+/// Runs the command and waits for the user before going back to the list, so its output can be read.
+fn run_and_wait(command: &[String]) -> Result<()> {
+    match ssh::run_command(command) {
+        Ok(status) if status.success() => println!("\nDone."),
+        Ok(status) => println!("\nCommand failed ({status})."),
+        Err(err) => println!("\nFailed to run the command: {err}"),
+    }
+
+    println!("Press Enter to go back to the list...");
+    let mut line = String::new();
+    io::stdin().read_line(&mut line)?;
+
+    Ok(())
 }
 
 fn render_footer(f: &mut Frame, app: &mut App, area: Rect) {
-    let info_footer = Paragraph::new(Line::from(INFO_TEXT)).centered().block(
+    let line = match app.selected_host() {
+        Some(host) if host.runs_local_command() => Line::styled(
+            format!(
+                "⚠ Runs on this machine after connecting: {}",
+                host.local_command.as_deref().unwrap_or_default()
+            ),
+            Style::default().fg(tailwind::AMBER.c400),
+        ),
+        Some(host) if host.current_maintenance().is_some() => Line::styled(
+            format!(
+                "⚠ In its maintenance window {}",
+                host.current_maintenance()
+                    .map(ToString::to_string)
+                    .unwrap_or_default()
+            ),
+            Style::default().fg(tailwind::AMBER.c400),
+        ),
+        Some(host) if host.is_untrusted() && app.forwards_agent(host) => {
+            Line::styled(
+                if app.config.strip_untrusted_agent {
+                    "⚠ Untrusted host, your agent will not be forwarded to it"
+                } else {
+                    "⚠ Forwards your agent to an untrusted host | --strip-untrusted-agent disables it"
+                },
+                Style::default().fg(tailwind::AMBER.c400),
+            )
+        }
+        Some(host) if app.key_in_agent(host) == Some(false) => Line::styled(
+            format!(
+                "The key {} is not loaded in the agent | (ctrl+k) add it",
+                host.identity_file.as_deref().unwrap_or_default()
+            ),
+            Style::default().fg(app.palette.c300),
+        ),
+        Some(ssh::Host {
+            remote_command: Some(command),
+            ..
+        }) => Line::styled(
+            format!(
+                "Runs on the host instead of a shell: {command} | (ctrl+o) open a shell instead"
+            ),
+            Style::default().fg(app.palette.c300),
+        ),
+        Some(ssh::Host {
+            request_tty: Some(request_tty),
+            ..
+        }) if request_tty.eq_ignore_ascii_case("no") => Line::styled(
+            "No terminal is requested for this host | (ctrl+o) open a shell instead",
+            Style::default().fg(app.palette.c300),
+        ),
+        Some(host) if host.hides_banner() => Line::styled(
+            format!(
+                "LogLevel {} hides the server banner and errors | (ctrl+v) connect with debug output",
+                host.log_level.as_deref().unwrap_or_default()
+            ),
+            Style::default().fg(app.palette.c300),
+        ),
+        _ => Line::from(INFO_TEXT),
+    };
+
+    let info_footer = Paragraph::new(line).centered().block(
         Block::default()
             .borders(Borders::ALL)
             .border_style(Style::new().fg(app.palette.c400))
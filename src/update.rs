@@ -0,0 +1,273 @@
+use anyhow::Result;
+use serde::Deserialize;
+use sha2::{Digest, Sha256};
+use std::cmp::Ordering;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+const RELEASES_URL: &str = "https://api.github.com/repos/quantumsheep/sshs/releases";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+pub enum Channel {
+    /// Releases only
+    Stable,
+    /// Pre-releases too
+    Prerelease,
+}
+
+#[derive(clap::Args, Debug)]
+pub struct Args {
+    /// Only tell whether a newer version is available
+    #[arg(long, default_value_t = false)]
+    check_only: bool,
+
+    /// Releases to update to
+    #[arg(long, value_enum, default_value_t = Channel::Stable)]
+    channel: Channel,
+}
+
+#[derive(Debug, Deserialize)]
+struct Release {
+    tag_name: String,
+    #[serde(default)]
+    prerelease: bool,
+    #[serde(default)]
+    draft: bool,
+    #[serde(default)]
+    assets: Vec<Asset>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Asset {
+    name: String,
+    browser_download_url: String,
+}
+
+/// Replaces the running executable with the binary of the latest release for this platform,
+/// once its SHA-256 matches the checksum published with the release.
+///
+/// # Errors
+///
+/// Will return `Err` if the releases cannot be fetched, if the release has no binary or no
+/// checksum for this platform, if the checksum does not match or if the executable cannot be
+/// replaced.
+pub fn run(args: &Args) -> Result<()> {
+    let current = env!("CARGO_PKG_VERSION");
+    let releases: Vec<Release> =
+        serde_json::from_slice(&fetch(&format!("{RELEASES_URL}?per_page=20"))?)?;
+
+    let Some(release) = latest(&releases, args.channel) else {
+        anyhow::bail!("No release found on the {:?} channel", args.channel);
+    };
+    let version = release.tag_name.trim_start_matches('v');
+
+    if compare_versions(version, current) != Ordering::Greater {
+        println!("sshs {current} is up to date");
+        return Ok(());
+    }
+    if args.check_only {
+        println!("sshs {version} is available, {current} is installed");
+        return Ok(());
+    }
+
+    let name = asset_name();
+    let Some(binary) = release.assets.iter().find(|asset| asset.name == name) else {
+        anyhow::bail!("Release {} has no {name} binary", release.tag_name);
+    };
+    let expected = expected_checksum(release, &name)?;
+
+    let executable = std::env::current_exe()?;
+    let download = executable.with_file_name(format!(".{name}.download"));
+    let content = fetch(&binary.browser_download_url)?;
+    let actual = format!("{:x}", Sha256::digest(&content));
+    if !actual.eq_ignore_ascii_case(&expected) {
+        anyhow::bail!("Checksum mismatch for {name}: expected {expected}, got {actual}");
+    }
+
+    std::fs::write(&download, &content)?;
+    if let Err(err) = replace(&executable, &download) {
+        let _ = std::fs::remove_file(&download);
+        return Err(err);
+    }
+
+    log::info!(from = current, to = version, path:? = executable; "Updated sshs");
+    println!("Updated sshs from {current} to {version}");
+
+    Ok(())
+}
+
+/// Downloads a URL with `curl`, which ships with Linux, macOS and Windows 10.
+fn fetch(url: &str) -> Result<Vec<u8>> {
+    log::debug!(url = url; "Fetching");
+    let mut command = Command::new("curl");
+    command.args(["--fail", "--silent", "--show-error", "--location"]);
+    if url.starts_with(RELEASES_URL) {
+        command.args(["--header", "Accept: application/vnd.github+json"]);
+    }
+    let output = command
+        .arg(url)
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|err| anyhow::anyhow!("Failed to run curl: {err}"))?;
+
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to fetch {url}: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    Ok(output.stdout)
+}
+
+fn latest(releases: &[Release], channel: Channel) -> Option<&Release> {
+    releases
+        .iter()
+        .filter(|release| !release.draft && (channel == Channel::Prerelease || !release.prerelease))
+        .max_by(|a, b| {
+            compare_versions(
+                a.tag_name.trim_start_matches('v'),
+                b.tag_name.trim_start_matches('v'),
+            )
+        })
+}
+
+/// Name of the binary of the releases for this platform, like `sshs-linux-amd64`.
+fn asset_name() -> String {
+    let os = match std::env::consts::OS {
+        "macos" => "darwin",
+        os => os,
+    };
+    let arch = match std::env::consts::ARCH {
+        "x86_64" => "amd64",
+        "aarch64" => "arm64",
+        "x86" => "386",
+        arch => arch,
+    };
+
+    format!("sshs-{os}-{arch}{}", std::env::consts::EXE_SUFFIX)
+}
+
+/// SHA-256 of the binary, from its `.sha256` file or from the checksums file of the release.
+fn expected_checksum(release: &Release, name: &str) -> Result<String> {
+    let sums = release.assets.iter().find(|asset| {
+        asset.name == format!("{name}.sha256")
+            || ["SHA256SUMS", "checksums.txt", "sha256sums.txt"].contains(&asset.name.as_str())
+    });
+    let Some(sums) = sums else {
+        anyhow::bail!(
+            "Release {} publishes no checksum, not installing it",
+            release.tag_name
+        );
+    };
+
+    let content = String::from_utf8(fetch(&sums.browser_download_url)?)?;
+    find_checksum(&content, name)
+        .ok_or_else(|| anyhow::anyhow!("{} has no checksum for {name}", sums.name))
+}
+
+/// Checksum of the file in `sha256sum` output, or the only checksum of a `.sha256` file.
+fn find_checksum(content: &str, name: &str) -> Option<String> {
+    let lines = content
+        .lines()
+        .filter_map(|line| {
+            let mut words = line.split_whitespace();
+            Some((words.next()?, words.next()))
+        })
+        .collect::<Vec<_>>();
+
+    lines
+        .iter()
+        .find(|(_, file)| file.is_some_and(|file| file.trim_start_matches('*') == name))
+        .or(lines.first().filter(|_| lines.len() == 1))
+        .map(|(sum, _)| (*sum).to_string())
+        .filter(|sum| sum.len() == 64 && sum.chars().all(|c| c.is_ascii_hexdigit()))
+}
+
+/// Moves the downloaded binary in place of the executable. A running executable cannot be
+/// overwritten on Windows but can be renamed, so the old one is moved aside first.
+fn replace(executable: &Path, download: &Path) -> Result<()> {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(download, std::fs::Permissions::from_mode(0o755))?;
+    }
+
+    if cfg!(windows) {
+        let old = PathBuf::from(format!("{}.old", executable.display()));
+        let _ = std::fs::remove_file(&old);
+        std::fs::rename(executable, &old)?;
+        if let Err(err) = std::fs::rename(download, executable) {
+            std::fs::rename(&old, executable)?;
+            return Err(err.into());
+        }
+    } else {
+        std::fs::rename(download, executable)?;
+    }
+
+    Ok(())
+}
+
+/// Compares `major.minor.patch` versions, a pre-release coming before its release.
+fn compare_versions(a: &str, b: &str) -> Ordering {
+    let parse = |version: &str| {
+        let (numbers, pre) = version
+            .split_once('-')
+            .map_or((version, None), |(numbers, pre)| {
+                (numbers, Some(pre.to_string()))
+            });
+        let numbers = numbers
+            .split('.')
+            .map(|number| number.parse::<u64>().unwrap_or(0))
+            .collect::<Vec<_>>();
+        (numbers, pre)
+    };
+    let (a_numbers, a_pre) = parse(a);
+    let (b_numbers, b_pre) = parse(b);
+
+    a_numbers
+        .cmp(&b_numbers)
+        .then_with(|| match (a_pre, b_pre) {
+            (None, None) => Ordering::Equal,
+            (None, Some(_)) => Ordering::Greater,
+            (Some(_), None) => Ordering::Less,
+            (Some(a), Some(b)) => a.cmp(&b),
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_update_checks() {
+        assert_eq!(compare_versions("4.4.0", "4.3.0"), Ordering::Greater);
+        assert_eq!(compare_versions("4.10.0", "4.9.1"), Ordering::Greater);
+        assert_eq!(compare_versions("5.0.0-rc.1", "5.0.0"), Ordering::Less);
+
+        let sum = "a".repeat(64);
+        let sums = format!(
+            "{}  sshs-linux-arm64\n{sum} *sshs-linux-amd64\n",
+            "b".repeat(64)
+        );
+        assert_eq!(find_checksum(&sums, "sshs-linux-amd64"), Some(sum.clone()));
+        assert_eq!(
+            find_checksum(&format!("{sum}\n"), "sshs-linux-amd64"),
+            Some(sum)
+        );
+        assert_eq!(find_checksum(&sums, "sshs-darwin-arm64"), None);
+
+        let releases: Vec<Release> = serde_json::from_str(
+            r#"[{"tag_name": "v5.0.0-rc.1", "prerelease": true}, {"tag_name": "v4.4.0"}]"#,
+        )
+        .unwrap();
+        assert_eq!(
+            latest(&releases, Channel::Stable).unwrap().tag_name,
+            "v4.4.0"
+        );
+        assert_eq!(
+            latest(&releases, Channel::Prerelease).unwrap().tag_name,
+            "v5.0.0-rc.1"
+        );
+    }
+}
@@ -0,0 +1,246 @@
+use anyhow::anyhow;
+use base64::{engine::general_purpose::STANDARD, Engine};
+use serde::Deserialize;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+use crate::ssh;
+use crate::ssh_config::wildcard_match;
+use crate::state;
+
+/// Certificates are signed again this long before they expire, in seconds, so that they
+/// do not expire while connecting.
+const RENEWAL_MARGIN: u64 = 60;
+
+/// Signs the key of the hosts with the SSH secrets engine of Vault before connecting,
+/// through the `vault` command line, the first signer matching a host being used.
+///
+/// ```toml
+/// [[vault]]
+/// hosts = ["*.corp"]
+/// mount = "ssh-client-signer"
+/// role = "ops"
+/// ttl = "30m"
+/// key = "~/.ssh/id_ed25519"
+/// ```
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Signer {
+    /// Names of the hosts with `*` and `?` wildcards, all of them when empty.
+    #[serde(default)]
+    pub hosts: Vec<String>,
+    /// Path the SSH secrets engine is mounted at.
+    #[serde(default = "default_mount")]
+    pub mount: String,
+    pub role: String,
+    /// How long the certificates are valid, the default of the role when missing.
+    pub ttl: Option<String>,
+    /// Private key whose public key is signed, the `IdentityFile` of the host or
+    /// `~/.ssh/id_ed25519` when missing.
+    pub key: Option<String>,
+    /// Address of Vault, `VAULT_ADDR` when missing.
+    pub address: Option<String>,
+}
+
+fn default_mount() -> String {
+    "ssh".to_string()
+}
+
+impl Signer {
+    #[must_use]
+    pub fn applies_to(&self, host: &ssh::Host) -> bool {
+        self.hosts.is_empty()
+            || self
+                .hosts
+                .iter()
+                .any(|pattern| wildcard_match(pattern, &host.name))
+    }
+
+    fn key_path(&self, host: &ssh::Host) -> PathBuf {
+        let key = self
+            .key
+            .as_deref()
+            .or(host.identity_file.as_deref())
+            .unwrap_or("~/.ssh/id_ed25519");
+
+        PathBuf::from(shellexpand::tilde(key).to_string())
+    }
+
+    /// Where the certificate of the key is kept, one per role and user.
+    fn certificate_path(&self, key: &Path, user: &str) -> PathBuf {
+        let key_name = key
+            .file_name()
+            .map(|name| name.to_string_lossy().to_string())
+            .unwrap_or_default();
+
+        state::state_dir().join("vault").join(format!(
+            "{}-{}-{user}-{key_name}-cert.pub",
+            self.mount.replace('/', "_"),
+            self.role
+        ))
+    }
+
+    /// Arguments of `ssh` connecting with the certificate, signed by [`Signer::renew`].
+    #[must_use]
+    pub fn arguments(&self, host: &ssh::Host) -> Vec<String> {
+        let key = self.key_path(host);
+        let user = host.user.clone().unwrap_or_else(ssh::local_user);
+
+        vec![
+            "-o".to_string(),
+            format!(
+                "CertificateFile={}",
+                self.certificate_path(&key, &user).display()
+            ),
+            "-i".to_string(),
+            key.display().to_string(),
+        ]
+    }
+
+    /// Signs the key for the user of the host, unless its certificate is still valid.
+    ///
+    /// Returns whether a certificate was signed.
+    ///
+    /// # Errors
+    ///
+    /// Will return `Err` if the public key cannot be read or Vault does not sign it.
+    pub fn renew(&self, host: &ssh::Host) -> anyhow::Result<bool> {
+        let key = self.key_path(host);
+        let user = host.user.clone().unwrap_or_else(ssh::local_user);
+        let path = self.certificate_path(&key, &user);
+
+        let valid_before = std::fs::read_to_string(&path)
+            .ok()
+            .and_then(|certificate| valid_before(&certificate));
+        if valid_before.is_some_and(|valid_before| state::now() + RENEWAL_MARGIN < valid_before) {
+            return Ok(false);
+        }
+
+        let public_key = PathBuf::from(format!("{}.pub", key.display()));
+        if !public_key.exists() {
+            anyhow::bail!("{} does not exist", public_key.display());
+        }
+
+        let mut command = Command::new("vault");
+        command.args([
+            "write".to_string(),
+            "-field=signed_key".to_string(),
+            format!("{}/sign/{}", self.mount, self.role),
+            format!("public_key=@{}", public_key.display()),
+            format!("valid_principals={user}"),
+        ]);
+        if let Some(ttl) = &self.ttl {
+            command.arg(format!("ttl={ttl}"));
+        }
+        if let Some(address) = &self.address {
+            command.env("VAULT_ADDR", address);
+        }
+        log::info!(host = host.name.as_str(), role = self.role.as_str(), expired_at:? = valid_before; "Signing key with Vault");
+
+        let output = command
+            .stdin(Stdio::null())
+            .output()
+            .map_err(|err| anyhow!("Failed to run vault: {err}"))?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "Vault did not sign {}: {}",
+                public_key.display(),
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+        std::fs::write(&path, output.stdout)?;
+
+        Ok(true)
+    }
+}
+
+/// When an OpenSSH certificate, as written in a `-cert.pub` file, stops being valid, in
+/// seconds since the Unix epoch.
+fn valid_before(certificate: &str) -> Option<u64> {
+    let blob = STANDARD
+        .decode(certificate.split_whitespace().nth(1)?)
+        .ok()?;
+    let mut reader = Reader(&blob);
+
+    // Fields of the public key, between the nonce and the serial
+    let key_fields = match reader.string()? {
+        b"ssh-ed25519-cert-v01@openssh.com" => 1,
+        b"ssh-rsa-cert-v01@openssh.com"
+        | b"ecdsa-sha2-nistp256-cert-v01@openssh.com"
+        | b"ecdsa-sha2-nistp384-cert-v01@openssh.com"
+        | b"ecdsa-sha2-nistp521-cert-v01@openssh.com"
+        | b"sk-ssh-ed25519-cert-v01@openssh.com" => 2,
+        b"sk-ecdsa-sha2-nistp256-cert-v01@openssh.com" => 3,
+        b"ssh-dss-cert-v01@openssh.com" => 4,
+        _ => return None,
+    };
+    reader.string()?;
+    for _ in 0..key_fields {
+        reader.string()?;
+    }
+    // Serial, type, key id, principals and valid after
+    reader.take(8)?;
+    reader.take(4)?;
+    reader.string()?;
+    reader.string()?;
+    reader.take(8)?;
+
+    Some(u64::from_be_bytes(reader.take(8)?.try_into().ok()?))
+}
+
+/// Reads the fields of the SSH wire format.
+struct Reader<'a>(&'a [u8]);
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, len: usize) -> Option<&'a [u8]> {
+        if self.0.len() < len {
+            return None;
+        }
+
+        let (field, rest) = self.0.split_at(len);
+        self.0 = rest;
+        Some(field)
+    }
+
+    fn string(&mut self) -> Option<&'a [u8]> {
+        let len = u32::from_be_bytes(self.take(4)?.try_into().ok()?);
+        self.take(usize::try_from(len).ok()?)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_valid_before() {
+        let mut blob = Vec::new();
+        for field in [
+            b"ssh-ed25519-cert-v01@openssh.com".as_slice(),
+            b"nonce",
+            b"public key",
+        ] {
+            blob.extend(u32::try_from(field.len()).unwrap().to_be_bytes());
+            blob.extend(field);
+        }
+        blob.extend(1u64.to_be_bytes());
+        blob.extend(1u32.to_be_bytes());
+        for field in [b"key id".as_slice(), b"\0\0\0\x05admin"] {
+            blob.extend(u32::try_from(field.len()).unwrap().to_be_bytes());
+            blob.extend(field);
+        }
+        blob.extend(1_700_000_000u64.to_be_bytes());
+        blob.extend(1_700_001_800u64.to_be_bytes());
+
+        let certificate = format!(
+            "ssh-ed25519-cert-v01@openssh.com {} vault",
+            STANDARD.encode(&blob)
+        );
+        assert_eq!(valid_before(&certificate), Some(1_700_001_800));
+        assert_eq!(valid_before("ssh-ed25519 AAAA"), None);
+    }
+}